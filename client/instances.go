@@ -32,8 +32,11 @@ type Instance struct {
 		Dev                  bool      `json:"dev"`
 		OnboardingFinished   bool      `json:"onboarding_finished"`
 		BytesDiskQuota       int64     `json:"disk_quota,string,omitempty"`
+		VersionsMaxNumber    int       `json:"versions_max_number,omitempty"`
+		VersionsMaxAge       int64     `json:"versions_max_age,omitempty"`
 		IndexViewsVersion    int       `json:"indexes_version"`
 		SwiftCluster         int       `json:"swift_cluster,omitempty"`
+		Dedup                bool      `json:"dedup,omitempty"`
 		PassphraseResetToken []byte    `json:"passphrase_reset_token"`
 		PassphraseResetTime  time.Time `json:"passphrase_reset_time"`
 		RegisterToken        []byte    `json:"register_token,omitempty"`
@@ -54,7 +57,10 @@ type InstanceOptions struct {
 	PublicName         string
 	Settings           string
 	SwiftCluster       int
+	Dedup              bool
 	DiskQuota          int64
+	MaxVersions        int
+	VersionsAge        time.Duration
 	Apps               []string
 	Passphrase         string
 	Debug              *bool
@@ -128,6 +134,7 @@ func (c *Client) CreateInstance(opts *InstanceOptions) (*Instance, error) {
 		"Apps":         {strings.Join(opts.Apps, ",")},
 		"Passphrase":   {opts.Passphrase},
 		"Dev":          {strconv.FormatBool(opts.Dev)},
+		"Dedup":        {strconv.FormatBool(opts.Dedup)},
 	}
 	if opts.DomainAliases != nil {
 		q.Add("DomainAliases", strings.Join(opts.DomainAliases, ","))
@@ -181,6 +188,12 @@ func (c *Client) ModifyInstance(opts *InstanceOptions) (*Instance, error) {
 	if opts.DomainAliases != nil {
 		q.Add("DomainAliases", strings.Join(opts.DomainAliases, ","))
 	}
+	if opts.MaxVersions != 0 {
+		q.Add("VersionsMaxNumber", strconv.Itoa(opts.MaxVersions))
+	}
+	if opts.VersionsAge != 0 {
+		q.Add("VersionsMaxAge", opts.VersionsAge.String())
+	}
 	if opts.Debug != nil {
 		q.Add("Debug", strconv.FormatBool(*opts.Debug))
 	}
@@ -180,3 +180,80 @@ func (c *Client) ListTriggers() ([]*Trigger, error) {
 	}
 	return list, nil
 }
+
+// FailedJob is a struct representing a job of the dead-letter store
+type FailedJob struct {
+	ID    string `json:"id"`
+	Rev   string `json:"rev"`
+	Attrs struct {
+		JobID     string          `json:"job_id"`
+		Domain    string          `json:"domain"`
+		Worker    string          `json:"worker"`
+		TriggerID string          `json:"trigger_id"`
+		Message   json.RawMessage `json:"message"`
+		Error     string          `json:"error"`
+		Attempts  []struct {
+			StartedAt  time.Time `json:"started_at"`
+			FinishedAt time.Time `json:"finished_at"`
+			Error      string    `json:"error"`
+		} `json:"attempts"`
+		QueuedAt time.Time `json:"queued_at"`
+		FailedAt time.Time `json:"failed_at"`
+	} `json:"attributes"`
+}
+
+// ListFailedJobs returns the list of the failed jobs of the dead-letter store
+// for the specified worker type (or all the workers if empty).
+func (c *Client) ListFailedJobs(worker string) ([]*FailedJob, error) {
+	res, err := c.Req(&request.Options{
+		Method:  "GET",
+		Path:    "/jobs/failed",
+		Queries: url.Values{"Worker": {worker}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []*FailedJob
+	if err := readJSONAPI(res.Body, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ReplayFailedJob pushes again the failed job with the specified ID.
+func (c *Client) ReplayFailedJob(failedID string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   fmt.Sprintf("/jobs/failed/%s/replay", url.PathEscape(failedID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var j *Job
+	if err := readJSONAPI(res.Body, &j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// PurgeFailedJobs removes the failed jobs of the dead-letter store for the
+// specified worker type (or all the workers if empty), and returns the number
+// of removed jobs.
+func (c *Client) PurgeFailedJobs(worker string) (int, error) {
+	res, err := c.Req(&request.Options{
+		Method:  "DELETE",
+		Path:    "/jobs/failed",
+		Queries: url.Values{"Worker": {worker}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Deleted, nil
+}
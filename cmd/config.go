@@ -164,6 +164,37 @@ keyfiles written in:
 	},
 }
 
+var genFsKeyCmd = &cobra.Command{
+	Use:   "gen-fs-key [filepath]",
+	Short: "Generate a master key for the encryption of the files",
+	Long: `
+cozy-stack config gen-fs-key generate a master key and save it in the
+specified path. This key is used to wrap the data keys of the instances, that
+encrypt the content of their files. Its path can be set in the vault section of
+the config file (fs_master_key).
+
+The file permissions are 0400.
+
+example: cozy-stack config gen-fs-key ~/fs.key
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+
+		filename := filepath.Join(utils.AbsPath(args[0]))
+		key, err := keymgmt.GenerateAESKey()
+		if err != nil {
+			return err
+		}
+		if err = writeFile(filename, keymgmt.MarshalAESKey(key), 0400); err != nil {
+			return err
+		}
+		errPrintfln("keyfile written in:\n  %s", filename)
+		return nil
+	},
+}
+
 var decryptCredentialsCmd = &cobra.Command{
 	Use:     "decrypt-creds [keyfile] [ciphertext]",
 	Aliases: []string{"decrypt-credentials"},
@@ -219,6 +250,7 @@ func init() {
 	configCmdGroup.AddCommand(configPrintCmd)
 	configCmdGroup.AddCommand(adminPasswdCmd)
 	configCmdGroup.AddCommand(genKeysCmd)
+	configCmdGroup.AddCommand(genFsKeyCmd)
 	configCmdGroup.AddCommand(decryptCredentialsCmd)
 	RootCmd.AddCommand(configCmdGroup)
 }
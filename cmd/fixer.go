@@ -284,7 +284,7 @@ var orphanAccountsFixer = &cobra.Command{
 
 var thumbnailsFixer = &cobra.Command{
 	Use:   "thumbnails [domain]",
-	Short: "Rebuild thumbnails image for images files",
+	Short: "Rebuild the missing thumbnails of the images, PDFs and videos",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 1 {
 			return cmd.Usage()
@@ -311,6 +311,108 @@ var thumbnailsFixer = &cobra.Command{
 	},
 }
 
+var metadataFixer = &cobra.Command{
+	Use:   "metadata [domain]",
+	Short: "Extract again the metadata of the files with the last version of the extractors",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		domain := args[0]
+		c := newClient(domain, consts.Jobs)
+		res, err := c.JobPush(&client.JobOptions{
+			Worker:    "metadata",
+			Arguments: struct{}{},
+		})
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var searchIndexFixer = &cobra.Command{
+	Use:   "search-index [domain]",
+	Short: "Rebuild the full-text search index of an instance",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		domain := args[0]
+		c := newClient(domain, consts.Jobs)
+		res, err := c.JobPush(&client.JobOptions{
+			Worker: "index",
+			Arguments: struct {
+				Reindex bool `json:"reindex"`
+			}{
+				Reindex: true,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var uploadsFixer = &cobra.Command{
+	Use:   "uploads [domain]",
+	Short: "Clean the expired upload sessions, and add the trigger for it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		domain := args[0]
+		c := newClient(domain, consts.Jobs)
+		res, err := c.JobPush(&client.JobOptions{
+			Worker: "clean-uploads",
+		})
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
+var versionsFixer = &cobra.Command{
+	Use:   "versions [domain]",
+	Short: "Clean the old versions of the files, and add the trigger for it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		domain := args[0]
+		c := newClient(domain, consts.Jobs)
+		res, err := c.JobPush(&client.JobOptions{
+			Worker: "clean-versions",
+		})
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
 func init() {
 	orphanAccountsFixer.Flags().BoolVar(&dryRunFlag, "dry-run", false, "Dry run")
 
@@ -320,11 +422,15 @@ func init() {
 	fixerCmdGroup.AddCommand(albumsCreatedAtFixerCmd)
 	fixerCmdGroup.AddCommand(jobsFixer)
 	fixerCmdGroup.AddCommand(md5FixerCmd)
+	fixerCmdGroup.AddCommand(metadataFixer)
 	fixerCmdGroup.AddCommand(mimeFixerCmd)
 	fixerCmdGroup.AddCommand(onboardingsFixer)
 	fixerCmdGroup.AddCommand(redisFixer)
 	fixerCmdGroup.AddCommand(orphanAccountsFixer)
+	fixerCmdGroup.AddCommand(searchIndexFixer)
 	fixerCmdGroup.AddCommand(thumbnailsFixer)
+	fixerCmdGroup.AddCommand(uploadsFixer)
+	fixerCmdGroup.AddCommand(versionsFixer)
 
 	RootCmd.AddCommand(fixerCmdGroup)
 }
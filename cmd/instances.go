@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/cozy/cozy-stack/client"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -26,8 +27,11 @@ var flagEmail string
 var flagPublicName string
 var flagSettings string
 var flagDiskQuota string
+var flagVersionsMaxNumber int
+var flagVersionsMaxAge time.Duration
 var flagApps []string
 var flagDev bool
+var flagDedup bool
 var flagPassphrase string
 var flagForce bool
 var flagFsckDry bool
@@ -142,6 +146,7 @@ be used as the error message.
 			PublicName:    flagPublicName,
 			Settings:      flagSettings,
 			SwiftCluster:  flagSwiftCluster,
+			Dedup:         flagDedup,
 			DiskQuota:     diskQuota,
 			Apps:          flagApps,
 			Passphrase:    flagPassphrase,
@@ -217,6 +222,8 @@ settings for a specified domain.
 			Settings:      flagSettings,
 			SwiftCluster:  flagSwiftCluster,
 			DiskQuota:     diskQuota,
+			MaxVersions:   flagVersionsMaxNumber,
+			VersionsAge:   flagVersionsMaxAge,
 		}
 		if flagOnboardingFinished {
 			opts.OnboardingFinished = &flagOnboardingFinished
@@ -648,6 +655,7 @@ func init() {
 	addInstanceCmd.Flags().StringVar(&flagPublicName, "public-name", "", "The public name of the owner")
 	addInstanceCmd.Flags().StringVar(&flagSettings, "settings", "", "A list of settings (eg context:foo,offer:premium)")
 	addInstanceCmd.Flags().IntVar(&flagSwiftCluster, "swift-cluster", 0, "Specify a cluster number for swift")
+	addInstanceCmd.Flags().BoolVar(&flagDedup, "dedup", false, "Deduplicate the content of the files in the VFS")
 	addInstanceCmd.Flags().StringVar(&flagDiskQuota, "disk-quota", "", "The quota allowed to the instance's VFS")
 	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled")
 	addInstanceCmd.Flags().BoolVar(&flagDev, "dev", false, "To create a development instance")
@@ -664,6 +672,8 @@ func init() {
 	modifyInstanceCmd.Flags().StringVar(&flagSettings, "settings", "", "New list of settings (eg offer:premium)")
 	modifyInstanceCmd.Flags().IntVar(&flagSwiftCluster, "swift-cluster", 0, "New swift cluster")
 	modifyInstanceCmd.Flags().StringVar(&flagDiskQuota, "disk-quota", "", "Specify a new disk quota")
+	modifyInstanceCmd.Flags().IntVar(&flagVersionsMaxNumber, "versions-max-number", 0, "Maximal number of old versions kept for a file (negative to disable versioning)")
+	modifyInstanceCmd.Flags().DurationVar(&flagVersionsMaxAge, "versions-max-age", 0, "Maximal age of the old versions of a file")
 	modifyInstanceCmd.Flags().BoolVar(&flagOnboardingFinished, "onboarding-finished", false, "Force the finishing of the onboarding")
 	destroyInstanceCmd.Flags().BoolVar(&flagForce, "force", false, "Force the deletion without asking for confirmation")
 	fsckInstanceCmd.Flags().BoolVar(&flagFsckDry, "dry", false, "Don't modify the VFS, only show the inconsistencies")
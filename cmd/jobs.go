@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/spf13/cobra"
+)
+
+var flagJobsDomain string
+var flagJobsWorker string
+
+var jobsCmdGroup = &cobra.Command{
+	Use:   "jobs [command]",
+	Short: "Interact with the jobs",
+	Long: `
+cozy-stack jobs allows to interact with the jobs of an instance.
+
+The jobs that have failed after all their executions are kept in a dead-letter
+store, where they can be inspected, replayed or purged.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var failedJobsCmdGroup = &cobra.Command{
+	Use:   "failed [command]",
+	Short: "Interact with the failed jobs of the dead-letter store",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Usage()
+	},
+}
+
+var lsFailedJobsCmd = &cobra.Command{
+	Use:     "ls",
+	Short:   `List the failed jobs`,
+	Example: "$ cozy-stack jobs failed ls --domain cozy.tools:8080 --worker sendmail",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagJobsDomain == "" {
+			errPrintfln("%s", errAppsMissingDomain)
+			return cmd.Usage()
+		}
+		c := newClient(flagJobsDomain, consts.JobsFailed)
+		list, err := c.ListFailedJobs(flagJobsWorker)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, f := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n",
+				f.ID,
+				f.Attrs.Worker,
+				f.Attrs.FailedAt.Format(time.RFC3339),
+				len(f.Attrs.Attempts),
+				f.Attrs.Error,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var replayFailedJobCmd = &cobra.Command{
+	Use:     "replay [failedJobId]",
+	Short:   `Push again a failed job in the queue of its worker`,
+	Example: "$ cozy-stack jobs failed replay --domain cozy.tools:8080 748f42b65aca8c99ec2492eb660d1891",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return cmd.Usage()
+		}
+		if flagJobsDomain == "" {
+			errPrintfln("%s", errAppsMissingDomain)
+			return cmd.Usage()
+		}
+		c := newClient(flagJobsDomain, consts.JobsFailed)
+		j, err := c.ReplayFailedJob(args[0])
+		if err != nil {
+			return err
+		}
+		json, err := json.MarshalIndent(j, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(json))
+		return nil
+	},
+}
+
+var purgeFailedJobsCmd = &cobra.Command{
+	Use:     "purge",
+	Short:   `Remove the failed jobs from the dead-letter store`,
+	Example: "$ cozy-stack jobs failed purge --domain cozy.tools:8080 --worker sendmail",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagJobsDomain == "" {
+			errPrintfln("%s", errAppsMissingDomain)
+			return cmd.Usage()
+		}
+		c := newClient(flagJobsDomain, consts.JobsFailed)
+		count, err := c.PurgeFailedJobs(flagJobsWorker)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Purged %d failed jobs on %s\n", count, flagJobsDomain)
+		return nil
+	},
+}
+
+func init() {
+	domain := os.Getenv("COZY_DOMAIN")
+	if domain == "" && config.IsDevRelease() {
+		domain = "cozy.tools:8080"
+	}
+
+	jobsCmdGroup.PersistentFlags().StringVar(&flagJobsDomain, "domain", domain, "specify the domain name of the instance")
+
+	lsFailedJobsCmd.Flags().StringVar(&flagJobsWorker, "worker", "", "only the failed jobs of this worker type")
+	purgeFailedJobsCmd.Flags().StringVar(&flagJobsWorker, "worker", "", "only the failed jobs of this worker type")
+
+	failedJobsCmdGroup.AddCommand(lsFailedJobsCmd)
+	failedJobsCmdGroup.AddCommand(replayFailedJobCmd)
+	failedJobsCmdGroup.AddCommand(purgeFailedJobsCmd)
+
+	jobsCmdGroup.AddCommand(failedJobsCmdGroup)
+	RootCmd.AddCommand(jobsCmdGroup)
+}
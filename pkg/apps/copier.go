@@ -1,8 +1,10 @@
 package apps
 
 import (
+	"bytes"
 	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
@@ -13,6 +15,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/magic"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/swift"
+	minio "github.com/minio/minio-go"
 )
 
 // Copier is an interface defining a common set of functions for the installer
@@ -32,6 +35,15 @@ type swiftCopier struct {
 	started   bool
 }
 
+type s3Copier struct {
+	c       *minio.Client
+	bucket  string
+	prefix  string
+	appObj  string
+	tmpObj  string
+	started bool
+}
+
 type aferoCopier struct {
 	fs      afero.Fs
 	appDir  string
@@ -142,6 +154,106 @@ func (f *swiftCopier) Commit() error {
 	return o.Close()
 }
 
+// NewS3Copier defines a Copier storing data into a S3 bucket, with keys
+// starting with the same name as the swift containers.
+func NewS3Copier(c *minio.Client, bucket string, appsType AppType) Copier {
+	return &s3Copier{
+		c:      c,
+		bucket: bucket,
+		prefix: containerName(appsType) + "/",
+	}
+}
+
+func (f *s3Copier) Start(slug, version string) (bool, error) {
+	// Like for swift, an empty object is created with the name of the app
+	// directory when all its files have been copied.
+	f.appObj = f.prefix + path.Join(slug, version)
+	_, err := f.c.StatObject(f.bucket, f.appObj, minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if !isS3NotFound(err) {
+		return false, err
+	}
+	f.tmpObj = f.prefix + "tmp-" + utils.RandomString(20) + "/"
+	f.started = true
+	return false, nil
+}
+
+func (f *s3Copier) Copy(stat os.FileInfo, src io.Reader) error {
+	if !f.started {
+		panic("copier should call Start() before Copy()")
+	}
+
+	objName := path.Join(f.tmpObj, stat.Name())
+	objMeta := map[string]string{
+		"Content-Encoding":        "gzip",
+		"Original-Content-Length": strconv.FormatInt(stat.Size(), 10),
+	}
+
+	contentType := magic.MIMETypeByExtension(path.Ext(stat.Name()))
+	if contentType == "" {
+		contentType, src = magic.MIMETypeFromReader(src)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// The files of the apps are small enough to be compressed in memory
+	buf := new(bytes.Buffer)
+	gw, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(gw, src); err != nil {
+		return err
+	}
+	if err = gw.Close(); err != nil {
+		return err
+	}
+
+	_, err = f.c.PutObject(f.bucket, objName, buf, int64(buf.Len()), minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: objMeta,
+	})
+	return err
+}
+
+func (f *s3Copier) Abort() error {
+	keys, err := listS3Keys(f.c, f.bucket, f.tmpObj)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = f.c.RemoveObject(f.bucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *s3Copier) Commit() error {
+	keys, err := listS3Keys(f.c, f.bucket, f.tmpObj)
+	if err != nil {
+		return err
+	}
+	for _, srcKey := range keys {
+		dstKey := path.Join(f.appObj, strings.TrimPrefix(srcKey, f.tmpObj))
+		dst, err := minio.NewDestinationInfo(f.bucket, dstKey, nil, nil)
+		if err == nil {
+			err = f.c.CopyObject(dst, minio.NewSourceInfo(f.bucket, srcKey, nil))
+		}
+		if err == nil {
+			err = f.c.RemoveObject(f.bucket, srcKey)
+		}
+		if err != nil {
+			return f.Abort()
+		}
+	}
+	_, err = f.c.PutObject(f.bucket, f.appObj, bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	return err
+}
+
 // NewAferoCopier defines a copier using an afero.Fs filesystem to store the
 // application data.
 func NewAferoCopier(fs afero.Fs) Copier {
@@ -209,6 +321,46 @@ func (f *aferoCopier) Abort() error {
 	return f.fs.RemoveAll(f.tmpDir)
 }
 
+// CopyApp copies the files of an application from a file server to a copier,
+// for example when migrating to another storage. It does nothing if the
+// application is already present in the destination.
+func CopyApp(src FileServer, dst Copier, slug, version string) error {
+	exists, err := dst.Start(slug, version)
+	if err != nil || exists {
+		return err
+	}
+	names, err := src.FilesList(slug, version)
+	if err == nil {
+		for _, name := range names {
+			if err = copyAppFile(src, dst, slug, version, name); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		dst.Abort() // #nosec
+		return err
+	}
+	return dst.Commit()
+}
+
+func copyAppFile(src FileServer, dst Copier, slug, version, name string) error {
+	rc, err := src.Open(slug, version, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return dst.Copy(&fileInfo{
+		name: strings.TrimPrefix(name, "/"),
+		size: int64(len(content)),
+		mode: 0644,
+	}, bytes.NewReader(content))
+}
+
 type fileInfo struct {
 	name string
 	size int64
@@ -18,6 +18,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/magic"
 	web_utils "github.com/cozy/cozy-stack/web/utils"
 	"github.com/cozy/swift"
+	minio "github.com/minio/minio-go"
 )
 
 // FileServer interface defines a way to access and serve the application's
@@ -34,6 +35,12 @@ type swiftServer struct {
 	container string
 }
 
+type s3Server struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+}
+
 type aferoServer struct {
 	mkPath func(slug, version, file string) string
 	fs     afero.Fs
@@ -165,6 +172,104 @@ func (s *swiftServer) FilesList(slug, version string) ([]string, error) {
 	return filtered, nil
 }
 
+// NewS3FileServer returns provides the apps.FileServer implementation
+// using a S3 bucket as file server.
+func NewS3FileServer(c *minio.Client, bucket string, appsType AppType) FileServer {
+	return &s3Server{
+		c:      c,
+		bucket: bucket,
+		prefix: containerName(appsType) + "/",
+	}
+}
+
+func (s *s3Server) open(slug, version, file string) (*minio.Object, minio.ObjectInfo, error) {
+	key := s.prefix + path.Join(slug, version, file)
+	obj, err := s.c.GetObject(s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	infos, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	return obj, infos, nil
+}
+
+func (s *s3Server) Open(slug, version, file string) (io.ReadCloser, error) {
+	obj, infos, err := s.open(slug, version, file)
+	if err != nil {
+		return nil, err
+	}
+	if infos.Metadata.Get("X-Amz-Meta-Content-Encoding") == "gzip" {
+		return newGzipReadCloser(obj)
+	}
+	return obj, nil
+}
+
+func (s *s3Server) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, file string) error {
+	obj, infos, err := s.open(slug, version, file)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	if checkETag := req.Header.Get("Cache-Control") == ""; checkETag && len(infos.ETag) >= 10 {
+		etag := fmt.Sprintf(`"%s"`, infos.ETag[:10])
+		if web_utils.CheckPreconditions(w, req, etag) {
+			return nil
+		}
+		w.Header().Set("Etag", etag)
+	}
+
+	var r io.Reader = obj
+	size := infos.Size
+	contentType := infos.ContentType
+	if infos.Metadata.Get("X-Amz-Meta-Content-Encoding") == "gzip" {
+		if acceptGzipEncoding(req) {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else {
+			size, _ = strconv.ParseInt(infos.Metadata.Get("X-Amz-Meta-Original-Content-Length"), 10, 64)
+			var gr *gzip.Reader
+			gr, err = gzip.NewReader(obj)
+			if err != nil {
+				return err
+			}
+			defer gr.Close()
+			r = gr
+		}
+	}
+
+	ext := path.Ext(file)
+	if contentType == "" {
+		contentType = magic.MIMETypeByExtension(ext)
+	}
+	if contentType == "text/html" {
+		contentType = "text/html; charset=utf-8"
+	} else if contentType == "text/xml" && ext == ".svg" {
+		// override for files with text/xml content because of leading <?xml tag
+		contentType = "image/svg+xml"
+	}
+
+	web_utils.ServeContent(w, req, contentType, size, r)
+	return nil
+}
+
+func (s *s3Server) FilesList(slug, version string) ([]string, error) {
+	prefix := s.prefix + path.Join(slug, version) + "/"
+	keys, err := listS3Keys(s.c, s.bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if n := strings.TrimPrefix(key, prefix); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
+
 // NewAferoFileServer returns a simple wrapper of the afero.Fs interface that
 // provides the apps.FileServer interface.
 //
@@ -311,6 +416,31 @@ func containerName(appsType AppType) string {
 	panic("Unknown AppType")
 }
 
+func listS3Keys(c *minio.Client, bucket, prefix string) ([]string, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	var keys []string
+	for obj := range c.ListObjectsV2(bucket, prefix, true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func isS3NotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchBucket"
+}
+
+func wrapS3Err(err error) error {
+	if isS3NotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
 func wrapSwiftErr(err error) error {
 	if err == swift.ObjectNotFound || err == swift.ContainerNotFound {
 		return os.ErrNotExist
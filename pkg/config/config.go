@@ -76,6 +76,9 @@ const (
 	SchemeMem = "mem"
 	// SchemeSwift is the URL scheme used to configure a swift filesystem.
 	SchemeSwift = "swift"
+	// SchemeS3 is the URL scheme used to configure an S3-compatible
+	// filesystem.
+	SchemeS3 = "s3"
 )
 
 // defaultAdminSecretFileName is the default name of the file containing the
@@ -107,6 +110,7 @@ type Config struct {
 
 	CredentialsEncryptorKey string
 	CredentialsDecryptorKey string
+	FsMasterKey             string
 
 	RemoteAssets map[string]string
 
@@ -114,6 +118,7 @@ type Config struct {
 	CouchDB       CouchDB
 	Jobs          Jobs
 	Konnectors    Konnectors
+	Search        Search
 	Mail          *gomail.DialerOptions
 	AutoUpdates   AutoUpdates
 	Notifications Notifications
@@ -138,6 +143,7 @@ type Config struct {
 type Vault struct {
 	credsEncryptor *keymgmt.NACLKey
 	credsDecryptor *keymgmt.NACLKey
+	fsMasterKey    *keymgmt.AESKey
 }
 
 // CredentialsEncryptorKey returns the key used to encrypt credentials values,
@@ -152,10 +158,31 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 	return v.credsDecryptor
 }
 
+// FsMasterKey returns the key used to wrap the data keys of the instances,
+// that encrypt the content of their files. It is nil if the encryption of the
+// files is not enabled.
+func (v *Vault) FsMasterKey() *keymgmt.AESKey {
+	if v == nil {
+		return nil
+	}
+	return v.fsMasterKey
+}
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	Auth *url.Userinfo
 	URL  *url.URL
+
+	// Default retention policy for the old versions of files
+	VersionsMaxNumber int
+	VersionsMaxAge    time.Duration
+
+	// Whether or not the new instances deduplicate the content of their files
+	Dedup bool
+
+	// URL of an S3-compatible storage for the instances migrated to it, when
+	// URL uses another scheme
+	S3URL *url.URL
 }
 
 // CouchDB contains the configuration values of the database
@@ -171,6 +198,16 @@ type Jobs struct {
 	NoWorkers             bool
 	Workers               []Worker
 	ImageMagickConvertCmd string
+	// Commands used to extract an image from the PDFs and the videos, that is
+	// then resized for the thumbnails. They are disabled when empty.
+	PDFThumbnailCmd   string
+	VideoThumbnailCmd string
+	// Limits of the workers that are overridden for the instances of a
+	// context.
+	Contexts map[string][]Worker
+	// Scheduler is the mode of the scheduler when redis is used: "redis"
+	// (the default) or "leader".
+	Scheduler string
 	// XXX for retro-compatibility
 	NbWorkers int
 }
@@ -180,6 +217,14 @@ type Konnectors struct {
 	Cmd string
 }
 
+// Search contains the configuration values for the full-text search
+type Search struct {
+	// Directory of the indexes, they are kept in memory if empty
+	Path string
+	// Doctypes indexed in addition to io.cozy.files
+	Doctypes []string
+}
+
 // AutoUpdates contains the configuration values for auto updates
 type AutoUpdates struct {
 	Activated bool
@@ -205,6 +250,12 @@ type Worker struct {
 	Concurrency  *int
 	MaxExecCount *int
 	Timeout      *time.Duration
+	// Limits for the jobs of each instance: the maximum number of jobs
+	// executed in parallel, and the number of jobs that can be started in a
+	// period of time.
+	DomainConcurrency *int
+	RateLimit         *int
+	RatePeriod        *time.Duration
 }
 
 // RedisConfig contains the configuration values for a redis system
@@ -274,6 +325,14 @@ func FsURL() *url.URL {
 	return config.Fs.URL
 }
 
+// S3URL returns the URL of the S3-compatible storage, or nil if there is none
+func S3URL() *url.URL {
+	if config.Fs.URL.Scheme == SchemeS3 {
+		return config.Fs.URL
+	}
+	return config.Fs.S3URL
+}
+
 // ServerAddr returns the address on which the stack is run
 func ServerAddr() string {
 	return net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
@@ -312,6 +371,18 @@ func GetVault() *Vault {
 
 var defaultPasswordResetInterval = 15 * time.Minute
 
+// defaultVersionsMaxNumber is the number of old versions kept for a file when
+// it is not configured.
+const defaultVersionsMaxNumber = 20
+
+// defaultPDFThumbnailCmd and defaultVideoThumbnailCmd are the commands that
+// write on stdout an image for the first page of a PDF, or for the first
+// keyframe of a video. {input} is replaced by the path of the file.
+const (
+	defaultPDFThumbnailCmd   = "pdftoppm -f 1 -l 1 -singlefile -jpeg -scale-to 1920 {input}"
+	defaultVideoThumbnailCmd = "ffmpeg -loglevel error -skip_frame nokey -i {input} -frames:v 1 -f image2pipe -vcodec mjpeg pipe:1"
+)
+
 // PasswordResetInterval returns the minimal delay between two password reset
 func PasswordResetInterval() time.Duration {
 	return config.PasswordResetInterval
@@ -379,6 +450,9 @@ func Setup(cfgFile string) (err error) {
 func applyDefaults(v *viper.Viper) {
 	v.SetDefault("password_reset_interval", defaultPasswordResetInterval)
 	v.SetDefault("jobs.imagemagick_convert_cmd", "convert")
+	v.SetDefault("jobs.pdf_thumbnail_cmd", defaultPDFThumbnailCmd)
+	v.SetDefault("jobs.video_thumbnail_cmd", defaultVideoThumbnailCmd)
+	v.SetDefault("fs.versions.max_number", defaultVersionsMaxNumber)
 }
 
 func envMap() map[string]string {
@@ -390,6 +464,66 @@ func envMap() map[string]string {
 	return env
 }
 
+// parseWorker returns the configuration of a worker type, from the value of
+// the given key.
+func parseWorker(key, workerType string, mapInterface interface{}) (Worker, error) {
+	w := Worker{WorkerType: workerType}
+
+	if enabled, ok := mapInterface.(bool); ok {
+		if !enabled {
+			zero := 0
+			w.Concurrency = &zero
+		}
+		return w, nil
+	}
+
+	m, ok := mapInterface.(map[string]interface{})
+	if !ok {
+		return w, fmt.Errorf("config: expecting a map in the key %q", key)
+	}
+	for k, v := range m {
+		switch k {
+		case "concurrency":
+			if concurrency, ok := v.(int); ok {
+				w.Concurrency = &concurrency
+			}
+		case "max_exec_count":
+			if maxExecCount, ok := v.(int); ok {
+				w.MaxExecCount = &maxExecCount
+			}
+		case "timeout":
+			if timeout, ok := v.(string); ok {
+				d, err := time.ParseDuration(timeout)
+				if err != nil {
+					return w, fmt.Errorf("config: could not parse timeout duration for worker %q: %s",
+						workerType, err)
+				}
+				w.Timeout = &d
+			}
+		case "domain_concurrency":
+			if concurrency, ok := v.(int); ok {
+				w.DomainConcurrency = &concurrency
+			}
+		case "rate_limit":
+			if limit, ok := v.(int); ok {
+				w.RateLimit = &limit
+			}
+		case "rate_period":
+			if period, ok := v.(string); ok {
+				d, err := time.ParseDuration(period)
+				if err != nil {
+					return w, fmt.Errorf("config: could not parse rate period for worker %q: %s",
+						workerType, err)
+				}
+				w.RatePeriod = &d
+			}
+		default:
+			return w, fmt.Errorf("config: unknown key %q", key+"."+k)
+		}
+	}
+	return w, nil
+}
+
 // UseViper sets the configured instance of Config
 func UseViper(v *viper.Viper) error {
 	// deactivate redis lib logging
@@ -409,6 +543,16 @@ func UseViper(v *viper.Viper) error {
 		}
 	}
 
+	var s3URL *url.URL
+	if u := v.GetString("fs.s3_url"); u != "" {
+		if s3URL, err = url.Parse(u); err != nil {
+			return err
+		}
+		if s3URL.Scheme != SchemeS3 {
+			return fmt.Errorf("The S3 storage URL should use the s3 scheme, was: %q", u)
+		}
+	}
+
 	couchURL, couchAuth, err := parseURL(v.GetString("couchdb.url"))
 	if err != nil {
 		return err
@@ -503,6 +647,9 @@ func UseViper(v *viper.Viper) error {
 	jobs := Jobs{
 		RedisConfig:           jobsRedis,
 		ImageMagickConvertCmd: v.GetString("jobs.imagemagick_convert_cmd"),
+		PDFThumbnailCmd:       v.GetString("jobs.pdf_thumbnail_cmd"),
+		VideoThumbnailCmd:     v.GetString("jobs.video_thumbnail_cmd"),
+		Scheduler:             v.GetString("jobs.scheduler"),
 	}
 	{
 		if nbWorkers := v.GetInt("jobs.workers"); nbWorkers > 0 {
@@ -511,50 +658,40 @@ func UseViper(v *viper.Viper) error {
 			jobs.NoWorkers = true
 		} else if workersMap := v.GetStringMap("jobs.workers"); len(workersMap) > 0 {
 			workers := make([]Worker, 0, len(workersMap))
-
 			for workerType, mapInterface := range workersMap {
-				w := Worker{WorkerType: workerType}
-
-				if enabled, ok := mapInterface.(bool); ok {
-					if !enabled {
-						zero := 0
-						w.Concurrency = &zero
-					}
-				} else if m, ok := mapInterface.(map[string]interface{}); ok {
-					for k, v := range m {
-						switch k {
-						case "concurrency":
-							if concurrency, ok := v.(int); ok {
-								w.Concurrency = &concurrency
-							}
-						case "max_exec_count":
-							if maxExecCount, ok := v.(int); ok {
-								w.MaxExecCount = &maxExecCount
-							}
-						case "timeout":
-							if timeout, ok := v.(string); ok {
-								var d time.Duration
-								d, err = time.ParseDuration(timeout)
-								if err != nil {
-									return fmt.Errorf("config: could not parse timeout duration for worker %q: %s",
-										workerType, err)
-								}
-								w.Timeout = &d
-							}
-						default:
-							return fmt.Errorf("config: unknown key %q",
-								"jobs.workers."+workerType+"."+k)
-						}
-					}
-				} else {
-					return fmt.Errorf("config: expecting a map in the key %q",
-						"jobs.workers."+workerType)
+				w, err := parseWorker("jobs.workers."+workerType, workerType, mapInterface)
+				if err != nil {
+					return err
 				}
-
 				workers = append(workers, w)
 			}
 			jobs.Workers = workers
 		}
+
+		contextsMap := v.GetStringMap("jobs.contexts")
+		if len(contextsMap) > 0 {
+			jobs.Contexts = make(map[string][]Worker, len(contextsMap))
+		}
+		for contextName, contextInterface := range contextsMap {
+			workersMap, ok := contextInterface.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("config: expecting a map in the key %q",
+					"jobs.contexts."+contextName)
+			}
+			workers := make([]Worker, 0, len(workersMap))
+			for workerType, mapInterface := range workersMap {
+				key := "jobs.contexts." + contextName + "." + workerType
+				w, err := parseWorker(key, workerType, mapInterface)
+				if err != nil {
+					return err
+				}
+				if w.Concurrency != nil || w.MaxExecCount != nil || w.Timeout != nil {
+					return fmt.Errorf("config: only the limits can be set in the key %q", key)
+				}
+				workers = append(workers, w)
+			}
+			jobs.Contexts[contextName] = workers
+		}
 	}
 
 	config = &Config{
@@ -578,9 +715,14 @@ func UseViper(v *viper.Viper) error {
 
 		CredentialsEncryptorKey: v.GetString("vault.credentials_encryptor_key"),
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
+		FsMasterKey:             v.GetString("vault.fs_master_key"),
 
 		Fs: Fs{
-			URL: fsURL,
+			URL:               fsURL,
+			VersionsMaxNumber: v.GetInt("fs.versions.max_number"),
+			VersionsMaxAge:    v.GetDuration("fs.versions.max_age"),
+			Dedup:             v.GetBool("fs.dedup"),
+			S3URL:             s3URL,
 		},
 		CouchDB: CouchDB{
 			Auth: couchAuth,
@@ -590,6 +732,10 @@ func UseViper(v *viper.Viper) error {
 		Konnectors: Konnectors{
 			Cmd: v.GetString("konnectors.cmd"),
 		},
+		Search: Search{
+			Path:     v.GetString("search.path"),
+			Doctypes: v.GetStringSlice("search.doctypes"),
+		},
 		AutoUpdates: AutoUpdates{
 			Activated: v.GetString("auto_updates.schedule") != "",
 			Schedule:  v.GetString("auto_updates.schedule"),
@@ -636,6 +782,7 @@ func UseViper(v *viper.Viper) error {
 func MakeVault(c *Config) error {
 	var credsEncryptor *keymgmt.NACLKey
 	var credsDecryptor *keymgmt.NACLKey
+	var fsMaster *keymgmt.AESKey
 
 	if credsEncryptorKey := config.CredentialsEncryptorKey; credsEncryptorKey != "" {
 		keyBytes, err := ioutil.ReadFile(credsEncryptorKey)
@@ -659,9 +806,21 @@ func MakeVault(c *Config) error {
 		}
 	}
 
+	if fsMasterKey := config.FsMasterKey; fsMasterKey != "" {
+		keyBytes, err := ioutil.ReadFile(fsMasterKey)
+		if err != nil {
+			return err
+		}
+		fsMaster, err = keymgmt.UnmarshalAESKey(keyBytes)
+		if err != nil {
+			return err
+		}
+	}
+
 	vault = &Vault{
 		credsEncryptor: credsEncryptor,
 		credsDecryptor: credsDecryptor,
+		fsMasterKey:    fsMaster,
 	}
 	return nil
 }
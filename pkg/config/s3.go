@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+var s3Client *minio.Client
+var s3Bucket string
+
+// InitS3Client initialize the global S3 client. The URL looks like
+// s3://host:port/bucket?AccessKey=...&SecretKey=...&Region=...
+// This is not a thread-safe method.
+func InitS3Client(s3URL *url.URL) error {
+	q := s3URL.Query()
+
+	bucket := strings.Trim(s3URL.Path, "/")
+	if bucket == "" {
+		return fmt.Errorf("s3: the bucket is missing in the URL %s", s3URL.Host)
+	}
+
+	secure := true
+	if v := q.Get("DisableSSL"); v != "" {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("s3: could not parse DisableSSL %s", err)
+		}
+		secure = !disabled
+	}
+
+	c, err := minio.NewWithRegion(s3URL.Host, q.Get("AccessKey"), q.Get("SecretKey"),
+		secure, q.Get("Region"))
+	if err != nil {
+		return err
+	}
+
+	exists, err := c.BucketExists(bucket)
+	if err != nil {
+		log.Errorf("Could not reach the S3 server on %s", s3URL.Host)
+		return err
+	}
+	if !exists {
+		if err = c.MakeBucket(bucket, q.Get("Region")); err != nil {
+			log.Errorf("Could not create the bucket %s on %s", bucket, s3URL.Host)
+			return err
+		}
+	}
+
+	s3Client = c
+	s3Bucket = bucket
+	log.Infof("Successfully connected to the S3 server %s", s3URL.Host)
+	return nil
+}
+
+// GetS3Client returns the S3 client created from the actual configuration.
+func GetS3Client() *minio.Client {
+	if s3Client == nil {
+		panic("Called GetS3Client() before InitS3Client()")
+	}
+	return s3Client
+}
+
+// S3Bucket returns the name of the bucket used by the stack on the S3 server.
+func S3Bucket() string {
+	return s3Bucket
+}
@@ -22,6 +22,16 @@ const (
 	Doctypes = "io.cozy.doctypes"
 	// Files doc type for type for files and directories
 	Files = "io.cozy.files"
+	// FilesVersions doc type for the old versions of the content of files
+	FilesVersions = "io.cozy.files.versions"
+	// FilesUploads doc type for the sessions of resumable uploads
+	FilesUploads = "io.cozy.files.uploads"
+	// FilesBlobs doc type for counting the references to the deduplicated
+	// contents of files
+	FilesBlobs = "io.cozy.files.blobs"
+	// FilesSizes doc type for the size of the files inside the directories
+	// with a quota
+	FilesSizes = "io.cozy.files.sizes"
 	// PhotosAlbums doc type for photos albums
 	PhotosAlbums = "io.cozy.photos.albums"
 	// Intents doc type for intents persisted in couchdb
@@ -30,6 +40,10 @@ const (
 	Jobs = "io.cozy.jobs"
 	// JobEvents doc type for realt time events sent by jobs
 	JobEvents = "io.cozy.jobs.events"
+	// JobsFailed doc type for the dead-letter store of the failed jobs
+	JobsFailed = "io.cozy.jobs.failed"
+	// JobsWorkflows doc type for the workflows of jobs
+	JobsWorkflows = "io.cozy.jobs.workflows"
 	// Notifications doc type for notifications
 	Notifications = "io.cozy.notifications"
 	// OAuthAccessCodes doc type for OAuth2 access codes
@@ -40,8 +54,12 @@ const (
 	Permissions = "io.cozy.permissions"
 	// Contacts doc type for sharing
 	Contacts = "io.cozy.contacts"
+	// Groups doc type for the groups of contacts
+	Groups = "io.cozy.contacts.groups"
 	// RemoteRequests doc type for logging requests to remote websites
 	RemoteRequests = "io.cozy.remote.requests"
+	// SearchResults doc type for the results of a full-text search
+	SearchResults = "io.cozy.search.results"
 	// Sessions doc type for sessions identifying a connection
 	Sessions = "io.cozy.sessions"
 	// SessionsLogins doc type for sessions identifying a connection
@@ -52,6 +70,9 @@ const (
 	Shared = "io.cozy.shared"
 	// Sharings doc type for document and file sharing
 	Sharings = "io.cozy.sharings"
+	// SharingsActivity doc type for the log of the changes applied by the
+	// members of the sharings
+	SharingsActivity = "io.cozy.sharings.activity"
 	// SharingsAnswer doc type for credentials exchange for sharings
 	SharingsAnswer = "io.cozy.sharings.answer"
 	// Triggers doc type for triggers, jobs launchers
@@ -7,7 +7,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 18
+const IndexViewsVersion int = 21
 
 // globalIndexes is the index list required on the global databases to run
 // properly.
@@ -61,6 +61,9 @@ var Indexes = []*mango.Index{
 	mango.IndexOnFields(Jobs, "by-worker-and-state", []string{"worker", "state"}),
 	mango.IndexOnFields(Jobs, "by-trigger-id", []string{"trigger_id", "queued_at"}),
 
+	// Used to lookup a @webhook trigger by the ID of its URL
+	mango.IndexOnFields(Triggers, "by-webhook-id", []string{"webhook_id"}),
+
 	// Used to lookup oauth clients by name
 	mango.IndexOnFields(OAuthClients, "by-client-name", []string{"client_name"}),
 	mango.IndexOnFields(OAuthClients, "by-notification-platform", []string{"notification_platform"}),
@@ -71,6 +74,9 @@ var Indexes = []*mango.Index{
 	// Used to lookup notifications by their source, ordered by their creation
 	// date
 	mango.IndexOnFields(Notifications, "by-source-id", []string{"source_id", "created_at"}),
+
+	// Used to lookup the activity of a sharing, ordered by the date
+	mango.IndexOnFields(SharingsActivity, "by-sharing-id", []string{"sharing_id", "created_at"}),
 }
 
 // DiskUsageView is the view used for computing the disk usage
@@ -87,6 +93,19 @@ function(doc) {
 	Reduce: "_sum",
 }
 
+// FilesVersionsView is the view used for listing the versions of a file,
+// ordered by their number, and for computing their disk usage.
+var FilesVersionsView = &couchdb.View{
+	Name:    "versions-by-file",
+	Doctype: FilesVersions,
+	Map: `
+function(doc) {
+  emit([doc.file_id, doc.number], +doc.size);
+}
+`,
+	Reduce: "_sum",
+}
+
 // FilesReferencedByView is the view used for fetching files referenced by a
 // given document
 var FilesReferencedByView = &couchdb.View{
@@ -229,9 +248,25 @@ function(doc) {
 `,
 }
 
+// ContactsByGroupID is used to find the contacts in a group
+var ContactsByGroupID = &couchdb.View{
+	Name:    "contacts-by-group-id",
+	Doctype: Contacts,
+	Map: `
+function(doc) {
+	if (doc.relationships && doc.relationships.groups && isArray(doc.relationships.groups.data)) {
+		for (var i = 0; i < doc.relationships.groups.data.length; i++) {
+			emit(doc.relationships.groups.data[i]._id);
+		}
+	}
+}
+`,
+}
+
 // Views is the list of all views that are created by the stack.
 var Views = []*couchdb.View{
 	DiskUsageView,
+	FilesVersionsView,
 	FilesReferencedByView,
 	ReferencedBySortedByDatetimeView,
 	FilesByParentView,
@@ -241,6 +276,7 @@ var Views = []*couchdb.View{
 	SharedDocsBySharingID,
 	SharingsByDocTypeView,
 	ContactByEmail,
+	ContactsByGroupID,
 }
 
 // ViewsByDoctype returns the list of views for a specified doc type.
@@ -55,19 +55,37 @@ type Cozy struct {
 	Primary bool   `json:"primary,omitempty"`
 }
 
+// GroupRef is a reference from a contact to a group of contacts
+type GroupRef struct {
+	ID   string `json:"_id"`
+	Type string `json:"_type,omitempty"`
+}
+
+// GroupsRelationship is the list of the groups of a contact
+type GroupsRelationship struct {
+	Data []GroupRef `json:"data"`
+}
+
+// Relationships is a struct describing the links of a contact to other
+// documents
+type Relationships struct {
+	Groups GroupsRelationship `json:"groups"`
+}
+
 // Contact is a struct containing all the informations about a contact
 type Contact struct {
 	DocID  string `json:"_id,omitempty"`
 	DocRev string `json:"_rev,omitempty"`
 
-	FullName string    `json:"fullname,omitempty"`
-	Name     Name      `json:"name,omitempty"`
-	Birthday string    `json:"birthday,omitempty"`
-	Note     string    `json:"note,omitempty"`
-	Email    []Email   `json:"email,omitempty"`
-	Address  []Address `json:"address,omitempty"`
-	Phone    []Phone   `json:"phone,omitempty"`
-	Cozy     []Cozy    `json:"cozy,omitempty"`
+	FullName      string         `json:"fullname,omitempty"`
+	Name          Name           `json:"name,omitempty"`
+	Birthday      string         `json:"birthday,omitempty"`
+	Note          string         `json:"note,omitempty"`
+	Email         []Email        `json:"email,omitempty"`
+	Address       []Address      `json:"address,omitempty"`
+	Phone         []Phone        `json:"phone,omitempty"`
+	Cozy          []Cozy         `json:"cozy,omitempty"`
+	Relationships *Relationships `json:"relationships,omitempty"`
 }
 
 // ID returns the contact qualified identifier
@@ -97,6 +115,13 @@ func (c *Contact) Clone() couchdb.Doc {
 	cloned.Cozy = make([]Cozy, len(c.Cozy))
 	copy(cloned.Cozy, c.Cozy)
 
+	if c.Relationships != nil {
+		rels := *c.Relationships
+		rels.Groups.Data = make([]GroupRef, len(c.Relationships.Groups.Data))
+		copy(rels.Groups.Data, c.Relationships.Groups.Data)
+		cloned.Relationships = &rels
+	}
+
 	return &cloned
 }
 
@@ -136,6 +161,31 @@ func (c *Contact) PrimaryName() string {
 	return ""
 }
 
+// HasEmail returns true if the given address is one of the email addresses of
+// the contact.
+func (c *Contact) HasEmail(address string) bool {
+	for _, email := range c.Email {
+		if email.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// InGroup returns true if the contact is in the group with the given
+// identifier.
+func (c *Contact) InGroup(groupID string) bool {
+	if c.Relationships == nil {
+		return false
+	}
+	for _, ref := range c.Relationships.Groups.Data {
+		if ref.ID == groupID {
+			return true
+		}
+	}
+	return false
+}
+
 // PrimaryCozyURL returns the URL of the primary cozy,
 // or a blank string if the contact has no known cozy.
 func (c *Contact) PrimaryCozyURL() string {
@@ -175,3 +225,24 @@ func FindByEmail(db couchdb.Database, email string) (*Contact, error) {
 	err = json.Unmarshal(res.Rows[0].Doc, &doc)
 	return doc, err
 }
+
+// FindByGroup returns the contacts in the group with the given identifier
+func FindByGroup(db couchdb.Database, groupID string) ([]*Contact, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.ContactsByGroupID, &couchdb.ViewRequest{
+		Key:         groupID,
+		IncludeDocs: true,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Contact, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		doc := &Contact{}
+		if err = json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, err
+		}
+		list = append(list, doc)
+	}
+	return list, nil
+}
@@ -0,0 +1,43 @@
+package contacts
+
+import (
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// Group is a struct for a group of contacts. The contacts are linked to their
+// groups with their relationships.
+type Group struct {
+	GID  string `json:"_id,omitempty"`
+	GRev string `json:"_rev,omitempty"`
+	Name string `json:"name"`
+}
+
+// ID returns the group qualified identifier
+func (g *Group) ID() string { return g.GID }
+
+// Rev returns the group revision
+func (g *Group) Rev() string { return g.GRev }
+
+// DocType returns the group document type
+func (g *Group) DocType() string { return consts.Groups }
+
+// Clone implements couchdb.Doc
+func (g *Group) Clone() couchdb.Doc {
+	cloned := *g
+	return &cloned
+}
+
+// SetID changes the group qualified identifier
+func (g *Group) SetID(id string) { g.GID = id }
+
+// SetRev changes the group revision
+func (g *Group) SetRev(rev string) { g.GRev = rev }
+
+// FindGroup returns the group of contacts stored in database from a given ID
+func FindGroup(db prefixer.Prefixer, groupID string) (*Group, error) {
+	doc := &Group{}
+	err := couchdb.GetDoc(db, consts.Groups, groupID, doc)
+	return doc, err
+}
@@ -209,6 +209,43 @@ func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) er
 	return nil
 }
 
+// BulkCreateDocs is used to persist several new documents in one call. Their
+// SetID and SetRev functions are called with the new IDs and revisions. The
+// database is created if needed.
+func BulkCreateDocs(db Database, doctype string, docs []Doc) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	body := struct {
+		Docs []Doc `json:"docs"`
+	}{
+		Docs: docs,
+	}
+	var res []UpdateResponse
+	err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res)
+	if IsNoDatabaseError(err) {
+		err = CreateDB(db, doctype)
+		if err == nil || IsFileExists(err) {
+			err = makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(res) != len(docs) {
+		return errors.New("BulkCreateDocs receive an unexpected number of responses")
+	}
+	for i, doc := range docs {
+		if res[i].ID == "" || res[i].Rev == "" {
+			continue
+		}
+		doc.SetID(res[i].ID)
+		doc.SetRev(res[i].Rev)
+		RTEvent(db, realtime.EventCreate, doc, nil)
+	}
+	return nil
+}
+
 // BulkDeleteDocs is used to delete serveral documents in one call.
 func BulkDeleteDocs(db Database, doctype string, docs []Doc) error {
 	if len(docs) == 0 {
@@ -26,9 +26,12 @@ import (
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/search"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
@@ -100,9 +103,33 @@ type Instance struct {
 	BytesDiskQuota     int64 `json:"disk_quota,string,omitempty"`   // The total size in bytes allowed to the user
 	IndexViewsVersion  int   `json:"indexes_version"`
 
+	// Retention policy for the old versions of files. When zero, the values
+	// from the configuration are used. A negative VersionsMaxNumber disables
+	// the versioning of files for this instance.
+	VersionsMaxNumber int           `json:"versions_max_number,omitempty"`
+	VersionsMaxAge    time.Duration `json:"versions_max_age,omitempty"`
+
+	// Whether or not a quota has been set on a directory. When it is not the
+	// case, the sizes of the directories are not counted by the VFS.
+	DirQuotas bool `json:"dir_quotas,omitempty"`
+
 	// Swift cluster number, indexed from 1. If not zero, it indicates we're using swift layout 2, see pkg/vfs/swift.
 	SwiftCluster int `json:"swift_cluster,omitempty"`
 
+	// Whether or not the instance has been migrated to the S3 storage, while
+	// the fs.url of the configuration still uses another storage.
+	S3Storage bool `json:"s3_storage,omitempty"`
+
+	// Whether or not the content of the files is deduplicated in the VFS. It is
+	// chosen when the instance is created and can't be changed after, as the
+	// layout of the storage depends on it.
+	Dedup bool `json:"dedup,omitempty"`
+
+	// FsDataKey is the key used to encrypt the content of the files at rest,
+	// wrapped by the master key of the stack (see config.Vault). The content is
+	// not encrypted if it is empty.
+	FsDataKey []byte `json:"fs_data_key,omitempty"`
+
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
 	// see crypto.GenerateFromPassphrase.
 	PassphraseHash       []byte     `json:"passphrase_hash,omitempty"`
@@ -123,6 +150,7 @@ type Instance struct {
 	CLISecret []byte `json:"cli_secret,omitempty"`
 
 	vfs              vfs.VFS
+	cipher           vfs.Cipher
 	managerURL       *url.URL
 	contextualDomain string
 }
@@ -144,7 +172,11 @@ type Options struct {
 	AuthMode      string
 	Passphrase    string
 	SwiftCluster  int
+	S3Storage     bool
+	Dedup         bool
 	DiskQuota     int64
+	MaxVersions   int
+	VersionsAge   time.Duration
 	Apps          []string
 	AutoUpdate    *bool
 	Debug         *bool
@@ -229,31 +261,63 @@ func (i *Instance) makeVFS() error {
 	if i.vfs != nil {
 		return nil
 	}
+	if len(i.FsDataKey) > 0 && i.cipher == nil {
+		masterKey := config.GetVault().FsMasterKey()
+		if masterKey == nil {
+			return errors.New("instance: the master key for the files is missing")
+		}
+		dataKey, err := masterKey.UnwrapKey(i.FsDataKey)
+		if err != nil {
+			return err
+		}
+		c, err := vfscrypt.New(dataKey)
+		if err != nil {
+			return err
+		}
+		i.cipher = c
+	}
+	var err error
+	i.vfs, err = i.VFSWithLocker(lock.ReadWrite(i, "vfs"))
+	return err
+}
+
+// VFSWithLocker returns a new VFS for the current storage of the instance,
+// that uses the given locker instead of the lock of the VFS of the instance.
+// It can be used to read the files while this lock is held, like during a
+// migration.
+func (i *Instance) VFSWithLocker(mutex lock.ErrorRWLocker) (vfs.VFS, error) {
 	fsURL := config.FsURL()
-	mutex := lock.ReadWrite(i, "vfs")
-	index := vfs.NewCouchdbIndexer(i)
+	index := vfs.NewCouchdbIndexerWithQuotasFlag(i, i)
 	disk := vfs.DiskThresholder(i)
-	var err error
-	switch fsURL.Scheme {
+	switch i.fsScheme() {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
+		return vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
 	case config.SchemeSwift:
 		if i.SwiftCluster > 0 {
-			i.vfs, err = vfsswift.NewV2(i, index, disk, mutex)
-		} else {
-			i.vfs, err = vfsswift.New(i, index, disk, mutex)
+			return vfsswift.NewV2(i, index, disk, mutex)
 		}
+		return vfsswift.New(i, index, disk, mutex)
+	case config.SchemeS3:
+		return vfss3.New(i, index, disk, mutex)
 	default:
-		err = fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
+		return nil, fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 	}
-	return err
+}
+
+// fsScheme returns the scheme of the storage used for the files of the
+// instance.
+func (i *Instance) fsScheme() string {
+	if i.S3Storage && config.S3URL() != nil {
+		return config.SchemeS3
+	}
+	return config.FsURL().Scheme
 }
 
 // AppsCopier returns the application copier associated with the specified
 // application type
 func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 	fsURL := config.FsURL()
-	switch fsURL.Scheme {
+	switch i.fsScheme() {
 	case config.SchemeFile, config.SchemeMem:
 		var baseDirName string
 		switch appsType {
@@ -267,6 +331,8 @@ func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 		return apps.NewAferoCopier(baseFS)
 	case config.SchemeSwift:
 		return apps.NewSwiftCopier(config.GetSwiftConnection(), appsType)
+	case config.SchemeS3:
+		return apps.NewS3Copier(config.GetS3Client(), config.S3Bucket(), appsType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -276,13 +342,15 @@ func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 // instance.
 func (i *Instance) AppsFileServer() apps.FileServer {
 	fsURL := config.FsURL()
-	switch fsURL.Scheme {
+	switch i.fsScheme() {
 	case config.SchemeFile, config.SchemeMem:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), vfs.WebappsDirName))
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
 		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Webapp)
+	case config.SchemeS3:
+		return apps.NewS3FileServer(config.GetS3Client(), config.S3Bucket(), apps.Webapp)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -292,13 +360,15 @@ func (i *Instance) AppsFileServer() apps.FileServer {
 // instance.
 func (i *Instance) KonnectorsFileServer() apps.FileServer {
 	fsURL := config.FsURL()
-	switch fsURL.Scheme {
+	switch i.fsScheme() {
 	case config.SchemeFile, config.SchemeMem:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), vfs.KonnectorsDirName))
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
 		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Konnector)
+	case config.SchemeS3:
+		return apps.NewS3FileServer(config.GetS3Client(), config.S3Bucket(), apps.Konnector)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -308,7 +378,7 @@ func (i *Instance) KonnectorsFileServer() apps.FileServer {
 // photos/image
 func (i *Instance) ThumbsFS() vfs.Thumbser {
 	fsURL := config.FsURL()
-	switch fsURL.Scheme {
+	switch i.fsScheme() {
 	case config.SchemeFile, config.SchemeMem:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), vfs.ThumbsDirName))
@@ -318,6 +388,8 @@ func (i *Instance) ThumbsFS() vfs.Thumbser {
 			return vfsswift.NewThumbsFsV2(config.GetSwiftConnection(), i.Domain)
 		}
 		return vfsswift.NewThumbsFs(config.GetSwiftConnection(), i.Domain)
+	case config.SchemeS3:
+		return vfss3.NewThumbsFs(config.GetS3Client(), config.S3Bucket(), i.DBPrefix())
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -345,6 +417,36 @@ func (i *Instance) SettingsEMail() (string, error) {
 	return email, nil
 }
 
+// SettingsTimezone returns the IANA timezone defined in the settings of this
+// instance, or an empty string if it is not set or not valid.
+func (i *Instance) SettingsTimezone() string {
+	settings, err := i.SettingsDocument()
+	if err != nil {
+		return ""
+	}
+	tz, _ := settings.M["tz"].(string)
+	if _, err := time.LoadLocation(tz); err != nil {
+		return ""
+	}
+	return tz
+}
+
+// SettingsTrashRetention returns the number of days after which the items in
+// the trash are deleted, as defined in the settings of this instance (0 if
+// they are kept until the trash is emptied), and if the user wants to be
+// notified before.
+func (i *Instance) SettingsTrashRetention() (days int, notify bool, err error) {
+	settings, err := i.SettingsDocument()
+	if err != nil {
+		return 0, false, err
+	}
+	if d, ok := settings.M["trash_retention_days"].(float64); ok && d > 0 {
+		days = int(d)
+	}
+	notify, _ = settings.M["trash_retention_notify"].(bool)
+	return days, notify, nil
+}
+
 // SettingsContext returns the map from the config that matches the context of
 // this instance
 func (i *Instance) SettingsContext() (map[string]interface{}, error) {
@@ -381,6 +483,51 @@ func (i *Instance) DiskQuota() int64 {
 	return i.BytesDiskQuota
 }
 
+// MaxFileVersions returns the maximal number of old versions kept for a file.
+func (i *Instance) MaxFileVersions() int {
+	if i.VersionsMaxNumber != 0 {
+		return i.VersionsMaxNumber
+	}
+	return config.GetConfig().Fs.VersionsMaxNumber
+}
+
+// FileVersionsMaxAge returns the duration after which the old versions of a
+// file are removed.
+func (i *Instance) FileVersionsMaxAge() time.Duration {
+	if i.VersionsMaxAge != 0 {
+		return i.VersionsMaxAge
+	}
+	return config.GetConfig().Fs.VersionsMaxAge
+}
+
+// HasDirQuotas returns true if a quota has been set on a directory of the
+// instance.
+func (i *Instance) HasDirQuotas() bool {
+	return i.DirQuotas
+}
+
+// EnableDirQuotas is called when a quota is set on a directory for the first
+// time, to start counting the sizes of the directories.
+func (i *Instance) EnableDirQuotas() error {
+	if i.DirQuotas {
+		return nil
+	}
+	i.DirQuotas = true
+	return i.update()
+}
+
+// Deduplication returns true if the content of the files is stored by hash
+// and shared between the files with the same content.
+func (i *Instance) Deduplication() bool {
+	return i.Dedup
+}
+
+// ContentCipher returns the cipher used to encrypt the content of the files,
+// or nil if they are not encrypted.
+func (i *Instance) ContentCipher() vfs.Cipher {
+	return i.cipher
+}
+
 // WithContextualDomain the current instance context with the given hostname.
 func (i *Instance) WithContextualDomain(domain string) *Instance {
 	if i.HasDomain(domain) {
@@ -637,6 +784,18 @@ func CreateWithoutHooks(opts *Options) (*Instance, error) {
 	i.TOSLatest = opts.TOSLatest
 	i.ContextName = opts.ContextName
 	i.BytesDiskQuota = opts.DiskQuota
+	i.VersionsMaxNumber = opts.MaxVersions
+	i.VersionsMaxAge = opts.VersionsAge
+	i.Dedup = opts.Dedup || config.GetConfig().Fs.Dedup
+	if masterKey := config.GetVault().FsMasterKey(); masterKey != nil {
+		var dataKey []byte
+		if dataKey, err = vfscrypt.NewDataKey(); err != nil {
+			return nil, err
+		}
+		if i.FsDataKey, err = masterKey.WrapKey(dataKey); err != nil {
+			return nil, err
+		}
+	}
 	i.Dev = opts.Dev
 	i.IndexViewsVersion = consts.IndexViewsVersion
 	i.RegisterToken = crypto.GenerateRandomBytes(RegisterTokenLen)
@@ -933,11 +1092,26 @@ func Patch(i *Instance, opts *Options) error {
 			needUpdate = true
 		}
 
+		if opts.S3Storage && !i.S3Storage {
+			i.S3Storage = true
+			needUpdate = true
+		}
+
 		if opts.DiskQuota > 0 && opts.DiskQuota != i.BytesDiskQuota {
 			i.BytesDiskQuota = opts.DiskQuota
 			needUpdate = true
 		}
 
+		if opts.MaxVersions != 0 && opts.MaxVersions != i.VersionsMaxNumber {
+			i.VersionsMaxNumber = opts.MaxVersions
+			needUpdate = true
+		}
+
+		if opts.VersionsAge != 0 && opts.VersionsAge != i.VersionsMaxAge {
+			i.VersionsMaxAge = opts.VersionsAge
+			needUpdate = true
+		}
+
 		if opts.AutoUpdate != nil && !(*opts.AutoUpdate) != i.NoAutoUpdate {
 			i.NoAutoUpdate = !(*opts.AutoUpdate)
 			needUpdate = true
@@ -1137,6 +1311,9 @@ func DestroyWithoutHooks(domain string) error {
 	if err = i.VFS().Delete(); err != nil {
 		i.Logger().Errorf("Could not delete VFS: %s", err.Error())
 	}
+	if err = search.DeleteIndex(i); err != nil {
+		i.Logger().Errorf("Could not delete the search index: %s", err.Error())
+	}
 	return couchdb.DeleteDoc(couchdb.GlobalDB, i)
 }
 
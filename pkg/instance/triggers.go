@@ -1,14 +1,18 @@
 package instance
 
 import (
+	"strings"
+
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 )
 
 // Triggers returns the list of the triggers to add when an instance is created
 func Triggers(db prefixer.Prefixer) []jobs.TriggerInfos {
 	// Create/update/remove thumbnails when an image is created/updated/removed
-	return []jobs.TriggerInfos{
+	triggers := []jobs.TriggerInfos{
 		{
 			Domain:     db.DomainName(),
 			Prefix:     db.DBPrefix(),
@@ -16,5 +20,97 @@ func Triggers(db prefixer.Prefixer) []jobs.TriggerInfos {
 			WorkerType: "thumbnail",
 			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
 		},
+		// Same for the thumbnails of the first page of the PDFs and of a
+		// keyframe of the videos
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "thumbnail",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:pdf,video:class",
+		},
+		// Extract the metadata of the PDF and office documents, as it is too
+		// slow to be done during the upload
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "metadata",
+			Arguments:  "io.cozy.files:CREATED,UPDATED:" + strings.Join(vfs.DocumentMimeTypes, ",") + ":mime",
+		},
+		// Remove the upload sessions that have not been finalized
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@cron",
+			WorkerType: "clean-uploads",
+			Arguments:  "0 0 3 * * *",
+		},
+		// Remove the old versions of the files that have exceeded their max
+		// age
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@cron",
+			WorkerType: "clean-versions",
+			Arguments:  "0 0 2 * * *",
+		},
+		// Delete the items of the trash after the retention period chosen by
+		// the user in the settings
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@cron",
+			WorkerType: "trash-clean",
+			Arguments:  "0 0 4 * * *",
+		},
+	}
+	// Keep the full-text index in sync with the indexed doctypes
+	for _, doctype := range search.Doctypes() {
+		msg, _ := jobs.NewMessage(map[string]string{"doctype": doctype})
+		triggers = append(triggers, jobs.TriggerInfos{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "index",
+			Arguments:  doctype + ":CREATED,UPDATED,DELETED",
+			Message:    msg,
+		})
+	}
+	return triggers
+}
+
+// AddMissingTriggers adds to the instance the triggers for the given worker
+// type that are returned by Triggers, but that have not been created, as the
+// instance was created before they were added to the stack.
+func AddMissingTriggers(i *Instance, workerType string) error {
+	sched := jobs.System()
+	triggers, err := sched.GetAllTriggers(i)
+	if err != nil {
+		return err
+	}
+	for _, infos := range Triggers(i) {
+		if infos.WorkerType != workerType {
+			continue
+		}
+		found := false
+		for _, t := range triggers {
+			if t.Infos().WorkerType == infos.WorkerType &&
+				t.Infos().Arguments == infos.Arguments {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		t, err := jobs.NewTrigger(i, infos, nil)
+		if err != nil {
+			return err
+		}
+		if err = sched.AddTrigger(t); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -24,6 +24,8 @@ const (
 	Done = "done"
 	// Errored state
 	Errored = "errored"
+	// Cancelled state
+	Cancelled = "cancelled"
 )
 
 const (
@@ -43,9 +45,17 @@ type (
 		// This method is asynchronous.
 		PushJob(db prefixer.Prefixer, request *JobRequest) (*Job, error)
 
+		// CancelJob cancels the job with the given identifier: it is removed
+		// from its queue if it is queued, and its execution is stopped if it
+		// is running.
+		CancelJob(db prefixer.Prefixer, jobID string) (*Job, error)
+
 		// WorkerQueueLen returns the total element in the queue of the specified
 		// worker type.
 		WorkerQueueLen(workerType string) (int, error)
+		// WorkerQueueLenByDomain returns the number of elements in the queue of
+		// the specified worker type, for each domain that has queued jobs.
+		WorkerQueueLenByDomain(workerType string) (map[string]int, error)
 		// WorkersTypes returns the list of registered workers types.
 		WorkersTypes() []string
 	}
@@ -73,15 +83,26 @@ type (
 		Manual     bool        `json:"manual_execution,omitempty"`
 		Debounced  bool        `json:"debounced,omitempty"`
 		Options    *JobOptions `json:"options,omitempty"`
+		WorkflowID string      `json:"workflow_id,omitempty"`
+		StepName   string      `json:"workflow_step,omitempty"`
 		State      State       `json:"state"`
 		QueuedAt   time.Time   `json:"queued_at"`
 		StartedAt  time.Time   `json:"started_at"`
 		FinishedAt time.Time   `json:"finished_at"`
+		Progress   *Progress   `json:"progress,omitempty"`
 		Error      string      `json:"error,omitempty"`
 	}
 
+	// Progress is the intermediate progress of a job, reported by its worker.
+	Progress struct {
+		Percent   int       `json:"percent"`
+		Message   string    `json:"message,omitempty"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
 	// JobRequest struct is used to represent a new job request.
 	JobRequest struct {
+		JobID      string
 		WorkerType string
 		TriggerID  string
 		Trigger    Trigger
@@ -90,16 +111,31 @@ type (
 		Manual     bool
 		Debounced  bool
 		Options    *JobOptions
+		WorkflowID string
+		StepName   string
 	}
 
 	// JobOptions struct contains the execution properties of the jobs.
 	JobOptions struct {
+		Priority     int           `json:"priority,omitempty"`
 		MaxExecCount int           `json:"max_exec_count"`
 		MaxExecTime  time.Duration `json:"max_exec_time"`
 		Timeout      time.Duration `json:"timeout"`
+		Retry        *RetryPolicy  `json:"retry,omitempty"`
 	}
 )
 
+const (
+	// nbPriorityLevels is the number of distinct levels of priority in the
+	// queues: the priorities from 1 to 100 are grouped by ten.
+	nbPriorityLevels = 10
+	// defaultPriority is the priority of a job when none is given.
+	defaultPriority = 50
+	// manualPriority is the priority of a job launched manually when none is
+	// given: the user is probably waiting for it.
+	manualPriority = 70
+)
+
 var joblog = logger.WithNamespace("jobs")
 
 // DBPrefix implements the prefixer.Prefixer interface.
@@ -121,12 +157,24 @@ func (j *Job) ID() string { return j.JobID }
 // Rev implements the couchdb.Doc interface
 func (j *Job) Rev() string { return j.JobRev }
 
+func (o *JobOptions) clone() *JobOptions {
+	cloned := *o
+	if o.Retry != nil {
+		tmp := *o.Retry
+		cloned.Retry = &tmp
+	}
+	return &cloned
+}
+
 // Clone implements the couchdb.Doc interface
 func (j *Job) Clone() couchdb.Doc {
 	cloned := *j
 	if j.Options != nil {
-		tmp := *j.Options
-		cloned.Options = &tmp
+		cloned.Options = j.Options.clone()
+	}
+	if j.Progress != nil {
+		tmp := *j.Progress
+		cloned.Progress = &tmp
 	}
 	if j.Message != nil {
 		tmp := j.Message
@@ -207,13 +255,27 @@ func (j *Job) Nack(err error) error {
 	return j.Update()
 }
 
+// Cancel sets the job infos state to Cancelled an sends the new job infos on
+// the channel.
+func (j *Job) Cancel() error {
+	j.Logger().Debugf("cancel %s ", j.ID())
+	j.FinishedAt = time.Now()
+	j.State = Cancelled
+	return j.Update()
+}
+
 // Update updates the job in couchdb
 func (j *Job) Update() error {
 	return couchdb.UpdateDoc(j, j)
 }
 
-// Create creates the job in couchdb
+// Create creates the job in couchdb. If the job request has given its
+// identifier, the job is created only once: a conflict error is returned if
+// it already exists.
 func (j *Job) Create() error {
+	if j.JobID != "" {
+		return couchdb.CreateNamedDocWithDB(j, j)
+	}
 	return couchdb.CreateDoc(j, j)
 }
 
@@ -250,6 +312,7 @@ func (m Message) MarshalJSON() ([]byte, error) {
 // NewJob creates a new Job instance from a job request.
 func NewJob(db prefixer.Prefixer, req *JobRequest) *Job {
 	return &Job{
+		JobID:      req.JobID,
 		Domain:     db.DomainName(),
 		Prefix:     db.DBPrefix(),
 		WorkerType: req.WorkerType,
@@ -259,11 +322,29 @@ func NewJob(db prefixer.Prefixer, req *JobRequest) *Job {
 		Debounced:  req.Debounced,
 		Event:      req.Event,
 		Options:    req.Options,
+		WorkflowID: req.WorkflowID,
+		StepName:   req.StepName,
 		State:      Queued,
 		QueuedAt:   time.Now(),
 	}
 }
 
+// priorityLevel returns the level of priority of the job, from 0 (lowest)
+// to nbPriorityLevels-1 (highest).
+func (j *Job) priorityLevel() int {
+	p := defaultPriority
+	if j.Manual {
+		p = manualPriority
+	}
+	if j.Options != nil && j.Options.Priority > 0 {
+		p = j.Options.Priority
+	}
+	if p > 100 {
+		p = 100
+	}
+	return (p - 1) * nbPriorityLevels / 100
+}
+
 // Get returns the informations about a job.
 func Get(db prefixer.Prefixer, jobID string) (*Job, error) {
 	var job Job
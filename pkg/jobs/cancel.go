@@ -0,0 +1,88 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// maxCancelAttempts is the number of times the cancellation of a job is tried
+// when its state changes at the same time.
+const maxCancelAttempts = 5
+
+// jobCanceller is implemented by the brokers to remove a job from its queue,
+// and to stop its execution.
+type jobCanceller interface {
+	unqueue(job *Job) error
+	cancelRunning(job *Job) error
+}
+
+// runningJobs are the jobs executed by the workers of this stack, with the
+// functions to cancel their context.
+var runningJobs = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: make(map[string]context.CancelFunc)}
+
+func registerRunningJob(job *Job, cancel context.CancelFunc) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	runningJobs.cancels[job.ID()] = cancel
+}
+
+func unregisterRunningJob(job *Job) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	delete(runningJobs.cancels, job.ID())
+}
+
+// cancelRunningJob cancels the context of the job if it is executed by this
+// stack. It returns false if the job is not running here.
+func cancelRunningJob(jobID string) bool {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	cancel, ok := runningJobs.cancels[jobID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// cancelJob is the implementation of CancelJob shared by the brokers. A
+// queued job is removed from its queue and marked as cancelled. For a running
+// job, its execution is stopped, and the worker marks it as cancelled.
+func cancelJob(c jobCanceller, db prefixer.Prefixer, jobID string) (*Job, error) {
+	var err error
+	for i := 0; i < maxCancelAttempts; i++ {
+		var job *Job
+		job, err = Get(db, jobID)
+		if err != nil {
+			return nil, err
+		}
+		switch job.State {
+		case Queued:
+			if err = c.unqueue(job); err != nil {
+				return nil, err
+			}
+			// A conflict means that a worker has started the job in the
+			// meantime: its state is fetched again to cancel its execution.
+			err = job.Cancel()
+			if err == nil {
+				return job, nil
+			}
+			if !couchdb.IsConflictError(err) {
+				return nil, err
+			}
+		case Running:
+			if err = c.cancelRunning(job); err != nil {
+				return nil, err
+			}
+			return job, nil
+		default:
+			return nil, ErrJobEnded
+		}
+	}
+	return nil, err
+}
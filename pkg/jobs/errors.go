@@ -23,6 +23,16 @@ var (
 	// ErrAbort can be used to abort the execution of the job without causing
 	// errors.
 	ErrAbort = errors.New("jobs: abort")
+	// ErrCancelled is used when the execution of a job has been cancelled
+	ErrCancelled = errors.New("jobs: cancelled")
+	// ErrJobEnded is used when trying to cancel a job that has already ended
+	ErrJobEnded = errors.New("jobs: the job has already ended")
+
+	// ErrNotFoundWorkflow is used when the workflow could not be found
+	ErrNotFoundWorkflow = errors.New("jobs: workflow not found")
+	// ErrInvalidWorkflow is used when the steps of a workflow are not a valid
+	// directed acyclic graph
+	ErrInvalidWorkflow = errors.New("jobs: invalid workflow")
 
 	// ErrUnknownTrigger is used when the trigger type is not recognized
 	ErrUnknownTrigger = errors.New("Unknown trigger type")
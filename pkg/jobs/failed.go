@@ -0,0 +1,228 @@
+package jobs
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// maxFailedJobsPerWorker is the number of failed jobs kept in the dead-letter
+// store of an instance for a worker type. The oldest ones are removed first.
+const maxFailedJobsPerWorker = 100
+
+// failedJobsMaxAge is the duration after which a failed job is removed from
+// the dead-letter store.
+const failedJobsMaxAge = 30 * 24 * time.Hour
+
+type (
+	// JobAttempt is an execution of a job by its worker.
+	JobAttempt struct {
+		StartedAt  time.Time `json:"started_at"`
+		FinishedAt time.Time `json:"finished_at"`
+		Error      string    `json:"error,omitempty"`
+	}
+
+	// FailedJob is a job that has failed after all its executions. It is kept
+	// in the dead-letter store, with the history of its executions, so that
+	// it can be inspected and replayed later.
+	FailedJob struct {
+		DocID      string        `json:"_id,omitempty"`
+		DocRev     string        `json:"_rev,omitempty"`
+		JobID      string        `json:"job_id"`
+		Domain     string        `json:"domain"`
+		Prefix     string        `json:"prefix,omitempty"`
+		WorkerType string        `json:"worker"`
+		TriggerID  string        `json:"trigger_id,omitempty"`
+		WorkflowID string        `json:"workflow_id,omitempty"`
+		StepName   string        `json:"workflow_step,omitempty"`
+		Message    Message       `json:"message"`
+		Event      Event         `json:"event,omitempty"`
+		Options    *JobOptions   `json:"options,omitempty"`
+		Error      string        `json:"error"`
+		Attempts   []*JobAttempt `json:"attempts"`
+		QueuedAt   time.Time     `json:"queued_at"`
+		FailedAt   time.Time     `json:"failed_at"`
+	}
+)
+
+// DBPrefix implements the prefixer.Prefixer interface.
+func (f *FailedJob) DBPrefix() string {
+	if f.Prefix != "" {
+		return f.Prefix
+	}
+	return f.Domain
+}
+
+// DomainName implements the prefixer.Prefixer interface.
+func (f *FailedJob) DomainName() string {
+	return f.Domain
+}
+
+// ID implements the couchdb.Doc interface
+func (f *FailedJob) ID() string { return f.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (f *FailedJob) Rev() string { return f.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (f *FailedJob) DocType() string { return consts.JobsFailed }
+
+// Clone implements the couchdb.Doc interface
+func (f *FailedJob) Clone() couchdb.Doc {
+	cloned := *f
+	if f.Options != nil {
+		cloned.Options = f.Options.clone()
+	}
+	cloned.Attempts = make([]*JobAttempt, len(f.Attempts))
+	for i, a := range f.Attempts {
+		tmp := *a
+		cloned.Attempts[i] = &tmp
+	}
+	return &cloned
+}
+
+// SetID implements the couchdb.Doc interface
+func (f *FailedJob) SetID(id string) { f.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (f *FailedJob) SetRev(rev string) { f.DocRev = rev }
+
+// JobRequest returns a request to push again the failed job.
+func (f *FailedJob) JobRequest() *JobRequest {
+	return &JobRequest{
+		WorkerType: f.WorkerType,
+		TriggerID:  f.TriggerID,
+		WorkflowID: f.WorkflowID,
+		StepName:   f.StepName,
+		Message:    f.Message,
+		Event:      f.Event,
+		Options:    f.Options,
+	}
+}
+
+// Replay removes the failed job from the dead-letter store, and pushes it
+// again in the queue of its worker. It is removed first, so that two replays
+// of the same failed job can't push it twice. If the push fails, the failed
+// job is put back in the store.
+func (f *FailedJob) Replay(b Broker) (*Job, error) {
+	if err := couchdb.DeleteDoc(f, f); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsConflictError(err) {
+			return nil, ErrNotFoundJob
+		}
+		return nil, err
+	}
+	job, err := b.PushJob(f, f.JobRequest())
+	if err != nil {
+		f.SetRev("")
+		if errc := couchdb.CreateNamedDocWithDB(f, f); errc != nil {
+			joblog.Errorf("Cannot put back the failed job %s: %s", f.ID(), errc)
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+// saveFailedJob puts a job that has failed in the dead-letter store.
+func saveFailedJob(job *Job, attempts []*JobAttempt) error {
+	f := &FailedJob{
+		JobID:      job.ID(),
+		Domain:     job.Domain,
+		Prefix:     job.Prefix,
+		WorkerType: job.WorkerType,
+		TriggerID:  job.TriggerID,
+		WorkflowID: job.WorkflowID,
+		StepName:   job.StepName,
+		Message:    job.Message,
+		Event:      job.Event,
+		Options:    job.Options,
+		Error:      job.Error,
+		Attempts:   attempts,
+		QueuedAt:   job.QueuedAt,
+		FailedAt:   job.FinishedAt,
+	}
+	if err := couchdb.CreateDoc(f, f); err != nil {
+		return err
+	}
+	return trimFailedJobs(f, f.WorkerType)
+}
+
+// trimFailedJobs removes the failed jobs of a worker type that are too old,
+// or that are over the limit of failed jobs kept for a worker type.
+func trimFailedJobs(db prefixer.Prefixer, workerType string) error {
+	failed, err := GetFailedJobs(db, workerType)
+	if err != nil {
+		return err
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].FailedAt.After(failed[j].FailedAt)
+	})
+	var toDelete []couchdb.Doc
+	for i, f := range failed {
+		if i >= maxFailedJobsPerWorker || time.Since(f.FailedAt) > failedJobsMaxAge {
+			toDelete = append(toDelete, f)
+		}
+	}
+	if len(toDelete) == 0 {
+		return nil
+	}
+	return couchdb.BulkDeleteDocs(db, consts.JobsFailed, toDelete)
+}
+
+// GetFailedJob returns the failed job with the given identifier.
+func GetFailedJob(db prefixer.Prefixer, id string) (*FailedJob, error) {
+	var f FailedJob
+	if err := couchdb.GetDoc(db, consts.JobsFailed, id, &f); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrNotFoundJob
+		}
+		return nil, err
+	}
+	return &f, nil
+}
+
+// GetFailedJobs returns the failed jobs of the dead-letter store for the given
+// worker type, or for all the workers if it is empty.
+func GetFailedJobs(db prefixer.Prefixer, workerType string) ([]*FailedJob, error) {
+	var failed []*FailedJob
+	err := couchdb.ForeachDocs(db, consts.JobsFailed, func(_ string, data json.RawMessage) error {
+		var f FailedJob
+		if err := json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+		if workerType == "" || f.WorkerType == workerType {
+			failed = append(failed, &f)
+		}
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// PurgeFailedJobs removes the failed jobs of the dead-letter store for the
+// given worker type, or for all the workers if it is empty. It returns the
+// number of removed jobs.
+func PurgeFailedJobs(db prefixer.Prefixer, workerType string) (int, error) {
+	failed, err := GetFailedJobs(db, workerType)
+	if err != nil {
+		return 0, err
+	}
+	var errm error
+	count := 0
+	for _, f := range failed {
+		if err := couchdb.DeleteDoc(db, f); err != nil {
+			errm = multierror.Append(errm, err)
+		} else {
+			count++
+		}
+	}
+	return count, errm
+}
+
+var _ couchdb.Doc = &FailedJob{}
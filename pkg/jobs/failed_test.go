@@ -0,0 +1,113 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func saveTestFailedJob(t *testing.T, content string, failedAt time.Time) {
+	msg, _ := NewMessage(content)
+	job := NewJob(localDB, &JobRequest{
+		WorkerType: "failed-test",
+		Message:    msg,
+		WorkflowID: "failed-workflow",
+		StepName:   "failed-step",
+	})
+	job.Error = "boom"
+	job.FinishedAt = failedAt
+	attempts := []*JobAttempt{
+		{StartedAt: failedAt, FinishedAt: failedAt, Error: "boom"},
+	}
+	if !assert.NoError(t, saveFailedJob(job, attempts)) {
+		t.FailNow()
+	}
+}
+
+func TestFailedJobs(t *testing.T) {
+	_, err := PurgeFailedJobs(localDB, "")
+	assert.NoError(t, err)
+
+	saveTestFailedJob(t, "foo", time.Now())
+	failed, err := GetFailedJobs(localDB, "failed-test")
+	assert.NoError(t, err)
+	if !assert.Len(t, failed, 1) {
+		return
+	}
+	f := failed[0]
+	assert.Equal(t, "failed-test", f.WorkerType)
+	assert.Equal(t, "failed-workflow", f.WorkflowID)
+	assert.Equal(t, "failed-step", f.StepName)
+	assert.Equal(t, "boom", f.Error)
+	assert.Len(t, f.Attempts, 1)
+	others, err := GetFailedJobs(localDB, "other")
+	assert.NoError(t, err)
+	assert.Len(t, others, 0)
+	f, err = GetFailedJob(localDB, f.ID())
+	assert.NoError(t, err)
+
+	done := make(chan string, 1)
+	broker := NewMemBroker()
+	err = broker.StartWorkers(WorkersList{
+		{
+			WorkerType:  "failed-test",
+			Concurrency: 1,
+			WorkerFunc: func(ctx *WorkerContext) error {
+				var msg string
+				err := ctx.UnmarshalMessage(&msg)
+				assert.NoError(t, err)
+				done <- msg
+				return nil
+			},
+		},
+	})
+	assert.NoError(t, err)
+	defer broker.ShutdownWorkers(context.Background())
+
+	job, err := f.Replay(broker)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "failed-workflow", job.WorkflowID)
+		assert.Equal(t, "failed-step", job.StepName)
+	}
+	select {
+	case msg := <-done:
+		assert.Equal(t, "foo", msg)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the failed job has not been replayed")
+	}
+	_, err = GetFailedJob(localDB, f.ID())
+	assert.Equal(t, ErrNotFoundJob, err)
+
+	// The failed job can't be replayed twice
+	_, err = f.Replay(broker)
+	assert.Equal(t, ErrNotFoundJob, err)
+	select {
+	case <-done:
+		t.Fatal("the failed job has been replayed twice")
+	default:
+	}
+
+	// The old failed jobs, and the oldest failed jobs over the limit, are
+	// removed
+	saveTestFailedJob(t, "old", time.Now().Add(-failedJobsMaxAge-time.Hour))
+	for i := 0; i < maxFailedJobsPerWorker+1; i++ {
+		saveTestFailedJob(t, "bar", time.Now().Add(time.Duration(i)*time.Second))
+	}
+	failed, err = GetFailedJobs(localDB, "failed-test")
+	assert.NoError(t, err)
+	assert.Len(t, failed, maxFailedJobsPerWorker)
+	for _, f := range failed {
+		var msg string
+		assert.NoError(t, f.Message.Unmarshal(&msg))
+		assert.Equal(t, "bar", msg)
+	}
+
+	count, err := PurgeFailedJobs(localDB, "failed-test")
+	assert.NoError(t, err)
+	assert.Equal(t, maxFailedJobsPerWorker, count)
+	failed, err = GetFailedJobs(localDB, "failed-test")
+	assert.NoError(t, err)
+	assert.Len(t, failed, 0)
+}
@@ -0,0 +1,351 @@
+package jobs
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/go-redis/redis"
+)
+
+// schedulerLeaseTTL is the duration of the lease of the leader scheduler. The
+// leader renews it on each tick, and another stack takes the lead if it has
+// not been renewed during this duration.
+var schedulerLeaseTTL = 15 * time.Second
+
+// schedulerResyncInterval is the time interval between two loads of the
+// triggers from redis by the leader, in case an update has been missed.
+var schedulerResyncInterval int64 = 600 // seconds
+
+// triggersUpdatesChannel is the redis pub/sub channel used to send the
+// changes of the triggers to the leader.
+const triggersUpdatesChannel = "triggers:updates"
+
+// luaClaim moves a trigger from the waiting set to the scheduling set, if its
+// next execution is still at the expected time. It ensures that a job is
+// pushed only once for an execution of a trigger, even if two stacks think
+// that they are the leader.
+const luaClaim = `
+local s = redis.call("ZSCORE", "` + TriggersKey + `", KEYS[1])
+if s and tonumber(s) == tonumber(ARGV[1]) then
+  redis.call("ZREM", "` + TriggersKey + `", KEYS[1])
+  redis.call("ZADD", "` + SchedKey + `", ARGV[1], KEYS[1])
+  return 1
+end
+return 0`
+
+// luaRetry returns the triggers that have been claimed for more than 10
+// seconds, as their job has not been pushed because of an error, with the
+// time of their execution. Their score is set to the current time, so that
+// they are not retried again before 10 seconds.
+const luaRetry = `
+local w = tonumber(ARGV[1]) - 10
+local s = redis.call("ZRANGEBYSCORE", "` + SchedKey + `", 0, w, "WITHSCORES", "LIMIT", 0, 100)
+for i = 1, #s, 2 do
+  redis.call("ZADD", "` + SchedKey + `", ARGV[1], s[i])
+end
+return s`
+
+// leaderScheduler is a scheduler where only one stack, the leader, schedules
+// the jobs of the @at, @in, @cron and debounced @event triggers. The leader is
+// elected with a lease, and keeps the next executions of the triggers in a
+// timer wheel, instead of polling redis. The triggers are still saved in
+// redis, so that a new leader can take over after a failure.
+type leaderScheduler struct {
+	*redisScheduler
+	lease lock.Lease
+	node  string
+
+	mu        sync.Mutex
+	wheel     *timerWheel // nil if this stack is not the leader
+	sub       *redis.PubSub
+	lastSync  int64
+	renewedAt time.Time
+}
+
+// NewLeaderScheduler creates a new scheduler that uses the given lease to
+// elect the stack that schedules the jobs, and redis to save the triggers.
+func NewLeaderScheduler(client redis.UniversalClient, lease lock.Lease) Scheduler {
+	s := &leaderScheduler{
+		redisScheduler: &redisScheduler{
+			client:  client,
+			log:     logger.WithNamespace("scheduler-leader"),
+			stopped: make(chan struct{}),
+		},
+		lease: lease,
+		node:  hex.EncodeToString(crypto.GenerateRandomBytes(16)),
+	}
+	s.redisScheduler.notify = s.publish
+	return s
+}
+
+// StartScheduler starts the election of the leader, and the dispatching of
+// the realtime events to the @event triggers.
+func (s *leaderScheduler) StartScheduler(b Broker) error {
+	s.broker = b
+	s.closed = make(chan struct{})
+	s.startEventDispatcher()
+	go s.electionLoop()
+	return nil
+}
+
+func (s *leaderScheduler) electionLoop() {
+	ticker := time.NewTicker(pollInterval)
+	for {
+		select {
+		case <-s.closed:
+			ticker.Stop()
+			s.stepDown()
+			if err := s.lease.Release(s.node); err != nil {
+				s.log.Warnf("Failed to release the lease: %s", err)
+			}
+			s.stopped <- struct{}{}
+			return
+		case <-ticker.C:
+			now := time.Now().UTC().Unix()
+			if err := s.PollScheduler(now); err != nil {
+				s.log.Warnf("Failed to schedule the triggers: %s", err)
+			}
+		}
+	}
+}
+
+// PollScheduler renews the lease of the leader, or tries to acquire it, and
+// pushes the jobs of the triggers that have expired if this stack is the
+// leader.
+func (s *leaderScheduler) PollScheduler(now int64) error {
+	wheel, err := s.elect(now)
+	if wheel == nil || err != nil {
+		return err
+	}
+	for _, timer := range wheel.advance(now) {
+		if err := s.fire(timer.key, timer.at); err != nil {
+			s.log.Warnf("Failed to fire the trigger %s: %s", timer.key, err)
+		}
+	}
+	return s.retry(now)
+}
+
+// retry finishes the executions of the triggers that have been claimed, but
+// whose job has not been pushed because of an error.
+func (s *leaderScheduler) retry(now int64) error {
+	res, err := s.client.Eval(luaRetry, nil, now).Result()
+	if err != nil {
+		return err
+	}
+	results, ok := res.([]interface{})
+	if !ok {
+		return errors.New("Unexpected response from redis")
+	}
+	for i := 0; i+1 < len(results); i += 2 {
+		member, _ := results[i].(string)
+		score, _ := results[i+1].(string)
+		at, err := strconv.ParseInt(score, 10, 64)
+		if err != nil {
+			at = now
+		}
+		if err := s.recover(member, at); err != nil {
+			s.log.Warnf("Failed to retry the trigger %s: %s", member, err)
+		}
+	}
+	return nil
+}
+
+// holdsLease returns true if the lease of this stack is still valid. It is
+// checked before claiming an execution of a trigger, so that a stack that has
+// lost the lead while firing a batch of triggers stops pushing their jobs. The
+// lease is renewed when a third of its duration has elapsed, which leaves
+// two thirds of it to push the job.
+func (s *leaderScheduler) holdsLease() (bool, error) {
+	s.mu.Lock()
+	renewedAt := s.renewedAt
+	s.mu.Unlock()
+	if time.Since(renewedAt) < schedulerLeaseTTL/3 {
+		return true, nil
+	}
+	ok, err := s.lease.TryAcquire(s.node, schedulerLeaseTTL)
+	if err != nil || !ok {
+		s.stepDown()
+		return false, err
+	}
+	s.mu.Lock()
+	s.renewedAt = time.Now()
+	s.mu.Unlock()
+	return true, nil
+}
+
+// elect returns the timer wheel if this stack is the leader, and nil
+// otherwise.
+func (s *leaderScheduler) elect(now int64) (*timerWheel, error) {
+	ok, err := s.lease.TryAcquire(s.node, schedulerLeaseTTL)
+	if err != nil || !ok {
+		// Without a renewed lease, another stack can become the leader at
+		// any time
+		s.stepDown()
+		return nil, err
+	}
+	s.mu.Lock()
+	s.renewedAt = time.Now()
+	wheel := s.wheel
+	lastSync := s.lastSync
+	s.mu.Unlock()
+	if wheel == nil {
+		return s.takeOver(now)
+	}
+	if now-lastSync >= schedulerResyncInterval {
+		if err := s.load(wheel, now); err != nil {
+			s.log.Warnf("Failed to load the triggers: %s", err)
+		}
+	}
+	return wheel, nil
+}
+
+// load adds the triggers waiting in redis to the timer wheel.
+func (s *leaderScheduler) load(wheel *timerWheel, now int64) error {
+	waiting, err := s.client.ZRangeWithScores(TriggersKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, z := range waiting {
+		if member, ok := z.Member.(string); ok {
+			wheel.add(member, int64(z.Score))
+		}
+	}
+	s.mu.Lock()
+	s.lastSync = now
+	s.mu.Unlock()
+	return nil
+}
+
+// takeOver loads the triggers from redis in a new timer wheel, and finishes
+// the executions that the previous leader has started.
+func (s *leaderScheduler) takeOver(now int64) (*timerWheel, error) {
+	s.log.Infof("Taking the lead of the scheduler (%s)", s.node)
+	wheel := newTimerWheel(now - 1)
+
+	// The subscription is made before loading the triggers, so that no
+	// update can be missed.
+	sub := s.client.Subscribe(triggersUpdatesChannel)
+	if _, err := sub.Receive(); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	go s.updatesLoop(sub.Channel(), wheel)
+
+	if err := s.load(wheel, now); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.wheel = wheel
+	s.sub = sub
+	s.mu.Unlock()
+
+	// The triggers in the scheduling set have been claimed by a previous
+	// leader that may have failed before pushing their jobs.
+	started, err := s.client.ZRangeWithScores(SchedKey, 0, -1).Result()
+	if err != nil {
+		return wheel, err
+	}
+	for _, z := range started {
+		member, ok := z.Member.(string)
+		if !ok {
+			continue
+		}
+		if err := s.recover(member, int64(z.Score)); err != nil {
+			s.log.Warnf("Failed to recover the trigger %s: %s", member, err)
+		}
+	}
+	return wheel, nil
+}
+
+// stepDown stops the scheduling of the triggers on this stack.
+func (s *leaderScheduler) stepDown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wheel == nil {
+		return
+	}
+	s.log.Infof("Leaving the lead of the scheduler (%s)", s.node)
+	s.wheel = nil
+	s.renewedAt = time.Time{}
+	if s.sub != nil {
+		s.sub.Close()
+		s.sub = nil
+	}
+}
+
+// publish sends an update of a trigger to the leader.
+func (s *leaderScheduler) publish(member string, at int64) {
+	s.mu.Lock()
+	wheel := s.wheel
+	s.mu.Unlock()
+	if wheel != nil {
+		applyTriggerUpdate(wheel, member, at)
+	}
+	msg := strconv.FormatInt(at, 10) + " " + member
+	if err := s.client.Publish(triggersUpdatesChannel, msg).Err(); err != nil {
+		s.log.Warnf("Failed to publish the update of %s: %s", member, err)
+	}
+}
+
+func (s *leaderScheduler) updatesLoop(ch <-chan *redis.Message, wheel *timerWheel) {
+	for msg := range ch {
+		parts := strings.SplitN(msg.Payload, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		at, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		applyTriggerUpdate(wheel, parts[1], at)
+	}
+}
+
+func applyTriggerUpdate(wheel *timerWheel, member string, at int64) {
+	if at == 0 {
+		wheel.del(member)
+	} else {
+		wheel.add(member, at)
+	}
+}
+
+// fire claims the execution of a trigger at the given time, and pushes its
+// job. The claim fails if the trigger has been changed or already executed.
+// If the job can't be pushed, the trigger stays claimed, and it is retried
+// after 10 seconds.
+func (s *leaderScheduler) fire(member string, at int64) error {
+	if ok, err := s.holdsLease(); !ok || err != nil {
+		return err
+	}
+	claimed, err := s.client.Eval(luaClaim, []string{member}, at).Result()
+	if err != nil {
+		return err
+	}
+	if claimed != int64(1) {
+		return nil
+	}
+	return s.fireTrigger(member, time.Unix(at, 0))
+}
+
+// recover finishes the execution of a trigger claimed by a previous leader,
+// or claimed by this stack and not finished because of an error. The job has
+// the same identifier as the one that may have been pushed for this
+// execution, so it can't be pushed twice, even if a previous leader is still
+// pushing it.
+func (s *leaderScheduler) recover(member string, at int64) error {
+	if ok, err := s.holdsLease(); !ok || err != nil {
+		return err
+	}
+	return s.fireTrigger(member, time.Unix(at, 0))
+}
+
+var _ Scheduler = &leaderScheduler{}
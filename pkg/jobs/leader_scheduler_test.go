@@ -0,0 +1,257 @@
+package jobs_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// cronExecutions returns the number of executions of a trigger every 3
+// seconds, from its first execution to the given time.
+func cronExecutions(first, to int64) int {
+	if to < first {
+		return 0
+	}
+	return int((to-first)/3) + 1
+}
+
+// newStoppedLeaderScheduler returns a leader scheduler without its loops, so
+// that the test can poll it manually.
+func newStoppedLeaderScheduler(client redis.UniversalClient, lease lock.Lease, bro jobs.Broker) jobs.Scheduler {
+	sch := jobs.NewLeaderScheduler(client, lease)
+	sch.StartScheduler(bro)
+	sch.ShutdownScheduler(context.Background())
+	return sch
+}
+
+func TestLeaderSchedulerFailover(t *testing.T) {
+	opts, _ := redis.ParseURL(redisURL)
+	client := redis.NewClient(opts)
+	err := client.Del(jobs.TriggersKey, jobs.SchedKey).Err()
+	assert.NoError(t, err)
+
+	clock := &fakeClock{now: time.Now()}
+	lease := &lock.MemLease{Now: clock.Now}
+	broA := &mockBroker{}
+	broB := &mockBroker{}
+	nodeA := newStoppedLeaderScheduler(client, lease, broA)
+	nodeB := newStoppedLeaderScheduler(client, lease, broB)
+
+	msg, _ := jobs.NewMessage("@cron")
+	infos := jobs.TriggerInfos{
+		Type:       "@cron",
+		Arguments:  "*/3 * * * * *",
+		WorkerType: "incr",
+	}
+	trigger, err := jobs.NewTrigger(testInstance, infos, msg)
+	assert.NoError(t, err)
+	err = nodeA.AddTrigger(trigger)
+	assert.NoError(t, err)
+	defer nodeA.DeleteTrigger(testInstance, trigger.ID())
+	score, err := client.ZScore(jobs.TriggersKey, testInstance.DBPrefix()+"/"+trigger.ID()).Result()
+	assert.NoError(t, err)
+	first := int64(score)
+
+	// The node A is the leader, and the node B does nothing
+	now := time.Now().UTC().Unix()
+	for i := int64(0); i < 6; i++ {
+		assert.NoError(t, nodeA.PollScheduler(now+i))
+		assert.NoError(t, nodeB.PollScheduler(now+i))
+	}
+	countA, _ := broA.WorkerQueueLen("incr")
+	countB, _ := broB.WorkerQueueLen("incr")
+	assert.Equal(t, cronExecutions(first, now+5), countA)
+	assert.Equal(t, 0, countB)
+
+	// The node A is lost: the node B takes the lead after the expiration of
+	// the lease, and catches up with the executions of the trigger, without
+	// executing twice the executions made by the node A
+	clock.Add(16 * time.Second)
+	for i := int64(16); i < 25; i++ {
+		assert.NoError(t, nodeB.PollScheduler(now+i))
+	}
+	countA, _ = broA.WorkerQueueLen("incr")
+	countB, _ = broB.WorkerQueueLen("incr")
+	assert.Equal(t, cronExecutions(first, now+5), countA)
+	assert.Equal(t, cronExecutions(first, now+24), countA+countB)
+
+	// The node A comes back, but it is no longer the leader
+	assert.NoError(t, nodeA.PollScheduler(now+25))
+	countA, _ = broA.WorkerQueueLen("incr")
+	assert.Equal(t, cronExecutions(first, now+5), countA)
+}
+
+func TestLeaderSchedulerSplitBrain(t *testing.T) {
+	opts, _ := redis.ParseURL(redisURL)
+	client := redis.NewClient(opts)
+	err := client.Del(jobs.TriggersKey, jobs.SchedKey).Err()
+	assert.NoError(t, err)
+
+	// Two leases: both nodes think that they are the leader
+	broA := &mockBroker{}
+	broB := &mockBroker{}
+	nodeA := newStoppedLeaderScheduler(client, &lock.MemLease{}, broA)
+	nodeB := newStoppedLeaderScheduler(client, &lock.MemLease{}, broB)
+
+	msg, _ := jobs.NewMessage("@cron")
+	infos := jobs.TriggerInfos{
+		Type:       "@cron",
+		Arguments:  "*/3 * * * * *",
+		WorkerType: "incr",
+	}
+	trigger, err := jobs.NewTrigger(testInstance, infos, msg)
+	assert.NoError(t, err)
+	err = nodeA.AddTrigger(trigger)
+	assert.NoError(t, err)
+	defer nodeA.DeleteTrigger(testInstance, trigger.ID())
+	score, err := client.ZScore(jobs.TriggersKey, testInstance.DBPrefix()+"/"+trigger.ID()).Result()
+	assert.NoError(t, err)
+	first := int64(score)
+
+	now := time.Now().UTC().Unix()
+	for i := int64(0); i < 15; i++ {
+		assert.NoError(t, nodeA.PollScheduler(now+i))
+		assert.NoError(t, nodeB.PollScheduler(now+i))
+	}
+	countA, _ := broA.WorkerQueueLen("incr")
+	countB, _ := broB.WorkerQueueLen("incr")
+	assert.Equal(t, cronExecutions(first, now+14), countA+countB)
+}
+
+func TestLeaderSchedulerRecovery(t *testing.T) {
+	opts, _ := redis.ParseURL(redisURL)
+	client := redis.NewClient(opts)
+	err := client.Del(jobs.TriggersKey, jobs.SchedKey).Err()
+	assert.NoError(t, err)
+
+	now := time.Now()
+	ts := now.UTC().Unix()
+	msg, _ := jobs.NewMessage("@at")
+
+	// Two @at triggers have been claimed by a leader that has been lost: the
+	// job of the first one has been pushed, but not the job of the second one
+	var triggers []jobs.Trigger
+	for i := 0; i < 2; i++ {
+		at := jobs.TriggerInfos{
+			Type:       "@at",
+			Arguments:  now.Format(time.RFC3339),
+			WorkerType: "incr",
+		}
+		tat, err := jobs.NewTrigger(testInstance, at, msg)
+		assert.NoError(t, err)
+		err = couchdb.CreateDoc(testInstance, tat.Infos())
+		assert.NoError(t, err)
+		err = client.ZAdd(jobs.SchedKey, redis.Z{
+			Score:  float64(ts),
+			Member: testInstance.DBPrefix() + "/" + tat.ID(),
+		}).Err()
+		assert.NoError(t, err)
+		triggers = append(triggers, tat)
+	}
+	req := triggers[0].Infos().JobRequest()
+	req.JobID = triggers[0].ID() + "-" + strconv.FormatInt(ts, 10)
+	assert.NoError(t, jobs.NewJob(testInstance, req).Create())
+
+	bro := &mockBroker{}
+	sch := newStoppedLeaderScheduler(client, &lock.MemLease{}, bro)
+	assert.NoError(t, sch.PollScheduler(ts+2))
+
+	if assert.Len(t, bro.jobs, 1) {
+		assert.Equal(t, triggers[1].ID(), bro.jobs[0].TriggerID)
+	}
+	sched, err := client.ZCard(jobs.SchedKey).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), sched)
+	for _, tat := range triggers {
+		_, err = sch.GetTrigger(testInstance, tat.ID())
+		assert.Equal(t, jobs.ErrNotFoundTrigger, err)
+	}
+}
+
+func TestLeaderSchedulerRetry(t *testing.T) {
+	opts, _ := redis.ParseURL(redisURL)
+	client := redis.NewClient(opts)
+	err := client.Del(jobs.TriggersKey, jobs.SchedKey).Err()
+	assert.NoError(t, err)
+
+	bro := &mockBroker{}
+	sch := newStoppedLeaderScheduler(client, &lock.MemLease{}, bro)
+	now := time.Now()
+	ts := now.UTC().Unix()
+	assert.NoError(t, sch.PollScheduler(ts))
+
+	// An @at trigger has been claimed by the leader, but its job has not been
+	// pushed because of an error
+	msg, _ := jobs.NewMessage("@at")
+	at := jobs.TriggerInfos{
+		Type:       "@at",
+		Arguments:  now.Format(time.RFC3339),
+		WorkerType: "incr",
+	}
+	tat, err := jobs.NewTrigger(testInstance, at, msg)
+	assert.NoError(t, err)
+	err = couchdb.CreateDoc(testInstance, tat.Infos())
+	assert.NoError(t, err)
+	err = client.ZAdd(jobs.SchedKey, redis.Z{
+		Score:  float64(ts),
+		Member: testInstance.DBPrefix() + "/" + tat.ID(),
+	}).Err()
+	assert.NoError(t, err)
+
+	// The claim is retried only after 10 seconds
+	assert.NoError(t, sch.PollScheduler(ts+5))
+	assert.Len(t, bro.jobs, 0)
+	assert.NoError(t, sch.PollScheduler(ts+11))
+	if assert.Len(t, bro.jobs, 1) {
+		assert.Equal(t, tat.ID(), bro.jobs[0].TriggerID)
+	}
+	sched, err := client.ZCard(jobs.SchedKey).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), sched)
+	_, err = sch.GetTrigger(testInstance, tat.ID())
+	assert.Equal(t, jobs.ErrNotFoundTrigger, err)
+
+	// It is not pushed twice if the job has been pushed before the error
+	tat, err = jobs.NewTrigger(testInstance, at, msg)
+	assert.NoError(t, err)
+	err = couchdb.CreateDoc(testInstance, tat.Infos())
+	assert.NoError(t, err)
+	err = client.ZAdd(jobs.SchedKey, redis.Z{
+		Score:  float64(ts),
+		Member: testInstance.DBPrefix() + "/" + tat.ID(),
+	}).Err()
+	assert.NoError(t, err)
+	req := tat.Infos().JobRequest()
+	req.JobID = tat.ID() + "-" + strconv.FormatInt(ts, 10)
+	assert.NoError(t, jobs.NewJob(testInstance, req).Create())
+	assert.NoError(t, sch.PollScheduler(ts+12))
+	assert.Len(t, bro.jobs, 1)
+	sched, err = client.ZCard(jobs.SchedKey).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), sched)
+}
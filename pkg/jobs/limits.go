@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+type (
+	// WorkerLimits are the limits applied to the jobs of a worker type for
+	// each instance. A zero value means that there is no limit.
+	WorkerLimits struct {
+		// DomainConcurrency is the maximum number of jobs of an instance that
+		// can be executed in parallel.
+		DomainConcurrency int
+		// RateLimit is the number of jobs of an instance that can be started
+		// during RatePeriod. It is a token bucket: a burst of RateLimit jobs is
+		// allowed, and then the jobs are spread over the period.
+		RateLimit  int
+		RatePeriod time.Duration
+	}
+
+	// workerLimiter is implemented by the brokers to know when a job has
+	// ended, and give back its slot to its instance. Before each attempt of a
+	// job, refresh is called with the time when the attempt will end at the
+	// latest.
+	workerLimiter interface {
+		refresh(job *Job, deadline time.Time)
+		release(job *Job)
+	}
+
+	// tokenBucket is the state of the rate limit of an instance for a worker
+	// type.
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+var cbContextName func(domain string) string
+
+// RegisterContextNameCallback allows to register a callback function that
+// returns the context of the instance with the given domain. It is used to
+// apply the limits of the workers configured for this context.
+func RegisterContextNameCallback(cb func(domain string) string) {
+	cbContextName = cb
+}
+
+// isZero returns true if there is no limit.
+func (l WorkerLimits) isZero() bool {
+	return l.DomainConcurrency <= 0 && !l.isRateLimited()
+}
+
+// isRateLimited returns true if there is a rate limit.
+func (l WorkerLimits) isRateLimited() bool {
+	return l.RateLimit > 0 && l.RatePeriod > 0
+}
+
+// domainLimits returns the limits for the jobs of the given domain, with the
+// overrides of the context of its instance.
+func (w *WorkerConfig) domainLimits(domain string) WorkerLimits {
+	if len(w.ContextsLimits) > 0 && cbContextName != nil {
+		if l, ok := w.ContextsLimits[cbContextName(domain)]; ok {
+			return l
+		}
+	}
+	return w.Limits
+}
+
+// take consumes a token if there is one. Else, it returns the delay before
+// the next token.
+func (b *tokenBucket) take(l WorkerLimits, now time.Time) (bool, time.Duration) {
+	max := float64(l.RateLimit)
+	period := float64(l.RatePeriod)
+	if b.last.IsZero() {
+		b.tokens = max
+	} else {
+		b.tokens += float64(now.Sub(b.last)) * max / period
+		if b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * period / max)
+	}
+	b.tokens--
+	return true, 0
+}
+
+func applyWorkerLimits(l WorkerLimits, c config.Worker) WorkerLimits {
+	if c.DomainConcurrency != nil {
+		l.DomainConcurrency = *c.DomainConcurrency
+	}
+	if c.RateLimit != nil {
+		l.RateLimit = *c.RateLimit
+	}
+	if c.RatePeriod != nil {
+		l.RatePeriod = *c.RatePeriod
+	}
+	return l
+}
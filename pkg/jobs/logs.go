@@ -0,0 +1,157 @@
+package jobs
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/go-redis/redis"
+)
+
+const (
+	// LogStdout is the stream of the lines printed on the standard output
+	LogStdout = "stdout"
+	// LogStderr is the stream of the lines printed on the standard error
+	LogStderr = "stderr"
+)
+
+// logsStoreTTL is the time the logs of a job stay alive after their last
+// line.
+var logsStoreTTL = 24 * time.Hour
+
+// logsStoreCleanInterval is the time interval between each cleanup of the
+// in-memory store.
+var logsStoreCleanInterval = 1 * time.Hour
+
+// logsStoreMaxLines is the maximal number of lines kept for a job.
+var logsStoreMaxLines = 10000
+
+// JobLog is a line printed by the process executed for a job.
+type JobLog struct {
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+	Time   time.Time `json:"time"`
+}
+
+// LogsStore is used to keep the logs of the jobs for some time, and to read
+// them while they are written.
+type LogsStore interface {
+	// Append adds a line to the logs of the job.
+	Append(jobID string, log *JobLog) error
+	// Read returns the lines of the logs of the job, starting at the offset.
+	Read(jobID string, offset int) ([]*JobLog, error)
+}
+
+var logsStoreMu sync.Mutex
+var globalLogsStore LogsStore
+
+// GetLogsStore returns the store for the logs of the jobs.
+func GetLogsStore() LogsStore {
+	logsStoreMu.Lock()
+	defer logsStoreMu.Unlock()
+	if globalLogsStore != nil {
+		return globalLogsStore
+	}
+	cli := config.GetConfig().Jobs.Client()
+	if cli == nil {
+		globalLogsStore = newMemLogsStore()
+	} else {
+		globalLogsStore = &redisLogsStore{cli}
+	}
+	return globalLogsStore
+}
+
+type memLogs struct {
+	logs []*JobLog
+	exp  time.Time
+}
+
+type memLogsStore struct {
+	mu   sync.Mutex
+	vals map[string]*memLogs
+}
+
+func newMemLogsStore() LogsStore {
+	store := &memLogsStore{vals: make(map[string]*memLogs)}
+	go store.cleaner()
+	return store
+}
+
+func (s *memLogsStore) cleaner() {
+	for range time.Tick(logsStoreCleanInterval) {
+		now := time.Now()
+		s.mu.Lock()
+		for k, v := range s.vals {
+			if now.After(v.exp) {
+				delete(s.vals, k)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *memLogsStore) Append(jobID string, log *JobLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.vals[jobID]
+	if !ok {
+		ref = &memLogs{}
+		s.vals[jobID] = ref
+	}
+	if len(ref.logs) < logsStoreMaxLines {
+		ref.logs = append(ref.logs, log)
+	}
+	ref.exp = time.Now().Add(logsStoreTTL)
+	return nil
+}
+
+func (s *memLogsStore) Read(jobID string, offset int) ([]*JobLog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.vals[jobID]
+	if !ok || offset >= len(ref.logs) {
+		return nil, nil
+	}
+	logs := make([]*JobLog, len(ref.logs)-offset)
+	copy(logs, ref.logs[offset:])
+	return logs, nil
+}
+
+type redisLogsStore struct {
+	c redis.UniversalClient
+}
+
+func redisLogsKey(jobID string) string {
+	return "jobs:logs:" + jobID
+}
+
+func (s *redisLogsStore) Append(jobID string, log *JobLog) error {
+	v, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+	key := redisLogsKey(jobID)
+	pipe := s.c.Pipeline()
+	pipe.RPush(key, v)
+	pipe.LTrim(key, 0, int64(logsStoreMaxLines-1))
+	pipe.Expire(key, logsStoreTTL)
+	_, err = pipe.Exec()
+	return err
+}
+
+func (s *redisLogsStore) Read(jobID string, offset int) ([]*JobLog, error) {
+	vals, err := s.c.LRange(redisLogsKey(jobID), int64(offset), -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]*JobLog, 0, len(vals))
+	for _, v := range vals {
+		var log JobLog
+		if err := json.Unmarshal([]byte(v), &log); err != nil {
+			return nil, err
+		}
+		logs = append(logs, &log)
+	}
+	return logs, nil
+}
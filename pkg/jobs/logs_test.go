@@ -0,0 +1,38 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemLogsStore(t *testing.T) {
+	store := newMemLogsStore()
+	logs, err := store.Read("job-1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 0)
+
+	now := time.Now()
+	assert.NoError(t, store.Append("job-1", &JobLog{Stream: LogStdout, Line: "foo", Time: now}))
+	assert.NoError(t, store.Append("job-1", &JobLog{Stream: LogStderr, Line: "bar", Time: now}))
+	assert.NoError(t, store.Append("job-2", &JobLog{Stream: LogStdout, Line: "baz", Time: now}))
+
+	logs, err = store.Read("job-1", 0)
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, "foo", logs[0].Line)
+		assert.Equal(t, LogStderr, logs[1].Stream)
+		assert.Equal(t, "bar", logs[1].Line)
+	}
+
+	logs, err = store.Read("job-1", 1)
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, "bar", logs[0].Line)
+	}
+
+	logs, err = store.Read("job-1", 2)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 0)
+}
@@ -6,21 +6,44 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	multierror "github.com/hashicorp/go-multierror"
 )
 
+// memEvictPeriod is the period between two evictions of the states of the
+// limits of the domains that have no job in the queue.
+const memEvictPeriod = time.Minute
+
 type (
 	// memQueue is a queue in-memory implementation of the Queue interface.
+	//
+	// The jobs are dispatched by level of priority, and inside a level, by
+	// domain: the domains take their turn in a round-robin fashion, so that an
+	// instance that pushes a lot of jobs can't starve the other instances. The
+	// domains that have reached their limits are skipped.
 	memQueue struct {
 		MaxCapacity int
 		Jobs        chan *Job
 
-		list *list.List
-		run  bool
-		jmu  sync.RWMutex
+		conf    *WorkerConfig
+		levels  [nbPriorityLevels]*memLevel
+		size    int
+		limits  map[string]WorkerLimits
+		running map[string]int
+		buckets map[string]*tokenBucket
+		evicted time.Time
+		wake    chan struct{}
+		run     bool
+		jmu     sync.RWMutex
+	}
+
+	// memLevel is the list of jobs of each domain for a level of priority.
+	memLevel struct {
+		domains map[string]*list.List
+		ring    []string
 	}
 
 	// memBroker is an in-memory broker implementation of the Broker interface.
@@ -34,37 +57,217 @@ type (
 )
 
 // newMemQueue creates and a new in-memory queue.
-func newMemQueue(workerType string) *memQueue {
-	return &memQueue{
-		list: list.New(),
-		Jobs: make(chan *Job),
+func newMemQueue(conf *WorkerConfig) *memQueue {
+	q := &memQueue{
+		Jobs:    make(chan *Job),
+		conf:    conf,
+		limits:  make(map[string]WorkerLimits),
+		running: make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+		wake:    make(chan struct{}, 1),
 	}
+	for i := range q.levels {
+		q.levels[i] = &memLevel{domains: make(map[string]*list.List)}
+	}
+	return q
 }
 
 // Enqueue into the queue
 func (q *memQueue) Enqueue(job *Job) error {
+	limits := q.conf.domainLimits(job.Domain)
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
-	q.list.PushBack(job.Clone())
+	if limits.isZero() {
+		delete(q.limits, job.Domain)
+	} else {
+		q.limits[job.Domain] = limits
+	}
+	level := q.levels[job.priorityLevel()]
+	l, ok := level.domains[job.Domain]
+	if !ok {
+		l = list.New()
+		level.domains[job.Domain] = l
+		level.ring = append(level.ring, job.Domain)
+	}
+	l.PushBack(job.Clone())
+	q.size++
 	if !q.run {
 		q.run = true
 		go q.send()
+	} else {
+		q.notify()
 	}
 	return nil
 }
 
+// Remove removes the job with the given identifier from the queue. It returns
+// false if the job is not in the queue.
+func (q *memQueue) Remove(jobID string) bool {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	for _, level := range q.levels {
+		for domain, l := range level.domains {
+			for e := l.Front(); e != nil; e = e.Next() {
+				if e.Value.(*Job).ID() != jobID {
+					continue
+				}
+				l.Remove(e)
+				q.size--
+				if l.Len() == 0 {
+					delete(level.domains, domain)
+					for i, d := range level.ring {
+						if d == domain {
+							level.ring = append(level.ring[:i], level.ring[i+1:]...)
+							break
+						}
+					}
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// notify wakes up the goroutine that sends the jobs, if it is waiting for a
+// domain to be under its limits.
+func (q *memQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// refresh does nothing: the slot of a job is kept in memory until the job is
+// released.
+func (q *memQueue) refresh(job *Job, deadline time.Time) {}
+
+// release gives back the slot of the job to its domain.
+func (q *memQueue) release(job *Job) {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	if n := q.running[job.Domain]; n > 1 {
+		q.running[job.Domain] = n - 1
+	} else {
+		delete(q.running, job.Domain)
+	}
+	q.notify()
+}
+
+// allow returns true if a job of the domain can be started, and takes a slot
+// for it. Else, it returns the delay before the rate limit allows a job, or
+// zero if the domain waits for the end of one of its jobs. It must be called
+// with the lock.
+func (q *memQueue) allow(domain string, now time.Time) (bool, time.Duration) {
+	limits, ok := q.limits[domain]
+	if ok {
+		if limits.DomainConcurrency > 0 && q.running[domain] >= limits.DomainConcurrency {
+			return false, 0
+		}
+		if limits.isRateLimited() {
+			b, ok := q.buckets[domain]
+			if !ok {
+				b = &tokenBucket{}
+				q.buckets[domain] = b
+			}
+			if ok, delay := b.take(limits, now); !ok {
+				return false, delay
+			}
+		}
+	}
+	q.running[domain]++
+	return true, 0
+}
+
+// evict removes the buckets that have not been used for a rate period, as
+// they are full again and a new bucket has the same state, and the limits of
+// the domains that have no job in the queue and no bucket. The running
+// counters are already removed when they reach zero. It must be called with
+// the lock.
+func (q *memQueue) evict(now time.Time) {
+	for domain, b := range q.buckets {
+		limits, ok := q.limits[domain]
+		if !ok || !limits.isRateLimited() || now.Sub(b.last) >= limits.RatePeriod {
+			delete(q.buckets, domain)
+		}
+	}
+	for domain := range q.limits {
+		if _, ok := q.buckets[domain]; ok {
+			continue
+		}
+		queued := false
+		for _, level := range q.levels {
+			if _, ok := level.domains[domain]; ok {
+				queued = true
+				break
+			}
+		}
+		if !queued {
+			delete(q.limits, domain)
+		}
+	}
+	q.evicted = now
+}
+
+// dequeue takes the next job from the queue: the first domain of the ring of
+// the highest non-empty level that is under its limits gives its oldest job,
+// and goes back to the end of the ring if it still has jobs. If no job can be
+// taken, it returns the delay before trying again, or zero to wait for a job
+// to end. It must be called with the lock.
+func (q *memQueue) dequeue(now time.Time) (*Job, time.Duration) {
+	if now.Sub(q.evicted) >= memEvictPeriod {
+		q.evict(now)
+	}
+	var wait time.Duration
+	for i := len(q.levels) - 1; i >= 0; i-- {
+		level := q.levels[i]
+		for j, domain := range level.ring {
+			ok, delay := q.allow(domain, now)
+			if !ok {
+				if delay > 0 && (wait == 0 || delay < wait) {
+					wait = delay
+				}
+				continue
+			}
+			level.ring = append(level.ring[:j], level.ring[j+1:]...)
+			l := level.domains[domain]
+			e := l.Front()
+			l.Remove(e)
+			if l.Len() > 0 {
+				level.ring = append(level.ring, domain)
+			} else {
+				delete(level.domains, domain)
+			}
+			q.size--
+			return e.Value.(*Job), 0
+		}
+	}
+	return nil, wait
+}
+
 func (q *memQueue) send() {
 	for {
 		q.jmu.Lock()
-		e := q.list.Front()
-		if e == nil {
-			q.run = false
+		job, delay := q.dequeue(time.Now())
+		if job == nil {
+			if q.size == 0 {
+				q.run = false
+				q.jmu.Unlock()
+				return
+			}
 			q.jmu.Unlock()
-			return
+			if delay > 0 {
+				select {
+				case <-q.wake:
+				case <-time.After(delay):
+				}
+			} else {
+				<-q.wake
+			}
+			continue
 		}
-		q.list.Remove(e)
 		q.jmu.Unlock()
-		q.Jobs <- e.Value.(*Job)
+		q.Jobs <- job
 	}
 }
 
@@ -72,7 +275,20 @@ func (q *memQueue) send() {
 func (q *memQueue) Len() int {
 	q.jmu.RLock()
 	defer q.jmu.RUnlock()
-	return q.list.Len()
+	return q.size
+}
+
+// LenByDomain returns the length of the queue for each domain
+func (q *memQueue) LenByDomain() map[string]int {
+	q.jmu.RLock()
+	defer q.jmu.RUnlock()
+	lens := make(map[string]int)
+	for _, level := range q.levels {
+		for domain, l := range level.domains {
+			lens[domain] += l.Len()
+		}
+	}
+	return lens
 }
 
 // NewMemBroker creates a new in-memory broker system.
@@ -96,8 +312,9 @@ func (b *memBroker) StartWorkers(ws WorkersList) error {
 		if conf.Concurrency <= 0 {
 			continue
 		}
-		q := newMemQueue(conf.WorkerType)
+		q := newMemQueue(conf)
 		w := NewWorker(conf)
+		w.limiter = q
 		b.queues[conf.WorkerType] = q
 		b.workers = append(b.workers, w)
 		if err := w.Start(q.Jobs); err != nil {
@@ -180,6 +397,26 @@ func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error)
 	return job, nil
 }
 
+// CancelJob cancels the job with the given identifier.
+func (b *memBroker) CancelJob(db prefixer.Prefixer, jobID string) (*Job, error) {
+	if atomic.LoadUint32(&b.running) == 0 {
+		return nil, ErrClosed
+	}
+	return cancelJob(b, db, jobID)
+}
+
+func (b *memBroker) unqueue(job *Job) error {
+	if q, ok := b.queues[job.WorkerType]; ok {
+		q.Remove(job.ID())
+	}
+	return nil
+}
+
+func (b *memBroker) cancelRunning(job *Job) error {
+	cancelRunningJob(job.ID())
+	return nil
+}
+
 // WorkerQueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *memBroker) WorkerQueueLen(workerType string) (int, error) {
@@ -190,6 +427,16 @@ func (b *memBroker) WorkerQueueLen(workerType string) (int, error) {
 	return q.Len(), nil
 }
 
+// WorkerQueueLenByDomain returns the number of elements in queue of the
+// specified worker type, for each domain.
+func (b *memBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	q, ok := b.queues[workerType]
+	if !ok {
+		return nil, ErrUnknownWorker
+	}
+	return q.LenByDomain(), nil
+}
+
 func (b *memBroker) WorkersTypes() []string {
 	return b.workersTypes
 }
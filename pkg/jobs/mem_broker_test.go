@@ -1,6 +1,7 @@
 package jobs
 
 import (
+	"context"
 	"encoding/json"
 	"strconv"
 	"strings"
@@ -199,6 +200,56 @@ func TestTimeout(t *testing.T) {
 	w.Wait()
 }
 
+func TestCancel(t *testing.T) {
+	started := make(chan struct{})
+	ended := make(chan error)
+
+	broker := NewMemBroker()
+	broker.StartWorkers(WorkersList{
+		{
+			WorkerType:   "cancel",
+			Concurrency:  1,
+			MaxExecCount: 3,
+			Timeout:      10 * time.Second,
+			WorkerFunc: func(ctx *WorkerContext) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				ended <- ctx.Err()
+				return ctx.Err()
+			},
+		},
+	})
+
+	running, err := broker.PushJob(localDB, &JobRequest{WorkerType: "cancel"})
+	assert.NoError(t, err)
+	<-started
+	queued, err := broker.PushJob(localDB, &JobRequest{WorkerType: "cancel"})
+	assert.NoError(t, err)
+
+	job, err := broker.CancelJob(localDB, queued.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, State(Cancelled), job.State)
+
+	job, err = broker.CancelJob(localDB, running.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, State(Running), job.State)
+	assert.Equal(t, context.Canceled, <-ended)
+
+	// The job is not retried, and it ends in the cancelled state
+	for i := 0; i < 100; i++ {
+		job, err = Get(localDB, running.ID())
+		assert.NoError(t, err)
+		if job.State != Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, State(Cancelled), job.State)
+
+	_, err = broker.CancelJob(localDB, running.ID())
+	assert.Equal(t, ErrJobEnded, err)
+}
+
 func TestRetry(t *testing.T) {
 	var w sync.WaitGroup
 
@@ -302,3 +353,106 @@ func TestPanic(t *testing.T) {
 	assert.NoError(t, err)
 	w.Wait()
 }
+
+func TestInMemoryQueueFairness(t *testing.T) {
+	q := newMemQueue(&WorkerConfig{WorkerType: "test"})
+	// Do not start the goroutine that sends the jobs to the workers
+	q.run = true
+
+	push := func(domain, id string, manual bool, priority int) {
+		job := &Job{JobID: id, Domain: domain, Manual: manual}
+		if priority > 0 {
+			job.Options = &JobOptions{Priority: priority}
+		}
+		assert.NoError(t, q.Enqueue(job))
+	}
+	push("alice.cozy.local", "a1", false, 0)
+	push("alice.cozy.local", "a2", false, 0)
+	push("alice.cozy.local", "a3", false, 0)
+	push("bob.cozy.local", "b1", false, 0)
+	push("bob.cozy.local", "b2", false, 0)
+	push("charlie.cozy.local", "c1", true, 0)
+	push("bob.cozy.local", "b3", false, 100)
+	push("alice.cozy.local", "a4", false, 1)
+
+	assert.Equal(t, 8, q.Len())
+	assert.Equal(t, map[string]int{
+		"alice.cozy.local":   4,
+		"bob.cozy.local":     3,
+		"charlie.cozy.local": 1,
+	}, q.LenByDomain())
+
+	var ids []string
+	now := time.Now()
+	for job, _ := q.dequeue(now); job != nil; job, _ = q.dequeue(now) {
+		ids = append(ids, job.JobID)
+	}
+	assert.Equal(t, []string{"b3", "c1", "a1", "b1", "a2", "b2", "a3", "a4"}, ids)
+	assert.Equal(t, 0, q.Len())
+	assert.Len(t, q.LenByDomain(), 0)
+}
+
+func TestInMemoryQueueLimits(t *testing.T) {
+	q := newMemQueue(&WorkerConfig{
+		WorkerType: "test",
+		Limits: WorkerLimits{
+			DomainConcurrency: 2,
+			RateLimit:         3,
+			RatePeriod:        3 * time.Second,
+		},
+	})
+	// Do not start the goroutine that sends the jobs to the workers
+	q.run = true
+
+	for i := 0; i < 5; i++ {
+		id := strconv.Itoa(i)
+		assert.NoError(t, q.Enqueue(&Job{JobID: "a" + id, Domain: "alice.cozy.local"}))
+		assert.NoError(t, q.Enqueue(&Job{JobID: "b" + id, Domain: "bob.cozy.local"}))
+	}
+
+	now := time.Now()
+	var ids []string
+	for job, _ := q.dequeue(now); job != nil; job, _ = q.dequeue(now) {
+		ids = append(ids, job.JobID)
+	}
+	assert.Equal(t, []string{"a0", "b0", "a1", "b1"}, ids)
+
+	// The concurrency limit is reached, a slot is needed
+	job, delay := q.dequeue(now)
+	assert.Nil(t, job)
+	assert.Equal(t, time.Duration(0), delay)
+	q.release(&Job{JobID: "a0", Domain: "alice.cozy.local"})
+	job, _ = q.dequeue(now)
+	if assert.NotNil(t, job) {
+		assert.Equal(t, "a2", job.JobID)
+	}
+
+	// The rate limit is reached, the next token comes after a second
+	q.release(&Job{JobID: "a1", Domain: "alice.cozy.local"})
+	job, delay = q.dequeue(now)
+	assert.Nil(t, job)
+	assert.Equal(t, time.Second, delay)
+	job, _ = q.dequeue(now.Add(1 * time.Second))
+	if assert.NotNil(t, job) {
+		assert.Equal(t, "a3", job.JobID)
+	}
+	assert.Equal(t, 4, q.Len())
+
+	// The states of the limits of the idle domains are evicted
+	for _, id := range []string{"a2", "a3"} {
+		q.release(&Job{JobID: id, Domain: "alice.cozy.local"})
+	}
+	for _, id := range []string{"b0", "b1"} {
+		q.release(&Job{JobID: id, Domain: "bob.cozy.local"})
+	}
+	later := now.Add(time.Hour)
+	for job, _ = q.dequeue(later); job != nil; job, _ = q.dequeue(later) {
+		q.release(job)
+	}
+	assert.Equal(t, 0, q.Len())
+	assert.Len(t, q.running, 0)
+	assert.Len(t, q.buckets, 2)
+	q.evict(later.Add(time.Hour))
+	assert.Len(t, q.buckets, 0)
+	assert.Len(t, q.limits, 0)
+}
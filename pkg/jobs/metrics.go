@@ -1,6 +1,9 @@
 package jobs
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"github.com/cozy/cozy-stack/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 type workersQueuesCollector struct {
 	prometheus.Desc
@@ -34,6 +37,29 @@ func (i *workersQueuesCollector) Collect(ch chan<- prometheus.Metric) {
 	}
 }
 
+type workersQueuesDomainCollector struct{}
+
+func (i *workersQueuesDomainCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.WorkersQueuesDomainLenDesc
+}
+
+func (i *workersQueuesDomainCollector) Collect(ch chan<- prometheus.Metric) {
+	broker := globalJobSystem
+	for _, workerType := range broker.WorkersTypes() {
+		lens, err := broker.WorkerQueueLenByDomain(workerType)
+		if err != nil {
+			continue
+		}
+		for domain, count := range lens {
+			ch <- prometheus.MustNewConstMetric(
+				metrics.WorkersQueuesDomainLenDesc, prometheus.GaugeValue, float64(count),
+				workerType, domain,
+			)
+		}
+	}
+}
+
 func init() {
 	prometheus.MustRegister(newWorkersQueuesCollector())
+	prometheus.MustRegister(&workersQueuesDomainCollector{})
 }
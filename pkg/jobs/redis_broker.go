@@ -3,7 +3,7 @@ package jobs
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -18,11 +18,226 @@ const (
 	// redisPrefix is the prefix for jobs queues in redis.
 	redisPrefix = "j/"
 	// redisHighPrioritySuffix suffix is the suffix used for prioritized queue.
+	// It is no longer used for pushing jobs, but the queues are still drained
+	// for the jobs pushed by the previous versions.
 	redisHighPrioritySuffix = "/p0"
+	// redisReadySuffix is the suffix used for the lists of the domains that
+	// have queued jobs for a level of priority.
+	redisReadySuffix = "/ready/"
+	// redisQueuedSuffix is the suffix used for the sets of the domains that
+	// have queued jobs for a level of priority. A domain of this set is either
+	// in the ready list, or claimed by a poller.
+	redisQueuedSuffix = "/queued/"
+	// redisClaimedSuffix is the suffix used for the sorted set of the domains
+	// taken from a ready list by a poller, that has not yet popped their job.
+	redisClaimedSuffix = "/claimed"
+	// redisSignalSuffix is the suffix used for the list used to wake up the
+	// pollers waiting for a domain to be ready.
+	redisSignalSuffix = "/signal"
+	// redisRunningSuffix is the suffix used for the sets of the running jobs
+	// of a domain.
+	redisRunningSuffix = "/running/"
+	// redisRateSuffix is the suffix used for the token buckets of the rate
+	// limits of a domain.
+	redisRateSuffix = "/rate/"
+	// redisCancelChannel is the pub/sub channel used to cancel the jobs that
+	// are running on another stack.
+	redisCancelChannel = "jobs:cancel"
 )
 
+// redisSignalScript is the lua code used to wake up a poller after a domain
+// has been added to a ready list. The signal list is trimmed, as the pollers
+// only need to know that there is something to do.
+//
+// KEYS[n] is the signal list.
+const redisSignalScript = `
+  redis.call("LPUSH", KEYS[%d], "1")
+  redis.call("LTRIM", KEYS[%d], 0, 99)
+`
+
+func redisSignal(key int) string {
+	return fmt.Sprintf(redisSignalScript, key, key)
+}
+
+// redisPushScript pushes a job in the list of its domain, and adds the domain
+// to the ready list of its level of priority if it is not already in it, or
+// claimed by a poller.
+//
+// KEYS[1] is the list of jobs of the domain, KEYS[2] is the ready list,
+// KEYS[3] is the set of the queued domains and KEYS[4] is the signal list.
+// ARGV[1] is the job and ARGV[2] is the domain.
+var redisPushScript = redis.NewScript(`
+redis.call("LPUSH", KEYS[1], ARGV[1])
+if redis.call("SADD", KEYS[3], ARGV[2]) == 1 then
+  redis.call("LPUSH", KEYS[2], ARGV[2])
+` + redisSignal(4) + `
+end
+return 1
+`)
+
+// redisClaimScript takes the next domain from the ready lists, sorted from
+// the highest level of priority to the lowest, and adds it to the claimed
+// domains. It returns the ready list and the domain, or nil if no domain is
+// ready. A domain that stays claimed for too long, because the stack that has
+// claimed it has crashed, is put back in its ready list by the reaper.
+//
+// KEYS[1..n] are the ready lists, and KEYS[n+1] is the set of the claimed
+// domains. ARGV[1] is the current time in milliseconds, and ARGV[2..n+1] are
+// the levels of priority of the ready lists.
+var redisClaimScript = redis.NewScript(`
+local n = #KEYS - 1
+for i = 1, n do
+  local domain = redis.call("RPOP", KEYS[i])
+  if domain then
+    redis.call("ZADD", KEYS[n+1], ARGV[1], ARGV[i+1] .. "/" .. domain)
+    return {KEYS[i], domain}
+  end
+end
+return false
+`)
+
+// redisReapScript puts back a claimed domain at the head of its ready list.
+//
+// KEYS[1] is the set of the claimed domains, KEYS[2] is the ready list and
+// KEYS[3] is the signal list. ARGV[1] is the claim and ARGV[2] is the domain.
+var redisReapScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+  return 0
+end
+redis.call("RPUSH", KEYS[2], ARGV[2])
+` + redisSignal(3) + `
+return 1
+`)
+
+// redisPopScript takes the oldest job of a domain that has been claimed from
+// a ready list, and puts back the domain at the end of the ready list if it
+// has more queued jobs.
+//
+// The limits of the domain are checked before: the jobs running for the
+// domain are kept in a sorted set, with their deadline as score, and the
+// state of the token bucket for the rate limit is kept in a hash. When the
+// domain has reached its limits, it is put back at the end of the ready list,
+// and the script returns the delay before the rate limit allows a job, or -1
+// if the domain waits for the end of one of its jobs. It returns 0 if the
+// domain has no queued jobs.
+//
+// KEYS[1] is the list of jobs of the domain, KEYS[2] is the ready list,
+// KEYS[3] is the set of the running jobs, KEYS[4] is the token bucket,
+// KEYS[5] is the set of the queued domains, KEYS[6] is the set of the claimed
+// domains and KEYS[7] is the signal list. ARGV[1] is the domain, ARGV[2] is
+// the current time in milliseconds, ARGV[3] is the concurrency limit, ARGV[4]
+// and ARGV[5] are the rate limit and its period in milliseconds, ARGV[6] is
+// the deadline of the job and ARGV[7] is the claim.
+var redisPopScript = redis.NewScript(`
+redis.call("ZREM", KEYS[6], ARGV[7])
+local now = tonumber(ARGV[2])
+local concurrency = tonumber(ARGV[3])
+local limit = tonumber(ARGV[4])
+local period = tonumber(ARGV[5])
+if concurrency > 0 then
+  redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", now)
+  if redis.call("ZCARD", KEYS[3]) >= concurrency then
+    redis.call("LPUSH", KEYS[2], ARGV[1])
+    return -1
+  end
+end
+local tokens = limit
+if limit > 0 and period > 0 then
+  local last = tonumber(redis.call("HGET", KEYS[4], "last"))
+  local stored = tonumber(redis.call("HGET", KEYS[4], "tokens"))
+  if last and stored then
+    tokens = math.min(limit, stored + (now - last) * limit / period)
+  end
+  if tokens < 1 then
+    redis.call("LPUSH", KEYS[2], ARGV[1])
+    return math.ceil((1 - tokens) * period / limit)
+  end
+end
+local val = redis.call("RPOP", KEYS[1])
+if not val then
+  redis.call("SREM", KEYS[5], ARGV[1])
+  return 0
+end
+if redis.call("LLEN", KEYS[1]) > 0 then
+  redis.call("LPUSH", KEYS[2], ARGV[1])
+` + redisSignal(7) + `
+else
+  redis.call("SREM", KEYS[5], ARGV[1])
+end
+if limit > 0 and period > 0 then
+  redis.call("HMSET", KEYS[4], "tokens", tostring(tokens - 1), "last", ARGV[2])
+  redis.call("PEXPIRE", KEYS[4], period)
+end
+if concurrency > 0 then
+  redis.call("ZADD", KEYS[3], ARGV[6], val)
+  redis.call("PEXPIRE", KEYS[3], tonumber(ARGV[6]) - now)
+end
+return val
+`)
+
+// redisRefreshScript moves the deadline of a job in the set of the running
+// jobs of its domain, if it is still there, and keeps the set at least until
+// this deadline.
+//
+// KEYS[1] is the set of the running jobs. ARGV[1] is the job, ARGV[2] is its
+// new deadline and ARGV[3] is the duration until this deadline, in
+// milliseconds.
+var redisRefreshScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+  return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[3]) then
+  redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// redisDomainKey returns the key of the list of the jobs of a domain for the
+// given worker type and level of priority.
+func redisDomainKey(workerType string, level int, domain string) string {
+	return redisPrefix + workerType + "/" + strconv.Itoa(level) + "/" + domain
+}
+
+// redisReadyKey returns the key of the list of the domains with queued jobs
+// for the given worker type and level of priority.
+func redisReadyKey(workerType string, level int) string {
+	return redisPrefix + workerType + redisReadySuffix + strconv.Itoa(level)
+}
+
+// redisQueuedKey returns the key of the set of the domains with queued jobs
+// for the given worker type and level of priority.
+func redisQueuedKey(workerType string, level int) string {
+	return redisPrefix + workerType + redisQueuedSuffix + strconv.Itoa(level)
+}
+
+// redisClaimedKey returns the key of the set of the claimed domains for the
+// given worker type.
+func redisClaimedKey(workerType string) string {
+	return redisPrefix + workerType + redisClaimedSuffix
+}
+
+// redisSignalKey returns the key of the list used to wake up the pollers for
+// the given worker type.
+func redisSignalKey(workerType string) string {
+	return redisPrefix + workerType + redisSignalSuffix
+}
+
+// redisRunningKey returns the key of the set of the running jobs of a domain
+// for the given worker type.
+func redisRunningKey(workerType, domain string) string {
+	return redisPrefix + workerType + redisRunningSuffix + domain
+}
+
+// redisRateKey returns the key of the token bucket of a domain for the given
+// worker type.
+func redisRateKey(workerType, domain string) string {
+	return redisPrefix + workerType + redisRateSuffix + domain
+}
+
 type redisBroker struct {
 	client       redis.UniversalClient
+	cancels      *redis.PubSub
 	workers      []*Worker
 	workersTypes []string
 	running      uint32
@@ -55,10 +270,13 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 		if err := w.Start(ch); err != nil {
 			return err
 		}
-		go b.pollLoop(redisPrefix+conf.WorkerType, ch)
+		w.limiter = b
+		go b.pollLoop(w, ch)
 	}
 
 	if len(b.workers) > 0 {
+		b.cancels = b.client.Subscribe(redisCancelChannel)
+		go b.cancelLoop(b.cancels.Channel())
 		joblog.Infof("Started redis broker for %d workers type", len(b.workers))
 	}
 
@@ -86,6 +304,9 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 
 	fmt.Print("  shutting down redis broker...")
 	defer b.client.Close()
+	if b.cancels != nil {
+		defer b.cancels.Close()
+	}
 
 	for i := 0; i < len(b.workers); i++ {
 		select {
@@ -118,39 +339,142 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 
 var redisBRPopTimeout = 10 * time.Second
 
-func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
+// redisLimitedDelay is the delay before polling again when all the domains
+// with queued jobs have reached their limits.
+var redisLimitedDelay = 100 * time.Millisecond
+
+// redisRunningMargin is added to the maximal duration of an attempt of a job
+// for its deadline in the set of the running jobs of its domain. After its
+// deadline, a job is no longer counted, even if the stack that runs it has
+// crashed. The deadline is moved before each attempt, with the delay and the
+// timeout given by the retry policy of the job.
+var redisRunningMargin = 1 * time.Minute
+
+// redisClaimTimeout is the duration after which a domain claimed by a poller
+// is put back in its ready list. A poller pops the job of the domain just
+// after claiming it, so it happens only if the stack has crashed in between.
+var redisClaimTimeout = 1 * time.Minute
+
+// redisReapInterval is the interval between two checks of the claimed
+// domains by a poller.
+var redisReapInterval = 10 * time.Second
+
+func (b *redisBroker) pollLoop(w *Worker, ch chan<- *Job) {
 	defer func() {
 		b.closed <- struct{}{}
 	}()
 
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	workerType := w.Type
+	conf := w.defaultedConf(nil)
+	maxDuration := conf.Timeout + redisRunningMargin
+
+	// The domains are claimed from the ready lists, sorted from the highest
+	// level of priority to the lowest. When no domain is ready, the poller
+	// waits for a signal, or for a job in the queues of the previous versions.
+	legacyKey := redisPrefix + workerType
+	claimedKey := redisClaimedKey(workerType)
+	signalKey := redisSignalKey(workerType)
+	claimKeys := make([]string, 0, nbPriorityLevels+1)
+	claimLevels := make([]interface{}, 0, nbPriorityLevels)
+	levels := make(map[string]int, nbPriorityLevels)
+	for level := nbPriorityLevels - 1; level >= 0; level-- {
+		key := redisReadyKey(workerType, level)
+		claimKeys = append(claimKeys, key)
+		claimLevels = append(claimLevels, level)
+		levels[key] = level
+	}
+	claimKeys = append(claimKeys, claimedKey)
+	waitKeys := []string{signalKey, legacyKey + redisHighPrioritySuffix, legacyKey}
+
+	// The domains that have reached their limits since the last job taken.
+	// When one of them is claimed again, all the domains have been tried, and
+	// the poller waits a bit before trying again.
+	limited := make(map[string]bool)
+	var wait time.Duration
+	var lastReap time.Time
+
 	for {
 		if atomic.LoadUint32(&b.running) == 0 {
 			return
 		}
 
-		// The brpop redis command will always take elements in priority from the
-		// first key containing elements at the call. By always priorizing the
-		// manual queue, this would cause a starvation for our main queue if too
-		// many "manual" jobs are pushed. By randomizing the order we make sure we
-		// avoid such starvation. For one in three call, the main queue is
-		// selected.
-		keyP0 := key + redisHighPrioritySuffix
-		keyP1 := key
-		if rng.Intn(3) == 0 {
-			keyP1, keyP0 = keyP0, keyP1
-		}
-		results, err := b.client.BRPop(redisBRPopTimeout, keyP0, keyP1).Result()
-		if err != nil || len(results) < 2 {
-			time.Sleep(100 * time.Millisecond)
-			continue
+		if time.Since(lastReap) > redisReapInterval {
+			b.reapClaims(workerType)
+			lastReap = time.Now()
 		}
 
-		key := results[0]
-		val := results[1]
-		if len(key) < len(redisPrefix) {
-			joblog.Warnf("Invalid key %s", key)
+		var val string
+		now := time.Now()
+		args := append([]interface{}{redisMillis(now)}, claimLevels...)
+		res, err := redisClaimScript.Run(b.client, claimKeys, args...).Result()
+		if err == redis.Nil {
+			results, err := b.client.BRPop(redisBRPopTimeout, waitKeys...).Result()
+			if err != nil || len(results) < 2 {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if results[0] == signalKey {
+				continue
+			}
+			val = results[1]
+		} else if err != nil {
+			joblog.Warnf("Cannot claim a domain: %s", err)
+			time.Sleep(100 * time.Millisecond)
 			continue
+		} else {
+			claim, _ := res.([]interface{})
+			if len(claim) != 2 {
+				joblog.Warnf("Invalid claim %v", res)
+				continue
+			}
+			key, _ := claim[0].(string)
+			domain, _ := claim[1].(string)
+			level := levels[key]
+			if limited[domain] {
+				if wait <= 0 || wait > redisLimitedDelay {
+					wait = redisLimitedDelay
+				}
+				time.Sleep(wait)
+				limited = make(map[string]bool)
+				wait = 0
+				now = time.Now()
+			}
+			limits := w.Conf.domainLimits(domain)
+			scriptKeys := []string{
+				redisDomainKey(workerType, level, domain),
+				key,
+				redisRunningKey(workerType, domain),
+				redisRateKey(workerType, domain),
+				redisQueuedKey(workerType, level),
+				claimedKey,
+				signalKey,
+			}
+			res, err := redisPopScript.Run(b.client, scriptKeys,
+				domain,
+				redisMillis(now),
+				limits.DomainConcurrency,
+				limits.RateLimit,
+				int64(limits.RatePeriod/time.Millisecond),
+				redisMillis(now.Add(maxDuration)),
+				strconv.Itoa(level)+"/"+domain,
+			).Result()
+			if err != nil {
+				joblog.Warnf("Cannot pop job for domain %s: %s", domain, err)
+				continue
+			}
+			if delay, ok := res.(int64); ok {
+				if delay == 0 {
+					continue
+				}
+				limited[domain] = true
+				if d := time.Duration(delay) * time.Millisecond; d > 0 && (wait <= 0 || d < wait) {
+					wait = d
+				}
+				continue
+			}
+			val, _ = res.(string)
+			limited = make(map[string]bool)
+			wait = 0
 		}
 
 		parts := strings.SplitN(val, "/", 2)
@@ -170,6 +494,119 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 	}
 }
 
+// reapClaims puts back in their ready lists the domains that have been
+// claimed for too long, by a stack that has crashed before popping their job.
+func (b *redisBroker) reapClaims(workerType string) {
+	claimedKey := redisClaimedKey(workerType)
+	max := redisMillis(time.Now().Add(-redisClaimTimeout))
+	claims, err := b.client.ZRangeByScore(claimedKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(max, 10),
+	}).Result()
+	if err != nil {
+		joblog.Warnf("Cannot reap the claimed domains: %s", err)
+		return
+	}
+	for _, claim := range claims {
+		parts := strings.SplitN(claim, "/", 2)
+		level, err := strconv.Atoi(parts[0])
+		if len(parts) != 2 || err != nil {
+			joblog.Warnf("Invalid claim %s", claim)
+			b.client.ZRem(claimedKey, claim)
+			continue
+		}
+		keys := []string{
+			claimedKey,
+			redisReadyKey(workerType, level),
+			redisSignalKey(workerType),
+		}
+		if err := redisReapScript.Run(b.client, keys, claim, parts[1]).Err(); err != nil {
+			joblog.Warnf("Cannot reap the claimed domain %s: %s", parts[1], err)
+		}
+	}
+}
+
+// cancelLoop cancels the jobs running on this stack, when their cancellation
+// is asked on another stack.
+func (b *redisBroker) cancelLoop(ch <-chan *redis.Message) {
+	for msg := range ch {
+		cancelRunningJob(msg.Payload)
+	}
+}
+
+// CancelJob cancels the job with the given identifier.
+func (b *redisBroker) CancelJob(db prefixer.Prefixer, jobID string) (*Job, error) {
+	if atomic.LoadUint32(&b.running) == 0 {
+		return nil, ErrClosed
+	}
+	return cancelJob(b, db, jobID)
+}
+
+func (b *redisBroker) unqueue(job *Job) error {
+	val := job.DBPrefix() + "/" + job.JobID
+	keys := []string{
+		redisDomainKey(job.WorkerType, job.priorityLevel(), job.Domain),
+		redisPrefix + job.WorkerType + redisHighPrioritySuffix,
+		redisPrefix + job.WorkerType,
+	}
+	for _, key := range keys {
+		if err := b.client.LRem(key, 0, val).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *redisBroker) cancelRunning(job *Job) error {
+	if cancelRunningJob(job.ID()) {
+		return nil
+	}
+	return b.client.Publish(redisCancelChannel, job.ID()).Err()
+}
+
+// hasRunningSet returns true if the running jobs of the domain of the job are
+// counted, as the worker has a concurrency limit for the domain.
+func (b *redisBroker) hasRunningSet(job *Job) bool {
+	for _, w := range b.workers {
+		if w.Type == job.WorkerType {
+			return w.Conf.domainLimits(job.Domain).DomainConcurrency > 0
+		}
+	}
+	return false
+}
+
+// refresh moves the deadline of the job in the set of the running jobs of its
+// domain.
+func (b *redisBroker) refresh(job *Job, deadline time.Time) {
+	if !b.hasRunningSet(job) {
+		return
+	}
+	deadline = deadline.Add(redisRunningMargin)
+	key := redisRunningKey(job.WorkerType, job.Domain)
+	val := job.DBPrefix() + "/" + job.JobID
+	ttl := int64(time.Until(deadline) / time.Millisecond)
+	err := redisRefreshScript.Run(b.client, []string{key}, val, redisMillis(deadline), ttl).Err()
+	if err != nil {
+		joblog.Warnf("Cannot refresh job %s on domain %s: %s", job.JobID, job.Domain, err)
+	}
+}
+
+// release removes the job from the set of the running jobs of its domain.
+func (b *redisBroker) release(job *Job) {
+	if !b.hasRunningSet(job) {
+		return
+	}
+	key := redisRunningKey(job.WorkerType, job.Domain)
+	val := job.DBPrefix() + "/" + job.JobID
+	if err := b.client.ZRem(key, val).Err(); err != nil {
+		joblog.Warnf("Cannot release job %s on domain %s: %s", job.JobID, job.Domain, err)
+	}
+}
+
+func redisMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error) {
@@ -198,25 +635,28 @@ func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, erro
 		return nil, err
 	}
 
-	key := redisPrefix + job.WorkerType
-	val := job.DBPrefix() + "/" + job.JobID
-
-	// When the job is manual, it is being pushed in a specific prioritized
-	// queue.
-	if job.Manual {
-		key += redisHighPrioritySuffix
+	level := job.priorityLevel()
+	keys := []string{
+		redisDomainKey(job.WorkerType, level, job.Domain),
+		redisReadyKey(job.WorkerType, level),
+		redisQueuedKey(job.WorkerType, level),
+		redisSignalKey(job.WorkerType),
 	}
-
-	if err := b.client.LPush(key, val).Err(); err != nil {
+	val := job.DBPrefix() + "/" + job.JobID
+	if err := redisPushScript.Run(b.client, keys, val, job.Domain).Err(); err != nil {
 		return nil, err
 	}
 
 	return job, nil
 }
 
-// QueueLen returns the size of the number of elements in queue of the
+// WorkerQueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
+	lens, err := b.WorkerQueueLenByDomain(workerType)
+	if err != nil {
+		return 0, err
+	}
 	key := redisPrefix + workerType
 	l1, err := b.client.LLen(key).Result()
 	if err != nil {
@@ -226,5 +666,39 @@ func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return int(l1 + l2), nil
+	count := int(l1 + l2)
+	for _, l := range lens {
+		count += l
+	}
+	return count, nil
+}
+
+// WorkerQueueLenByDomain returns the number of elements in queue of the
+// specified worker type, for each domain. The jobs pushed by the previous
+// versions of the stack are not counted.
+func (b *redisBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	lens := make(map[string]int)
+	for level := 0; level < nbPriorityLevels; level++ {
+		ready, err := b.client.LRange(redisReadyKey(workerType, level), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		queued, err := b.client.SMembers(redisQueuedKey(workerType, level)).Result()
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(queued))
+		for _, domain := range append(ready, queued...) {
+			if seen[domain] {
+				continue
+			}
+			seen[domain] = true
+			l, err := b.client.LLen(redisDomainKey(workerType, level, domain)).Result()
+			if err != nil {
+				return nil, err
+			}
+			lens[domain] += int(l)
+		}
+	}
+	return lens, nil
 }
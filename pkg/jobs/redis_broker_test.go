@@ -112,3 +112,132 @@ func TestRedisJobs(t *testing.T) {
 	assert.NoError(t, err)
 	time.Sleep(1 * time.Second)
 }
+
+func TestRedisStrandedDomains(t *testing.T) {
+	config.UseTestFile()
+
+	redisBRPopTimeout = 1 * time.Second
+	redisClaimTimeout = 1 * time.Second
+	redisReapInterval = 100 * time.Millisecond
+	defer func() {
+		redisClaimTimeout = 1 * time.Minute
+		redisReapInterval = 10 * time.Second
+	}()
+	opts, _ := redis.ParseURL(redisURL1)
+	client := redis.NewClient(opts)
+
+	workerType := "test-stranded"
+	keys, err := client.Keys(redisPrefix + workerType + "*").Result()
+	assert.NoError(t, err)
+	if len(keys) > 0 {
+		assert.NoError(t, client.Del(keys...).Err())
+	}
+
+	done := make(chan string, 3)
+	broker := NewRedisBroker(client)
+	err = broker.StartWorkers(WorkersList{
+		{
+			WorkerType:  workerType,
+			Concurrency: 1,
+			WorkerFunc: func(ctx *WorkerContext) error {
+				var msg string
+				err := ctx.UnmarshalMessage(&msg)
+				assert.NoError(t, err)
+				done <- msg
+				return nil
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	createJob := func(content string) (*Job, string) {
+		msg, _ := NewMessage(content)
+		job := NewJob(localDB, &JobRequest{
+			WorkerType: workerType,
+			Message:    msg,
+		})
+		assert.NoError(t, job.Create())
+		return job, job.DBPrefix() + "/" + job.JobID
+	}
+	waitFor := func(expected string) {
+		select {
+		case msg := <-done:
+			assert.Equal(t, expected, msg)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("job %s has not been executed", expected)
+		}
+	}
+
+	// A domain claimed by a stack that has crashed before popping its job is
+	// put back in its ready list
+	job, val := createJob("claimed")
+	level := job.priorityLevel()
+	assert.NoError(t, client.LPush(redisDomainKey(workerType, level, job.Domain), val).Err())
+	assert.NoError(t, client.SAdd(redisQueuedKey(workerType, level), job.Domain).Err())
+	assert.NoError(t, client.ZAdd(redisClaimedKey(workerType), redis.Z{
+		Score:  float64(redisMillis(time.Now().Add(-2 * time.Second))),
+		Member: strconv.Itoa(level) + "/" + job.Domain,
+	}).Err())
+	waitFor("claimed")
+
+	// A domain with queued jobs that is missing from its ready list is added
+	// again when a job is pushed
+	job, val = createJob("missing")
+	assert.NoError(t, client.LPush(redisDomainKey(workerType, level, job.Domain), val).Err())
+	msg, _ := NewMessage("pushed")
+	_, err = broker.PushJob(localDB, &JobRequest{
+		WorkerType: workerType,
+		Message:    msg,
+	})
+	assert.NoError(t, err)
+	waitFor("missing")
+	waitFor("pushed")
+
+	err = broker.ShutdownWorkers(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestRedisRefreshRunning(t *testing.T) {
+	config.UseTestFile()
+
+	opts, _ := redis.ParseURL(redisURL1)
+	client := redis.NewClient(opts)
+	workerType := "test-refresh"
+	broker := &redisBroker{client: client}
+	broker.workers = []*Worker{
+		{Type: workerType, Conf: &WorkerConfig{
+			WorkerType: workerType,
+			Limits:     WorkerLimits{DomainConcurrency: 1},
+		}},
+	}
+
+	job := NewJob(localDB, &JobRequest{WorkerType: workerType})
+	job.JobID = "refresh"
+	key := redisRunningKey(workerType, job.Domain)
+	val := job.DBPrefix() + "/" + job.JobID
+	assert.NoError(t, client.Del(key).Err())
+
+	// A released job is not added back
+	deadline := time.Now().Add(2 * time.Hour)
+	broker.refresh(job, deadline)
+	_, err := client.ZScore(key, val).Result()
+	assert.Equal(t, redis.Nil, err)
+
+	// The deadline of a running job is moved, even after a long retry delay
+	assert.NoError(t, client.ZAdd(key, redis.Z{
+		Score:  float64(redisMillis(time.Now().Add(time.Minute))),
+		Member: val,
+	}).Err())
+	assert.NoError(t, client.PExpire(key, time.Minute).Err())
+	broker.refresh(job, deadline)
+	score, err := client.ZScore(key, val).Result()
+	assert.NoError(t, err)
+	assert.EqualValues(t, redisMillis(deadline.Add(redisRunningMargin)), score)
+	ttl, err := client.PTTL(key).Result()
+	assert.NoError(t, err)
+	assert.True(t, ttl > 2*time.Hour)
+
+	broker.release(job)
+	_, err = client.ZScore(key, val).Result()
+	assert.Equal(t, redis.Nil, err)
+}
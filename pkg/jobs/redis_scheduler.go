@@ -59,6 +59,11 @@ type redisScheduler struct {
 	closed  chan struct{}
 	stopped chan struct{}
 	log     *logrus.Entry
+
+	// notify is called when the time of the next execution of a trigger
+	// changes in redis, with a zero timestamp when it has been removed. It is
+	// used by the leader scheduler to keep its timers up-to-date.
+	notify func(member string, at int64)
 }
 
 // NewRedisScheduler creates a new scheduler that use redis to synchronize with
@@ -165,10 +170,13 @@ func (s *redisScheduler) eventLoop(eventsCh <-chan *realtime.Event) {
 				var d time.Duration
 				if d, err = time.ParseDuration(et.Infos().Debounce); err == nil {
 					timestamp := time.Now().Add(d)
-					s.client.ZAddNX(TriggersKey, redis.Z{
+					added, err := s.client.ZAddNX(TriggersKey, redis.Z{
 						Score:  float64(timestamp.UTC().Unix()),
 						Member: redisKey(t),
-					})
+					}).Result()
+					if err == nil && added > 0 && s.notify != nil {
+						s.notify(redisKey(t), timestamp.UTC().Unix())
+					}
 					continue
 				} else {
 					s.log.Warnf("Trigger %s %s has an invalid debounce: %s",
@@ -224,57 +232,77 @@ func (s *redisScheduler) PollScheduler(now int64) error {
 		if len(results) < 2 {
 			return nil
 		}
-		parts := strings.SplitN(results[0].(string), "/", 2)
-		if len(parts) != 2 {
-			s.client.ZRem(SchedKey, results[0])
-			return fmt.Errorf("Invalid key %s", res)
+		var prev time.Time
+		if score, err := strconv.ParseInt(results[1].(string), 10, 64); err != nil {
+			prev = time.Now()
+		} else {
+			prev = time.Unix(score, 0)
+		}
+		if err = s.fireTrigger(results[0].(string), prev); err != nil {
+			return err
 		}
+	}
+}
 
-		prefix := parts[0]
-		t, err := s.GetTrigger(prefixer.NewPrefixer("", prefix), parts[1])
-		if err != nil {
-			if err == ErrNotFoundTrigger {
-				s.client.ZRem(SchedKey, results[0])
-			}
+// fireTrigger pushes the job of a trigger that has been moved to the
+// scheduling set, and schedules its next execution if any.
+func (s *redisScheduler) fireTrigger(member string, prev time.Time) error {
+	parts := strings.SplitN(member, "/", 2)
+	if len(parts) != 2 {
+		s.client.ZRem(SchedKey, member)
+		return fmt.Errorf("Invalid key %s", member)
+	}
+
+	prefix := parts[0]
+	t, err := s.GetTrigger(prefixer.NewPrefixer("", prefix), parts[1])
+	if err != nil {
+		if err == ErrNotFoundTrigger {
+			s.client.ZRem(SchedKey, member)
+		}
+		return err
+	}
+	switch t := t.(type) {
+	case *EventTrigger: // Debounced
+		job := t.Infos().JobRequest()
+		job.Debounced = true
+		if err = s.client.ZRem(SchedKey, member).Err(); err != nil {
 			return err
 		}
-		switch t := t.(type) {
-		case *EventTrigger: // Debounced
-			job := t.Infos().JobRequest()
-			job.Debounced = true
-			if err = s.client.ZRem(SchedKey, results[0]).Err(); err != nil {
-				return err
-			}
-			if _, err = s.broker.PushJob(t, job); err != nil {
-				return err
-			}
-		case *AtTrigger:
-			job := t.Infos().JobRequest()
-			if _, err = s.broker.PushJob(t, job); err != nil {
-				return err
-			}
-			if err = s.deleteTrigger(t); err != nil {
-				return err
-			}
-		case *CronTrigger:
-			job := t.Infos().JobRequest()
-			if _, err = s.broker.PushJob(t, job); err != nil {
-				return err
-			}
-			score, err := strconv.ParseInt(results[1].(string), 10, 64)
-			var prev time.Time
-			if err != nil {
-				prev = time.Now()
-			} else {
-				prev = time.Unix(score, 0)
-			}
-			if err := s.addToRedis(t, prev); err != nil {
-				return err
-			}
-		default:
-			return errors.New("Not implemented yet")
+		if err = s.pushScheduledJob(t, job, prev); err != nil {
+			return err
+		}
+	case *AtTrigger:
+		job := t.Infos().JobRequest()
+		if err = s.pushScheduledJob(t, job, prev); err != nil {
+			return err
 		}
+		if err = s.deleteTrigger(t); err != nil {
+			return err
+		}
+	case *CronTrigger:
+		job := t.Infos().JobRequest()
+		if err = s.pushScheduledJob(t, job, prev); err != nil {
+			return err
+		}
+		if err := s.addToRedis(t, prev); err != nil {
+			return err
+		}
+	default:
+		return errors.New("Not implemented yet")
 	}
+	return nil
+}
+
+// pushScheduledJob pushes the job of an execution of a trigger. The job
+// identifier is derived from the trigger and the time of the execution, so
+// that the job is not pushed twice for the same execution, even by two stacks.
+func (s *redisScheduler) pushScheduledJob(t Trigger, job *JobRequest, at time.Time) error {
+	job.JobID = t.Infos().TID + "-" + strconv.FormatInt(at.Unix(), 10)
+	_, err := s.broker.PushJob(t, job)
+	if couchdb.IsConflictError(err) {
+		return nil
+	}
+	return err
 }
 
 // AddTrigger a trigger to the system, by persisting it and using redis for
@@ -293,6 +321,9 @@ func (s *redisScheduler) addToRedis(t Trigger, prev time.Time) error {
 	case *EventTrigger:
 		hKey := eventsKey(t)
 		return s.client.HSet(hKey, t.ID(), t.Infos().Arguments).Err()
+	case *WebhookTrigger:
+		// The jobs are pushed when the webhook is called
+		return nil
 	case *AtTrigger:
 		timestamp = t.at
 	case *CronTrigger:
@@ -310,8 +341,13 @@ func (s *redisScheduler) addToRedis(t Trigger, prev time.Time) error {
 		Member: redisKey(t),
 	}).Err()
 	pipe.ZRem(SchedKey, redisKey(t))
-	_, err := pipe.Exec()
-	return err
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	if s.notify != nil {
+		s.notify(redisKey(t), timestamp.UTC().Unix())
+	}
+	return nil
 }
 
 // GetTrigger returns the trigger with the specified ID.
@@ -347,8 +383,12 @@ func (s *redisScheduler) deleteTrigger(t Trigger) error {
 		pipe := s.client.Pipeline()
 		pipe.ZRem(TriggersKey, redisKey(t))
 		pipe.ZRem(SchedKey, redisKey(t))
-		_, err := pipe.Exec()
-		return err
+		if _, err := pipe.Exec(); err != nil {
+			return err
+		}
+		if s.notify != nil {
+			s.notify(redisKey(t), 0)
+		}
 	}
 	return nil
 }
@@ -48,10 +48,21 @@ func (b *mockBroker) ShutdownWorkers(ctx context.Context) error {
 }
 
 func (b *mockBroker) PushJob(db prefixer.Prefixer, request *jobs.JobRequest) (*jobs.Job, error) {
+	// The jobs of the scheduled executions are created, to check that they
+	// are not pushed twice
+	if request.JobID != "" {
+		if err := jobs.NewJob(db, request).Create(); err != nil {
+			return nil, err
+		}
+	}
 	b.jobs = append(b.jobs, request)
 	return nil, nil
 }
 
+func (b *mockBroker) CancelJob(db prefixer.Prefixer, jobID string) (*jobs.Job, error) {
+	return nil, jobs.ErrNotFoundJob
+}
+
 func (b *mockBroker) WorkerQueueLen(workerType string) (int, error) {
 	count := 0
 	for _, job := range b.jobs {
@@ -62,6 +73,10 @@ func (b *mockBroker) WorkerQueueLen(workerType string) (int, error) {
 	return count, nil
 }
 
+func (b *mockBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	return map[string]int{}, nil
+}
+
 func (b *mockBroker) WorkersTypes() []string {
 	return []string{}
 }
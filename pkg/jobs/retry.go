@@ -0,0 +1,138 @@
+package jobs
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	// RetryExponential is the strategy where the delay between two executions
+	// is doubled after each failure, with some jitter. It is the default.
+	RetryExponential = "exponential"
+	// RetryFixed is the strategy where the delay between two executions is
+	// always the same.
+	RetryFixed = "fixed"
+	// RetryNone is the strategy where a failed job is never executed again.
+	RetryNone = "none"
+)
+
+// ErrInvalidRetryPolicy is used when the retry policy of a job is not valid
+var ErrInvalidRetryPolicy = errors.New("jobs: invalid retry policy")
+
+// RetryPolicy describes how a failed job is executed again. The delays are
+// durations like "30s" or "5m".
+type RetryPolicy struct {
+	Strategy string `json:"strategy,omitempty"`
+	Delay    string `json:"delay,omitempty"`
+	MaxDelay string `json:"max_delay,omitempty"`
+}
+
+// ErrPermanent is an error returned by a worker for a failure that cannot be
+// fixed by executing the job again: the job is not retried.
+type ErrPermanent struct {
+	Err error
+}
+
+func (e ErrPermanent) Error() string {
+	return e.Err.Error()
+}
+
+// ErrRetryable is an error returned by a worker for a transient failure: the
+// job is retried, even if the retry policy says otherwise, as long as its
+// maximal number of executions is not reached. If Delay is not zero, it is
+// used as the delay before the next execution.
+type ErrRetryable struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e ErrRetryable) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent wraps the error to mark it as permanent.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return ErrPermanent{Err: err}
+}
+
+// IsPermanent returns true if the error should not provoke a retry of the
+// job.
+func IsPermanent(err error) bool {
+	if _, ok := err.(ErrPermanent); ok {
+		return true
+	}
+	if _, ok := err.(ErrBadTrigger); ok {
+		return true
+	}
+	switch err {
+	case ErrAbort, ErrMessageUnmarshal, ErrMessageNil:
+		return true
+	}
+	return false
+}
+
+// Validate checks that the strategy is known and that the delays can be
+// parsed.
+func (p *RetryPolicy) Validate() error {
+	switch p.Strategy {
+	case "", RetryExponential, RetryFixed, RetryNone:
+	default:
+		return ErrInvalidRetryPolicy
+	}
+	for _, d := range []string{p.Delay, p.MaxDelay} {
+		if d == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d); err != nil || v < 0 {
+			return ErrInvalidRetryPolicy
+		}
+	}
+	return nil
+}
+
+// applyRetryPolicy overrides the retry configuration of the worker with the
+// policy of a job.
+func applyRetryPolicy(c *WorkerConfig, p *RetryPolicy) {
+	if p.Strategy != "" {
+		c.RetryStrategy = p.Strategy
+	}
+	if d, err := time.ParseDuration(p.Delay); err == nil && d > 0 {
+		c.RetryDelay = d
+	}
+	if d, err := time.ParseDuration(p.MaxDelay); err == nil && d > 0 {
+		c.RetryMaxDelay = d
+	}
+}
+
+// retryDelay returns the delay before the given execution of a job (the
+// first retry is the execution 1), according to the retry strategy of the
+// worker configuration.
+func retryDelay(c *WorkerConfig, execCount int) time.Duration {
+	var delay time.Duration
+	switch c.RetryStrategy {
+	case RetryFixed:
+		delay = c.RetryDelay
+	default:
+		delay = c.RetryDelay << uint(execCount-1)
+		// an overflow of the shift gives a non-positive delay
+		if delay <= 0 || delay < c.RetryDelay {
+			delay = maxRetryDelay
+		}
+		// fuzzDelay number between delay * (1 +/- 0.1)
+		if fuzzDelay := int64(0.1 * float64(delay)); fuzzDelay > 0 {
+			delay = delay + time.Duration(rand.Int63n(2*fuzzDelay)-fuzzDelay)
+		}
+	}
+	max := c.RetryMaxDelay
+	if max <= 0 || max > maxRetryDelay {
+		max = maxRetryDelay
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
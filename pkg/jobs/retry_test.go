@@ -0,0 +1,70 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyValidate(t *testing.T) {
+	assert.NoError(t, (&RetryPolicy{}).Validate())
+	assert.NoError(t, (&RetryPolicy{Strategy: RetryFixed, Delay: "30s"}).Validate())
+	assert.NoError(t, (&RetryPolicy{Strategy: RetryExponential, MaxDelay: "5m"}).Validate())
+	assert.Equal(t, ErrInvalidRetryPolicy, (&RetryPolicy{Strategy: "linear"}).Validate())
+	assert.Equal(t, ErrInvalidRetryPolicy, (&RetryPolicy{Delay: "foo"}).Validate())
+	assert.Equal(t, ErrInvalidRetryPolicy, (&RetryPolicy{MaxDelay: "-1s"}).Validate())
+}
+
+func TestNextDelay(t *testing.T) {
+	w := &Worker{Type: "test", Conf: &WorkerConfig{
+		MaxExecCount: 5,
+		RetryDelay:   10 * time.Second,
+	}}
+	errTest := errors.New("test")
+
+	// Default exponential strategy
+	task := &task{w: w, conf: w.defaultedConf(nil)}
+	retry, delay, _ := task.nextDelay(nil)
+	assert.True(t, retry)
+	assert.Equal(t, time.Duration(0), delay)
+	task.execCount = 3
+	retry, delay, _ = task.nextDelay(errTest)
+	assert.True(t, retry)
+	assert.InDelta(t, float64(40*time.Second), float64(delay), float64(4*time.Second))
+	task.execCount = 5
+	retry, _, _ = task.nextDelay(errTest)
+	assert.False(t, retry)
+
+	// Exponential strategy with a max delay
+	task.conf = w.defaultedConf(&JobOptions{Retry: &RetryPolicy{MaxDelay: "15s"}})
+	task.execCount = 3
+	retry, delay, _ = task.nextDelay(errTest)
+	assert.True(t, retry)
+	assert.Equal(t, 15*time.Second, delay)
+
+	// Fixed strategy
+	task.conf = w.defaultedConf(&JobOptions{Retry: &RetryPolicy{Strategy: RetryFixed, Delay: "3s"}})
+	task.execCount = 4
+	retry, delay, _ = task.nextDelay(errTest)
+	assert.True(t, retry)
+	assert.Equal(t, 3*time.Second, delay)
+
+	// No retry, except for the retryable errors
+	task.conf = w.defaultedConf(&JobOptions{Retry: &RetryPolicy{Strategy: RetryNone}})
+	task.execCount = 1
+	retry, _, _ = task.nextDelay(errTest)
+	assert.False(t, retry)
+	retry, delay, _ = task.nextDelay(ErrRetryable{Err: errTest, Delay: 2 * time.Second})
+	assert.True(t, retry)
+	assert.Equal(t, 2*time.Second, delay)
+
+	// Permanent errors
+	task.conf = w.defaultedConf(nil)
+	retry, _, _ = task.nextDelay(Permanent(errTest))
+	assert.False(t, retry)
+	retry, _, _ = task.nextDelay(ErrAbort)
+	assert.False(t, retry)
+	assert.Equal(t, "test", Permanent(errTest).Error())
+}
@@ -51,8 +51,10 @@ type (
 		WorkerType   string        `json:"worker"`
 		Arguments    string        `json:"arguments"`
 		Debounce     string        `json:"debounce"`
+		Timezone     string        `json:"timezone,omitempty"`
 		Options      *JobOptions   `json:"options"`
 		Message      Message       `json:"message"`
+		WebhookID    string        `json:"webhook_id,omitempty"`
 		CurrentState *TriggerState `json:"current_state,omitempty"`
 	}
 
@@ -99,6 +101,9 @@ func NewTrigger(db prefixer.Prefixer, infos TriggerInfos, data interface{}) (Tri
 	infos.Message = msg
 	infos.Prefix = db.DBPrefix()
 	infos.Domain = db.DomainName()
+	if infos.Timezone == "" && isCronLike(infos.Type) && cbTimezone != nil {
+		infos.Timezone = cbTimezone(infos.Domain)
+	}
 	return fromTriggerInfos(&infos)
 }
 
@@ -112,8 +117,12 @@ func fromTriggerInfos(infos *TriggerInfos) (Trigger, error) {
 		return NewCronTrigger(infos)
 	case "@every":
 		return NewEveryTrigger(infos)
+	case "@hourly", "@daily", "@weekly", "@monthly":
+		return NewPeriodicTrigger(infos)
 	case "@event":
 		return NewEventTrigger(infos)
+	case "@webhook":
+		return NewWebhookTrigger(infos)
 	default:
 		return nil, ErrUnknownTrigger
 	}
@@ -132,8 +141,7 @@ func (t *TriggerInfos) DocType() string { return consts.Triggers }
 func (t *TriggerInfos) Clone() couchdb.Doc {
 	cloned := *t
 	if t.Options != nil {
-		tmp := *t.Options
-		cloned.Options = &tmp
+		cloned.Options = t.Options.clone()
 	}
 	if t.Message != nil {
 		tmp := t.Message
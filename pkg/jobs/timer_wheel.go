@@ -0,0 +1,108 @@
+package jobs
+
+import "sync"
+
+// timerWheel is a hashed timing wheel with a resolution of one second. The
+// timers are put in the slot of their timestamp modulo the size of the
+// wheel, and each advance of the wheel only looks at the slots of the
+// elapsed seconds.
+type timerWheel struct {
+	mu     sync.Mutex
+	now    int64
+	slots  []map[string]int64 // the timestamps of the timers by slot
+	timers map[string]int     // the slots of the timers
+}
+
+// wheelSize is the number of slots of the wheels (one hour).
+const wheelSize = 3600
+
+func newTimerWheel(now int64) *timerWheel {
+	slots := make([]map[string]int64, wheelSize)
+	for i := range slots {
+		slots[i] = make(map[string]int64)
+	}
+	return &timerWheel{
+		now:    now,
+		slots:  slots,
+		timers: make(map[string]int),
+	}
+}
+
+func wheelSlot(at int64) int {
+	s := int(at % wheelSize)
+	if s < 0 {
+		s += wheelSize
+	}
+	return s
+}
+
+// add sets the timer of the key to the given timestamp (in seconds). A timer
+// in the past is fired by the next advance of the wheel.
+func (w *timerWheel) add(key string, at int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.remove(key)
+	slot := wheelSlot(at)
+	if at <= w.now {
+		slot = wheelSlot(w.now + 1)
+	}
+	w.timers[key] = slot
+	w.slots[slot][key] = at
+}
+
+// del removes the timer of the key.
+func (w *timerWheel) del(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.remove(key)
+}
+
+func (w *timerWheel) remove(key string) {
+	if slot, ok := w.timers[key]; ok {
+		delete(w.slots[slot], key)
+		delete(w.timers, key)
+	}
+}
+
+// len returns the number of timers in the wheel.
+func (w *timerWheel) len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.timers)
+}
+
+// wheelTimer is a timer that has expired.
+type wheelTimer struct {
+	key string
+	at  int64
+}
+
+// advance moves the wheel to the given timestamp, and returns the timers that
+// have expired in the meantime.
+func (w *timerWheel) advance(to int64) []wheelTimer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var expired []wheelTimer
+	start := w.now + 1
+	if to-start >= wheelSize {
+		start = to - wheelSize + 1
+	}
+	for t := start; t <= to; t++ {
+		slot := w.slots[wheelSlot(t)]
+		var late []wheelTimer
+		for key, at := range slot {
+			if at <= t {
+				late = append(late, wheelTimer{key, at})
+			}
+		}
+		for _, timer := range late {
+			delete(slot, timer.key)
+			delete(w.timers, timer.key)
+		}
+		expired = append(expired, late...)
+	}
+	if to > w.now {
+		w.now = to
+	}
+	return expired
+}
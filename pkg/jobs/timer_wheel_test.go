@@ -0,0 +1,36 @@
+package jobs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := newTimerWheel(1000)
+	w.add("a", 1002)
+	w.add("b", 1005)
+	w.add("c", 1000+wheelSize+2) // same slot as a, but one turn later
+	w.add("d", 990)              // in the past
+	assert.Equal(t, 4, w.len())
+
+	expired := w.advance(1001)
+	assert.Equal(t, []wheelTimer{{"d", 990}}, expired)
+
+	expired = w.advance(1002)
+	assert.Equal(t, []wheelTimer{{"a", 1002}}, expired)
+
+	w.add("b", 1010) // update
+	expired = w.advance(1009)
+	assert.Len(t, expired, 0)
+
+	w.del("b")
+	expired = w.advance(1100)
+	assert.Len(t, expired, 0)
+	assert.Equal(t, 1, w.len())
+
+	// A jump of more than a turn of the wheel
+	expired = w.advance(1000 + 3*wheelSize)
+	assert.Equal(t, []wheelTimer{{"c", 1000 + wheelSize + 2}}, expired)
+	assert.Equal(t, 0, w.len())
+}
@@ -7,11 +7,27 @@ import (
 	"github.com/robfig/cron"
 )
 
+var cbTimezone func(domain string) string
+
+// RegisterTimezoneCallback allows to register a callback function that
+// returns the timezone of the instance with the given domain. It is used as
+// the default timezone of the new @cron triggers.
+func RegisterTimezoneCallback(cb func(domain string) string) {
+	cbTimezone = cb
+}
+
+// isCronLike returns true for the types of triggers that are executed at some
+// times of the day, and depend on the timezone.
+func isCronLike(typ string) bool {
+	return typ == "@cron" || periodicTypes[typ]
+}
+
 // CronTrigger implements the @cron trigger type. It schedules recurring jobs with
 // the weird but very used Cron syntax.
 type CronTrigger struct {
 	*TriggerInfos
 	sched cron.Schedule
+	loc   *time.Location
 	done  chan struct{}
 }
 
@@ -21,9 +37,21 @@ func NewCronTrigger(infos *TriggerInfos) (*CronTrigger, error) {
 	if err != nil {
 		return nil, ErrMalformedTrigger
 	}
+	return newCronTrigger(infos, schedule)
+}
+
+func newCronTrigger(infos *TriggerInfos, schedule cron.Schedule) (*CronTrigger, error) {
+	loc := time.Local
+	if infos.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(infos.Timezone); err != nil {
+			return nil, ErrMalformedTrigger
+		}
+	}
 	return &CronTrigger{
 		TriggerInfos: infos,
 		sched:        schedule,
+		loc:          loc,
 		done:         make(chan struct{}),
 	}, nil
 }
@@ -35,11 +63,7 @@ func NewEveryTrigger(infos *TriggerInfos) (*CronTrigger, error) {
 	if err != nil {
 		return nil, ErrMalformedTrigger
 	}
-	return &CronTrigger{
-		TriggerInfos: infos,
-		sched:        schedule,
-		done:         make(chan struct{}),
-	}, nil
+	return newCronTrigger(infos, schedule)
 }
 
 // Type implements the Type method of the Trigger interface.
@@ -66,9 +90,10 @@ func (c *CronTrigger) Match(key, value string) bool {
 	return false
 }
 
-// NextExecution returns the next time when a job should be fired for this trigger
+// NextExecution returns the next time when a job should be fired for this
+// trigger. The schedule is computed in the timezone of the trigger.
 func (c *CronTrigger) NextExecution(last time.Time) time.Time {
-	return c.sched.Next(last)
+	return c.sched.Next(last.In(c.loc))
 }
 
 // Schedule implements the Schedule method of the Trigger interface.
@@ -0,0 +1,232 @@
+package jobs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/robfig/cron"
+)
+
+// periodicTypes are the types of the triggers with a calendar-style spec.
+var periodicTypes = map[string]bool{
+	"@hourly":  true,
+	"@daily":   true,
+	"@weekly":  true,
+	"@monthly": true,
+}
+
+var weekdays = []string{
+	"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday",
+}
+
+// periodicSpec is the parsed form of the arguments of a periodic trigger.
+// The hours are in [startHour, endHour[.
+type periodicSpec struct {
+	days      []int
+	startHour int
+	endHour   int
+}
+
+// NewPeriodicTrigger returns a new instance of CronTrigger for the @hourly,
+// @daily, @weekly and @monthly triggers. Their arguments restrict the days
+// and hours of the executions, like "on monday between 2am and 5am", and the
+// exact time is picked randomly in this range to spread the load. The random
+// choice is stable for a given trigger.
+func NewPeriodicTrigger(infos *TriggerInfos) (*CronTrigger, error) {
+	spec, err := parsePeriodicSpec(infos.Type, infos.Arguments)
+	if err != nil {
+		return nil, ErrMalformedTrigger
+	}
+	rng := rand.New(rand.NewSource(periodicSeed(infos)))
+	schedule, err := cron.Parse(spec.cronSpec(infos.Type, rng))
+	if err != nil {
+		return nil, ErrMalformedTrigger
+	}
+	return newCronTrigger(infos, schedule)
+}
+
+// periodicSeed returns a seed for the random choices of a trigger that
+// doesn't change when the stack is restarted.
+func periodicSeed(infos *TriggerInfos) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(infos.Domain))
+	h.Write([]byte(infos.WorkerType))
+	h.Write([]byte(infos.Arguments))
+	h.Write(infos.Message)
+	return int64(h.Sum64())
+}
+
+func parsePeriodicSpec(typ, args string) (*periodicSpec, error) {
+	spec := &periodicSpec{startHour: 0, endHour: 24}
+	fields := strings.Fields(strings.ToLower(args))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "on":
+			if i+1 < len(fields) && fields[i+1] == "the" {
+				i++
+			}
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("missing days after on")
+			}
+			i++
+			var err error
+			switch typ {
+			case "@weekly":
+				spec.days, err = parseWeekdays(fields[i])
+			case "@monthly":
+				spec.days, err = parseMonthDays(fields[i])
+			default:
+				err = fmt.Errorf("days are not allowed for %s", typ)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case "between":
+			if i+3 >= len(fields) || fields[i+2] != "and" {
+				return nil, fmt.Errorf("invalid hours range")
+			}
+			start, err := parseHour(fields[i+1])
+			if err != nil {
+				return nil, err
+			}
+			end, err := parseHour(fields[i+3])
+			if err != nil {
+				return nil, err
+			}
+			if end == 0 {
+				end = 24
+			}
+			if start >= end {
+				return nil, fmt.Errorf("invalid hours range")
+			}
+			spec.startHour, spec.endHour = start, end
+			i += 3
+		default:
+			return nil, fmt.Errorf("unexpected %q", fields[i])
+		}
+	}
+	return spec, nil
+}
+
+// parseWeekdays parses a list of days like "monday,thursday" or a range like
+// "monday-friday".
+func parseWeekdays(arg string) ([]int, error) {
+	var days []int
+	for _, part := range strings.Split(arg, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := parseWeekday(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = parseWeekday(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		for d := start; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == end {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseWeekday(arg string) (int, error) {
+	for i, day := range weekdays {
+		if arg == day || (len(arg) >= 3 && strings.HasPrefix(day, arg)) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", arg)
+}
+
+// parseMonthDays parses a list of days of the month like "1,15" or a range
+// like "3-5". The days are limited to 28 to have an execution every month.
+func parseMonthDays(arg string) ([]int, error) {
+	var days []int
+	for _, part := range strings.Split(arg, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := parseMonthDay(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = parseMonthDay(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if start > end {
+			return nil, fmt.Errorf("invalid days range %q", part)
+		}
+		for d := start; d <= end; d++ {
+			days = append(days, d)
+		}
+	}
+	return days, nil
+}
+
+func parseMonthDay(arg string) (int, error) {
+	for _, suffix := range []string{"st", "nd", "rd", "th"} {
+		arg = strings.TrimSuffix(arg, suffix)
+	}
+	d, err := strconv.Atoi(arg)
+	if err != nil || d < 1 || d > 28 {
+		return 0, fmt.Errorf("invalid day of month %q", arg)
+	}
+	return d, nil
+}
+
+// parseHour parses an hour like "2am", "5pm" or "14".
+func parseHour(arg string) (int, error) {
+	offset := 0
+	max := 24
+	if strings.HasSuffix(arg, "am") || strings.HasSuffix(arg, "pm") {
+		if strings.HasSuffix(arg, "pm") {
+			offset = 12
+		}
+		arg = arg[:len(arg)-2]
+		max = 13
+	}
+	h, err := strconv.Atoi(arg)
+	if err != nil || h < 0 || h >= max || (max == 13 && h == 0) {
+		return 0, fmt.Errorf("invalid hour %q", arg)
+	}
+	if max == 13 {
+		h = h%12 + offset
+	}
+	return h, nil
+}
+
+// cronSpec returns a spec for the cron syntax, with the random choices made.
+func (s *periodicSpec) cronSpec(typ string, rng *rand.Rand) string {
+	minute := rng.Intn(60)
+	hour := strconv.Itoa(s.startHour + rng.Intn(s.endHour-s.startHour))
+	switch typ {
+	case "@hourly":
+		if s.startHour == 0 && s.endHour == 24 {
+			return fmt.Sprintf("0 %d * * * *", minute)
+		}
+		return fmt.Sprintf("0 %d %d-%d * * *", minute, s.startHour, s.endHour-1)
+	case "@daily":
+		return fmt.Sprintf("0 %d %s * * *", minute, hour)
+	case "@weekly":
+		day := rng.Intn(7)
+		if len(s.days) > 0 {
+			day = s.days[rng.Intn(len(s.days))]
+		}
+		return fmt.Sprintf("0 %d %s * * %d", minute, hour, day)
+	default: // @monthly
+		day := 1 + rng.Intn(28)
+		if len(s.days) > 0 {
+			day = s.days[rng.Intn(len(s.days))]
+		}
+		return fmt.Sprintf("0 %d %s %d * *", minute, hour, day)
+	}
+}
@@ -0,0 +1,85 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeriodicTriggers(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	assert.NoError(t, err)
+	now := time.Date(2018, 5, 14, 12, 0, 0, 0, paris) // a Monday
+
+	trigger, err := NewPeriodicTrigger(&TriggerInfos{
+		Type:      "@weekly",
+		Domain:    "cozy.example.net",
+		Arguments: "on monday between 2am and 5am",
+		Timezone:  "Europe/Paris",
+	})
+	assert.NoError(t, err)
+	next := trigger.NextExecution(now).In(paris)
+	assert.Equal(t, time.Monday, next.Weekday())
+	assert.True(t, next.Hour() >= 2 && next.Hour() < 5)
+	assert.True(t, next.After(now))
+	assert.True(t, next.Before(now.Add(7*24*time.Hour)))
+	assert.Equal(t, next, trigger.NextExecution(now).In(paris))
+
+	// The random choice is stable for a trigger
+	same, err := NewPeriodicTrigger(&TriggerInfos{
+		Type:      "@weekly",
+		Domain:    "cozy.example.net",
+		Arguments: "on monday between 2am and 5am",
+		Timezone:  "Europe/Paris",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, next, same.NextExecution(now).In(paris))
+
+	trigger, err = NewPeriodicTrigger(&TriggerInfos{
+		Type:      "@monthly",
+		Domain:    "cozy.example.net",
+		Arguments: "on the 3-5 between 10pm and 12am",
+		Timezone:  "Europe/Paris",
+	})
+	assert.NoError(t, err)
+	next = trigger.NextExecution(now).In(paris)
+	assert.True(t, next.Day() >= 3 && next.Day() <= 5)
+	assert.True(t, next.Hour() >= 22)
+
+	trigger, err = NewPeriodicTrigger(&TriggerInfos{
+		Type:     "@daily",
+		Domain:   "cozy.example.net",
+		Timezone: "Europe/Paris",
+	})
+	assert.NoError(t, err)
+	next = trigger.NextExecution(now)
+	assert.True(t, next.Before(now.Add(24*time.Hour)))
+
+	for _, args := range []string{
+		"on monday",
+		"between 5am and 2am",
+		"between 2am",
+		"at noon",
+	} {
+		_, err = NewPeriodicTrigger(&TriggerInfos{Type: "@daily", Arguments: args})
+		assert.Error(t, err, args)
+	}
+	_, err = NewPeriodicTrigger(&TriggerInfos{Type: "@monthly", Arguments: "on the 31"})
+	assert.Error(t, err)
+	_, err = NewPeriodicTrigger(&TriggerInfos{Type: "@daily", Timezone: "Mars/Olympus"})
+	assert.Error(t, err)
+}
+
+func TestCronTriggerTimezone(t *testing.T) {
+	trigger, err := NewCronTrigger(&TriggerInfos{
+		Type:      "@cron",
+		Arguments: "0 0 3 * * *",
+		Timezone:  "America/New_York",
+	})
+	assert.NoError(t, err)
+	ny, _ := time.LoadLocation("America/New_York")
+	now := time.Date(2018, 5, 14, 12, 0, 0, 0, time.UTC)
+	next := trigger.NextExecution(now)
+	assert.Equal(t, time.Date(2018, 5, 15, 3, 0, 0, 0, ny).Unix(), next.Unix())
+}
@@ -0,0 +1,207 @@
+package jobs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// WebhookSignatureHeader is the HTTP header used by the third-party services
+// to send the HMAC-SHA256 signature of the body of their requests.
+const WebhookSignatureHeader = "X-Cozy-Signature"
+
+// webhookIDLen is the number of random bytes of the ID of a webhook.
+const webhookIDLen = 32
+
+// webhookLimits are the limits on the calls of a webhook. They are applied by
+// each stack, in memory: with several stacks behind a load-balancer, a
+// webhook can be called this number of times on each of them.
+var webhookLimits = WorkerLimits{RateLimit: 30, RatePeriod: 1 * time.Minute}
+
+// webhookBuckets are the states of the rate limits of the webhooks. The
+// buckets that have not been used for a period are full again: they are
+// evicted, as a new bucket has the same state.
+var webhookBuckets = struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	evicted time.Time
+}{buckets: make(map[string]*tokenBucket)}
+
+// WebhookTrigger implements the @webhook trigger type. It pushes a job each
+// time a third-party service makes a request on its secret URL. The arguments
+// of the trigger are an optional secret used to check the HMAC-SHA256
+// signature of the requests.
+type WebhookTrigger struct {
+	*TriggerInfos
+	unscheduled chan struct{}
+}
+
+// NewWebhookTrigger returns a new instance of WebhookTrigger given the
+// specified options. The ID of the webhook is generated for a new trigger.
+func NewWebhookTrigger(infos *TriggerInfos) (*WebhookTrigger, error) {
+	if infos.WebhookID == "" {
+		infos.WebhookID = hex.EncodeToString(crypto.GenerateRandomBytes(webhookIDLen))
+	}
+	return &WebhookTrigger{
+		TriggerInfos: infos,
+		unscheduled:  make(chan struct{}),
+	}, nil
+}
+
+// GetWebhookTrigger returns the @webhook trigger with the given webhook ID.
+func GetWebhookTrigger(db prefixer.Prefixer, webhookID string) (*WebhookTrigger, error) {
+	var infos []*TriggerInfos
+	req := &couchdb.FindRequest{
+		UseIndex: "by-webhook-id",
+		Selector: mango.Equal("webhook_id", webhookID),
+		Limit:    1,
+	}
+	err := couchdb.FindDocs(db, consts.Triggers, req, &infos)
+	if couchdb.IsNoUsableIndexError(err) {
+		// The index is missing for the instances created before the webhooks
+		for _, index := range consts.IndexesByDoctype(consts.Triggers) {
+			if err = couchdb.DefineIndex(db, index); err != nil {
+				return nil, err
+			}
+		}
+		err = couchdb.FindDocs(db, consts.Triggers, req, &infos)
+	}
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, ErrNotFoundTrigger
+		}
+		return nil, err
+	}
+	if len(infos) == 0 || infos[0].Type != "@webhook" ||
+		!hmac.Equal([]byte(infos[0].WebhookID), []byte(webhookID)) {
+		return nil, ErrNotFoundTrigger
+	}
+	return NewWebhookTrigger(infos[0])
+}
+
+// Type implements the Type method of the Trigger interface.
+func (t *WebhookTrigger) Type() string {
+	return t.TriggerInfos.Type
+}
+
+// DocType implements the permissions.Matcher interface
+func (t *WebhookTrigger) DocType() string {
+	return consts.Triggers
+}
+
+// ID implements the permissions.Matcher interface
+func (t *WebhookTrigger) ID() string {
+	return t.TriggerInfos.TID
+}
+
+// Match implements the permissions.Matcher interface
+func (t *WebhookTrigger) Match(key, value string) bool {
+	switch key {
+	case WorkerType:
+		return t.TriggerInfos.WorkerType == value
+	}
+	return false
+}
+
+// Schedule implements the Schedule method of the Trigger interface. The jobs
+// of a webhook are not scheduled, but pushed when its URL is requested.
+func (t *WebhookTrigger) Schedule() <-chan *JobRequest {
+	ch := make(chan *JobRequest)
+	go func() {
+		<-t.unscheduled
+		close(ch)
+	}()
+	return ch
+}
+
+// Unschedule implements the Unschedule method of the Trigger interface.
+func (t *WebhookTrigger) Unschedule() {
+	close(t.unscheduled)
+}
+
+// Infos implements the Infos method of the Trigger interface.
+func (t *WebhookTrigger) Infos() *TriggerInfos {
+	return t.TriggerInfos
+}
+
+// CheckSignature returns true if the signature matches the body, or if the
+// trigger has no secret. The signature is the hex-encoded HMAC-SHA256 of the
+// body, optionally prefixed by "sha256=".
+func (t *WebhookTrigger) CheckSignature(body []byte, signature string) bool {
+	secret := t.TriggerInfos.Arguments
+	if secret == "" {
+		return true
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// Allow returns false if the webhook has been called too many times recently.
+func (t *WebhookTrigger) Allow() bool {
+	webhookBuckets.Lock()
+	defer webhookBuckets.Unlock()
+	now := time.Now()
+	if now.Sub(webhookBuckets.evicted) >= webhookLimits.RatePeriod {
+		evictWebhookBuckets(now)
+	}
+	b, ok := webhookBuckets.buckets[t.WebhookID]
+	if !ok {
+		b = &tokenBucket{}
+		webhookBuckets.buckets[t.WebhookID] = b
+	}
+	ok, _ = b.take(webhookLimits, now)
+	return ok
+}
+
+// evictWebhookBuckets removes the buckets of the webhooks that have not been
+// called for a period. It must be called with the lock.
+func evictWebhookBuckets(now time.Time) {
+	for id, b := range webhookBuckets.buckets {
+		if now.Sub(b.last) >= webhookLimits.RatePeriod {
+			delete(webhookBuckets.buckets, id)
+		}
+	}
+	webhookBuckets.evicted = now
+}
+
+// JobRequestWithBody returns a job request for a call of the webhook. The
+// message of the job is the message of the trigger, with the body of the
+// request in its "body" field: as JSON if the body is valid JSON, or else as
+// a string.
+func (t *WebhookTrigger) JobRequestWithBody(body []byte) (*JobRequest, error) {
+	msg := make(map[string]interface{})
+	if len(t.TriggerInfos.Message) > 0 {
+		if err := json.Unmarshal(t.TriggerInfos.Message, &msg); err != nil {
+			return nil, ErrMessageUnmarshal
+		}
+	}
+	if json.Valid(body) {
+		msg["body"] = json.RawMessage(body)
+	} else {
+		msg["body"] = string(body)
+	}
+	req := t.TriggerInfos.JobRequest()
+	var err error
+	req.Message, err = NewMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+var _ Trigger = &WebhookTrigger{}
@@ -0,0 +1,63 @@
+package jobs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookTrigger(t *testing.T) {
+	msg, err := NewMessage(map[string]interface{}{"slug": "github"})
+	assert.NoError(t, err)
+	infos := &TriggerInfos{
+		Type:       "@webhook",
+		WorkerType: "service",
+		Arguments:  "secret",
+		Message:    msg,
+	}
+	trigger, err := NewWebhookTrigger(infos)
+	assert.NoError(t, err)
+	assert.Len(t, infos.WebhookID, 2*webhookIDLen)
+
+	other, err := NewWebhookTrigger(&TriggerInfos{Type: "@webhook"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, infos.WebhookID, other.WebhookID)
+
+	body := []byte(`{"ref":"refs/heads/master"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+	assert.True(t, trigger.CheckSignature(body, sig))
+	assert.True(t, trigger.CheckSignature(body, "sha256="+sig))
+	assert.False(t, trigger.CheckSignature(body, ""))
+	assert.False(t, trigger.CheckSignature([]byte("{}"), sig))
+	assert.True(t, other.CheckSignature(body, ""))
+
+	req, err := trigger.JobRequestWithBody(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "service", req.WorkerType)
+	var data map[string]interface{}
+	assert.NoError(t, req.Message.Unmarshal(&data))
+	assert.Equal(t, "github", data["slug"])
+	assert.Equal(t, map[string]interface{}{"ref": "refs/heads/master"}, data["body"])
+
+	req, err = other.JobRequestWithBody([]byte("foo=bar"))
+	assert.NoError(t, err)
+	data = nil
+	assert.NoError(t, req.Message.Unmarshal(&data))
+	assert.Equal(t, "foo=bar", data["body"])
+
+	// The buckets of the webhooks that have not been called for a period are
+	// evicted
+	assert.True(t, trigger.Allow())
+	webhookBuckets.Lock()
+	assert.Contains(t, webhookBuckets.buckets, trigger.WebhookID)
+	webhookBuckets.buckets[trigger.WebhookID].last = time.Now().Add(-webhookLimits.RatePeriod)
+	evictWebhookBuckets(time.Now())
+	assert.NotContains(t, webhookBuckets.buckets, trigger.WebhookID)
+	webhookBuckets.Unlock()
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"runtime"
 	"runtime/debug"
 	"sync/atomic"
@@ -20,6 +19,7 @@ var (
 	defaultConcurrency  = runtime.NumCPU()
 	defaultMaxExecCount = 3
 	defaultRetryDelay   = 60 * time.Millisecond
+	maxRetryDelay       = 1 * time.Hour
 	defaultTimeout      = 10 * time.Second
 )
 
@@ -59,6 +59,17 @@ type (
 		MaxExecCount int
 		Timeout      time.Duration
 		RetryDelay   time.Duration
+
+		// RetryStrategy is one of RetryExponential, RetryFixed or RetryNone,
+		// and RetryMaxDelay caps the delay between two executions. They can
+		// be overridden by the retry policy of a job.
+		RetryStrategy string
+		RetryMaxDelay time.Duration
+
+		// Limits are applied to the jobs of each instance, and they can be
+		// overridden for the instances of a context.
+		Limits         WorkerLimits
+		ContextsLimits map[string]WorkerLimits
 	}
 
 	// Worker is a unit of work that will consume from a queue and execute the do
@@ -67,6 +78,7 @@ type (
 		Type    string
 		Conf    *WorkerConfig
 		jobs    chan *Job
+		limiter workerLimiter
 		running uint32
 		closed  chan struct{}
 	}
@@ -184,6 +196,31 @@ func (c *WorkerContext) TriggerID() (string, bool) {
 	return triggerID, triggerID != ""
 }
 
+// SetProgress saves the progress of the job, as a percentage with a message.
+// As the job is updated, a realtime event is published for it.
+func (c *WorkerContext) SetProgress(percent int, message string) error {
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	c.job.Progress = &Progress{
+		Percent:   percent,
+		Message:   message,
+		UpdatedAt: time.Now(),
+	}
+	return c.job.Update()
+}
+
+// AppendLog adds a line printed by the process executed for the job to its
+// logs, on the given stream (stdout or stderr).
+func (c *WorkerContext) AppendLog(stream, line string) {
+	log := &JobLog{Stream: stream, Line: line, Time: time.Now()}
+	if err := GetLogsStore().Append(c.job.ID(), log); err != nil {
+		c.log.Warnf("Cannot append log: %s", err)
+	}
+}
+
 // Cookie returns the cookie associated with the worker context.
 func (c *WorkerContext) Cookie() interface{} {
 	return c.cookie
@@ -243,12 +280,19 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 		domain := job.Domain
 		if domain == "" {
 			joblog.Errorf("%s: missing domain from job request", workerID)
+			w.release(job)
 			continue
 		}
 		parentCtx := NewWorkerContext(workerID, job)
+		ctx, cancel := context.WithCancel(parentCtx.Context)
+		parentCtx.Context = ctx
+		registerRunningJob(job, cancel)
 		if err := job.AckConsumed(); err != nil {
 			parentCtx.Logger().Errorf("error acking consume job: %s",
 				err.Error())
+			unregisterRunningJob(job)
+			cancel()
+			w.release(job)
 			continue
 		}
 		t := &task{
@@ -263,11 +307,26 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 		if errRun == ErrAbort {
 			errRun = nil
 		}
-		if errRun != nil {
+		if errRun != nil && ctx.Err() == context.Canceled {
+			errRun = ErrCancelled
+		}
+		unregisterRunningJob(job)
+		cancel()
+		if errRun == ErrCancelled {
+			parentCtx.Logger().Infof("job cancelled")
+			runResultLabel = metrics.WorkerExecResultCancelled
+			errAck = job.Cancel()
+		} else if errRun != nil {
 			parentCtx.Logger().Errorf("error while performing job: %s",
 				errRun.Error())
 			runResultLabel = metrics.WorkerExecResultErrored
 			errAck = job.Nack(errRun)
+			if errAck == nil {
+				if err := saveFailedJob(job, t.attempts); err != nil {
+					parentCtx.Logger().Errorf("error while saving failed job: %s",
+						err.Error())
+				}
+			}
 		} else {
 			runResultLabel = metrics.WorkerExecResultSuccess
 			errAck = job.Ack()
@@ -277,6 +336,7 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 			parentCtx.Logger().Errorf("error while acking job done: %s",
 				errAck.Error())
 		}
+		w.release(job)
 
 		// Delete the trigger associated with the job (if any) when we receive a
 		// ErrBadTrigger.
@@ -288,11 +348,35 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 				globalJobSystem.DeleteTrigger(job, job.TriggerID)
 			}
 		}
+
+		// Push the jobs of the next steps when the job is part of a workflow.
+		if job.WorkflowID != "" && globalJobSystem != nil {
+			if err := workflowJobEnded(globalJobSystem, job, errRun); err != nil {
+				parentCtx.Logger().Errorf("error while running workflow %s: %s",
+					job.WorkflowID, err.Error())
+			}
+		}
 	}
 	joblog.Debugf("%s: worker shut down", workerID)
 	closed <- struct{}{}
 }
 
+// refresh tells the broker that an attempt of the job will run until the
+// deadline at the latest.
+func (w *Worker) refresh(job *Job, deadline time.Time) {
+	if w.limiter != nil {
+		w.limiter.refresh(job, deadline)
+	}
+}
+
+// release tells the broker that the job has ended, to give back its slot to
+// its instance.
+func (w *Worker) release(job *Job) {
+	if w.limiter != nil {
+		w.limiter.release(job)
+	}
+}
+
 func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
 	c := w.Conf.Clone()
 	if c.Concurrency == 0 {
@@ -316,6 +400,9 @@ func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
 	if opts.Timeout > 0 && opts.Timeout < c.Timeout {
 		c.Timeout = opts.Timeout
 	}
+	if opts.Retry != nil {
+		applyRetryPolicy(c, opts.Retry)
+	}
 	return c
 }
 
@@ -327,6 +414,7 @@ type task struct {
 
 	startTime time.Time
 	execCount int
+	attempts  []*JobAttempt
 }
 
 func (t *task) run() (err error) {
@@ -351,13 +439,21 @@ func (t *task) run() (err error) {
 		if !retry {
 			break
 		}
+		t.w.refresh(t.job, time.Now().Add(delay+timeout))
 		if err != nil {
 			t.ctx.Logger().Warnf("Error while performing job: %s (retry in %s)",
 				err.Error(), delay)
 		}
 
 		if delay > 0 {
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-t.ctx.Done():
+			}
+		}
+		if t.ctx.Err() == context.Canceled {
+			err = ErrCancelled
+			break
 		}
 
 		t.ctx.Logger().Debugf("Executing job (%d) (timeout set to %s)",
@@ -369,7 +465,13 @@ func (t *task) run() (err error) {
 		}))
 
 		ctx, cancel := t.ctx.WithTimeout(timeout)
+		attempt := &JobAttempt{StartedAt: time.Now()}
 		err = t.exec(ctx)
+		attempt.FinishedAt = time.Now()
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		t.attempts = append(t.attempts, attempt)
 		if err == nil {
 			execResultLabel = metrics.WorkerExecResultSuccess
 			timer.ObserveDuration()
@@ -418,14 +520,8 @@ func (t *task) exec(ctx *WorkerContext) (err error) {
 func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
 	// for certain kinds of errors, we do not have a retry since these error
 	// cannot be recovered from
-	{
-		if _, ok := prevError.(ErrBadTrigger); ok {
-			return false, 0, 0
-		}
-		switch prevError {
-		case ErrAbort, ErrMessageUnmarshal, ErrMessageNil:
-			return false, 0, 0
-		}
+	if IsPermanent(prevError) {
+		return false, 0, 0
 	}
 
 	c := t.conf
@@ -438,17 +534,20 @@ func (t *task) nextDelay(prevError error) (bool, time.Duration, time.Duration) {
 	// allowed to the task
 	timeout := c.Timeout
 
-	var nextDelay time.Duration
 	if t.execCount == 0 {
 		// on first execution, execute immediately
-		nextDelay = 0
-	} else {
-		nextDelay = c.RetryDelay << uint(t.execCount-1)
+		return true, 0, timeout
+	}
 
-		// fuzzDelay number between delay * (1 +/- 0.1)
-		fuzzDelay := int(0.1 * float64(nextDelay))
-		nextDelay = nextDelay + time.Duration((rand.Intn(2*fuzzDelay) - fuzzDelay))
+	// a retryable error can ask for a retry even if the strategy does not
+	// allow it, and it can give its own delay
+	if e, ok := prevError.(ErrRetryable); ok {
+		if e.Delay > 0 {
+			return true, e.Delay, timeout
+		}
+	} else if c.RetryStrategy == RetryNone {
+		return false, 0, 0
 	}
 
-	return true, nextDelay, timeout
+	return true, retryDelay(c, t.execCount), timeout
 }
@@ -30,6 +30,13 @@ func GetWorkersList() ([]*WorkerConfig, error) {
 					w = applyWorkerConfig(w, c)
 				}
 			}
+			for contextName, confs := range config.GetConfig().Jobs.Contexts {
+				for _, c := range confs {
+					if c.WorkerType == w.WorkerType {
+						w = applyWorkerContextConfig(w, contextName, c)
+					}
+				}
+			}
 		}
 		workers = append(workers, w)
 	}
@@ -57,6 +64,18 @@ func applyWorkerConfig(w *WorkerConfig, c config.Worker) *WorkerConfig {
 	if c.Timeout != nil {
 		w.Timeout = *c.Timeout
 	}
+	w.Limits = applyWorkerLimits(w.Limits, c)
+	return w
+}
+
+func applyWorkerContextConfig(w *WorkerConfig, contextName string, c config.Worker) *WorkerConfig {
+	w = w.Clone()
+	limits := make(map[string]WorkerLimits, len(w.ContextsLimits)+1)
+	for name, l := range w.ContextsLimits {
+		limits[name] = l
+	}
+	limits[contextName] = applyWorkerLimits(w.Limits, c)
+	w.ContextsLimits = limits
 	return w
 }
 
@@ -0,0 +1,403 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// Pending state is used for a step of a workflow that waits for the
+	// steps it depends on
+	Pending State = "pending"
+	// Skipped state is used for a step of a workflow that will never run,
+	// as the conditions of its edges can't be met
+	Skipped State = "skipped"
+)
+
+const (
+	// OnSuccess is used for an edge that is followed when the step succeeds
+	OnSuccess = "success"
+	// OnFailure is used for an edge that is followed when the step fails
+	OnFailure = "failure"
+	// OnAlways is used for an edge that is followed when the step ends
+	OnAlways = "always"
+)
+
+// maxWorkflowUpdates is the number of times an update of a workflow is tried
+// when there are conflicts (several steps that end at the same time).
+const maxWorkflowUpdates = 10
+
+type (
+	// Workflow is a directed acyclic graph of job requests. A step is pushed
+	// in the queue of its worker when the steps it depends on have ended,
+	// and the conditions of the edges are met.
+	Workflow struct {
+		WorkflowID  string          `json:"_id,omitempty"`
+		WorkflowRev string          `json:"_rev,omitempty"`
+		Domain      string          `json:"domain"`
+		Prefix      string          `json:"prefix,omitempty"`
+		Steps       []*WorkflowStep `json:"steps"`
+		State       State           `json:"state"`
+		CreatedAt   time.Time       `json:"created_at"`
+		FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+	}
+
+	// WorkflowStep is a job request inside a workflow.
+	WorkflowStep struct {
+		Name       string          `json:"name"`
+		WorkerType string          `json:"worker"`
+		Message    Message         `json:"message,omitempty"`
+		Options    *JobOptions     `json:"options,omitempty"`
+		After      []*WorkflowEdge `json:"after,omitempty"`
+		State      State           `json:"state"`
+		JobID      string          `json:"job_id,omitempty"`
+		Error      string          `json:"error,omitempty"`
+	}
+
+	// WorkflowEdge is a dependency of a step on another step of the workflow.
+	// On can be "success", "failure" or "always".
+	WorkflowEdge struct {
+		Step string `json:"step"`
+		On   string `json:"on,omitempty"`
+	}
+)
+
+// DBPrefix implements the prefixer.Prefixer interface.
+func (w *Workflow) DBPrefix() string {
+	if w.Prefix != "" {
+		return w.Prefix
+	}
+	return w.Domain
+}
+
+// DomainName implements the prefixer.Prefixer interface.
+func (w *Workflow) DomainName() string {
+	return w.Domain
+}
+
+// ID implements the couchdb.Doc interface
+func (w *Workflow) ID() string { return w.WorkflowID }
+
+// Rev implements the couchdb.Doc interface
+func (w *Workflow) Rev() string { return w.WorkflowRev }
+
+// DocType implements the couchdb.Doc interface
+func (w *Workflow) DocType() string { return consts.JobsWorkflows }
+
+// Clone implements the couchdb.Doc interface
+func (w *Workflow) Clone() couchdb.Doc {
+	cloned := *w
+	cloned.Steps = make([]*WorkflowStep, len(w.Steps))
+	for i, s := range w.Steps {
+		step := *s
+		cloned.Steps[i] = &step
+	}
+	if w.FinishedAt != nil {
+		tmp := *w.FinishedAt
+		cloned.FinishedAt = &tmp
+	}
+	return &cloned
+}
+
+// SetID implements the couchdb.Doc interface
+func (w *Workflow) SetID(id string) { w.WorkflowID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (w *Workflow) SetRev(rev string) { w.WorkflowRev = rev }
+
+// JobRequest returns the job request for the step of the workflow.
+func (s *WorkflowStep) JobRequest(w *Workflow) *JobRequest {
+	return &JobRequest{
+		WorkerType: s.WorkerType,
+		Message:    s.Message,
+		Options:    s.Options,
+		WorkflowID: w.ID(),
+		StepName:   s.Name,
+	}
+}
+
+// Step returns the step of the workflow with the given name, or nil.
+func (w *Workflow) Step(name string) *WorkflowStep {
+	for _, s := range w.Steps {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Validate checks that the steps have distinct names and valid retry
+// policies, that their edges are valid, and that there is no cycle.
+func (w *Workflow) Validate() error {
+	if len(w.Steps) == 0 {
+		return ErrInvalidWorkflow
+	}
+	steps := make(map[string]*WorkflowStep, len(w.Steps))
+	for _, s := range w.Steps {
+		if s.Name == "" || s.WorkerType == "" {
+			return ErrInvalidWorkflow
+		}
+		if _, ok := steps[s.Name]; ok {
+			return ErrInvalidWorkflow
+		}
+		if s.Options != nil && s.Options.Retry != nil {
+			if err := s.Options.Retry.Validate(); err != nil {
+				return err
+			}
+		}
+		steps[s.Name] = s
+	}
+	for _, s := range w.Steps {
+		for _, e := range s.After {
+			if _, ok := steps[e.Step]; !ok || e.Step == s.Name {
+				return ErrInvalidWorkflow
+			}
+			switch e.On {
+			case "":
+				e.On = OnSuccess
+			case OnSuccess, OnFailure, OnAlways:
+			default:
+				return ErrInvalidWorkflow
+			}
+		}
+	}
+
+	// Kahn's algorithm: the graph is acyclic if all the steps can be sorted
+	remaining := make(map[string]int, len(w.Steps))
+	for _, s := range w.Steps {
+		remaining[s.Name] = len(s.After)
+	}
+	sorted := 0
+	for sorted < len(w.Steps) {
+		var next []string
+		for name, count := range remaining {
+			if count == 0 {
+				next = append(next, name)
+			}
+		}
+		if len(next) == 0 {
+			return ErrInvalidWorkflow
+		}
+		for _, name := range next {
+			delete(remaining, name)
+			sorted++
+			for _, s := range w.Steps {
+				for _, e := range s.After {
+					if e.Step == name {
+						remaining[s.Name]--
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isFinished returns true if the step has ended, or will never run.
+func (s *WorkflowStep) isFinished() bool {
+	return s.State == Done || s.State == Errored || s.State == Skipped
+}
+
+// isFollowed returns true if the edge from a finished step can be followed.
+func (e *WorkflowEdge) isFollowed(from *WorkflowStep) bool {
+	switch e.On {
+	case OnFailure:
+		return from.State == Errored
+	case OnAlways:
+		return from.State == Done || from.State == Errored
+	default:
+		return from.State == Done
+	}
+}
+
+// claimReadySteps marks as queued the pending steps whose dependencies have
+// ended and whose edges can be followed, and returns them. The pending steps
+// that can't run anymore are marked as skipped.
+func (w *Workflow) claimReadySteps() []*WorkflowStep {
+	var ready []*WorkflowStep
+	for changed := true; changed; {
+		changed = false
+		for _, s := range w.Steps {
+			if s.State != Pending {
+				continue
+			}
+			finished, followed := true, true
+			for _, e := range s.After {
+				from := w.Step(e.Step)
+				if !from.isFinished() {
+					finished = false
+					break
+				}
+				if !e.isFollowed(from) {
+					followed = false
+				}
+			}
+			if !finished {
+				continue
+			}
+			if followed {
+				s.State = Queued
+				ready = append(ready, s)
+			} else {
+				s.State = Skipped
+			}
+			changed = true
+		}
+	}
+	w.refreshState()
+	return ready
+}
+
+// refreshState updates the state of the workflow from the states of its
+// steps. A workflow has errored if one of its steps has failed, even if the
+// failure was handled by another step.
+func (w *Workflow) refreshState() {
+	errored := false
+	for _, s := range w.Steps {
+		if !s.isFinished() {
+			return
+		}
+		if s.State == Errored {
+			errored = true
+		}
+	}
+	if w.FinishedAt != nil {
+		return
+	}
+	now := time.Now()
+	w.FinishedAt = &now
+	if errored {
+		w.State = Errored
+	} else {
+		w.State = Done
+	}
+}
+
+// GetWorkflow returns the workflow with the given identifier.
+func GetWorkflow(db prefixer.Prefixer, workflowID string) (*Workflow, error) {
+	var w Workflow
+	if err := couchdb.GetDoc(db, consts.JobsWorkflows, workflowID, &w); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrNotFoundWorkflow
+		}
+		return nil, err
+	}
+	return &w, nil
+}
+
+// PushWorkflow validates and saves the workflow, and pushes the jobs for the
+// steps that don't depend on other steps.
+func PushWorkflow(b Broker, db prefixer.Prefixer, w *Workflow) error {
+	if err := w.Validate(); err != nil {
+		return err
+	}
+	w.Domain = db.DomainName()
+	w.Prefix = db.DBPrefix()
+	w.State = Running
+	w.CreatedAt = time.Now()
+	w.FinishedAt = nil
+	for _, s := range w.Steps {
+		s.State = Pending
+		s.JobID = ""
+		s.Error = ""
+	}
+	if err := couchdb.CreateDoc(db, w); err != nil {
+		return err
+	}
+	updated, err := runWorkflow(b, db, w.ID())
+	if updated != nil {
+		*w = *updated
+	}
+	return err
+}
+
+// workflowJobEnded is called when a job of a workflow has ended, to record
+// its result and push the jobs of the next steps.
+func workflowJobEnded(b Broker, job *Job, errRun error) error {
+	_, err := updateWorkflow(job, job.WorkflowID, func(w *Workflow) {
+		s := w.Step(job.StepName)
+		if s == nil {
+			return
+		}
+		if errRun != nil {
+			s.State = Errored
+			s.Error = errRun.Error()
+		} else {
+			s.State = Done
+		}
+		if s.JobID == "" {
+			s.JobID = job.ID()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	_, err = runWorkflow(b, job, job.WorkflowID)
+	return err
+}
+
+// runWorkflow pushes the jobs for the steps that are ready. A step for which
+// the job can't be pushed is marked as errored, and it can make other steps
+// ready.
+func runWorkflow(b Broker, db prefixer.Prefixer, workflowID string) (*Workflow, error) {
+	for {
+		var ready []*WorkflowStep
+		w, err := updateWorkflow(db, workflowID, func(w *Workflow) {
+			ready = w.claimReadySteps()
+		})
+		if err != nil || len(ready) == 0 {
+			return w, err
+		}
+		failed := false
+		for _, step := range ready {
+			name := step.Name
+			job, errPush := b.PushJob(db, step.JobRequest(w))
+			if errPush != nil {
+				failed = true
+			}
+			w, err = updateWorkflow(db, workflowID, func(w *Workflow) {
+				s := w.Step(name)
+				if errPush != nil {
+					s.State = Errored
+					s.Error = errPush.Error()
+					w.refreshState()
+				} else if s.JobID == "" {
+					s.JobID = job.ID()
+				}
+			})
+			if err != nil {
+				return w, err
+			}
+		}
+		if !failed {
+			return w, nil
+		}
+	}
+}
+
+// updateWorkflow fetches the workflow, applies the change and saves it. The
+// operation is retried when there is a conflict.
+func updateWorkflow(db prefixer.Prefixer, workflowID string, change func(w *Workflow)) (*Workflow, error) {
+	var err error
+	for i := 0; i < maxWorkflowUpdates; i++ {
+		var w *Workflow
+		w, err = GetWorkflow(db, workflowID)
+		if err != nil {
+			return nil, err
+		}
+		change(w)
+		err = couchdb.UpdateDoc(db, w)
+		if err == nil {
+			return w, nil
+		}
+		if !couchdb.IsConflictError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+var _ couchdb.Doc = &Workflow{}
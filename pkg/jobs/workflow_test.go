@@ -0,0 +1,99 @@
+package jobs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkflowValidate(t *testing.T) {
+	w := &Workflow{}
+	assert.Equal(t, ErrInvalidWorkflow, w.Validate())
+
+	w = &Workflow{Steps: []*WorkflowStep{
+		{Name: "konnector", WorkerType: "konnector"},
+		{Name: "thumbnail", WorkerType: "thumbnail", After: []*WorkflowEdge{
+			{Step: "konnector"},
+		}},
+	}}
+	assert.NoError(t, w.Validate())
+	assert.Equal(t, OnSuccess, w.Steps[1].After[0].On)
+
+	w = &Workflow{Steps: []*WorkflowStep{
+		{Name: "a", WorkerType: "log"},
+		{Name: "a", WorkerType: "log"},
+	}}
+	assert.Equal(t, ErrInvalidWorkflow, w.Validate())
+
+	w = &Workflow{Steps: []*WorkflowStep{
+		{Name: "a", WorkerType: "log", After: []*WorkflowEdge{{Step: "unknown"}}},
+	}}
+	assert.Equal(t, ErrInvalidWorkflow, w.Validate())
+
+	w = &Workflow{Steps: []*WorkflowStep{
+		{Name: "a", WorkerType: "log"},
+		{Name: "b", WorkerType: "log", After: []*WorkflowEdge{{Step: "a", On: "sometimes"}}},
+	}}
+	assert.Equal(t, ErrInvalidWorkflow, w.Validate())
+
+	w = &Workflow{Steps: []*WorkflowStep{
+		{Name: "a", WorkerType: "log", Options: &JobOptions{
+			Retry: &RetryPolicy{Strategy: "linear"},
+		}},
+	}}
+	assert.Equal(t, ErrInvalidRetryPolicy, w.Validate())
+
+	w = &Workflow{Steps: []*WorkflowStep{
+		{Name: "a", WorkerType: "log", After: []*WorkflowEdge{{Step: "c"}}},
+		{Name: "b", WorkerType: "log", After: []*WorkflowEdge{{Step: "a"}}},
+		{Name: "c", WorkerType: "log", After: []*WorkflowEdge{{Step: "b"}}},
+	}}
+	assert.Equal(t, ErrInvalidWorkflow, w.Validate())
+}
+
+func TestWorkflowClaimReadySteps(t *testing.T) {
+	w := &Workflow{State: Running, Steps: []*WorkflowStep{
+		{Name: "export", WorkerType: "export", State: Pending},
+		{Name: "mail", WorkerType: "sendmail", State: Pending, After: []*WorkflowEdge{
+			{Step: "export", On: OnSuccess},
+		}},
+		{Name: "alert", WorkerType: "sendmail", State: Pending, After: []*WorkflowEdge{
+			{Step: "export", On: OnFailure},
+		}},
+		{Name: "after-alert", WorkerType: "log", State: Pending, After: []*WorkflowEdge{
+			{Step: "alert", On: OnAlways},
+		}},
+		{Name: "clean", WorkerType: "log", State: Pending, After: []*WorkflowEdge{
+			{Step: "mail", On: OnAlways},
+			{Step: "export", On: OnAlways},
+		}},
+	}}
+	assert.NoError(t, w.Validate())
+
+	ready := w.claimReadySteps()
+	if assert.Len(t, ready, 1) {
+		assert.Equal(t, "export", ready[0].Name)
+	}
+	assert.Equal(t, State(Queued), w.Step("export").State)
+	assert.Len(t, w.claimReadySteps(), 0)
+
+	w.Step("export").State = Done
+	ready = w.claimReadySteps()
+	if assert.Len(t, ready, 1) {
+		assert.Equal(t, "mail", ready[0].Name)
+	}
+	assert.Equal(t, Skipped, w.Step("alert").State)
+	assert.Equal(t, Skipped, w.Step("after-alert").State)
+	assert.Equal(t, State(Running), w.State)
+
+	w.Step("mail").State = Errored
+	ready = w.claimReadySteps()
+	if assert.Len(t, ready, 1) {
+		assert.Equal(t, "clean", ready[0].Name)
+	}
+
+	w.Step("clean").State = Done
+	assert.Len(t, w.claimReadySteps(), 0)
+	assert.Equal(t, State(Errored), w.State)
+	assert.NotNil(t, w.FinishedAt)
+}
@@ -0,0 +1,95 @@
+package keymgmt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+)
+
+const (
+	aesKeyBlockType = "AES KEY"
+
+	aesKeyLen = 32
+)
+
+var (
+	errAESBadKey        = errors.New("keymgmt: bad aes key")
+	errAESBadWrappedKey = errors.New("keymgmt: bad wrapped key")
+)
+
+// AESKey contains a symmetric key, used as a master key to wrap other keys.
+type AESKey struct {
+	key []byte
+}
+
+// GenerateAESKey returns a new random symmetric key.
+func GenerateAESKey() (*AESKey, error) {
+	key := make([]byte, aesKeyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return &AESKey{key: key}, nil
+}
+
+// UnmarshalAESKey takes an encoded value of a symmetric key and unmarshal
+// its value.
+func UnmarshalAESKey(marshaledKey []byte) (*AESKey, error) {
+	key, err := unmarshalPEMBlock(marshaledKey, aesKeyBlockType)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != aesKeyLen {
+		return nil, errAESBadKey
+	}
+	return &AESKey{key: key}, nil
+}
+
+// MarshalAESKey takes a symmetric key and returns its encoded version.
+func MarshalAESKey(key *AESKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  aesKeyBlockType,
+		Bytes: key.key,
+	})
+}
+
+func (k *AESKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapKey encrypts the given key with this master key. The result can be
+// stored next to the data it protects.
+func (k *AESKey) WrapKey(key []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapKey decrypts a key that has been wrapped with this master key.
+func (k *AESKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errAESBadWrappedKey
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errAESBadWrappedKey
+	}
+	return key, nil
+}
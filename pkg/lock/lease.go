@@ -0,0 +1,105 @@
+package lock
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// luaAcquire takes the lease if it is free, or renews it if it is already
+// owned by the same owner.
+const luaAcquire = `local v = redis.call("get", KEYS[1])
+if v == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end
+if v then return 0 end
+redis.call("set", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1`
+
+const leaseNS = "leases:"
+
+// A Lease is a lock with an expiration, that can be used to elect a leader
+// among several processes: the owner of the lease must renew it before its
+// expiration, or another process can take it.
+type Lease interface {
+	// TryAcquire takes the lease for the owner, or renews it if the owner
+	// already holds it. It returns false if the lease is held by another
+	// owner.
+	TryAcquire(owner string, ttl time.Duration) (bool, error)
+	// Release gives the lease back, if it is held by the owner.
+	Release(owner string) error
+}
+
+// ErrNoRedisLease is returned when a lease is asked, but redis is not used for
+// the locks: a lease in memory can't be shared by the stacks.
+var ErrNoRedisLease = errors.New("lock: a lease needs redis for the locks")
+
+// GetLease returns the lease for the given name, shared by the stacks in
+// redis. It returns ErrNoRedisLease if redis is not used for the locks.
+func GetLease(name string) (Lease, error) {
+	cli := config.GetConfig().Lock.Client()
+	if cli == nil {
+		return nil, ErrNoRedisLease
+	}
+	return &redisLease{client: cli, key: leaseNS + name}, nil
+}
+
+type redisLease struct {
+	client subRedisInterface
+	key    string
+}
+
+func (l *redisLease) TryAcquire(owner string, ttl time.Duration) (bool, error) {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	res, err := l.client.Eval(luaAcquire, []string{l.key}, owner, ms).Result()
+	if err != nil {
+		return false, err
+	}
+	return res == int64(1), nil
+}
+
+func (l *redisLease) Release(owner string) error {
+	return l.client.Eval(luaRelease, []string{l.key}, owner).Err()
+}
+
+// MemLease is a lease kept in memory. It can be used to share a lease between
+// several goroutines of the same process, and its clock can be changed for
+// the tests.
+type MemLease struct {
+	mu    sync.Mutex
+	owner string
+	exp   time.Time
+	// Now returns the current time (time.Now by default)
+	Now func() time.Time
+}
+
+func (l *MemLease) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// TryAcquire implements the Lease interface
+func (l *MemLease) TryAcquire(owner string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.owner != "" && l.owner != owner && now.Before(l.exp) {
+		return false, nil
+	}
+	l.owner = owner
+	l.exp = now.Add(ttl)
+	return true, nil
+}
+
+// Release implements the Lease interface
+func (l *MemLease) Release(owner string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.owner == owner {
+		l.owner = ""
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -130,6 +131,56 @@ func TestRedisLock(t *testing.T) {
 	}
 }
 
+func TestRedisLease(t *testing.T) {
+	backconf := config.GetConfig().Lock
+	defer func() { config.GetConfig().Lock = backconf }()
+
+	config.GetConfig().Lock = config.RedisConfig{}
+	if _, err := GetLease("test-lease"); err != ErrNoRedisLease {
+		t.Fatalf("expected ErrNoRedisLease, got %v", err)
+	}
+
+	var err error
+	config.GetConfig().Lock, err = config.NewRedisConfig("redis://localhost:6379/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := GetLease("test-lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.(*redisLease); !ok {
+		t.Fatalf("expected a redis lease, got %T", l)
+	}
+	defer l.Release("a")
+
+	if ok, err := l.TryAcquire("a", time.Second); !ok || err != nil {
+		t.Fatalf("a should acquire the lease: %v %v", ok, err)
+	}
+	if ok, err := l.TryAcquire("a", time.Second); !ok || err != nil {
+		t.Fatalf("a should renew the lease: %v %v", ok, err)
+	}
+	if ok, err := l.TryAcquire("b", time.Second); ok || err != nil {
+		t.Fatalf("b should not acquire the lease held by a: %v %v", ok, err)
+	}
+	if err := l.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := l.TryAcquire("b", time.Second); ok || err != nil {
+		t.Fatalf("b should not release the lease held by a: %v %v", ok, err)
+	}
+	if err := l.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := l.TryAcquire("b", 100*time.Millisecond); !ok || err != nil {
+		t.Fatalf("b should acquire the released lease: %v %v", ok, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if ok, err := l.TryAcquire("a", time.Second); !ok || err != nil {
+		t.Fatalf("a should acquire the expired lease: %v %v", ok, err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	if testing.Short() {
@@ -9,6 +9,8 @@ const (
 	WorkerExecResultSuccess = "success"
 	// WorkerExecResultErrored for errored result label
 	WorkerExecResultErrored = "errored"
+	// WorkerExecResultCancelled for cancelled result label
+	WorkerExecResultCancelled = "cancelled"
 )
 
 // WorkerExecDurations is a histogram metric of the execution duration in
@@ -60,6 +62,16 @@ var WorkerExecRetries = prometheus.NewHistogramVec(
 	[]string{"worker_type"},
 )
 
+// WorkersQueuesDomainLenDesc is the description of the gauge metric of the
+// number of queued jobs, labelled by worker type and domain. The values are
+// collected from the broker by the jobs package.
+var WorkersQueuesDomainLenDesc = prometheus.NewDesc(
+	prometheus.BuildFQName("workers", "queues", "domain_len"),
+	`Len of the workers queues by worker type and domain`,
+	[]string{"worker_type", "domain"},
+	prometheus.Labels{},
+)
+
 // WorkersKonnectorsExecDurations is a histogram metric of the number of
 // execution durations of the commands executed for konnectors and services,
 // labelled by application slug
@@ -23,6 +23,9 @@ const (
 	// NotificationDiskQuota category for sending alert when reaching 90% of disk
 	// usage quota.
 	NotificationDiskQuota = "disk-quota"
+	// NotificationTrashExpiry category for warning the user that some items
+	// of the trash will be deleted soon.
+	NotificationTrashExpiry = "trash-expiry"
 )
 
 var (
@@ -34,6 +37,12 @@ var (
 			MailTemplate: "notifications_diskquota",
 			MinInterval:  7 * 24 * time.Hour,
 		},
+		NotificationTrashExpiry: {
+			Description:  "Warn about the items of the trash that will be deleted soon",
+			Collapsible:  true,
+			Stateful:     true,
+			MailTemplate: "notifications_trash_expiry",
+		},
 	}
 )
 
@@ -51,11 +60,13 @@ func init() {
 			State: exceeded,
 			Data:  map[string]interface{}{"OffersLink": offersLink},
 		}
-		pushStack(domain, NotificationDiskQuota, n)
+		PushStack(domain, NotificationDiskQuota, n)
 	})
 }
 
-func pushStack(domain string, category string, n *notification.Notification) error {
+// PushStack creates and sends a new notification from the stack, for one of
+// the categories of notifications of the stack.
+func PushStack(domain string, category string, n *notification.Notification) error {
 	inst, err := instance.Get(domain)
 	if err != nil {
 		return err
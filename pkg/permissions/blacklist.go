@@ -19,8 +19,13 @@ var blackList = map[string]bool{
 	consts.OAuthClients:     none,
 	consts.OAuthAccessCodes: none,
 	consts.Archives:         none,
+	consts.FilesUploads:     none,
+	consts.FilesBlobs:       none,
+	consts.FilesSizes:       none,
 	consts.Sharings:         none,
 	consts.Shared:           none,
+	consts.JobsWorkflows:    none,
+	consts.JobsFailed:       none,
 
 	// TODO: uncomment to restric jobs permissions (make these none instead of
 	// readable).
@@ -28,12 +33,13 @@ var blackList = map[string]bool{
 	consts.Triggers:      readable,
 	consts.TriggersState: readable,
 
-	consts.Apps:           readable,
-	consts.Konnectors:     readable,
-	consts.Files:          readable,
-	consts.Notifications:  readable,
-	consts.RemoteRequests: readable,
-	consts.SessionsLogins: readable,
+	consts.Apps:             readable,
+	consts.Konnectors:       readable,
+	consts.Files:            readable,
+	consts.Notifications:    readable,
+	consts.RemoteRequests:   readable,
+	consts.SessionsLogins:   readable,
+	consts.SharingsActivity: readable,
 }
 
 // CheckReadable will abort the context and returns false if the doctype
@@ -35,6 +35,31 @@ var (
 	ErrOnlyAppCanCreateSubSet = echo.NewHTTPError(http.StatusForbidden,
 		"Only apps can create sharing permissions")
 
+	// ErrSharePasswordRequired is used when a share by link is protected by
+	// a password, and the request has no password.
+	ErrSharePasswordRequired = echo.NewHTTPError(http.StatusUnauthorized,
+		"A password is required for this share")
+
+	// ErrInvalidSharePassword is used when the password sent for a share by
+	// link is not the good one.
+	ErrInvalidSharePassword = echo.NewHTTPError(http.StatusForbidden,
+		"Invalid password for this share")
+
+	// ErrTooManySharePasswordFailures is used when too many bad passwords
+	// have been sent recently for a share by link.
+	ErrTooManySharePasswordFailures = echo.NewHTTPError(http.StatusTooManyRequests,
+		"Too many bad passwords for this share, please retry later")
+
+	// ErrViewOnly is used when trying to download a file from a share by
+	// link in view-only mode.
+	ErrViewOnly = echo.NewHTTPError(http.StatusForbidden,
+		"This share is in view-only mode")
+
+	// ErrMaxDownloads is used when the maximal number of downloads of a share
+	// by link has been reached.
+	ErrMaxDownloads = echo.NewHTTPError(http.StatusForbidden,
+		"The maximal number of downloads has been reached")
+
 	// ErrNotParent is used when the permissions should have a specific parent.
 	ErrNotParent = echo.NewHTTPError(http.StatusForbidden,
 		"Permissions can be updated only by its parent")
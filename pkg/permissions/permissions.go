@@ -24,6 +24,17 @@ type Permission struct {
 	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
 	Codes       map[string]string `json:"codes,omitempty"`
 
+	// Options for the sharing by link
+	Password     []byte           `json:"password,omitempty"` // scrypt hash
+	MaxDownloads int              `json:"max_downloads,omitempty"`
+	Downloads    int              `json:"downloads,omitempty"`
+	ViewOnly     bool             `json:"view_only,omitempty"`
+	AccessLog    []AccessLogEntry `json:"access_log,omitempty"`
+
+	// Failed attempts to use the password of a share by link
+	PasswordFailures    int        `json:"password_failures,omitempty"`
+	LastPasswordFailure *time.Time `json:"last_password_failure,omitempty"`
+
 	Client interface{} `json:"-"` // Contains the *oauth.Client client pointer for Oauth permission type
 }
 
@@ -68,6 +79,8 @@ func (p *Permission) Clone() couchdb.Doc {
 	for k, v := range p.Codes {
 		cloned.Codes[k] = v
 	}
+	cloned.AccessLog = make([]AccessLogEntry, len(p.AccessLog))
+	copy(cloned.AccessLog, p.AccessLog)
 	return &cloned
 }
 
@@ -323,8 +336,9 @@ func updateAppSet(db prefixer.Prefixer, doc *Permission, typ, docType, slug stri
 	return doc, nil
 }
 
-// CreateShareSet creates a Permission doc for sharing by link
-func CreateShareSet(db prefixer.Prefixer, parent *Permission, codes map[string]string, set Set, expiresAt *time.Time) (*Permission, error) {
+// CreateShareSet creates a Permission doc for sharing by link. The options
+// can be nil.
+func CreateShareSet(db prefixer.Prefixer, parent *Permission, codes map[string]string, set Set, opts *ShareOptions) (*Permission, error) {
 	if parent.Type != TypeWebapp && parent.Type != TypeKonnector && parent.Type != TypeOauth {
 		return nil, ErrOnlyAppCanCreateSubSet
 	}
@@ -349,7 +363,11 @@ func CreateShareSet(db prefixer.Prefixer, parent *Permission, codes map[string]s
 		SourceID:    parent.SourceID,
 		Permissions: set,
 		Codes:       codes,
-		ExpiresAt:   expiresAt,
+	}
+	if opts != nil {
+		if err := opts.apply(doc); err != nil {
+			return nil, err
+		}
 	}
 
 	err := couchdb.CreateDoc(db, doc)
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cozy/echo"
 	"github.com/stretchr/testify/assert"
@@ -305,6 +306,49 @@ func TestCreateShareSetBlacklist(t *testing.T) {
 	assert.Equal(t, "reserved doctype io.cozy.notifications unwritable", e.Message)
 }
 
+func TestShareOptions(t *testing.T) {
+	doc := &Permission{Type: TypeShareByLink}
+	opts := &ShareOptions{Password: "secret", MaxDownloads: 2}
+	assert.NoError(t, opts.apply(doc))
+	assert.NotEqual(t, []byte("secret"), doc.Password)
+	assert.Equal(t, ErrSharePasswordRequired, doc.CheckPassword(""))
+	assert.Equal(t, ErrInvalidSharePassword, doc.CheckPassword("wrong"))
+	assert.NoError(t, doc.CheckPassword("secret"))
+
+	assert.NoError(t, doc.CanDownload())
+	doc.addAccess(AccessView, "127.0.0.1")
+	doc.addAccess(AccessDownload, "127.0.0.1")
+	assert.NoError(t, doc.CanDownload())
+	doc.addAccess(AccessDownload, "127.0.0.1")
+	assert.Equal(t, ErrMaxDownloads, doc.CanDownload())
+	assert.Equal(t, 2, doc.Downloads)
+	if assert.Len(t, doc.AccessLog, 3) {
+		assert.Equal(t, AccessView, doc.AccessLog[0].Action)
+		assert.Equal(t, AccessDownload, doc.AccessLog[2].Action)
+	}
+
+	for i := 0; i < maxAccessLogEntries; i++ {
+		doc.addAccess(AccessView, "127.0.0.1")
+	}
+	assert.Len(t, doc.AccessLog, maxAccessLogEntries)
+
+	for i := 0; i < maxSharePasswordFailures; i++ {
+		assert.False(t, doc.passwordLocked())
+		doc.addPasswordFailure()
+	}
+	assert.True(t, doc.passwordLocked())
+	assert.Equal(t, ErrTooManySharePasswordFailures, doc.VerifyPassword(nil, "secret"))
+	old := time.Now().Add(-sharePasswordLockDuration)
+	doc.LastPasswordFailure = &old
+	assert.False(t, doc.passwordLocked())
+	doc.addPasswordFailure()
+	assert.Equal(t, 1, doc.PasswordFailures)
+
+	noPassword := &Permission{Type: TypeShareByLink, ViewOnly: true}
+	assert.NoError(t, noPassword.CheckPassword(""))
+	assert.Equal(t, ErrViewOnly, noPassword.CanDownload())
+}
+
 func assertEqualJSON(t *testing.T, value []byte, expected string) {
 	expectedBytes := new(bytes.Buffer)
 	err := json.Compact(expectedBytes, []byte(expected))
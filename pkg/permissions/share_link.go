@@ -0,0 +1,177 @@
+package permissions
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+const (
+	// AccessView is the action logged when the page of a share by link is
+	// opened
+	AccessView = "view"
+	// AccessDownload is the action logged when a file of a share by link is
+	// downloaded
+	AccessDownload = "download"
+)
+
+// maxAccessLogEntries is the number of entries kept in the access log of a
+// share by link. The oldest entries are removed first.
+const maxAccessLogEntries = 100
+
+// maxSharePasswordFailures is the number of bad passwords accepted for a
+// share by link before the password is refused for sharePasswordLockDuration.
+const maxSharePasswordFailures = 10
+
+// sharePasswordLockDuration is the duration during which the password of a
+// share by link is refused after too many failures. The failures are counted
+// again from zero after this duration without failure.
+const sharePasswordLockDuration = 5 * time.Minute
+
+// ShareOptions are the optional settings for a share by link
+type ShareOptions struct {
+	ExpiresAt    *time.Time
+	Password     string
+	MaxDownloads int
+	ViewOnly     bool
+}
+
+func (o *ShareOptions) apply(doc *Permission) error {
+	doc.ExpiresAt = o.ExpiresAt
+	doc.MaxDownloads = o.MaxDownloads
+	doc.ViewOnly = o.ViewOnly
+	if o.Password != "" {
+		hash, err := crypto.GenerateFromPassphrase([]byte(o.Password))
+		if err != nil {
+			return err
+		}
+		doc.Password = hash
+	}
+	return nil
+}
+
+// AccessLogEntry is an access to a share by link
+type AccessLogEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	IP     string    `json:"ip,omitempty"`
+}
+
+// CheckPassword returns an error if the permissions are protected by a
+// password, and the given password is not the good one.
+func (p *Permission) CheckPassword(password string) error {
+	if len(p.Password) == 0 {
+		return nil
+	}
+	if password == "" {
+		return ErrSharePasswordRequired
+	}
+	if _, err := crypto.CompareHashAndPassphrase(p.Password, []byte(password)); err != nil {
+		return ErrInvalidSharePassword
+	}
+	return nil
+}
+
+// VerifyPassword checks the password of a share by link, like CheckPassword,
+// but it also counts the bad passwords, and refuses the password without
+// checking it after too many failures.
+func (p *Permission) VerifyPassword(db prefixer.Prefixer, password string) error {
+	if len(p.Password) == 0 {
+		return nil
+	}
+	if password == "" {
+		return ErrSharePasswordRequired
+	}
+	if p.passwordLocked() {
+		return ErrTooManySharePasswordFailures
+	}
+	err := p.CheckPassword(password)
+	if err != ErrInvalidSharePassword {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		p.addPasswordFailure()
+		erru := couchdb.UpdateDoc(db, p)
+		if erru == nil {
+			break
+		}
+		if !couchdb.IsConflictError(erru) {
+			return erru
+		}
+		fresh, errg := GetByID(db, p.PID)
+		if errg != nil {
+			return errg
+		}
+		*p = *fresh
+	}
+	return err
+}
+
+func (p *Permission) passwordLocked() bool {
+	return p.PasswordFailures >= maxSharePasswordFailures &&
+		p.LastPasswordFailure != nil &&
+		time.Since(*p.LastPasswordFailure) < sharePasswordLockDuration
+}
+
+func (p *Permission) addPasswordFailure() {
+	now := time.Now().UTC()
+	if p.LastPasswordFailure == nil || now.Sub(*p.LastPasswordFailure) >= sharePasswordLockDuration {
+		p.PasswordFailures = 0
+	}
+	p.PasswordFailures++
+	p.LastPasswordFailure = &now
+}
+
+// CanDownload returns an error if the files can't be downloaded with these
+// permissions, because they are in view-only mode or the maximal number of
+// downloads has been reached.
+func (p *Permission) CanDownload() error {
+	if p.ViewOnly {
+		return ErrViewOnly
+	}
+	if p.MaxDownloads > 0 && p.Downloads >= p.MaxDownloads {
+		return ErrMaxDownloads
+	}
+	return nil
+}
+
+func (p *Permission) addAccess(action, ip string) {
+	if action == AccessDownload {
+		p.Downloads++
+	}
+	p.AccessLog = append(p.AccessLog, AccessLogEntry{
+		Time:   time.Now().UTC(),
+		Action: action,
+		IP:     ip,
+	})
+	if len(p.AccessLog) > maxAccessLogEntries {
+		p.AccessLog = p.AccessLog[len(p.AccessLog)-maxAccessLogEntries:]
+	}
+}
+
+// RecordAccess adds an entry to the access log of the permissions, and
+// counts the downloads. The permissions are reloaded in case of a conflict
+// with another access, and the limit of downloads is checked again.
+func (p *Permission) RecordAccess(db prefixer.Prefixer, action, ip string) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		if action == AccessDownload {
+			if err = p.CanDownload(); err != nil {
+				return err
+			}
+		}
+		p.addAccess(action, ip)
+		err = couchdb.UpdateDoc(db, p)
+		if err == nil || !couchdb.IsConflictError(err) {
+			return err
+		}
+		fresh, errg := GetByID(db, p.PID)
+		if errg != nil {
+			return errg
+		}
+		*p = *fresh
+	}
+	return err
+}
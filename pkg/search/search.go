@@ -0,0 +1,559 @@
+// Package search is for the full-text index of an instance. The files and
+// the documents of the doctypes listed in the configuration are indexed with
+// bleve, and the index is kept up-to-date by the index worker.
+package search
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// maxContentSize is the maximal size of the text files whose content is
+// indexed.
+const maxContentSize = 1 << (2 * 10) // 1 MiB
+
+// defaultLimit is the number of hits returned when the query has no limit.
+const defaultLimit = 30
+
+// batchSize is the number of hits fetched at once from the index. The hits
+// are then filtered with the permissions, so several batches may be needed.
+const batchSize = 100
+
+// maxHits is the maximal number of hits that are looked at for a query.
+const maxHits = 1000
+
+// ErrInvalidQuery is used when the query string is empty
+var ErrInvalidQuery = errors.New("search: the query is empty")
+
+// maxOpenIndexes is the number of indexes in memory kept by the process. When
+// more indexes are used, the least recently used ones are closed.
+const maxOpenIndexes = 64
+
+// boltTimeout is the time to wait for an index opened by another process. An
+// index stored on disk is closed as soon as it is no longer used, so it is
+// only held for the duration of a write or a query.
+const boltTimeout = "10s"
+
+// openIndex is an index opened by this process. refs is the number of
+// callers that are using it: an index can't be closed while it is in use.
+type openIndex struct {
+	key   string
+	index bleve.Index
+	refs  int
+	elem  *list.Element
+}
+
+var (
+	indexesMu sync.Mutex
+	indexes   = make(map[string]*openIndex)
+	// lru is the list of the open indexes, the most recently used first
+	lru = list.New()
+)
+
+// document is what is indexed for a file, a directory or a document.
+type document struct {
+	DocType string   `json:"doctype"`
+	Name    string   `json:"name,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Mime    string   `json:"mime,omitempty"`
+	Content string   `json:"content,omitempty"`
+}
+
+// Query is a full-text search request.
+type Query struct {
+	// The query string, in the bleve syntax: words, "phrases", +required,
+	// -excluded, field:value...
+	Q string
+	// The doctypes to look for, all the indexed doctypes if empty
+	Doctypes []string
+	Limit    int
+	Skip     int
+}
+
+// Hit is a document that matches a query.
+type Hit struct {
+	DocType string  `json:"doctype"`
+	DocID   string  `json:"id"`
+	Score   float64 `json:"score"`
+	Name    string  `json:"name,omitempty"`
+	Path    string  `json:"path,omitempty"`
+}
+
+// Doctypes returns the list of the doctypes that are indexed.
+func Doctypes() []string {
+	doctypes := []string{consts.Files}
+	for _, doctype := range config.GetConfig().Search.Doctypes {
+		if doctype != consts.Files {
+			doctypes = append(doctypes, doctype)
+		}
+	}
+	return doctypes
+}
+
+// IsIndexed returns true if the documents of the given doctype are indexed.
+func IsIndexed(doctype string) bool {
+	for _, d := range Doctypes() {
+		if d == doctype {
+			return true
+		}
+	}
+	return false
+}
+
+func newMapping() mapping.IndexMapping {
+	keywordField := bleve.NewTextFieldMapping()
+	keywordField.Analyzer = keyword.Name
+	keywordField.IncludeInAll = false
+
+	storedField := bleve.NewTextFieldMapping()
+	storedField.Store = true
+
+	textField := bleve.NewTextFieldMapping()
+	textField.Store = false
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("doctype", keywordField)
+	doc.AddFieldMappingsAt("mime", keywordField)
+	doc.AddFieldMappingsAt("name", storedField)
+	doc.AddFieldMappingsAt("path", storedField)
+	doc.AddFieldMappingsAt("tags", textField)
+	doc.AddFieldMappingsAt("content", textField)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	return m
+}
+
+func indexPath(db prefixer.Prefixer) string {
+	dir := config.GetConfig().Search.Path
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, db.DBPrefix())
+}
+
+// getIndex returns the index of the instance, opened or created if needed.
+// The release function must be called when the index is no longer used.
+func getIndex(db prefixer.Prefixer) (bleve.Index, func(), error) {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	key := db.DBPrefix()
+	oi, ok := indexes[key]
+	if !ok {
+		idx, err := openOrCreate(indexPath(db))
+		if err != nil {
+			return nil, nil, err
+		}
+		oi = &openIndex{key: key, index: idx}
+		oi.elem = lru.PushFront(oi)
+		indexes[key] = oi
+	} else {
+		lru.MoveToFront(oi.elem)
+	}
+	oi.refs++
+	evictIndexes()
+	return oi.index, func() { releaseIndex(oi, indexPath(db) != "") }, nil
+}
+
+func openOrCreate(p string) (bleve.Index, error) {
+	if p == "" {
+		return bleve.NewMemOnly(newMapping())
+	}
+	kvconfig := map[string]interface{}{"bolt_timeout": boltTimeout}
+	idx, err := bleve.OpenUsing(p, kvconfig)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		idx, err = bleve.NewUsing(p, newMapping(), bleve.Config.DefaultIndexType,
+			bleve.Config.DefaultKVStore, kvconfig)
+	}
+	return idx, err
+}
+
+// releaseIndex is called when a caller no longer uses an index. An index
+// stored on disk is closed when it is no longer used, so that another process
+// of the stack can open it.
+func releaseIndex(oi *openIndex, onDisk bool) {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	oi.refs--
+	if oi.refs > 0 || indexes[oi.key] != oi {
+		return
+	}
+	if onDisk {
+		closeIndex(oi)
+		return
+	}
+	evictIndexes()
+}
+
+// evictIndexes closes the least recently used indexes, when there are too
+// many of them. The indexes in use are kept open. It must be called with
+// indexesMu locked.
+func evictIndexes() {
+	for e := lru.Back(); e != nil && lru.Len() > maxOpenIndexes; {
+		oi := e.Value.(*openIndex)
+		e = e.Prev()
+		if oi.refs == 0 {
+			closeIndex(oi)
+		}
+	}
+}
+
+// closeIndex closes an index and forgets it. It must be called with
+// indexesMu locked.
+func closeIndex(oi *openIndex) {
+	lru.Remove(oi.elem)
+	delete(indexes, oi.key)
+	if err := oi.index.Close(); err != nil {
+		logger.WithNamespace("search").Warnf("Cannot close the index %s: %s", oi.key, err)
+	}
+}
+
+// DeleteIndex closes and removes the index of the instance.
+func DeleteIndex(db prefixer.Prefixer) error {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	if oi, ok := indexes[db.DBPrefix()]; ok {
+		closeIndex(oi)
+	}
+	if p := indexPath(db); p != "" {
+		return os.RemoveAll(p)
+	}
+	return nil
+}
+
+func indexKey(doctype, id string) string {
+	return doctype + "/" + id
+}
+
+func splitIndexKey(key string) (doctype, id string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return "", key
+	}
+	return parts[0], parts[1]
+}
+
+func isTrashed(fullpath string) bool {
+	return strings.HasPrefix(fullpath, vfs.TrashDirName)
+}
+
+// IndexDir adds or updates a directory in the index. The directories in the
+// trash are removed from the index instead.
+func IndexDir(db prefixer.Prefixer, dir *vfs.DirDoc) error {
+	if isTrashed(dir.Fullpath) {
+		return Delete(db, consts.Files, dir.ID())
+	}
+	idx, release, err := getIndex(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return idx.Index(indexKey(consts.Files, dir.ID()), &document{
+		DocType: consts.Files,
+		Name:    dir.DocName,
+		Path:    dir.Fullpath,
+		Tags:    dir.Tags,
+	})
+}
+
+// IndexFile adds or updates a file in the index, with its content if it is a
+// small text file, or the text extracted in its metadata. The trashed files
+// are removed from the index instead.
+func IndexFile(db prefixer.Prefixer, fs vfs.VFS, file *vfs.FileDoc) error {
+	fullpath, err := file.Path(fs)
+	if err != nil {
+		return err
+	}
+	if file.Trashed || isTrashed(fullpath) {
+		return Delete(db, consts.Files, file.ID())
+	}
+	doc := &document{
+		DocType: consts.Files,
+		Name:    file.DocName,
+		Path:    fullpath,
+		Tags:    file.Tags,
+		Mime:    file.Mime,
+	}
+	if text, ok := file.Metadata["text"].(string); ok {
+		// The text extracted from the PDF and office documents
+		doc.Content = text
+	} else if strings.HasPrefix(file.Mime, "text/") && file.ByteSize <= maxContentSize {
+		if doc.Content, err = readContent(fs, file); err != nil {
+			return err
+		}
+	}
+	idx, release, err := getIndex(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return idx.Index(indexKey(consts.Files, file.ID()), doc)
+}
+
+func readContent(fs vfs.VFS, file *vfs.FileDoc) (string, error) {
+	f, err := fs.OpenFile(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(f, maxContentSize))
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// IndexDoc adds or updates a document in the index. All the string values of
+// the document, except the special fields, are indexed as its content.
+func IndexDoc(db prefixer.Prefixer, doc *couchdb.JSONDoc) error {
+	idx, release, err := getIndex(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return idx.Index(indexKey(doc.DocType(), doc.ID()), &document{
+		DocType: doc.DocType(),
+		Content: strings.Join(stringValues(nil, doc.M), "\n"),
+	})
+}
+
+func stringValues(values []string, v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, item := range v {
+			values = stringValues(values, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			if !strings.HasPrefix(k, "_") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			values = stringValues(values, v[k])
+		}
+	}
+	return values
+}
+
+// Delete removes a document from the index.
+func Delete(db prefixer.Prefixer, doctype, id string) error {
+	idx, release, err := getIndex(db)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return idx.Delete(indexKey(doctype, id))
+}
+
+// IndexTree adds or updates a directory and all its descendants in the
+// index. It is used when a directory is moved, renamed or trashed, as the
+// paths of its descendants change too.
+func IndexTree(db prefixer.Prefixer, fs vfs.VFS, dirID string) error {
+	return vfs.WalkByID(fs, dirID, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			return IndexDir(db, dir)
+		}
+		return IndexFile(db, fs, file)
+	})
+}
+
+// Reindex rebuilds the index of the instance from scratch.
+func Reindex(db prefixer.Prefixer, fs vfs.VFS) error {
+	if err := DeleteIndex(db); err != nil {
+		return err
+	}
+	err := vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			if dir.ID() == consts.RootDirID {
+				return nil
+			}
+			if dir.ID() == consts.TrashDirID {
+				return vfs.ErrSkipDir
+			}
+			return IndexDir(db, dir)
+		}
+		return IndexFile(db, fs, file)
+	})
+	if err != nil {
+		return err
+	}
+	for _, doctype := range Doctypes() {
+		if doctype == consts.Files {
+			continue
+		}
+		err = couchdb.ForeachDocs(db, doctype, func(id string, raw json.RawMessage) error {
+			doc := couchdb.JSONDoc{Type: doctype}
+			if err := json.Unmarshal(raw, &doc); err != nil {
+				return err
+			}
+			return IndexDoc(db, &doc)
+		})
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the documents that match the query, by decreasing
+// relevance. Only the documents that can be read with the given permissions
+// are returned.
+func Search(db prefixer.Prefixer, fs vfs.VFS, pset permissions.Set, q *Query) ([]*Hit, error) {
+	if strings.TrimSpace(q.Q) == "" {
+		return nil, ErrInvalidQuery
+	}
+	doctypes := allowedDoctypes(pset, q.Doctypes)
+	if len(doctypes) == 0 {
+		return []*Hit{}, nil
+	}
+	terms := make([]query.Query, len(doctypes))
+	for i, doctype := range doctypes {
+		term := bleve.NewTermQuery(doctype)
+		term.SetField("doctype")
+		terms[i] = term
+	}
+	qq := bleve.NewConjunctionQuery(
+		bleve.NewQueryStringQuery(q.Q),
+		bleve.NewDisjunctionQuery(terms...),
+	)
+
+	idx, release, err := getIndex(db)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	hits := []*Hit{}
+	skip := q.Skip
+	for from := 0; from < maxHits; from += batchSize {
+		req := bleve.NewSearchRequestOptions(qq, batchSize, from, false)
+		req.Fields = []string{"name", "path"}
+		res, err := idx.Search(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range res.Hits {
+			doctype, id := splitIndexKey(match.ID)
+			allowed, withPath := checkAccess(db, fs, pset, doctype, id)
+			if !allowed {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			hit := &Hit{DocType: doctype, DocID: id, Score: match.Score}
+			hit.Name, _ = match.Fields["name"].(string)
+			if withPath {
+				hit.Path, _ = match.Fields["path"].(string)
+			}
+			hits = append(hits, hit)
+			if len(hits) >= limit {
+				return hits, nil
+			}
+		}
+		if uint64(from+batchSize) >= res.Total {
+			break
+		}
+	}
+	return hits, nil
+}
+
+// allowedDoctypes returns the indexed doctypes, restricted to the requested
+// ones, on which the permissions have at least one rule for reading.
+func allowedDoctypes(pset permissions.Set, requested []string) []string {
+	var doctypes []string
+	for _, doctype := range Doctypes() {
+		if len(requested) > 0 && !contains(requested, doctype) {
+			continue
+		}
+		ok := pset.Some(func(r permissions.Rule) bool {
+			return r.Type == doctype && r.Verbs.Contains(permissions.GET)
+		})
+		if ok {
+			doctypes = append(doctypes, doctype)
+		}
+	}
+	return doctypes
+}
+
+// checkAccess returns true if the document can be read with the permissions.
+// For a file or a directory, it also tells if its path can be shown: the path
+// gives the names of the parent directories, so it is returned only if the
+// parent directory can be read too.
+func checkAccess(db prefixer.Prefixer, fs vfs.VFS, pset permissions.Set, doctype, id string) (allowed, withPath bool) {
+	if pset.AllowWholeType(permissions.GET, doctype) {
+		return true, true
+	}
+	if doctype == consts.Files {
+		dir, file, err := fs.DirOrFileByID(id)
+		if err != nil {
+			return false, false
+		}
+		var parentID string
+		if dir != nil {
+			allowed = vfs.Allows(fs, pset, permissions.GET, dir) == nil
+			parentID = dir.DirID
+		} else {
+			allowed = vfs.Allows(fs, pset, permissions.GET, file) == nil
+			parentID = file.DirID
+		}
+		if !allowed {
+			return false, false
+		}
+		parent, err := fs.DirByID(parentID)
+		if err != nil {
+			return true, false
+		}
+		return true, vfs.Allows(fs, pset, permissions.GET, parent) == nil
+	}
+	doc := couchdb.JSONDoc{Type: doctype}
+	if err := couchdb.GetDoc(db, doctype, id, &doc); err != nil {
+		return false, false
+	}
+	return pset.Allow(permissions.GET, doc), false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
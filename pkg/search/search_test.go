@@ -0,0 +1,185 @@
+package search
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+const notesDoctype = "io.cozy.notes"
+
+var db = prefixer.NewPrefixer("search.cozy.tools", "search-cozy-tools")
+
+func TestStringValues(t *testing.T) {
+	doc := map[string]interface{}{
+		"_id":   "123",
+		"title": "Groceries",
+		"items": []interface{}{"apples", 3, "pears"},
+		"meta":  map[string]interface{}{"author": "Alice", "_rev": "1-abc"},
+	}
+	values := stringValues(nil, doc)
+	assert.Equal(t, []string{"apples", "pears", "Alice", "Groceries"}, values)
+}
+
+func TestSplitIndexKey(t *testing.T) {
+	doctype, id := splitIndexKey(indexKey(consts.Files, "123/456"))
+	assert.Equal(t, consts.Files, doctype)
+	assert.Equal(t, "123/456", id)
+}
+
+func TestAllowedDoctypes(t *testing.T) {
+	pset := permissions.Set{
+		permissions.Rule{
+			Type:  notesDoctype,
+			Verbs: permissions.Verbs(permissions.GET),
+		},
+		permissions.Rule{
+			Type:  consts.Files,
+			Verbs: permissions.Verbs(permissions.POST),
+		},
+	}
+	assert.Equal(t, []string{notesDoctype}, allowedDoctypes(pset, nil))
+	assert.Empty(t, allowedDoctypes(pset, []string{consts.Files}))
+	assert.Empty(t, allowedDoctypes(pset, []string{"io.cozy.contacts"}))
+}
+
+func TestSearch(t *testing.T) {
+	defer DeleteIndex(db)
+	for id, content := range map[string]string{
+		"note1": "Buy some apples and pears",
+		"note2": "Call the plumber",
+		"note3": "Apples pie recipe",
+	} {
+		doc := &couchdb.JSONDoc{
+			Type: notesDoctype,
+			M:    map[string]interface{}{"_id": id, "content": content},
+		}
+		assert.NoError(t, IndexDoc(db, doc))
+	}
+
+	pset := permissions.Set{
+		permissions.Rule{
+			Type:  notesDoctype,
+			Verbs: permissions.Verbs(permissions.GET),
+		},
+	}
+	hits, err := Search(db, nil, pset, &Query{Q: "apples"})
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 2) {
+		ids := []string{hits[0].DocID, hits[1].DocID}
+		assert.Contains(t, ids, "note1")
+		assert.Contains(t, ids, "note3")
+		assert.Equal(t, notesDoctype, hits[0].DocType)
+	}
+
+	hits, err = Search(db, nil, pset, &Query{Q: "apples", Limit: 1, Skip: 1})
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+
+	assert.NoError(t, Delete(db, notesDoctype, "note1"))
+	hits, err = Search(db, nil, pset, &Query{Q: "apples"})
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 1) {
+		assert.Equal(t, "note3", hits[0].DocID)
+	}
+
+	// No permission on the doctype
+	hits, err = Search(db, nil, permissions.Set{}, &Query{Q: "plumber"})
+	assert.NoError(t, err)
+	assert.Empty(t, hits)
+
+	_, err = Search(db, nil, pset, &Query{Q: "  "})
+	assert.Equal(t, ErrInvalidQuery, err)
+}
+
+func TestIndexesLRU(t *testing.T) {
+	first := prefixer.NewPrefixer("lru0.cozy.tools", "lru0-cozy-tools")
+	defer DeleteIndex(first)
+	_, releaseFirst, err := getIndex(first)
+	assert.NoError(t, err)
+
+	// The first index is in use, it is not closed
+	for i := 1; i <= maxOpenIndexes; i++ {
+		other := prefixer.NewPrefixer("lru.cozy.tools", fmt.Sprintf("lru%d-cozy-tools", i))
+		_, release, err := getIndex(other)
+		assert.NoError(t, err)
+		release()
+		defer DeleteIndex(other)
+	}
+	indexesMu.Lock()
+	assert.Equal(t, maxOpenIndexes, lru.Len())
+	assert.Contains(t, indexes, first.DBPrefix())
+	assert.NotContains(t, indexes, "lru1-cozy-tools")
+	indexesMu.Unlock()
+
+	// When it is released, it can be closed
+	releaseFirst()
+	other := prefixer.NewPrefixer("lru.cozy.tools", "lru-last-cozy-tools")
+	defer DeleteIndex(other)
+	_, release, err := getIndex(other)
+	assert.NoError(t, err)
+	release()
+	indexesMu.Lock()
+	assert.Equal(t, maxOpenIndexes, lru.Len())
+	assert.NotContains(t, indexes, first.DBPrefix())
+	indexesMu.Unlock()
+}
+
+func TestIndexOnDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-search")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config.GetConfig().Search.Path = dir
+	defer func() { config.GetConfig().Search.Path = "" }()
+	disk := prefixer.NewPrefixer("disk.cozy.tools", "disk-cozy-tools")
+	defer DeleteIndex(disk)
+
+	// The index is closed after a write, so another process can open it
+	doc := &couchdb.JSONDoc{
+		Type: notesDoctype,
+		M:    map[string]interface{}{"_id": "note1", "content": "Buy some apples"},
+	}
+	assert.NoError(t, IndexDoc(disk, doc))
+	kvconfig := map[string]interface{}{"bolt_timeout": "1s"}
+	other, err := bleve.OpenUsing(indexPath(disk), kvconfig)
+	if assert.NoError(t, err) {
+		count, err := other.DocCount()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), count)
+		assert.NoError(t, other.Close())
+	}
+
+	// And after a query too
+	pset := permissions.Set{
+		permissions.Rule{
+			Type:  notesDoctype,
+			Verbs: permissions.Verbs(permissions.GET),
+		},
+	}
+	hits, err := Search(disk, nil, pset, &Query{Q: "apples"})
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+	other, err = bleve.OpenUsing(indexPath(disk), kvconfig)
+	if assert.NoError(t, err) {
+		assert.NoError(t, other.Close())
+	}
+	indexesMu.Lock()
+	assert.NotContains(t, indexes, disk.DBPrefix())
+	indexesMu.Unlock()
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	config.GetConfig().Search.Path = ""
+	config.GetConfig().Search.Doctypes = []string{notesDoctype}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,181 @@
+package sharing
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+)
+
+const (
+	// ActivityCreate is the action for a shared document created by a member
+	ActivityCreate = "create"
+	// ActivityUpdate is the action for a shared document modified by a member
+	ActivityUpdate = "update"
+	// ActivityDelete is the action for a shared document deleted by a member
+	ActivityDelete = "delete"
+)
+
+// defaultActivityLimit is the maximal number of activities returned by
+// GetActivities
+const defaultActivityLimit = 100
+
+// activityMaxAge is the duration after which the activities are removed
+const activityMaxAge = 90 * 24 * time.Hour
+
+// Activity is an entry of the activity log of a sharing: a change on a shared
+// document, sent by a member and applied on this cozy. On a recipient, all the
+// changes come from the owner, even if they were made by another recipient.
+type Activity struct {
+	AID  string `json:"_id,omitempty"`
+	ARev string `json:"_rev,omitempty"`
+
+	SharingID      string    `json:"sharing_id"`
+	MemberIndex    int       `json:"member_index"`
+	MemberName     string    `json:"member_name,omitempty"`
+	MemberInstance string    `json:"member_instance,omitempty"`
+	Action         string    `json:"action"`
+	DocumentType   string    `json:"doctype"`
+	DocumentID     string    `json:"document_id"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// ID returns the activity qualified identifier
+func (a *Activity) ID() string { return a.AID }
+
+// Rev returns the activity revision
+func (a *Activity) Rev() string { return a.ARev }
+
+// DocType returns the activity document type
+func (a *Activity) DocType() string { return consts.SharingsActivity }
+
+// SetID changes the activity qualified identifier
+func (a *Activity) SetID(id string) { a.AID = id }
+
+// SetRev changes the activity revision
+func (a *Activity) SetRev(rev string) { a.ARev = rev }
+
+// Clone implements couchdb.Doc
+func (a *Activity) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// Included is part of jsonapi.Object interface
+func (a *Activity) Included() []jsonapi.Object { return nil }
+
+// Relationships is part of jsonapi.Object interface
+func (a *Activity) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Links is part of jsonapi.Object interface
+func (a *Activity) Links() *jsonapi.LinksList { return nil }
+
+var _ jsonapi.Object = (*Activity)(nil)
+
+// newActivity returns an activity for a change made by the given member. It
+// returns nil if the member is unknown.
+func (s *Sharing) newActivity(m *Member, action, doctype, docID string) *Activity {
+	if m == nil {
+		return nil
+	}
+	index := -1
+	for i, member := range s.Members {
+		if *m == member {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	return &Activity{
+		SharingID:      s.SID,
+		MemberIndex:    index,
+		MemberName:     m.PrimaryName(),
+		MemberInstance: m.Instance,
+		Action:         action,
+		DocumentType:   doctype,
+		DocumentID:     docID,
+		CreatedAt:      time.Now().UTC(),
+	}
+}
+
+// recordActivities saves the activities in CouchDB, which also publishes them
+// on the realtime hub, and removes the old activities of their sharings. An
+// error is just logged, as the changes have already been applied.
+func recordActivities(inst *instance.Instance, activities []*Activity) {
+	docs := make([]couchdb.Doc, 0, len(activities))
+	sharings := make(map[string]struct{})
+	for _, a := range activities {
+		if a != nil {
+			docs = append(docs, a)
+			sharings[a.SharingID] = struct{}{}
+		}
+	}
+	log := inst.Logger().WithField("nspace", "sharing")
+	if err := couchdb.BulkCreateDocs(inst, consts.SharingsActivity, docs); err != nil {
+		log.Warnf("Cannot record %d activities: %s", len(docs), err)
+		return
+	}
+	for sharingID := range sharings {
+		if err := trimActivities(inst, sharingID); err != nil {
+			log.Warnf("Cannot remove the old activities of %s: %s", sharingID, err)
+		}
+	}
+}
+
+// trimActivities removes the activities of the sharing that are older than
+// activityMaxAge.
+func trimActivities(inst *instance.Instance, sharingID string) error {
+	var old []*Activity
+	req := &couchdb.FindRequest{
+		UseIndex: "by-sharing-id",
+		Selector: mango.And(
+			mango.Equal("sharing_id", sharingID),
+			mango.Lt("created_at", time.Now().UTC().Add(-activityMaxAge)),
+		),
+		Limit: 1000,
+	}
+	if err := couchdb.FindDocs(inst, consts.SharingsActivity, req, &old); err != nil {
+		return err
+	}
+	docs := make([]couchdb.Doc, len(old))
+	for i, a := range old {
+		docs[i] = a
+	}
+	return couchdb.BulkDeleteDocs(inst, consts.SharingsActivity, docs)
+}
+
+// recordActivity is the same as recordActivities for a single change.
+func (s *Sharing) recordActivity(inst *instance.Instance, m *Member, action, doctype, docID string) {
+	recordActivities(inst, []*Activity{s.newActivity(m, action, doctype, docID)})
+}
+
+// GetActivities returns the last activities of the sharing, the most recent
+// first.
+func (s *Sharing) GetActivities(inst *instance.Instance, limit int) ([]*Activity, error) {
+	if limit <= 0 || limit > defaultActivityLimit {
+		limit = defaultActivityLimit
+	}
+	var activities []*Activity
+	req := &couchdb.FindRequest{
+		UseIndex: "by-sharing-id",
+		Selector: mango.Equal("sharing_id", s.SID),
+		Sort: mango.SortBy{
+			{Field: "sharing_id", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Limit: limit,
+	}
+	err := couchdb.FindDocs(inst, consts.SharingsActivity, req, &activities)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return []*Activity{}, nil
+		}
+		return nil, err
+	}
+	return activities, nil
+}
@@ -0,0 +1,62 @@
+package sharing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewActivity(t *testing.T) {
+	s := Sharing{
+		SID:   "b8a3c1e0d5f24c6e9a7d0f3b2e1c4d5a",
+		Owner: true,
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice", Instance: "https://alice.example.net"},
+			{Status: MemberStatusReady, Email: "bob@example.net", Instance: "https://bob.example.net"},
+		},
+	}
+	a := s.newActivity(&s.Members[1], ActivityUpdate, consts.Files, "4a6a5a0e")
+	if assert.NotNil(t, a) {
+		assert.Equal(t, s.SID, a.SharingID)
+		assert.Equal(t, 1, a.MemberIndex)
+		assert.Equal(t, "bob@example.net", a.MemberName)
+		assert.Equal(t, "https://bob.example.net", a.MemberInstance)
+		assert.Equal(t, ActivityUpdate, a.Action)
+		assert.Equal(t, consts.Files, a.DocumentType)
+		assert.Equal(t, "4a6a5a0e", a.DocumentID)
+		assert.False(t, a.CreatedAt.IsZero())
+		assert.Equal(t, consts.SharingsActivity, a.DocType())
+	}
+
+	assert.Nil(t, s.newActivity(nil, ActivityCreate, "io.cozy.tests", "foo"))
+	other := Member{Status: MemberStatusReady, Email: "eve@example.net"}
+	assert.Nil(t, s.newActivity(&other, ActivityCreate, "io.cozy.tests", "foo"))
+}
+
+func TestRecordActivities(t *testing.T) {
+	s := Sharing{
+		SID:   "e4b2d1c0a9f84e7d8c6b5a4f3e2d1c0b",
+		Owner: true,
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice", Instance: "https://alice.example.net"},
+			{Status: MemberStatusReady, Email: "bob@example.net", Instance: "https://bob.example.net"},
+		},
+	}
+	old := s.newActivity(&s.Members[1], ActivityCreate, consts.Files, "old")
+	old.CreatedAt = time.Now().UTC().Add(-activityMaxAge - time.Hour)
+	recordActivities(inst, []*Activity{old, nil})
+	assert.NotEmpty(t, old.ID())
+
+	recent := s.newActivity(&s.Members[1], ActivityUpdate, consts.Files, "recent")
+	recordActivities(inst, []*Activity{recent})
+	assert.NotEmpty(t, recent.ID())
+
+	activities, err := s.GetActivities(inst, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, activities, 1) {
+		assert.Equal(t, recent.ID(), activities[0].ID())
+		assert.Equal(t, ActivityUpdate, activities[0].Action)
+	}
+}
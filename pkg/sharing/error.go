@@ -43,4 +43,10 @@ var (
 	ErrFolderNotFound = errors.New("This folder was not found")
 	// ErrSafety is used when an operation is aborted due to the safery principal
 	ErrSafety = errors.New("Operation aborted")
+	// ErrReadOnlyMember is used when a member with the viewer role tries to
+	// send changes on the shared documents
+	ErrReadOnlyMember = errors.New("The member can't change the shared documents")
+	// ErrInvalidRole is used when the role given to a member is unknown, or
+	// not allowed by the rules of the sharing
+	ErrInvalidRole = errors.New("The role is invalid for this member")
 )
@@ -359,9 +359,14 @@ func (s *Sharing) GetFolder(inst *instance.Instance, m *Member, xoredID string)
 }
 
 // ApplyBulkFiles takes a list of documents for the io.cozy.files doctype and
-// will apply changes to the VFS according to those documents.
-func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
+// will apply changes to the VFS according to those documents, if the member
+// who has sent them is allowed to write.
+func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, m *Member, docs DocsList) error {
+	if err := s.CheckWriteAccess(m); err != nil {
+		return err
+	}
 	var errm error
+	var activities []*Activity
 	fs := inst.VFS()
 
 	for _, target := range docs {
@@ -396,6 +401,7 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 			errm = multierror.Append(errm, err)
 			continue
 		}
+		var action string
 		if _, ok := target["_deleted"]; ok {
 			if ref == nil || infos.Removed {
 				continue
@@ -408,23 +414,29 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 			} else {
 				err = s.TrashFile(inst, file, &s.Rules[infos.Rule])
 			}
+			action = ActivityDelete
 		} else if file != nil {
 			err = multierror.Append(errm, ErrSafety)
 		} else if ref != nil && infos.Removed {
 			continue
 		} else if dir == nil {
 			err = s.CreateDir(inst, target)
+			action = ActivityCreate
 		} else if ref == nil {
 			err = multierror.Append(errm, ErrSafety)
 		} else {
 			err = s.UpdateDir(inst, target, dir, ref)
+			action = ActivityUpdate
 		}
 		if err != nil {
 			inst.Logger().WithField("nspace", "replicator").
 				Debugf("Error on apply bulk file: %s (%#v - %#v)", err, target, ref)
 			errm = multierror.Append(errm, err)
+		} else if action != "" {
+			activities = append(activities, s.newActivity(m, action, consts.Files, id))
 		}
 	}
+	recordActivities(inst, activities)
 
 	if errm != nil {
 		inst.Logger().WithField("nspace", "replicator").
@@ -0,0 +1,163 @@
+package sharing
+
+import (
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/contacts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// Group is a group of contacts (io.cozy.contacts.groups) used as a recipient
+// of a sharing: the contacts of the group are members of the sharing, and the
+// contacts added to or removed from the group later join or leave it.
+type Group struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// GroupsMessage is used for jobs on the share-groups worker
+type GroupsMessage struct {
+	SharingID string `json:"sharing_id"`
+}
+
+// ContactEvent is the event sent to the share-groups worker when a contact is
+// created, updated or deleted
+type ContactEvent struct {
+	Verb   string            `json:"verb"`
+	Doc    contacts.Contact  `json:"doc"`
+	OldDoc *contacts.Contact `json:"old,omitempty"`
+}
+
+// AddGroup adds the group of contacts with the given identifier, and its
+// contacts as members. The contacts without an email address are skipped, as
+// they can't be invited.
+func (s *Sharing) AddGroup(inst *instance.Instance, groupID string, readOnly bool) error {
+	for _, g := range s.Groups {
+		if g.ID == groupID {
+			return nil
+		}
+	}
+	group, err := contacts.FindGroup(inst, groupID)
+	if err != nil {
+		return err
+	}
+	s.Groups = append(s.Groups, Group{
+		ID:       group.ID(),
+		Name:     group.Name,
+		ReadOnly: readOnly,
+	})
+
+	list, err := contacts.FindByGroup(inst, groupID)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	for _, c := range list {
+		if s.findMemberForContact(c) != nil {
+			continue
+		}
+		if err = s.addContact(c, readOnly, true); err != nil && err != contacts.ErrNoMailAddress {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddGroupsTrigger creates the share-groups trigger for this sharing: it
+// will add or revoke the members when the contacts are added to or removed
+// from the groups of the sharing.
+func (s *Sharing) AddGroupsTrigger(inst *instance.Instance) error {
+	if s.Triggers.GroupsID != "" || len(s.Groups) == 0 {
+		return nil
+	}
+	msg := &GroupsMessage{SharingID: s.SID}
+	args := consts.Contacts + ":CREATED,UPDATED,DELETED"
+	t, err := jobs.NewTrigger(inst, jobs.TriggerInfos{
+		Type:       "@event",
+		WorkerType: "share-groups",
+		Arguments:  args,
+	}, msg)
+	if err != nil {
+		return err
+	}
+	if err = jobs.System().AddTrigger(t); err != nil {
+		return err
+	}
+	s.Triggers.GroupsID = t.ID()
+	return couchdb.UpdateDoc(inst, s)
+}
+
+// groupsOf returns true if the contact is in at least one group of the
+// sharing, and if it is only in read-only groups.
+func (s *Sharing) groupsOf(c *contacts.Contact) (in bool, readOnly bool) {
+	readOnly = true
+	for _, g := range s.Groups {
+		if c.InGroup(g.ID) {
+			in = true
+			readOnly = readOnly && g.ReadOnly
+		}
+	}
+	return in, in && readOnly
+}
+
+// ApplyContactChange is called on the owner's cozy when a contact is
+// modified. If the contact has joined the groups of the sharing, it is
+// invited as a new member. If it has left them, and it was a member only for
+// them, the member is revoked.
+func (s *Sharing) ApplyContactChange(inst *instance.Instance, evt *ContactEvent) error {
+	if !s.Owner || !s.Active || len(s.Groups) == 0 {
+		return nil
+	}
+
+	isIn, readOnly := false, false
+	if evt.Verb != realtime.EventDelete {
+		isIn, readOnly = s.groupsOf(&evt.Doc)
+	}
+	wasIn := false
+	if evt.OldDoc != nil {
+		wasIn, _ = s.groupsOf(evt.OldDoc)
+	}
+
+	// A contact already in the groups is not invited again, even if it has
+	// left the sharing
+	if isIn && !wasIn {
+		if s.findMemberForContact(&evt.Doc) != nil {
+			return nil
+		}
+		if err := s.addContact(&evt.Doc, readOnly, true); err != nil {
+			if err == contacts.ErrNoMailAddress {
+				return nil
+			}
+			return err
+		}
+		var codes map[string]string
+		if s.PreviewPath != "" {
+			var err error
+			if codes, err = s.CreatePreviewPermissions(inst); err != nil {
+				return err
+			}
+		}
+		if err := s.SendMails(inst, codes); err != nil {
+			return err
+		}
+		cloned := s.Clone().(*Sharing)
+		go cloned.NotifyRecipients(inst, nil)
+		return nil
+	}
+
+	if isIn || !wasIn {
+		return nil
+	}
+	for i := range s.Members {
+		m := &s.Members[i]
+		if i > 0 && m.Status != MemberStatusRevoked && evt.OldDoc.HasEmail(m.Email) {
+			if !m.OnlyInGroups {
+				return nil
+			}
+			return s.RevokeRecipient(inst, i)
+		}
+	}
+	return nil
+}
@@ -126,6 +126,14 @@ func (s *sharingIndexer) DiskUsage() (int64, error) {
 	return s.indexer.DiskUsage()
 }
 
+func (s *sharingIndexer) DirSizes() ([]*vfs.DirSize, error) {
+	return s.indexer.DirSizes()
+}
+
+func (s *sharingIndexer) UpdateDirSizes(oldpath string, oldsize int64, newpath string, newsize int64) error {
+	return s.indexer.UpdateDirSizes(oldpath, oldsize, newpath, newsize)
+}
+
 func (s *sharingIndexer) CreateFileDoc(doc *vfs.FileDoc) error {
 	return ErrInternalServerError
 }
@@ -141,7 +149,14 @@ func (s *sharingIndexer) CreateNamedFileDoc(doc *vfs.FileDoc) error {
 	stash := s.StashRevision(true)
 	err := s.bulkForceUpdateDoc(doc)
 	s.UnstashRevision(stash)
-	return err
+	if err != nil {
+		return err
+	}
+	fullpath, err := doc.Path(s)
+	if err != nil {
+		return err
+	}
+	return s.indexer.UpdateDirSizes("", 0, fullpath, doc.ByteSize)
 }
 
 func (s *sharingIndexer) UpdateFileDoc(olddoc, doc *vfs.FileDoc) error {
@@ -160,18 +175,20 @@ func (s *sharingIndexer) UpdateFileDoc(olddoc, doc *vfs.FileDoc) error {
 	}
 
 	// Ensure that fullpath is filled because it's used in realtime/@events
-	if _, err := doc.Path(s); err != nil {
+	newpath, err := doc.Path(s)
+	if err != nil {
 		return err
 	}
 	if olddoc != nil {
-		if _, err := olddoc.Path(s); err != nil {
+		oldpath, err := olddoc.Path(s)
+		if err != nil {
 			return err
 		}
 		couchdb.RTEvent(s.db, realtime.EventUpdate, doc, olddoc)
-	} else {
-		couchdb.RTEvent(s.db, realtime.EventUpdate, doc, nil)
+		return s.indexer.UpdateDirSizes(oldpath, olddoc.ByteSize, newpath, doc.ByteSize)
 	}
-	return nil
+	couchdb.RTEvent(s.db, realtime.EventUpdate, doc, nil)
+	return s.indexer.UpdateDirSizes("", 0, newpath, doc.ByteSize)
 }
 
 func (s *sharingIndexer) bulkForceUpdateDoc(doc *vfs.FileDoc) error {
@@ -258,7 +275,7 @@ func (s *sharingIndexer) DeleteDirDoc(doc *vfs.DirDoc) error {
 	return ErrInternalServerError
 }
 
-func (s *sharingIndexer) DeleteDirDocAndContent(doc *vfs.DirDoc, onlyContent bool) (n int64, ids []string, err error) {
+func (s *sharingIndexer) DeleteDirDocAndContent(doc *vfs.DirDoc, onlyContent bool) (n int64, files []*vfs.FileDoc, err error) {
 	return 0, nil, ErrInternalServerError
 }
 
@@ -318,4 +335,36 @@ func (s *sharingIndexer) CheckIndexIntegrity() ([]*vfs.FsckLog, error) {
 	return nil, ErrInternalServerError
 }
 
+func (s *sharingIndexer) CreateVersion(v *vfs.Version) error {
+	return s.indexer.CreateVersion(v)
+}
+
+func (s *sharingIndexer) DeleteVersion(v *vfs.Version) error {
+	return s.indexer.DeleteVersion(v)
+}
+
+func (s *sharingIndexer) AllVersions(fileID string) ([]*vfs.Version, error) {
+	return s.indexer.AllVersions(fileID)
+}
+
+func (s *sharingIndexer) VersionByNumber(fileID string, number int) (*vfs.Version, error) {
+	return s.indexer.VersionByNumber(fileID, number)
+}
+
+func (s *sharingIndexer) AddBlobRef(md5sum, sha256sum []byte, size int64) (bool, error) {
+	return s.indexer.AddBlobRef(md5sum, sha256sum, size)
+}
+
+func (s *sharingIndexer) RemoveBlobRef(md5sum []byte) (bool, error) {
+	return s.indexer.RemoveBlobRef(md5sum)
+}
+
+func (s *sharingIndexer) SetBlobRefs(blob *vfs.Blob) error {
+	return s.indexer.SetBlobRefs(blob)
+}
+
+func (s *sharingIndexer) CheckBlobsIntegrity(stored map[string]int64) ([]*vfs.FsckLog, error) {
+	return nil, ErrInternalServerError
+}
+
 var _ vfs.Indexer = (*sharingIndexer)(nil)
@@ -33,6 +33,17 @@ const (
 	MemberStatusRevoked = "revoked"
 )
 
+const (
+	// MemberRoleOwner is the role of the member that has created the sharing
+	MemberRoleOwner = "owner"
+	// MemberRoleEditor is the role of a recipient whose changes on the shared
+	// documents are sent to the other members
+	MemberRoleEditor = "editor"
+	// MemberRoleViewer is the role of a recipient that can only receive the
+	// changes made by the other members
+	MemberRoleViewer = "viewer"
+)
+
 // Member contains the information about a recipient (or the sharer) for a sharing
 type Member struct {
 	Status     string `json:"status"`
@@ -40,6 +51,11 @@ type Member struct {
 	PublicName string `json:"public_name,omitempty"`
 	Email      string `json:"email"`
 	Instance   string `json:"instance,omitempty"`
+	Role       string `json:"role,omitempty"`
+
+	// OnlyInGroups is true for a member that has been added to the sharing
+	// because it is in a group of contacts, and not for itself
+	OnlyInGroups bool `json:"only_in_groups,omitempty"`
 }
 
 // PrimaryName returns the main name of this member
@@ -71,21 +87,39 @@ type Credentials struct {
 	InboundClientID string `json:"inbound_client_id,omitempty"`
 }
 
-// AddContact adds the contact with the given identifier
-func (s *Sharing) AddContact(inst *instance.Instance, contactID string) error {
+// AddContact adds the contact with the given identifier. The new member is
+// a viewer if readOnly is true or if the rules of the sharing don't allow the
+// recipients to send their changes, and an editor else.
+func (s *Sharing) AddContact(inst *instance.Instance, contactID string, readOnly bool) error {
 	c, err := contacts.Find(inst, contactID)
 	if err != nil {
 		return err
 	}
+	// A contact already added with a group is now a member for itself
+	if m := s.findMemberForContact(c); m != nil && m.OnlyInGroups {
+		m.OnlyInGroups = false
+		return nil
+	}
+	return s.addContact(c, readOnly, false)
+}
+
+// addContact adds the contact as a new member. onlyInGroups is true when the
+// contact is added because it is in a group of contacts of the sharing.
+func (s *Sharing) addContact(c *contacts.Contact, readOnly, onlyInGroups bool) error {
 	addr, err := c.ToMailAddress()
 	if err != nil {
 		return err
 	}
 	m := Member{
-		Status:   MemberStatusMailNotSent,
-		Name:     addr.Name,
-		Email:    addr.Email,
-		Instance: c.PrimaryCozyURL(),
+		Status:       MemberStatusMailNotSent,
+		Name:         addr.Name,
+		Email:        addr.Email,
+		Instance:     c.PrimaryCozyURL(),
+		Role:         MemberRoleEditor,
+		OnlyInGroups: onlyInGroups,
+	}
+	if readOnly || s.ReadOnly() {
+		m.Role = MemberRoleViewer
 	}
 	s.Members = append(s.Members, m)
 	state := crypto.Base64Encode(crypto.GenerateRandomBytes(StateLen))
@@ -97,8 +131,78 @@ func (s *Sharing) AddContact(inst *instance.Instance, contactID string) error {
 	return nil
 }
 
+// MemberRole returns the role of the given member. For the members added
+// before the roles, it is deduced from the rules of the sharing.
+func (s *Sharing) MemberRole(m *Member) string {
+	if m.Status == MemberStatusOwner || (len(s.Members) > 0 && m == &s.Members[0]) {
+		return MemberRoleOwner
+	}
+	if m.Role != "" {
+		return m.Role
+	}
+	if s.ReadOnly() {
+		return MemberRoleViewer
+	}
+	return MemberRoleEditor
+}
+
+// CheckWriteAccess returns an error if the given member is not allowed to
+// send changes on the shared documents to this cozy. On a recipient, the
+// changes can only come from the owner, who can always write.
+func (s *Sharing) CheckWriteAccess(m *Member) error {
+	if !s.Owner {
+		return nil
+	}
+	if m == nil || s.MemberRole(m) == MemberRoleViewer {
+		return ErrReadOnlyMember
+	}
+	return nil
+}
+
+// ReadOnlyRecipient returns true if this cozy is a recipient of the sharing
+// that must not send its changes to the owner.
+func (s *Sharing) ReadOnlyRecipient() bool {
+	if s.Owner {
+		return false
+	}
+	if s.ReadOnly() {
+		return true
+	}
+	// The instance URL of the members is private, except for the owner and
+	// the recipient of this cozy
+	for i, m := range s.Members {
+		if i > 0 && m.Instance != "" {
+			return s.MemberRole(&s.Members[i]) == MemberRoleViewer
+		}
+	}
+	return false
+}
+
+// SetMemberRole is used by the owner to promote or demote a recipient. The
+// change must then be sent to the other members with NotifyRecipients.
+func (s *Sharing) SetMemberRole(inst *instance.Instance, index int, role string) error {
+	if !s.Owner {
+		return ErrInvalidSharing
+	}
+	if index <= 0 || index >= len(s.Members) {
+		return ErrMemberNotFound
+	}
+	switch role {
+	case MemberRoleViewer:
+	case MemberRoleEditor:
+		if s.ReadOnly() {
+			return ErrInvalidRole
+		}
+	default:
+		return ErrInvalidRole
+	}
+	s.Members[index].Role = role
+	return couchdb.UpdateDoc(inst, s)
+}
+
 // UpdateRecipients updates the list of recipients
 func (s *Sharing) UpdateRecipients(inst *instance.Instance, members []Member) error {
+	wasReadOnly := s.ReadOnlyRecipient()
 	for i, m := range members {
 		if i >= len(s.Members) {
 			s.Members = append(s.Members, Member{})
@@ -111,8 +215,33 @@ func (s *Sharing) UpdateRecipients(inst *instance.Instance, members []Member) er
 		s.Members[i].Email = m.Email
 		s.Members[i].PublicName = m.PublicName
 		s.Members[i].Status = m.Status
+		s.Members[i].Role = m.Role
 	}
-	return couchdb.UpdateDoc(inst, s)
+	if err := couchdb.UpdateDoc(inst, s); err != nil {
+		return err
+	}
+
+	// The triggers for sending the changes to the owner are added or removed
+	// when the recipient of this cozy has been promoted or demoted
+	if s.Owner || !s.Active || s.ReadOnlyRecipient() == wasReadOnly {
+		return nil
+	}
+	if wasReadOnly {
+		return s.SetupReceiver(inst)
+	}
+	return s.RemoveReplicateTriggers(inst)
+}
+
+// findMemberForContact returns the recipient, not revoked, for the given
+// contact, or nil if the contact is not a member of the sharing.
+func (s *Sharing) findMemberForContact(c *contacts.Contact) *Member {
+	for i := range s.Members {
+		m := &s.Members[i]
+		if i > 0 && m.Status != MemberStatusRevoked && c.HasEmail(m.Email) {
+			return m
+		}
+	}
+	return nil
 }
 
 // FindMemberByState returns the member that is linked to the sharing by
@@ -160,6 +289,12 @@ func (s *Sharing) FindMemberBySharecode(db prefixer.Prefixer, sharecode string)
 // FindMemberByInboundClientID returns the member that have used this client
 // ID to make a request on the given sharing
 func (s *Sharing) FindMemberByInboundClientID(clientID string) (*Member, error) {
+	if !s.Owner {
+		if len(s.Credentials) > 0 && s.Credentials[0].InboundClientID == clientID {
+			return &s.Members[0], nil
+		}
+		return nil, ErrMemberNotFound
+	}
 	for i, c := range s.Credentials {
 		if c.InboundClientID == clientID {
 			return &s.Members[i+1], nil
@@ -327,6 +462,7 @@ func (s *Sharing) NotifyRecipients(inst *instance.Instance, except *Member) {
 			Status:     m.Status,
 			PublicName: m.PublicName,
 			Email:      m.Email,
+			Role:       s.MemberRole(&s.Members[i]),
 			// Instance and name are private
 		}
 	}
@@ -0,0 +1,139 @@
+package sharing
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/contacts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemberRole(t *testing.T) {
+	s := Sharing{
+		Owner: true,
+		Rules: []Rule{
+			{
+				Title:   "sync rule",
+				DocType: "io.cozy.tests",
+				Values:  []string{"foo"},
+				Add:     "sync",
+				Update:  "sync",
+				Remove:  "sync",
+			},
+		},
+		Members: []Member{
+			{Status: MemberStatusOwner},
+			{Status: MemberStatusReady, Role: MemberRoleViewer},
+			{Status: MemberStatusReady, Role: MemberRoleEditor},
+			{Status: MemberStatusReady},
+		},
+	}
+	assert.Equal(t, MemberRoleOwner, s.MemberRole(&s.Members[0]))
+	assert.Equal(t, MemberRoleViewer, s.MemberRole(&s.Members[1]))
+	assert.Equal(t, MemberRoleEditor, s.MemberRole(&s.Members[2]))
+	assert.Equal(t, MemberRoleEditor, s.MemberRole(&s.Members[3]))
+
+	assert.Equal(t, ErrReadOnlyMember, s.CheckWriteAccess(&s.Members[1]))
+	assert.NoError(t, s.CheckWriteAccess(&s.Members[2]))
+	assert.NoError(t, s.CheckWriteAccess(&s.Members[3]))
+	assert.Equal(t, ErrReadOnlyMember, s.CheckWriteAccess(nil))
+
+	assert.Equal(t, ErrMemberNotFound, s.SetMemberRole(nil, 0, MemberRoleViewer))
+	assert.Equal(t, ErrMemberNotFound, s.SetMemberRole(nil, 4, MemberRoleViewer))
+	assert.Equal(t, ErrInvalidRole, s.SetMemberRole(nil, 1, MemberRoleOwner))
+
+	// Without a sync rule, the recipients can't be editors by default
+	s.Rules[0].Update = "push"
+	s.Rules[0].Remove = "push"
+	s.Rules[0].Add = "push"
+	assert.Equal(t, MemberRoleViewer, s.MemberRole(&s.Members[3]))
+	assert.Equal(t, ErrReadOnlyMember, s.CheckWriteAccess(&s.Members[3]))
+	assert.Equal(t, ErrInvalidRole, s.SetMemberRole(nil, 1, MemberRoleEditor))
+}
+
+func TestReadOnlyRecipient(t *testing.T) {
+	s := Sharing{
+		Rules: []Rule{
+			{
+				Title:   "sync rule",
+				DocType: "io.cozy.tests",
+				Values:  []string{"foo"},
+				Add:     "sync",
+				Update:  "sync",
+				Remove:  "sync",
+			},
+		},
+		Members: []Member{
+			{Status: MemberStatusOwner, Instance: "https://alice.example.net"},
+			{Status: MemberStatusReady, Role: MemberRoleEditor},
+			{Status: MemberStatusReady, Role: MemberRoleViewer, Instance: "https://bob.example.net"},
+		},
+	}
+	assert.True(t, s.ReadOnlyRecipient())
+	assert.NoError(t, s.CheckWriteAccess(&s.Members[0]))
+
+	s.Members[2].Role = MemberRoleEditor
+	assert.False(t, s.ReadOnlyRecipient())
+
+	s.Owner = true
+	s.Members[2].Role = MemberRoleViewer
+	assert.False(t, s.ReadOnlyRecipient())
+}
+
+func TestMembersFromGroups(t *testing.T) {
+	s := Sharing{
+		Owner: true,
+		Rules: []Rule{
+			{
+				Title:   "sync rule",
+				DocType: "io.cozy.tests",
+				Values:  []string{"foo"},
+				Add:     "sync",
+				Update:  "sync",
+				Remove:  "sync",
+			},
+		},
+		Members: []Member{
+			{Status: MemberStatusOwner},
+			{Status: MemberStatusRevoked, Email: "bob@example.net"},
+		},
+		Credentials: []Credentials{{}},
+		Groups: []Group{
+			{ID: "family", Name: "Family"},
+			{ID: "friends", Name: "Friends", ReadOnly: true},
+		},
+	}
+	bob := &contacts.Contact{
+		FullName: "Bob",
+		Email:    []contacts.Email{{Address: "bob@example.net"}},
+		Relationships: &contacts.Relationships{
+			Groups: contacts.GroupsRelationship{
+				Data: []contacts.GroupRef{{ID: "friends", Type: "io.cozy.contacts.groups"}},
+			},
+		},
+	}
+	in, readOnly := s.groupsOf(bob)
+	assert.True(t, in)
+	assert.True(t, readOnly)
+
+	// A revoked member is not the member for this contact
+	assert.Nil(t, s.findMemberForContact(bob))
+	assert.NoError(t, s.addContact(bob, readOnly, true))
+	m := s.findMemberForContact(bob)
+	if assert.NotNil(t, m) {
+		assert.True(t, m.OnlyInGroups)
+		assert.Equal(t, MemberRoleViewer, m.Role)
+		assert.Equal(t, &s.Members[2], m)
+	}
+	assert.Len(t, s.Credentials, 2)
+
+	bob.Relationships.Groups.Data = append(bob.Relationships.Groups.Data,
+		contacts.GroupRef{ID: "family", Type: "io.cozy.contacts.groups"})
+	in, readOnly = s.groupsOf(bob)
+	assert.True(t, in)
+	assert.False(t, readOnly)
+
+	bob.Relationships = nil
+	in, readOnly = s.groupsOf(bob)
+	assert.False(t, in)
+	assert.False(t, readOnly)
+}
@@ -0,0 +1,214 @@
+package sharing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+// docConflict is a conflict between the local version of a shared document
+// (not a file or folder), and the version sent by another member.
+type docConflict struct {
+	local    map[string]interface{}
+	incoming map[string]interface{}
+	// chain is the chain of revisions of the incoming version
+	chain []string
+	// base is the last common ancestor of the two versions, or nil if it is
+	// no longer available
+	base map[string]interface{}
+}
+
+// docResolution is the result of the resolution of a conflict on a shared
+// document. doc is the document to write on top of the local revision, with
+// chain for its revisions, or nil if the local version is kept. copy is the
+// version that has lost the conflict, with a new identifier, for the
+// conflict-copy strategy.
+type docResolution struct {
+	doc   map[string]interface{}
+	chain []string
+	copy  map[string]interface{}
+}
+
+// resolveDocConflict resolves a conflict with the given merge strategy. The
+// members on both sides of the conflict make the same choices, and the one
+// that doesn't keep its local version writes the result on top of it, so that
+// they converge to the same content.
+func resolveDocConflict(strategy string, c *docConflict) docResolution {
+	localRev, _ := c.local["_rev"].(string)
+	incomingWins := detectConflict(localRev, c.chain) == WonConflict
+	if sameContent(c.local, c.incoming) {
+		// Only one side should write a new revision to reconciliate the
+		// revisions, and the revisions are enough to choose it
+		if incomingWins {
+			return c.writeOnTop(c.incoming)
+		}
+		return docResolution{}
+	}
+
+	var res docResolution
+	var content map[string]interface{}
+	switch strategy {
+	case MergeConflictCopy:
+		if incomingWins {
+			content = c.incoming
+			res.copy = conflictCopy(c.local)
+		} else {
+			content = c.local
+			res.copy = conflictCopy(c.incoming)
+		}
+	case MergeThreeWay:
+		content = threeWayMerge(c.base, c.local, c.incoming, c.lastWriterIsIncoming(incomingWins))
+	default:
+		if c.lastWriterIsIncoming(incomingWins) {
+			content = c.incoming
+		} else {
+			content = c.local
+		}
+	}
+
+	if !sameContent(content, c.local) {
+		written := c.writeOnTop(content)
+		res.doc = written.doc
+		res.chain = written.chain
+	}
+	return res
+}
+
+// lastWriterIsIncoming returns true if the incoming version has been modified
+// after the local version. When the dates are missing or equal, the choice is
+// made with the revisions.
+func (c *docConflict) lastWriterIsIncoming(incomingWins bool) bool {
+	local, okl := updatedAt(c.local)
+	incoming, oki := updatedAt(c.incoming)
+	if !okl || !oki || local.Equal(incoming) {
+		return incomingWins
+	}
+	return incoming.After(local)
+}
+
+// writeOnTop returns the resolution where the given content is written as a
+// child of the local revision. The incoming revision is reused when it is
+// possible, else a new revision is generated.
+func (c *docConflict) writeOnTop(content map[string]interface{}) docResolution {
+	localRev, _ := c.local["_rev"].(string)
+	incomingRev, _ := c.incoming["_rev"].(string)
+	if sameContent(content, c.incoming) && RevGeneration(incomingRev) > RevGeneration(localRev) {
+		chain := MixupChainToResolveConflict(localRev, c.chain)
+		if len(chain) > 1 {
+			doc := cloneDocContent(c.incoming)
+			doc["_id"] = c.local["_id"]
+			doc["_rev"] = incomingRev
+			doc["_revisions"] = revsChainToStruct(chain)
+			return docResolution{doc: doc, chain: chain}
+		}
+	}
+
+	generated := hex.EncodeToString(crypto.GenerateRandomBytes(16))
+	rev := fmt.Sprintf("%d-%s", RevGeneration(localRev)+1, generated)
+	chain := []string{localRev, rev}
+	doc := cloneDocContent(content)
+	doc["_id"] = c.local["_id"]
+	doc["_rev"] = rev
+	doc["_revisions"] = revsChainToStruct(chain)
+	return docResolution{doc: doc, chain: chain}
+}
+
+// threeWayMerge merges the fields of the local and incoming versions of a
+// document. A field modified on only one side since the base takes the value
+// from this side, and a field modified on both sides takes the value from the
+// last writer. Without a base, all the fields that differ are seen as modified
+// on both sides.
+func threeWayMerge(base, local, incoming map[string]interface{}, incomingIsLastWriter bool) map[string]interface{} {
+	merged := make(map[string]interface{})
+	keys := make(map[string]struct{})
+	for _, doc := range []map[string]interface{}{base, local, incoming} {
+		for k := range doc {
+			if !strings.HasPrefix(k, "_") {
+				keys[k] = struct{}{}
+			}
+		}
+	}
+	for k := range keys {
+		lv, lok := local[k]
+		iv, iok := incoming[k]
+		var from map[string]interface{}
+		switch {
+		case lok == iok && reflect.DeepEqual(lv, iv):
+			from = local
+		case base != nil && sameField(base, local, k):
+			from = incoming
+		case base != nil && sameField(base, incoming, k):
+			from = local
+		case incomingIsLastWriter:
+			from = incoming
+		default:
+			from = local
+		}
+		if v, ok := from[k]; ok {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func sameField(a, b map[string]interface{}, key string) bool {
+	va, oka := a[key]
+	vb, okb := b[key]
+	return oka == okb && reflect.DeepEqual(va, vb)
+}
+
+// sameContent returns true if the two documents have the same fields, except
+// the special fields of CouchDB (_id, _rev, etc.)
+func sameContent(a, b map[string]interface{}) bool {
+	return reflect.DeepEqual(cloneDocContent(a), cloneDocContent(b))
+}
+
+// cloneDocContent returns a shallow copy of the document, without the special
+// fields of CouchDB
+func cloneDocContent(doc map[string]interface{}) map[string]interface{} {
+	cloned := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if !strings.HasPrefix(k, "_") {
+			cloned[k] = v
+		}
+	}
+	return cloned
+}
+
+// conflictCopy returns a copy of a document that has lost a conflict. The
+// identifier of the copy is derived from the revision, and the copy keeps the
+// same revision, so that all the members create the same document.
+func conflictCopy(doc map[string]interface{}) map[string]interface{} {
+	id, _ := doc["_id"].(string)
+	rev, _ := doc["_rev"].(string)
+	cp := cloneDocContent(doc)
+	cp["_id"] = conflictID(id, rev)
+	cp["_rev"] = rev
+	cp["_revisions"] = revsChainToStruct([]string{rev})
+	return cp
+}
+
+// updatedAt returns the date of the last modification of a document, from its
+// cozyMetadata or its updated_at field.
+func updatedAt(doc map[string]interface{}) (time.Time, bool) {
+	var date interface{}
+	if meta, ok := doc["cozyMetadata"].(map[string]interface{}); ok {
+		date = meta["updatedAt"]
+	}
+	if date == nil {
+		date = doc["updated_at"]
+	}
+	str, ok := date.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,163 @@
+package sharing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func conflictingDocs() *docConflict {
+	base := map[string]interface{}{
+		"_id":   "4a6a5a0ec3c9d5b5b2ae8e0a1b9c1f20",
+		"_rev":  "2-bbb",
+		"title": "Groceries",
+		"items": []interface{}{"milk"},
+		"color": "blue",
+	}
+	local := map[string]interface{}{
+		"_id":   "4a6a5a0ec3c9d5b5b2ae8e0a1b9c1f20",
+		"_rev":  "3-ccc",
+		"title": "Groceries for the week",
+		"items": []interface{}{"milk", "eggs"},
+		"color": "blue",
+		"cozyMetadata": map[string]interface{}{
+			"updatedAt": "2018-05-04T10:00:00Z",
+		},
+	}
+	incoming := map[string]interface{}{
+		"_id":   "4a6a5a0ec3c9d5b5b2ae8e0a1b9c1f20",
+		"_rev":  "3-ddd",
+		"title": "Groceries",
+		"items": []interface{}{"milk", "bread"},
+		"color": "red",
+		"cozyMetadata": map[string]interface{}{
+			"updatedAt": "2018-05-04T11:00:00Z",
+		},
+	}
+	return &docConflict{
+		local:    local,
+		incoming: incoming,
+		chain:    []string{"1-aaa", "2-bbb", "3-ddd"},
+		base:     base,
+	}
+}
+
+func TestResolveDocConflictSameContent(t *testing.T) {
+	c := conflictingDocs()
+	c.local = cloneDocContent(c.incoming)
+	c.local["_id"] = c.incoming["_id"]
+	c.local["_rev"] = "3-ccc"
+
+	// 3-ddd > 3-ccc: the incoming version wins, and a new revision is
+	// created to reconciliate the revisions
+	res := resolveDocConflict(MergeConflictCopy, c)
+	assert.Nil(t, res.copy)
+	if assert.NotNil(t, res.doc) {
+		assert.Equal(t, "3-ccc", res.chain[0])
+		assert.Equal(t, 4, RevGeneration(res.chain[1]))
+		assert.Equal(t, res.chain[1], res.doc["_rev"])
+		assert.True(t, sameContent(c.incoming, res.doc))
+	}
+
+	// On the other side, the local version is kept
+	c.local["_rev"] = "3-eee"
+	res = resolveDocConflict(MergeConflictCopy, c)
+	assert.Nil(t, res.doc)
+	assert.Nil(t, res.copy)
+}
+
+func TestResolveDocConflictLastWriterWins(t *testing.T) {
+	c := conflictingDocs()
+	res := resolveDocConflict(MergeLastWriterWins, c)
+	assert.Nil(t, res.copy)
+	if assert.NotNil(t, res.doc) {
+		assert.Equal(t, "red", res.doc["color"])
+		assert.Equal(t, "Groceries", res.doc["title"])
+		assert.Equal(t, "3-ccc", res.chain[0])
+		assert.Equal(t, c.local["_id"], res.doc["_id"])
+	}
+
+	// The local version has been modified after the incoming version
+	c.local["cozyMetadata"] = map[string]interface{}{
+		"updatedAt": "2018-05-04T12:00:00Z",
+	}
+	res = resolveDocConflict(MergeLastWriterWins, c)
+	assert.Nil(t, res.doc)
+	assert.Nil(t, res.copy)
+
+	// Without dates, the revisions are used: 3-ddd > 3-ccc
+	delete(c.local, "cozyMetadata")
+	delete(c.incoming, "cozyMetadata")
+	res = resolveDocConflict("", c)
+	if assert.NotNil(t, res.doc) {
+		assert.Equal(t, "red", res.doc["color"])
+	}
+
+	// The incoming revision is reused when its generation is greater
+	c.chain = []string{"1-aaa", "2-bbb", "3-ddd", "4-ddd"}
+	c.incoming["_rev"] = "4-ddd"
+	res = resolveDocConflict(MergeLastWriterWins, c)
+	if assert.NotNil(t, res.doc) {
+		assert.Equal(t, []string{"3-ccc", "4-ddd"}, res.chain)
+		assert.Equal(t, "4-ddd", res.doc["_rev"])
+		assert.Equal(t, RevsStruct{Start: 4, IDs: []string{"ddd", "ccc"}}, res.doc["_revisions"])
+	}
+}
+
+func TestResolveDocConflictThreeWay(t *testing.T) {
+	c := conflictingDocs()
+	res := resolveDocConflict(MergeThreeWay, c)
+	assert.Nil(t, res.copy)
+	if assert.NotNil(t, res.doc) {
+		// Modified only locally
+		assert.Equal(t, "Groceries for the week", res.doc["title"])
+		// Modified only on the other side
+		assert.Equal(t, "red", res.doc["color"])
+		// Modified on both sides: the last writer wins
+		assert.Equal(t, []interface{}{"milk", "bread"}, res.doc["items"])
+		assert.Equal(t, "3-ccc", res.chain[0])
+		assert.Equal(t, 4, RevGeneration(res.chain[1]))
+	}
+
+	// Without the base, the fields that differ are taken from the last writer
+	c.base = nil
+	res = resolveDocConflict(MergeThreeWay, c)
+	if assert.NotNil(t, res.doc) {
+		assert.True(t, sameContent(c.incoming, res.doc))
+	}
+}
+
+func TestThreeWayMergeRemovedFields(t *testing.T) {
+	base := map[string]interface{}{"a": "1", "b": "2", "c": "3"}
+	local := map[string]interface{}{"a": "1", "c": "3"}
+	incoming := map[string]interface{}{"a": "1", "b": "2", "c": "4", "d": "5"}
+	merged := threeWayMerge(base, local, incoming, false)
+	expected := map[string]interface{}{"a": "1", "c": "4", "d": "5"}
+	assert.Equal(t, expected, merged)
+}
+
+func TestResolveDocConflictCopy(t *testing.T) {
+	c := conflictingDocs()
+	res := resolveDocConflict(MergeConflictCopy, c)
+	// 3-ddd > 3-ccc: the incoming version wins, the local one is copied
+	if assert.NotNil(t, res.doc) {
+		assert.True(t, sameContent(c.incoming, res.doc))
+	}
+	if assert.NotNil(t, res.copy) {
+		assert.Equal(t, conflictID(c.local["_id"].(string), "3-ccc"), res.copy["_id"])
+		assert.NotEqual(t, c.local["_id"], res.copy["_id"])
+		assert.Equal(t, "3-ccc", res.copy["_rev"])
+		assert.True(t, sameContent(c.local, res.copy))
+	}
+
+	// On the other side, the local version wins and the same copy is made
+	other := &docConflict{
+		local:    c.incoming,
+		incoming: c.local,
+		chain:    []string{"1-aaa", "2-bbb", "3-ccc"},
+		base:     c.base,
+	}
+	res2 := resolveDocConflict(MergeConflictCopy, other)
+	assert.Nil(t, res2.doc)
+	assert.Equal(t, res.copy, res2.copy)
+}
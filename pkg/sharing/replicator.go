@@ -42,6 +42,10 @@ func (s *Sharing) Replicate(inst *instance.Instance, errors int) error {
 
 	pending := false
 	var errm error
+	if s.ReadOnlyRecipient() {
+		// The recipient has been demoted since the job was pushed
+		return nil
+	}
 	if !s.Owner {
 		pending, errm = s.ReplicateTo(inst, &s.Members[0], false)
 	} else {
@@ -559,15 +563,21 @@ func (s *Sharing) sendBulkDocs(inst *instance.Instance, m *Member, creds *Creden
 	return nil
 }
 
-// ApplyBulkDocs is a multi-doctypes version of the POST _bulk_docs endpoint of CouchDB
-func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype) error {
+// ApplyBulkDocs is a multi-doctypes version of the POST _bulk_docs endpoint of
+// CouchDB. The changes are rejected if the member who has sent them is not
+// allowed to write.
+func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, m *Member, payload DocsByDoctype) error {
+	if err := s.CheckWriteAccess(m); err != nil {
+		return err
+	}
 	var refs []*SharedRef
+	var activities []*Activity
 
 	for doctype, docs := range payload {
 		inst.Logger().WithField("nspace", "replicator").
 			Debugf("Apply bulk docs %s: %#v", doctype, docs)
 		if doctype == consts.Files {
-			err := s.ApplyBulkFiles(inst, docs)
+			err := s.ApplyBulkFiles(inst, m, docs)
 			if err != nil {
 				return err
 			}
@@ -575,14 +585,13 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 		}
 		var okDocs, docsToUpdate DocsList
 		var newRefs, existingRefs []*SharedRef
-		newDocs, existingDocs, err := partitionDocsPayload(inst, doctype, docs)
+		newDocs, existingDocs, localDocs, err := partitionDocsPayload(inst, doctype, docs)
 		if err == nil {
 			okDocs, newRefs = s.filterDocsToAdd(inst, doctype, newDocs)
-			docsToUpdate, existingRefs, err = s.filterDocsToUpdate(inst, doctype, existingDocs)
+			docsToUpdate, existingRefs, err = s.filterDocsToUpdate(inst, doctype, existingDocs, localDocs)
 			if err != nil {
 				return err
 			}
-			okDocs = append(okDocs, docsToUpdate...)
 		} else {
 			okDocs, newRefs = s.filterDocsToAdd(inst, doctype, docs)
 			if len(okDocs) > 0 {
@@ -591,14 +600,33 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 				}
 			}
 		}
+		for _, doc := range okDocs {
+			activities = append(activities, s.newActivity(m, ActivityCreate, doctype, doc["_id"].(string)))
+		}
+		existingIDs := make(map[string]struct{}, len(existingDocs))
+		for _, doc := range existingDocs {
+			existingIDs[doc["_id"].(string)] = struct{}{}
+		}
+		for _, doc := range docsToUpdate {
+			action := ActivityUpdate
+			if _, ok := doc["_deleted"]; ok {
+				action = ActivityDelete
+			} else if _, ok := existingIDs[doc["_id"].(string)]; !ok {
+				// The copy of a document made to resolve a conflict
+				action = ActivityCreate
+			}
+			activities = append(activities, s.newActivity(m, action, doctype, doc["_id"].(string)))
+		}
+		okDocs = append(okDocs, docsToUpdate...)
 		if len(okDocs) > 0 {
 			if err = couchdb.BulkForceUpdateDocs(inst, doctype, okDocs); err != nil {
 				return err
 			}
-			refs = append(refs, newRefs...)
-			refs = append(refs, existingRefs...)
 		}
+		refs = append(refs, newRefs...)
+		refs = append(refs, existingRefs...)
 	}
+	recordActivities(inst, activities)
 
 	// TODO call rtevent for docs
 	refsToUpdate := make([]interface{}, len(refs))
@@ -609,33 +637,37 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 	return couchdb.BulkUpdateDocs(inst, consts.Shared, refsToUpdate, olds)
 }
 
-// partitionDocsPayload returns two slices: the first with documents that are new,
-// the second with documents that already exist on this cozy and must be updated.
-func partitionDocsPayload(inst *instance.Instance, doctype string, docs DocsList) (news DocsList, existings DocsList, err error) {
+// partitionDocsPayload returns three slices: the first with documents that are
+// new, the second with documents that already exist on this cozy and must be
+// updated, and the third with the current version of those documents on this
+// cozy.
+func partitionDocsPayload(inst *instance.Instance, doctype string, docs DocsList) (news DocsList, existings DocsList, locals DocsList, err error) {
 	ids := make([]string, len(docs))
 	for i, doc := range docs {
 		_, ok := doc["_rev"].(string)
 		if !ok {
-			return nil, nil, ErrMissingRev
+			return nil, nil, nil, ErrMissingRev
 		}
 		ids[i], ok = doc["_id"].(string)
 		if !ok {
-			return nil, nil, ErrMissingID
+			return nil, nil, nil, ErrMissingID
 		}
 	}
 	results := make([]interface{}, 0, len(docs))
 	req := couchdb.AllDocsRequest{Keys: ids}
 	if err = couchdb.GetAllDocs(inst, doctype, &req, &results); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	for i, doc := range docs {
 		if results[i] == nil {
 			news = append(news, doc)
 		} else {
 			existings = append(existings, doc)
+			local, _ := results[i].(map[string]interface{})
+			locals = append(locals, local)
 		}
 	}
-	return news, existings, nil
+	return news, existings, locals, nil
 }
 
 // filterDocsToAdd returns a subset of the docs slice with just the documents
@@ -673,8 +705,10 @@ func (s *Sharing) filterDocsToAdd(inst *instance.Instance, doctype string, docs
 }
 
 // filterDocsToUpdate returns a subset of the docs slice with just the documents
-// that are referenced for this sharing in the io.cozy.shared database.
-func (s *Sharing) filterDocsToUpdate(inst *instance.Instance, doctype string, docs DocsList) (DocsList, []*SharedRef, error) {
+// that are referenced for this sharing in the io.cozy.shared database. The
+// conflicts with the local versions of the documents are resolved with the
+// merge strategy of their rule.
+func (s *Sharing) filterDocsToUpdate(inst *instance.Instance, doctype string, docs, locals DocsList) (DocsList, []*SharedRef, error) {
 	ids := make([]string, len(docs))
 	for i, doc := range docs {
 		id, ok := doc["_id"].(string)
@@ -688,17 +722,44 @@ func (s *Sharing) filterDocsToUpdate(inst *instance.Instance, doctype string, do
 		return nil, nil, err
 	}
 
-	filtered := docs[:0]
-	frefs := refs[:0]
+	filtered := make(DocsList, 0, len(docs))
+	frefs := make([]*SharedRef, 0, len(refs))
 	for i, doc := range docs {
 		if refs[i] != nil {
 			infos, ok := refs[i].Infos[s.SID]
 			if ok && !infos.Removed {
 				rev := doc["_rev"].(string)
 				if refs[i].Revisions.Find(rev) == nil {
+					var chain []string
 					revs := revsMapToStruct(doc["_revisions"])
 					if revs != nil && len(revs.IDs) > 0 {
-						chain := revsStructToChain(*revs)
+						chain = revsStructToChain(*revs)
+					}
+					if c := s.findDocConflict(inst, doctype, refs[i], locals[i], doc, chain); c != nil {
+						res := resolveDocConflict(s.mergeStrategy(infos.Rule), c)
+						if res.doc != nil {
+							refs[i].Revisions.InsertChain(res.chain)
+							filtered = append(filtered, res.doc)
+						}
+						// The incoming revisions are kept in the tree, even
+						// if they were not written, to not ask them again
+						if refs[i].Revisions.Find(rev) == nil {
+							refs[i].Revisions.InsertBranch(chain)
+						}
+						if res.copy != nil {
+							frefs = append(frefs, &SharedRef{
+								SID:       doctype + "/" + res.copy["_id"].(string),
+								Revisions: &RevsTree{Rev: res.copy["_rev"].(string)},
+								Infos: map[string]SharedInfo{
+									s.SID: {Rule: infos.Rule},
+								},
+							})
+							filtered = append(filtered, res.copy)
+						}
+						frefs = append(frefs, refs[i])
+						continue
+					}
+					if len(chain) > 0 {
 						refs[i].Revisions.InsertChain(chain)
 					}
 				}
@@ -714,3 +775,40 @@ func (s *Sharing) filterDocsToUpdate(inst *instance.Instance, doctype string, do
 
 	return filtered, frefs, nil
 }
+
+// findDocConflict returns the conflict between the local version of a shared
+// document and the incoming version, or nil if there is no conflict. The
+// deletions are not seen as conflicts.
+func (s *Sharing) findDocConflict(inst *instance.Instance, doctype string, ref *SharedRef, local, incoming map[string]interface{}, chain []string) *docConflict {
+	if local == nil || len(chain) == 0 {
+		return nil
+	}
+	if _, ok := incoming["_deleted"]; ok {
+		return nil
+	}
+	localRev, _ := local["_rev"].(string)
+	if localRev == "" || detectConflict(localRev, chain) == NoConflict {
+		return nil
+	}
+	c := &docConflict{local: local, incoming: incoming, chain: chain}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if ref.Revisions.Find(chain[i]) == nil {
+			continue
+		}
+		var base couchdb.JSONDoc
+		id, _ := local["_id"].(string)
+		if err := couchdb.GetDocRev(inst, doctype, id, chain[i], &base); err == nil {
+			c.base = base.M
+		}
+		break
+	}
+	return c
+}
+
+// mergeStrategy returns the merge strategy of the rule with the given index
+func (s *Sharing) mergeStrategy(r int) string {
+	if r < 0 || r >= len(s.Rules) {
+		return MergeLastWriterWins
+	}
+	return s.Rules[r].MergeStrategy()
+}
@@ -138,6 +138,29 @@ func (rt *RevsTree) InsertChain(chain []string) {
 	// TODO rebalance (conflicts)
 }
 
+// InsertBranch inserts a chain of revisions in the tree, but as a secondary
+// branch: the main branch, that leads to the current revision, is left
+// untouched. It is used to remember the revisions that have lost a conflict.
+// The chain is ignored if none of its revisions is already in the tree.
+func (rt *RevsTree) InsertBranch(chain []string) {
+	var subtree *RevsTree
+	i := 0
+	for ; i < len(chain); i++ {
+		sub := rt.Find(chain[i])
+		if sub == nil {
+			break
+		}
+		subtree = sub
+	}
+	if subtree == nil || len(subtree.Branches) == 0 {
+		return
+	}
+	for _, rev := range chain[i:] {
+		subtree.Branches = append(subtree.Branches, RevsTree{Rev: rev})
+		subtree = &subtree.Branches[len(subtree.Branches)-1]
+	}
+}
+
 // RevGeneration returns the number before the hyphen, called the generation of a revision
 func RevGeneration(rev string) int {
 	parts := strings.SplitN(rev, "-", 2)
@@ -138,6 +138,21 @@ func TestRevsTreeInsertChain(t *testing.T) {
 	assert.Len(t, sub.Branches, 0)
 }
 
+func TestRevsTreeInsertBranch(t *testing.T) {
+	tree := &RevsTree{Rev: "1-aaa"}
+	tree.InsertChain([]string{"1-aaa", "2-baa", "3-caa"})
+	tree.InsertBranch([]string{"1-aaa", "2-baa", "3-cbb", "4-dbb"})
+	tree.InsertBranch([]string{"5-eee", "6-fff"})
+	assert.Equal(t, "3-caa", tree.Branches[0].Branches[0].Rev)
+	assert.Equal(t, 4, tree.Generation())
+	assert.NotNil(t, tree.Find("4-dbb"))
+	assert.Nil(t, tree.Find("5-eee"))
+	sub := tree.Branches[0]
+	assert.Len(t, sub.Branches, 2)
+	assert.Equal(t, "3-cbb", sub.Branches[1].Rev)
+	assert.Len(t, sub.Branches[0].Branches, 0)
+}
+
 func TestRevGeneration(t *testing.T) {
 	assert.Equal(t, 1, RevGeneration("1-aaa"))
 	assert.Equal(t, 3, RevGeneration("3-123"))
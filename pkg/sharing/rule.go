@@ -22,6 +22,19 @@ const (
 	ActionRuleRevoke = "revoke"
 )
 
+const (
+	// MergeLastWriterWins is the merge strategy where the most recently
+	// modified version of a document wins a conflict (the default)
+	MergeLastWriterWins = "last-writer-wins"
+	// MergeThreeWay is the merge strategy where the fields modified on only one
+	// side are kept, and the most recently modified version wins for the
+	// fields modified on both sides
+	MergeThreeWay = "three-way"
+	// MergeConflictCopy is the merge strategy where the losing version of a
+	// document in conflict is kept as a copy with a new identifier
+	MergeConflictCopy = "conflict-copy"
+)
+
 // Rule describes how the sharing behave when a document matching the rule is
 // added, updated or deleted.
 type Rule struct {
@@ -33,6 +46,7 @@ type Rule struct {
 	Add      string   `json:"add"`
 	Update   string   `json:"update"`
 	Remove   string   `json:"remove"`
+	Merge    string   `json:"merge,omitempty"`
 }
 
 // FilesByID returns true if the rule is for the files by doctype and the
@@ -109,10 +123,30 @@ func (s *Sharing) ValidateRules() error {
 			rule.Remove != ActionRuleRevoke {
 			return ErrInvalidRule
 		}
+		if rule.Merge != "" {
+			// The conflicts on files and folders have their own resolution
+			if rule.DocType == consts.Files {
+				return ErrInvalidRule
+			}
+			if rule.Merge != MergeLastWriterWins &&
+				rule.Merge != MergeThreeWay &&
+				rule.Merge != MergeConflictCopy {
+				return ErrInvalidRule
+			}
+		}
 	}
 	return nil
 }
 
+// MergeStrategy returns the strategy used to resolve the conflicts on the
+// documents matched by this rule.
+func (r Rule) MergeStrategy() string {
+	if r.Merge == "" {
+		return MergeLastWriterWins
+	}
+	return r.Merge
+}
+
 // Accept returns true if the document matches the rule criteria
 func (r Rule) Accept(doctype string, doc map[string]interface{}) bool {
 	if r.Local || doctype != r.DocType {
@@ -99,6 +99,33 @@ func TestValidatesRules(t *testing.T) {
 		},
 	}
 	assert.Equal(t, ErrInvalidRule, s.ValidateRules())
+	s.Rules = []Rule{
+		{
+			Title:   "merge is OK",
+			DocType: "io.cozy.tests",
+			Values:  []string{"foo"},
+			Merge:   MergeThreeWay,
+		},
+	}
+	assert.NoError(t, s.ValidateRules())
+	s.Rules = []Rule{
+		{
+			Title:   "merge is invalid",
+			DocType: "io.cozy.tests",
+			Values:  []string{"foo"},
+			Merge:   "flip",
+		},
+	}
+	assert.Equal(t, ErrInvalidRule, s.ValidateRules())
+	s.Rules = []Rule{
+		{
+			Title:   "merge is not for files",
+			DocType: consts.Files,
+			Values:  []string{"foo"},
+			Merge:   MergeConflictCopy,
+		},
+	}
+	assert.Equal(t, ErrInvalidRule, s.ValidateRules())
 }
 
 func TestRuleAccept(t *testing.T) {
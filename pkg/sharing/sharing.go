@@ -24,6 +24,7 @@ type Triggers struct {
 	TrackID     string `json:"track_id,omitempty"`
 	ReplicateID string `json:"replicate_id,omitempty"`
 	UploadID    string `json:"upload_id,omitempty"`
+	GroupsID    string `json:"groups_id,omitempty"`
 }
 
 // Sharing contains all the information about a sharing.
@@ -49,6 +50,9 @@ type Sharing struct {
 	// On the owner, credentials[i] is associated to members[i+1]
 	// On a recipient, there is only credentials[0] (for the owner)
 	Credentials []Credentials `json:"credentials,omitempty"`
+
+	// Groups are the groups of contacts whose contacts are members
+	Groups []Group `json:"groups,omitempty"`
 }
 
 // ID returns the sharing qualified identifier
@@ -75,6 +79,8 @@ func (s *Sharing) Clone() couchdb.Doc {
 	copy(cloned.Members, s.Members)
 	cloned.Credentials = make([]Credentials, len(s.Credentials))
 	copy(cloned.Credentials, s.Credentials)
+	cloned.Groups = make([]Group, len(s.Groups))
+	copy(cloned.Groups, s.Groups)
 	return &cloned
 }
 
@@ -122,8 +128,10 @@ func (s *Sharing) BeOwner(inst *instance.Instance, slug string) error {
 		return err
 	}
 
+	s.Groups = nil
 	s.Members = make([]Member, 1)
 	s.Members[0].Status = MemberStatusOwner
+	s.Members[0].Role = MemberRoleOwner
 	s.Members[0].PublicName = name
 	s.Members[0].Email = email
 	s.Members[0].Instance = inst.PageURL("", nil)
@@ -169,7 +177,9 @@ func (s *Sharing) Create(inst *instance.Instance) (map[string]string, error) {
 	if err := s.ValidateRules(); err != nil {
 		return nil, err
 	}
-	if len(s.Members) < 2 {
+	// A group can be empty when the sharing is created, and its contacts will
+	// be added later
+	if len(s.Members) < 2 && len(s.Groups) == 0 {
 		return nil, ErrNoRecipients
 	}
 
@@ -277,6 +287,9 @@ func (s *Sharing) RemoveTriggers(inst *instance.Instance) error {
 	if err := removeSharingTrigger(inst, s.Triggers.UploadID); err != nil {
 		return err
 	}
+	if err := removeSharingTrigger(inst, s.Triggers.GroupsID); err != nil {
+		return err
+	}
 	s.Triggers = Triggers{}
 	return nil
 }
@@ -291,6 +304,20 @@ func removeSharingTrigger(inst *instance.Instance, triggerID string) error {
 	return nil
 }
 
+// RemoveReplicateTriggers removes the triggers used by a recipient to send
+// its changes to the owner, when it can no longer write.
+func (s *Sharing) RemoveReplicateTriggers(inst *instance.Instance) error {
+	if err := removeSharingTrigger(inst, s.Triggers.ReplicateID); err != nil {
+		return err
+	}
+	if err := removeSharingTrigger(inst, s.Triggers.UploadID); err != nil {
+		return err
+	}
+	s.Triggers.ReplicateID = ""
+	s.Triggers.UploadID = ""
+	return couchdb.UpdateDoc(inst, s)
+}
+
 // RevokeByNotification is called on the recipient side, after a revocation
 // performed by the sharer
 func (s *Sharing) RevokeByNotification(inst *instance.Instance) error {
@@ -330,8 +357,12 @@ func (s *Sharing) RevokeRecipientByNotification(inst *instance.Instance, m *Memb
 	return s.NoMoreRecipient(inst)
 }
 
-// NoMoreRecipient cleans up the sharing if there is no more active recipient
+// NoMoreRecipient cleans up the sharing if there is no more active recipient.
+// A sharing with groups of contacts is kept, as new contacts can join them.
 func (s *Sharing) NoMoreRecipient(inst *instance.Instance) error {
+	if len(s.Groups) > 0 {
+		return couchdb.UpdateDoc(inst, s)
+	}
 	for _, m := range s.Members {
 		if m.Status == MemberStatusReady {
 			return couchdb.UpdateDoc(inst, s)
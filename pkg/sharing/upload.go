@@ -32,6 +32,10 @@ func (s *Sharing) Upload(inst *instance.Instance, errors int) error {
 
 	var errm error
 	var members []*Member
+	if s.ReadOnlyRecipient() {
+		// The recipient has been demoted since the job was pushed
+		return nil
+	}
 	if !s.Owner {
 		members = append(members, &s.Members[0])
 	} else {
@@ -293,8 +297,9 @@ func (s *Sharing) createUploadKey(inst *instance.Instance, target *FileDocWithRe
 }
 
 // SyncFile tries to synchronize a file with just the metadata. If it can't,
-// it will return a key to upload the content.
-func (s *Sharing) SyncFile(inst *instance.Instance, target *FileDocWithRevisions) (*KeyToUpload, error) {
+// it will return a key to upload the content. m is the member who has sent
+// the changes.
+func (s *Sharing) SyncFile(inst *instance.Instance, m *Member, target *FileDocWithRevisions) (*KeyToUpload, error) {
 	inst.Logger().WithField("nspace", "upload").Debugf("SyncFile %#v", target)
 	mu := lock.ReadWrite(inst, "shared")
 	mu.Lock()
@@ -331,7 +336,11 @@ func (s *Sharing) SyncFile(inst *instance.Instance, target *FileDocWithRevisions
 	if !bytes.Equal(target.MD5Sum, current.MD5Sum) {
 		return s.createUploadKey(inst, target)
 	}
-	return nil, s.updateFileMetadata(inst, target, current, &ref)
+	if err = s.updateFileMetadata(inst, target, current, &ref); err != nil {
+		return nil, err
+	}
+	s.recordActivity(inst, m, ActivityUpdate, consts.Files, target.DocID)
+	return nil, nil
 }
 
 // prepareFileWithAncestors find the parent directory for file, and recreates it
@@ -414,8 +423,8 @@ func (s *Sharing) updateFileMetadata(inst *instance.Instance, target *FileDocWit
 }
 
 // HandleFileUpload is used to receive a file upload when synchronizing just
-// the metadata was not enough.
-func (s *Sharing) HandleFileUpload(inst *instance.Instance, key string, body io.ReadCloser) error {
+// the metadata was not enough. m is the member who has sent the file.
+func (s *Sharing) HandleFileUpload(inst *instance.Instance, m *Member, key string, body io.ReadCloser) error {
 	defer body.Close()
 	target, err := getStore().Get(inst, key)
 	inst.Logger().WithField("nspace", "upload").Debugf("HandleFileUpload %#v", target)
@@ -436,10 +445,18 @@ func (s *Sharing) HandleFileUpload(inst *instance.Instance, key string, body io.
 		return err
 	}
 
+	action := ActivityUpdate
 	if current == nil {
-		return s.UploadNewFile(inst, target, body)
+		action = ActivityCreate
+		err = s.UploadNewFile(inst, target, body)
+	} else {
+		err = s.UploadExistingFile(inst, target, current, body)
 	}
-	return s.UploadExistingFile(inst, target, current, body)
+	if err != nil {
+		return err
+	}
+	s.recordActivity(inst, m, action, consts.Files, target.DocID)
+	return nil
 }
 
 // UploadNewFile is used to receive a new file.
@@ -9,7 +9,9 @@ import (
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -92,6 +94,14 @@ security features. Please do not use this binary as your production server.
 		}
 	}
 
+	// Init the client of the S3 storage, that can be used for the instances
+	// migrated to it even if the main storage is another one
+	if s3URL := config.S3URL(); s3URL != nil {
+		if err = config.InitS3Client(s3URL); err != nil {
+			return
+		}
+	}
+
 	workersList, err := jobs.GetWorkersList()
 	if err != nil {
 		return
@@ -102,12 +112,41 @@ security features. Please do not use this binary as your production server.
 	jobsConfig := config.GetConfig().Jobs
 	if cli := jobsConfig.Client(); cli != nil {
 		broker = jobs.NewRedisBroker(cli)
-		schder = jobs.NewRedisScheduler(cli)
+		if jobsConfig.Scheduler == "leader" {
+			var lease lock.Lease
+			if lease, err = lock.GetLease("jobs/scheduler"); err != nil {
+				err = fmt.Errorf("Could not start the leader scheduler: %s", err)
+				return
+			}
+			schder = jobs.NewLeaderScheduler(cli, lease)
+		} else {
+			schder = jobs.NewRedisScheduler(cli)
+		}
 	} else {
 		broker = jobs.NewMemBroker()
 		schder = jobs.NewMemScheduler()
 	}
 
+	// The limits of the workers can be overridden for the instances of a
+	// context
+	jobs.RegisterContextNameCallback(func(domain string) string {
+		i, err := instance.Get(domain)
+		if err != nil {
+			return ""
+		}
+		return i.ContextName
+	})
+
+	// The @cron triggers are executed by default in the timezone of their
+	// instance
+	jobs.RegisterTimezoneCallback(func(domain string) string {
+		i, err := instance.Get(domain)
+		if err != nil {
+			return ""
+		}
+		return i.SettingsTimezone()
+	})
+
 	if err = jobs.SystemStart(broker, schder, workersList); err != nil {
 		return
 	}
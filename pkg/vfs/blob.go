@@ -0,0 +1,64 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// Blob is used when the deduplication is enabled: the content of the files
+// is stored once by its md5sum, and the blob document counts the files and
+// versions that reference this content. Its identifier is the md5sum in
+// hexadecimal. The sha256 of the content is also kept, to check that a new
+// content with the same md5sum is really the same before sharing the blob.
+type Blob struct {
+	DocID     string `json:"_id,omitempty"`
+	DocRev    string `json:"_rev,omitempty"`
+	ByteSize  int64  `json:"size,string"`
+	Refs      int    `json:"refs"`
+	SHA256Sum []byte `json:"sha256,omitempty"`
+}
+
+// ID returns the blob identifier
+func (b *Blob) ID() string { return b.DocID }
+
+// Rev returns the blob revision
+func (b *Blob) Rev() string { return b.DocRev }
+
+// DocType returns the blob document type
+func (b *Blob) DocType() string { return consts.FilesBlobs }
+
+// Clone implements couchdb.Doc
+func (b *Blob) Clone() couchdb.Doc {
+	cloned := *b
+	return &cloned
+}
+
+// SetID changes the blob identifier
+func (b *Blob) SetID(id string) { b.DocID = id }
+
+// SetRev changes the blob revision
+func (b *Blob) SetRev(rev string) { b.DocRev = rev }
+
+// Size returns the length in bytes of the content of the blob
+func (b *Blob) Size() int64 { return b.ByteSize }
+
+// BlobID returns the identifier of the blob for a content with the given
+// md5sum.
+func BlobID(md5sum []byte) string {
+	return hex.EncodeToString(md5sum)
+}
+
+// SameContent returns true if a content with the given sha256 and size can
+// share this blob. A blob without sha256, rebuilt by the fsck, takes the one
+// of the next content.
+func (b *Blob) SameContent(sha256sum []byte, size int64) bool {
+	if b.ByteSize != size {
+		return false
+	}
+	return len(b.SHA256Sum) == 0 || bytes.Equal(b.SHA256Sum, sha256sum)
+}
+
+var _ couchdb.Doc = &Blob{}
@@ -16,7 +16,16 @@ import (
 )
 
 type couchdbIndexer struct {
-	db prefixer.Prefixer
+	db     prefixer.Prefixer
+	quotas DirQuotasFlag
+}
+
+// DirQuotasFlag is used to know if a quota has ever been set on a directory:
+// when it is not the case, the sizes of the directories are not counted, and
+// the indexer doesn't need to look for them on each file change.
+type DirQuotasFlag interface {
+	HasDirQuotas() bool
+	EnableDirQuotas() error
 }
 
 // NewCouchdbIndexer creates an Indexer instance based on couchdb to store
@@ -27,6 +36,16 @@ func NewCouchdbIndexer(db prefixer.Prefixer) Indexer {
 	}
 }
 
+// NewCouchdbIndexerWithQuotasFlag creates an Indexer instance based on
+// couchdb, that uses the given flag to skip the sizes of the directories when
+// no quota has been set.
+func NewCouchdbIndexerWithQuotasFlag(db prefixer.Prefixer, quotas DirQuotasFlag) Indexer {
+	return &couchdbIndexer{
+		db:     db,
+		quotas: quotas,
+	}
+}
+
 func (c *couchdbIndexer) InitIndex() error {
 	createDate := time.Now()
 	err := couchdb.CreateNamedDocWithDB(c.db, &DirDoc{
@@ -73,52 +92,106 @@ func (c *couchdbIndexer) DiskUsage() (int64, error) {
 	if !ok {
 		return 0, ErrWrongCouchdbState
 	}
+	versions, err := c.versionsDiskUsage()
+	if err != nil {
+		return 0, err
+	}
+	return int64(f64) + versions, nil
+}
+
+func (c *couchdbIndexer) versionsDiskUsage() (int64, error) {
+	var doc couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.FilesVersionsView, &couchdb.ViewRequest{
+		Reduce: true,
+	}, &doc)
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	f64, ok := doc.Rows[0].Value.(float64)
+	if !ok {
+		return 0, ErrWrongCouchdbState
+	}
 	return int64(f64), nil
 }
 
 func (c *couchdbIndexer) CreateFileDoc(doc *FileDoc) error {
 	// Ensure that fullpath is filled because it's used in realtime/@events
-	if _, err := doc.Path(c); err != nil {
+	fullpath, err := doc.Path(c)
+	if err != nil {
 		return err
 	}
-	return couchdb.CreateDoc(c.db, doc)
+	if err = couchdb.CreateDoc(c.db, doc); err != nil {
+		return err
+	}
+	return c.UpdateDirSizes("", 0, fullpath, doc.ByteSize)
 }
 
 func (c *couchdbIndexer) CreateNamedFileDoc(doc *FileDoc) error {
 	// Ensure that fullpath is filled because it's used in realtime/@events
-	if _, err := doc.Path(c); err != nil {
+	fullpath, err := doc.Path(c)
+	if err != nil {
 		return err
 	}
-	return couchdb.CreateNamedDoc(c.db, doc)
+	if err = couchdb.CreateNamedDoc(c.db, doc); err != nil {
+		return err
+	}
+	return c.UpdateDirSizes("", 0, fullpath, doc.ByteSize)
 }
 
 func (c *couchdbIndexer) UpdateFileDoc(olddoc, newdoc *FileDoc) error {
 	// Ensure that fullpath is filled because it's used in realtime/@events
-	if _, err := olddoc.Path(c); err != nil {
+	oldpath, err := olddoc.Path(c)
+	if err != nil {
 		return err
 	}
-	if _, err := newdoc.Path(c); err != nil {
+	newpath, err := newdoc.Path(c)
+	if err != nil {
 		return err
 	}
+	if oldpath != newpath {
+		size := func() (int64, error) { return newdoc.ByteSize, nil }
+		if err = c.checkMoveQuotas(oldpath, newpath, size); err != nil {
+			return err
+		}
+	}
 	newdoc.SetID(olddoc.ID())
 	newdoc.SetRev(olddoc.Rev())
-	return couchdb.UpdateDocWithOld(c.db, newdoc, olddoc)
+	if err = couchdb.UpdateDocWithOld(c.db, newdoc, olddoc); err != nil {
+		return err
+	}
+	return c.UpdateDirSizes(oldpath, olddoc.ByteSize, newpath, newdoc.ByteSize)
 }
 
 func (c *couchdbIndexer) DeleteFileDoc(doc *FileDoc) error {
 	// Ensure that fullpath is filled because it's used in realtime/@events
-	if _, err := doc.Path(c); err != nil {
+	fullpath, err := doc.Path(c)
+	if err != nil {
+		return err
+	}
+	if err = couchdb.DeleteDoc(c.db, doc); err != nil {
 		return err
 	}
-	return couchdb.DeleteDoc(c.db, doc)
+	return c.UpdateDirSizes(fullpath, doc.ByteSize, "", 0)
 }
 
 func (c *couchdbIndexer) CreateDirDoc(doc *DirDoc) error {
-	return couchdb.CreateDoc(c.db, doc)
+	if err := couchdb.CreateDoc(c.db, doc); err != nil {
+		return err
+	}
+	return c.setDirQuota(doc)
 }
 
 func (c *couchdbIndexer) CreateNamedDirDoc(doc *DirDoc) error {
-	return couchdb.CreateNamedDoc(c.db, doc)
+	if err := couchdb.CreateNamedDoc(c.db, doc); err != nil {
+		return err
+	}
+	return c.setDirQuota(doc)
 }
 
 func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
@@ -131,6 +204,13 @@ func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
 	isRestored := oldTrashed && !newTrashed
 	isTrashed := !oldTrashed && newTrashed
 
+	if newdoc.Fullpath != olddoc.Fullpath {
+		size := func() (int64, error) { return c.dirContentSize(olddoc) }
+		if err := c.checkMoveQuotas(olddoc.Fullpath, newdoc.Fullpath, size); err != nil {
+			return err
+		}
+	}
+
 	if isTrashed {
 		if err := c.setTrashedForFilesInsideDir(olddoc, true); err != nil {
 			return err
@@ -141,12 +221,21 @@ func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
 		if err := c.moveDir(olddoc.Fullpath, newdoc.Fullpath); err != nil {
 			return err
 		}
+		if err := c.moveDirSizes(olddoc, newdoc); err != nil {
+			return err
+		}
 	}
 
 	if err := couchdb.UpdateDocWithOld(c.db, newdoc, olddoc); err != nil {
 		return err
 	}
 
+	if newdoc.Quota != olddoc.Quota {
+		if err := c.setDirQuota(newdoc); err != nil {
+			return err
+		}
+	}
+
 	if isRestored {
 		if err := c.setTrashedForFilesInsideDir(newdoc, false); err != nil {
 			return err
@@ -157,10 +246,13 @@ func (c *couchdbIndexer) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
 }
 
 func (c *couchdbIndexer) DeleteDirDoc(doc *DirDoc) error {
-	return couchdb.DeleteDoc(c.db, doc)
+	if err := couchdb.DeleteDoc(c.db, doc); err != nil {
+		return err
+	}
+	return c.deleteDirSizes(doc.Fullpath, false)
 }
 
-func (c *couchdbIndexer) DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (n int64, ids []string, err error) {
+func (c *couchdbIndexer) DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (n int64, fileDocs []*FileDoc, err error) {
 	var files []couchdb.Doc
 	if !onlyContent {
 		files = append(files, doc)
@@ -176,7 +268,7 @@ func (c *couchdbIndexer) DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (
 			files = append(files, dir)
 		} else {
 			files = append(files, file)
-			ids = append(ids, file.ID())
+			fileDocs = append(fileDocs, file)
 			n += file.ByteSize
 		}
 		return err
@@ -184,6 +276,16 @@ func (c *couchdbIndexer) DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (
 	if err == nil {
 		err = c.BatchDelete(files)
 	}
+	if err == nil {
+		if onlyContent {
+			err = c.UpdateDirSizes(doc.Fullpath+"/", n, "", 0)
+		} else {
+			err = c.UpdateDirSizes(doc.Fullpath, n, "", 0)
+		}
+	}
+	if err == nil {
+		err = c.deleteDirSizes(doc.Fullpath, onlyContent)
+	}
 	return
 }
 
@@ -722,3 +824,395 @@ func listChildren(root *TreeFile, files []couchdb.Doc) []couchdb.Doc {
 	}
 	return files
 }
+
+func (c *couchdbIndexer) CreateVersion(v *Version) error {
+	return couchdb.CreateNamedDocWithDB(c.db, v)
+}
+
+func (c *couchdbIndexer) DeleteVersion(v *Version) error {
+	return couchdb.DeleteDoc(c.db, v)
+}
+
+func (c *couchdbIndexer) AllVersions(fileID string) ([]*Version, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.FilesVersionsView, &couchdb.ViewRequest{
+		StartKey:    []interface{}{fileID},
+		EndKey:      []interface{}{fileID, map[string]interface{}{}},
+		IncludeDocs: true,
+		Reduce:      false,
+	}, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]*Version, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var v Version
+		if err = json.Unmarshal(row.Doc, &v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, &v)
+	}
+	return versions, nil
+}
+
+func (c *couchdbIndexer) VersionByNumber(fileID string, number int) (*Version, error) {
+	v := &Version{}
+	err := couchdb.GetDoc(c.db, consts.FilesVersions, MakeVersionID(fileID, number), v)
+	if couchdb.IsNotFoundError(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *couchdbIndexer) AddBlobRef(md5sum, sha256sum []byte, size int64) (bool, error) {
+	blob := &Blob{}
+	err := couchdb.GetDoc(c.db, consts.FilesBlobs, BlobID(md5sum), blob)
+	if couchdb.IsNotFoundError(err) {
+		blob = &Blob{
+			DocID:     BlobID(md5sum),
+			ByteSize:  size,
+			Refs:      1,
+			SHA256Sum: sha256sum,
+		}
+		return true, couchdb.CreateNamedDocWithDB(c.db, blob)
+	}
+	if err != nil {
+		return false, err
+	}
+	if !blob.SameContent(sha256sum, size) {
+		return false, ErrBlobCollision
+	}
+	if len(blob.SHA256Sum) == 0 {
+		blob.SHA256Sum = sha256sum
+	}
+	blob.Refs++
+	return false, couchdb.UpdateDoc(c.db, blob)
+}
+
+func (c *couchdbIndexer) RemoveBlobRef(md5sum []byte) (bool, error) {
+	blob := &Blob{}
+	err := couchdb.GetDoc(c.db, consts.FilesBlobs, BlobID(md5sum), blob)
+	if couchdb.IsNotFoundError(err) {
+		// Without its document, we can't know if the blob is still used, so it
+		// is kept: the fsck will tell if it is an orphan.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	blob.Refs--
+	if blob.Refs <= 0 {
+		return true, couchdb.DeleteDoc(c.db, blob)
+	}
+	return false, couchdb.UpdateDoc(c.db, blob)
+}
+
+func (c *couchdbIndexer) SetBlobRefs(blob *Blob) error {
+	old := &Blob{}
+	err := couchdb.GetDoc(c.db, consts.FilesBlobs, blob.ID(), old)
+	if couchdb.IsNotFoundError(err) {
+		if blob.Refs <= 0 {
+			return nil
+		}
+		blob.SetRev("")
+		return couchdb.CreateNamedDocWithDB(c.db, blob)
+	}
+	if err != nil {
+		return err
+	}
+	blob.SetRev(old.Rev())
+	if blob.Refs <= 0 {
+		return couchdb.DeleteDoc(c.db, blob)
+	}
+	return couchdb.UpdateDoc(c.db, blob)
+}
+
+func (c *couchdbIndexer) DirSizes() ([]*DirSize, error) {
+	if c.quotas != nil && !c.quotas.HasDirQuotas() {
+		return nil, nil
+	}
+	var sizes []*DirSize
+	err := couchdb.GetAllDocs(c.db, consts.FilesSizes, nil, &sizes)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+func (c *couchdbIndexer) UpdateDirSizes(oldpath string, oldsize int64, newpath string, newsize int64) error {
+	sizes, err := c.DirSizes()
+	if err != nil {
+		return err
+	}
+	for _, s := range sizes {
+		var delta int64
+		if oldpath != "" && s.Contains(oldpath) {
+			delta -= oldsize
+		}
+		if newpath != "" && s.Contains(newpath) {
+			delta += newsize
+		}
+		if delta == 0 {
+			continue
+		}
+		s.ByteSize += delta
+		if s.ByteSize < 0 {
+			s.ByteSize = 0
+		}
+		if err = couchdb.UpdateDoc(c.db, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setDirQuota creates the document used to count the size of the files inside
+// a directory when a quota is set on it, and deletes it when the quota is
+// removed.
+func (c *couchdbIndexer) setDirQuota(doc *DirDoc) error {
+	old := &DirSize{}
+	err := couchdb.GetDoc(c.db, consts.FilesSizes, doc.ID(), old)
+	if err != nil && !couchdb.IsNotFoundError(err) {
+		return err
+	}
+	exists := err == nil
+	if doc.Quota <= 0 {
+		if exists {
+			return couchdb.DeleteDoc(c.db, old)
+		}
+		return nil
+	}
+	if exists {
+		return nil
+	}
+	if c.quotas != nil {
+		if err = c.quotas.EnableDirQuotas(); err != nil {
+			return err
+		}
+	}
+	size, err := c.dirContentSize(doc)
+	if err != nil {
+		return err
+	}
+	return couchdb.CreateNamedDocWithDB(c.db, &DirSize{
+		DocID:    doc.ID(),
+		Fullpath: doc.Fullpath,
+		ByteSize: size,
+	})
+}
+
+// moveDirSizes updates the paths of the sizes of the moved directory and of
+// its sub-directories, and the sizes of the directories where it has been
+// moved from or to.
+func (c *couchdbIndexer) moveDirSizes(olddoc, newdoc *DirDoc) error {
+	sizes, err := c.DirSizes()
+	if err != nil || len(sizes) == 0 {
+		return err
+	}
+	oldpath, newpath := olddoc.Fullpath, newdoc.Fullpath
+	subtree := int64(-1)
+	for _, s := range sizes {
+		if s.Fullpath == oldpath || strings.HasPrefix(s.Fullpath, oldpath+"/") {
+			s.Fullpath = newpath + s.Fullpath[len(oldpath):]
+			if err = couchdb.UpdateDoc(c.db, s); err != nil {
+				return err
+			}
+			continue
+		}
+		wasInside, isInside := s.Contains(oldpath), s.Contains(newpath)
+		if wasInside == isInside {
+			continue
+		}
+		if subtree < 0 {
+			if subtree, err = c.dirContentSize(olddoc); err != nil {
+				return err
+			}
+		}
+		if isInside {
+			s.ByteSize += subtree
+		} else {
+			s.ByteSize -= subtree
+		}
+		if s.ByteSize < 0 {
+			s.ByteSize = 0
+		}
+		if err = couchdb.UpdateDoc(c.db, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMoveQuotas returns ErrDirQuotaExceeded if moving a file or a
+// directory from oldpath to newpath exceeds the quota of a directory that
+// contains newpath but not oldpath. The size of what is moved is computed
+// only when such a directory exists.
+func (c *couchdbIndexer) checkMoveQuotas(oldpath, newpath string, size func() (int64, error)) error {
+	sizes, err := c.DirSizes()
+	if err != nil || len(sizes) == 0 {
+		return err
+	}
+	moved := int64(-1)
+	for _, s := range sizes {
+		if !s.Contains(newpath) || s.Contains(oldpath) {
+			continue
+		}
+		dir, err := c.DirByID(s.ID())
+		if err != nil {
+			return err
+		}
+		if dir.Quota <= 0 {
+			continue
+		}
+		if moved < 0 {
+			if moved, err = size(); err != nil {
+				return err
+			}
+		}
+		if s.ByteSize+moved > dir.Quota {
+			return ErrDirQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// deleteDirSizes deletes the sizes of the sub-directories of a deleted
+// directory, and the size of the directory itself if onlyContent is false.
+func (c *couchdbIndexer) deleteDirSizes(dirpath string, onlyContent bool) error {
+	sizes, err := c.DirSizes()
+	if err != nil {
+		return err
+	}
+	for _, s := range sizes {
+		if strings.HasPrefix(s.Fullpath, dirpath+"/") || (!onlyContent && s.Fullpath == dirpath) {
+			if err = couchdb.DeleteDoc(c.db, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dirContentSize returns the size of the files inside a directory and its
+// sub-directories.
+func (c *couchdbIndexer) dirContentSize(doc *DirDoc) (int64, error) {
+	var size int64
+	err := walk(c, doc.Fullpath, doc, nil, func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			size += file.ByteSize
+		}
+		return nil
+	}, 0)
+	return size, err
+}
+
+func (c *couchdbIndexer) CheckBlobsIntegrity(stored map[string]int64) ([]*FsckLog, error) {
+	refs := make(map[string]int)
+	users := make(map[string][]*FileDoc)
+	err := couchdb.ForeachDocs(c.db, consts.Files, func(_ string, data json.RawMessage) error {
+		var doc FileDoc
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		if doc.Type != consts.FileType || len(doc.MD5Sum) == 0 {
+			return nil
+		}
+		id := BlobID(doc.MD5Sum)
+		refs[id]++
+		users[id] = append(users[id], &doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = couchdb.ForeachDocs(c.db, consts.FilesVersions, func(_ string, data json.RawMessage) error {
+		var v Version
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		refs[BlobID(v.MD5Sum)]++
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+
+	blobs := make(map[string]*Blob)
+	err = couchdb.ForeachDocs(c.db, consts.FilesBlobs, func(_ string, data json.RawMessage) error {
+		var blob Blob
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return err
+		}
+		blobs[blob.ID()] = &blob
+		return nil
+	})
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+
+	var logs []*FsckLog
+	for id, count := range refs {
+		size, ok := stored[id]
+		if !ok {
+			for _, doc := range users[id] {
+				fullpath, _ := c.FilePath(doc)
+				logs = append(logs, &FsckLog{
+					Type:     BlobMissing,
+					IsFile:   true,
+					FileDoc:  doc,
+					Filename: fullpath,
+				})
+			}
+			continue
+		}
+		blob, ok := blobs[id]
+		if !ok {
+			blob = &Blob{DocID: id, ByteSize: size}
+		}
+		if blob.Refs != count {
+			fixed := blob.Clone().(*Blob)
+			fixed.Refs = count
+			logs = append(logs, &FsckLog{
+				Type:     BlobRefsMismatch,
+				Blob:     fixed,
+				Filename: id,
+			})
+		}
+	}
+	for id, size := range stored {
+		if _, ok := refs[id]; !ok {
+			blob, ok := blobs[id]
+			if !ok {
+				blob = &Blob{DocID: id, ByteSize: size}
+			}
+			logs = append(logs, &FsckLog{
+				Type:     BlobOrphan,
+				Blob:     blob,
+				Filename: id,
+			})
+		}
+	}
+	for id, blob := range blobs {
+		_, isStored := stored[id]
+		if _, ok := refs[id]; !ok && !isStored {
+			fixed := blob.Clone().(*Blob)
+			fixed.Refs = 0
+			logs = append(logs, &FsckLog{
+				Type:     BlobRefsMismatch,
+				Blob:     fixed,
+				Filename: id,
+			})
+		}
+	}
+	return logs, nil
+}
@@ -26,11 +26,17 @@ type DirDoc struct {
 	// Parent directory identifier
 	DirID       string `json:"dir_id"`
 	RestorePath string `json:"restore_path,omitempty"`
+	// Date of the move to the trash, for the directories at the root of the
+	// trash
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Tags      []string  `json:"tags"`
 
+	// Optional maximal size, in bytes, of the files inside the directory
+	Quota int64 `json:"quota,omitempty"`
+
 	// Directory path on VFS.
 	// Fullpath should always be present. It is marked "omitempty" because
 	// DirDoc is the base of the DirOrFile struct.
@@ -203,6 +209,7 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 		RestorePath: &olddoc.RestorePath,
 		Tags:        &olddoc.Tags,
 		UpdatedAt:   &olddoc.UpdatedAt,
+		Quota:       &olddoc.Quota,
 	}, patch, cdate)
 
 	if err != nil {
@@ -220,6 +227,10 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	}
 
 	newdoc.RestorePath = *patch.RestorePath
+	newdoc.TrashedAt = trashedAt(newdoc.RestorePath, olddoc.TrashedAt)
+	if *patch.Quota > 0 {
+		newdoc.Quota = *patch.Quota
+	}
 	newdoc.CreatedAt = cdate
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.ReferencedBy = olddoc.ReferencedBy
@@ -249,6 +260,7 @@ func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 		newdoc = olddoc.Clone().(*DirDoc)
 		newdoc.DirID = trashDirID
 		newdoc.RestorePath = restorePath
+		newdoc.TrashedAt = trashedAt(restorePath, nil)
 		newdoc.DocName = name
 		newdoc.Fullpath = path.Join(TrashDirName, name)
 		return fs.UpdateDirDoc(olddoc, newdoc)
@@ -278,6 +290,7 @@ func RestoreDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 		newdoc = olddoc.Clone().(*DirDoc)
 		newdoc.DirID = restoreDir.DocID
 		newdoc.RestorePath = ""
+		newdoc.TrashedAt = nil
 		newdoc.DocName = name
 		newdoc.Fullpath = path.Join(restoreDir.Fullpath, name)
 		return fs.UpdateDirDoc(olddoc, newdoc)
@@ -40,4 +40,19 @@ var (
 	ErrWrongCouchdbState = errors.New("Wrong couchdb reduce value")
 	// ErrFileTooBig is used when there is no more space left on the filesystem
 	ErrFileTooBig = errors.New("The file is too big and exceeds the disk quota")
+	// ErrDirQuotaExceeded is used when a file is too big for the quota of a
+	// directory that contains it
+	ErrDirQuotaExceeded = errors.New("The file is too big and exceeds the quota of its directory")
+	// ErrBlobCollision is used when the deduplication is enabled, and a content
+	// has the same md5sum as the content of a blob, but not the same sha256
+	ErrBlobCollision = errors.New("The content has the same md5sum as another content")
+	// ErrUploadOffsetMismatch is used when a chunk of an upload session does
+	// not start where the previous one has ended
+	ErrUploadOffsetMismatch = errors.New("Upload offset does not match")
+	// ErrUploadMissingHash is used when an upload session is finalized without
+	// the md5sum of the content
+	ErrUploadMissingHash = errors.New("The md5sum of the uploaded content is required")
+	// ErrInvalidThumbFormat is used when a thumbnail is asked for a format
+	// that does not exist
+	ErrInvalidThumbFormat = errors.New("Invalid format for the thumbnail")
 )
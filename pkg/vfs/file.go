@@ -29,6 +29,8 @@ type FileDoc struct {
 	// Parent directory identifier
 	DirID       string `json:"dir_id,omitempty"`
 	RestorePath string `json:"restore_path,omitempty"`
+	// Date of the move to the trash, for the files at the root of the trash
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -279,6 +281,7 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	}
 
 	newdoc.RestorePath = *patch.RestorePath
+	newdoc.TrashedAt = trashedAt(newdoc.RestorePath, olddoc.TrashedAt)
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.Metadata = olddoc.Metadata
 	newdoc.ReferencedBy = olddoc.ReferencedBy
@@ -312,6 +315,7 @@ func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 		newdoc = olddoc.Clone().(*FileDoc)
 		newdoc.DirID = trashDirID
 		newdoc.RestorePath = restorePath
+		newdoc.TrashedAt = trashedAt(restorePath, nil)
 		newdoc.DocName = name
 		newdoc.Trashed = true
 		newdoc.fullpath = path.Join(TrashDirName, name)
@@ -340,6 +344,7 @@ func RestoreFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 		newdoc = olddoc.Clone().(*FileDoc)
 		newdoc.DirID = restoreDir.DocID
 		newdoc.RestorePath = ""
+		newdoc.TrashedAt = nil
 		newdoc.DocName = name
 		newdoc.Trashed = false
 		newdoc.fullpath = path.Join(restoreDir.Fullpath, name)
@@ -349,6 +354,20 @@ func RestoreFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 	return newdoc, err
 }
 
+// trashedAt returns the date of the move to the trash for a document with
+// the given restore path: the previous date is kept if it was already in the
+// trash.
+func trashedAt(restorePath string, previous *time.Time) *time.Time {
+	if restorePath == "" {
+		return nil
+	}
+	if previous != nil {
+		return previous
+	}
+	now := time.Now()
+	return &now
+}
+
 func getFileMode(executable bool) os.FileMode {
 	if executable {
 		return 0755 // -rwxr-xr-x
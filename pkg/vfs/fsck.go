@@ -31,6 +31,15 @@ const (
 	// ContentMismatch is used when a document content checksum does not match
 	// with the one in the underlying fs.
 	ContentMismatch
+	// BlobMissing is used when a file references a blob that is not stored, with
+	// the deduplication.
+	BlobMissing
+	// BlobOrphan is used when a blob is stored but is not referenced by any
+	// file or version, with the deduplication.
+	BlobOrphan
+	// BlobRefsMismatch is used when the number of references of a blob does not
+	// match the number of files and versions using it, with the deduplication.
+	BlobRefsMismatch
 )
 
 // FsckLog is a struct for an inconsistency in the VFS
@@ -40,6 +49,7 @@ type FsckLog struct {
 	OldFileDoc  *FileDoc
 	DirDoc      *DirDoc
 	OldDirDoc   *DirDoc
+	Blob        *Blob
 	Deletions   []couchdb.Doc
 	IsFile      bool
 	Filename    string
@@ -73,6 +83,12 @@ func (f *FsckLog) String() string {
 		return "the document is present on the local filesystem but not in the index"
 	case ContentMismatch:
 		return "then document content does not match the store content checksum"
+	case BlobMissing:
+		return "the file references a blob that is not stored"
+	case BlobOrphan:
+		return "the blob is stored but no file or version references it"
+	case BlobRefsMismatch:
+		return "the blob does not have the correct number of references"
 	}
 	panic("bad FsckLog type")
 }
@@ -85,9 +101,12 @@ func (f *FsckLog) MarshalJSON() ([]byte, error) {
 	}
 	if f.IsFile {
 		v["file_id"] = f.FileDoc.ID()
-	} else {
+	} else if f.DirDoc != nil {
 		v["file_id"] = f.DirDoc.ID()
 	}
+	if f.Blob != nil {
+		v["blob_id"] = f.Blob.ID()
+	}
 	if f.PruneAction != "" {
 		v["prune_action"] = f.PruneAction
 		if f.PruneError != nil {
@@ -190,6 +209,23 @@ func FsckPrune(fs VFS, indexer Indexer, entry *FsckLog, dryrun bool) {
 		if err := indexer.CreateFileDoc(fileDoc); err != nil {
 			entry.PruneError = err
 		}
+	case BlobMissing:
+		entry.PruneAction = "deleting entry from index"
+		if !dryrun {
+			if err := indexer.DeleteFileDoc(entry.FileDoc); err != nil {
+				entry.PruneError = err
+			}
+		}
+	case BlobOrphan:
+		entry.PruneAction = "no action: requires manual inspection"
+	case BlobRefsMismatch:
+		entry.PruneAction = fmt.Sprintf("updating the number of references of the blob to %d",
+			entry.Blob.Refs)
+		if !dryrun {
+			if err := indexer.SetBlobRefs(entry.Blob); err != nil {
+				entry.PruneError = err
+			}
+		}
 	case ContentMismatch:
 		if !entry.IsFile {
 			return
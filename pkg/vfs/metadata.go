@@ -22,9 +22,9 @@ import (
 )
 
 // MetadataExtractorVersion is the version number of the metadata extractor.
-// It will be used later to know which files can be re-examined to get more
-// metadata when the extractor is improved.
-const MetadataExtractorVersion = 2
+// It is used to know which files can be re-examined to get more metadata when
+// the extractor is improved.
+const MetadataExtractorVersion = 3
 
 // Metadata is a list of metadata specific to each mimetype:
 // id3 for music, exif for jpegs, etc.
@@ -45,7 +45,7 @@ type MetaExtractor interface {
 }
 
 // NewMetaExtractor returns an extractor for metadata if the mime type has one,
-// or null else
+// or null else. The documents are not examined here, see NewDocumentExtractor.
 func NewMetaExtractor(doc *FileDoc) *MetaExtractor {
 	var e MetaExtractor
 	switch doc.Mime {
@@ -57,6 +57,10 @@ func NewMetaExtractor(doc *FileDoc) *MetaExtractor {
 		e = NewImageExtractor(doc.CreatedAt)
 	case "audio/mp3", "audio/mpeg", "audio/ogg", "audio/x-m4a", "audio/flac":
 		e = NewAudioExtractor()
+	case "text/plain":
+		e = NewTextExtractor(false)
+	case "text/markdown", "text/x-markdown":
+		e = NewTextExtractor(true)
 	}
 	if e != nil {
 		return &e
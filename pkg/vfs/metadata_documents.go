@@ -0,0 +1,456 @@
+package vfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// maxDocumentSize is the maximal size of the PDF, ODF and OOXML documents
+// whose metadata are extracted: they are kept in memory, as these formats
+// can't be parsed as a stream.
+const maxDocumentSize = 20 << (2 * 10) // 20 MiB
+
+// DocumentMimeTypes is the list of the mime types of the PDF, ODF and OOXML
+// documents. Their metadata are not extracted when they are uploaded, but
+// later, by the metadata worker.
+var DocumentMimeTypes = []string{
+	"application/pdf",
+	"application/vnd.oasis.opendocument.text",
+	"application/vnd.oasis.opendocument.spreadsheet",
+	"application/vnd.oasis.opendocument.presentation",
+	"application/vnd.oasis.opendocument.graphics",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+// maxTextLength is the maximal length, in bytes, of the text body kept in the
+// metadata.
+const maxTextLength = 16 << 10 // 16 KiB
+
+// TextExtractor is used to extract the beginning of the text from plain text
+// and markdown files, and the title of the markdown files
+type TextExtractor struct {
+	buf      bytes.Buffer
+	markdown bool
+}
+
+// NewTextExtractor returns an extractor for plain text and markdown files
+func NewTextExtractor(markdown bool) *TextExtractor {
+	return &TextExtractor{markdown: markdown}
+}
+
+// Write is called to push some bytes to the extractor
+func (e *TextExtractor) Write(p []byte) (n int, err error) {
+	if rest := maxTextLength + utf8.UTFMax - e.buf.Len(); rest > 0 {
+		if len(p) > rest {
+			e.buf.Write(p[:rest])
+		} else {
+			e.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Close is called when all the bytes has been pushed, to finalize the extraction
+func (e *TextExtractor) Close() error {
+	return nil
+}
+
+// Abort is called when the extractor can be discarded
+func (e *TextExtractor) Abort(err error) {
+	e.buf.Reset()
+}
+
+// Result is called to get the extracted metadata
+func (e *TextExtractor) Result() Metadata {
+	m := NewMetadata()
+	text := truncateText(e.buf.Bytes())
+	setMetadataString(m, "text", text)
+	if e.markdown {
+		setMetadataString(m, "title", markdownTitle(text))
+	}
+	return m
+}
+
+// markdownTitle returns the first heading of a markdown text.
+func markdownTitle(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			return strings.TrimSpace(strings.Trim(line, "#"))
+		}
+	}
+	return ""
+}
+
+// NewDocumentExtractor returns an extractor for the metadata of a PDF, ODF or
+// OOXML document, or null if the file is not such a document. As parsing them
+// can be slow, it is not used for the uploads, but by the metadata worker.
+func NewDocumentExtractor(doc *FileDoc) *MetaExtractor {
+	var e MetaExtractor
+	switch doc.Mime {
+	case "application/pdf":
+		e = NewPDFExtractor()
+	case "application/vnd.oasis.opendocument.text",
+		"application/vnd.oasis.opendocument.spreadsheet",
+		"application/vnd.oasis.opendocument.presentation",
+		"application/vnd.oasis.opendocument.graphics":
+		e = NewODFExtractor()
+	case "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation":
+		e = NewOOXMLExtractor()
+	default:
+		return nil
+	}
+	return &e
+}
+
+// documentExtractor keeps the content of a document in memory, and parses it
+// when the result is asked.
+type documentExtractor struct {
+	buf     bytes.Buffer
+	skipped bool
+	parse   func(content []byte, m Metadata) error
+}
+
+// Write is called to push some bytes to the extractor
+func (e *documentExtractor) Write(p []byte) (n int, err error) {
+	if e.skipped {
+		return len(p), nil
+	}
+	if e.buf.Len()+len(p) > maxDocumentSize {
+		e.skipped = true
+		e.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return e.buf.Write(p)
+}
+
+// Close is called when all the bytes has been pushed, to finalize the extraction
+func (e *documentExtractor) Close() error {
+	return nil
+}
+
+// Abort is called when the extractor can be discarded
+func (e *documentExtractor) Abort(err error) {
+	e.skipped = true
+	e.buf = bytes.Buffer{}
+}
+
+// Result is called to get the extracted metadata. The extraction is made on
+// a best-effort basis: a document that can't be parsed has no metadata.
+func (e *documentExtractor) Result() Metadata {
+	m := NewMetadata()
+	if !e.skipped && e.buf.Len() > 0 {
+		e.parse(e.buf.Bytes(), m) // #nosec
+		e.buf = bytes.Buffer{}
+	}
+	return m
+}
+
+// PDFExtractor is used to extract the page count, the title, the author, the
+// language and the text from PDF documents
+type PDFExtractor struct {
+	*documentExtractor
+}
+
+// NewPDFExtractor returns an extractor for PDF documents
+func NewPDFExtractor() *PDFExtractor {
+	return &PDFExtractor{&documentExtractor{parse: parsePDF}}
+}
+
+func parsePDF(content []byte, m Metadata) (err error) {
+	// The PDF library panics on some malformed documents
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("vfs: invalid PDF document: %v", r)
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return err
+	}
+	m["pages"] = r.NumPage()
+	info := r.Trailer().Key("Info")
+	setMetadataString(m, "title", info.Key("Title").Text())
+	setMetadataString(m, "author", info.Key("Author").Text())
+	setMetadataString(m, "language", r.Trailer().Key("Root").Key("Lang").Text())
+	text, err := r.GetPlainText()
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(text, maxTextLength+utf8.UTFMax))
+	if err != nil {
+		return err
+	}
+	setMetadataString(m, "text", truncateText(buf))
+	return nil
+}
+
+// ODFExtractor is used to extract the page count, the title, the author, the
+// language and the text from OpenDocument files (odt, ods, odp, odg)
+type ODFExtractor struct {
+	*documentExtractor
+}
+
+// NewODFExtractor returns an extractor for OpenDocument files
+func NewODFExtractor() *ODFExtractor {
+	return &ODFExtractor{&documentExtractor{parse: parseODF}}
+}
+
+var odfParagraphs = []string{"p", "h"}
+
+type odfMeta struct {
+	Title          string `xml:"meta>title"`
+	InitialCreator string `xml:"meta>initial-creator"`
+	Creator        string `xml:"meta>creator"`
+	Language       string `xml:"meta>language"`
+	Statistic      struct {
+		PageCount int `xml:"page-count,attr"`
+	} `xml:"meta>document-statistic"`
+}
+
+func parseODF(content []byte, m Metadata) error {
+	z, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return err
+	}
+	var meta odfMeta
+	if err = decodeZipXML(z, "meta.xml", &meta); err == nil {
+		if meta.Statistic.PageCount > 0 {
+			m["pages"] = meta.Statistic.PageCount
+		}
+		setMetadataString(m, "title", meta.Title)
+		if meta.InitialCreator != "" {
+			setMetadataString(m, "author", meta.InitialCreator)
+		} else {
+			setMetadataString(m, "author", meta.Creator)
+		}
+		setMetadataString(m, "language", meta.Language)
+	}
+	text := &textBuffer{}
+	if f := findZipFile(z, "content.xml"); f != nil {
+		if err = readZipXMLText(f, text, odfParagraphs, odfParagraphs); err != nil {
+			return err
+		}
+	}
+	setMetadataString(m, "text", truncateText(text.Bytes()))
+	return nil
+}
+
+// OOXMLExtractor is used to extract the page count, the title, the author,
+// the language and the text from Office Open XML files (docx, xlsx, pptx)
+type OOXMLExtractor struct {
+	*documentExtractor
+}
+
+// NewOOXMLExtractor returns an extractor for Office Open XML files
+func NewOOXMLExtractor() *OOXMLExtractor {
+	return &OOXMLExtractor{&documentExtractor{parse: parseOOXML}}
+}
+
+var ooxmlTexts = []string{"t"}
+var ooxmlParagraphs = []string{"p", "si"}
+
+type ooxmlCore struct {
+	Title    string `xml:"title"`
+	Creator  string `xml:"creator"`
+	Language string `xml:"language"`
+}
+
+type ooxmlApp struct {
+	Pages  int `xml:"Pages"`
+	Slides int `xml:"Slides"`
+}
+
+func parseOOXML(content []byte, m Metadata) error {
+	z, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return err
+	}
+	var core ooxmlCore
+	if err = decodeZipXML(z, "docProps/core.xml", &core); err == nil {
+		setMetadataString(m, "title", core.Title)
+		setMetadataString(m, "author", core.Creator)
+		setMetadataString(m, "language", core.Language)
+	}
+	var app ooxmlApp
+	if err = decodeZipXML(z, "docProps/app.xml", &app); err == nil {
+		if app.Pages > 0 {
+			m["pages"] = app.Pages
+		} else if app.Slides > 0 {
+			m["pages"] = app.Slides
+		}
+	}
+
+	// The text is in the document for docx, in the slides for pptx, and in
+	// the shared strings for xlsx
+	var parts []*zip.File
+	if f := findZipFile(z, "word/document.xml"); f != nil {
+		parts = append(parts, f)
+	}
+	parts = append(parts, pptxSlides(z)...)
+	if f := findZipFile(z, "xl/sharedStrings.xml"); f != nil {
+		parts = append(parts, f)
+	}
+	text := &textBuffer{}
+	for _, f := range parts {
+		if err = readZipXMLText(f, text, ooxmlTexts, ooxmlParagraphs); err != nil {
+			return err
+		}
+	}
+	setMetadataString(m, "text", truncateText(text.Bytes()))
+	return nil
+}
+
+// pptxSlides returns the slides of a pptx presentation, in order.
+func pptxSlides(z *zip.Reader) []*zip.File {
+	var slides []*zip.File
+	for _, f := range z.File {
+		if path.Dir(f.Name) == "ppt/slides" && slideNumber(f.Name) > 0 {
+			slides = append(slides, f)
+		}
+	}
+	sort.Slice(slides, func(i, j int) bool {
+		return slideNumber(slides[i].Name) < slideNumber(slides[j].Name)
+	})
+	return slides
+}
+
+func slideNumber(name string) int {
+	base := strings.TrimSuffix(path.Base(name), ".xml")
+	n, err := strconv.Atoi(strings.TrimPrefix(base, "slide"))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func findZipFile(z *zip.Reader, name string) *zip.File {
+	for _, f := range z.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func decodeZipXML(z *zip.Reader, name string, v interface{}) error {
+	f := findZipFile(z, name)
+	if f == nil {
+		return os.ErrNotExist
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// textBuffer is a buffer for the text of a document, that ignores what is
+// written after maxTextLength.
+type textBuffer struct {
+	bytes.Buffer
+}
+
+func (b *textBuffer) full() bool {
+	return b.Len() >= maxTextLength+utf8.UTFMax
+}
+
+// readZipXMLText writes to the buffer the character data inside the text
+// elements, with a new line at the end of each paragraph element, and a space
+// for the tabulations and line breaks.
+func readZipXMLText(f *zip.File, text *textBuffer, textElems, paraElems []string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dec := xml.NewDecoder(rc)
+	depth := 0
+	for !text.full() {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if containsString(textElems, t.Name.Local) {
+				depth++
+			}
+			switch t.Name.Local {
+			case "s", "tab", "br", "line-break":
+				text.WriteByte(' ')
+			}
+		case xml.EndElement:
+			if containsString(textElems, t.Name.Local) {
+				depth--
+			}
+			if containsString(paraElems, t.Name.Local) {
+				text.WriteByte('\n')
+			}
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(t)
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateText returns the text, without the invalid UTF-8 sequences, and
+// truncated to maxTextLength bytes.
+func truncateText(b []byte) string {
+	if len(b) > maxTextLength {
+		b = b[:maxTextLength]
+		// Do not cut a multi-bytes character
+		for i := len(b); i > 0 && i > len(b)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(b[i-1]) {
+				if !utf8.FullRune(b[i-1:]) {
+					b = b[:i-1]
+				}
+				break
+			}
+		}
+	}
+	text := strings.Map(func(r rune) rune {
+		if r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, string(b))
+	return strings.TrimSpace(text)
+}
+
+func setMetadataString(m Metadata, key, value string) {
+	if value = strings.TrimSpace(value); value != "" {
+		m[key] = value
+	}
+}
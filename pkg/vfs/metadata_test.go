@@ -1,8 +1,11 @@
 package vfs
 
 import (
+	"archive/zip"
+	"bytes"
 	"io"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -58,3 +61,127 @@ func TestExifMetadataExtractor(t *testing.T) {
 	assert.True(t, ok, "height is present")
 	assert.Equal(t, 294, h)
 }
+
+func TestMarkdownMetadataExtractor(t *testing.T) {
+	doc := &FileDoc{Mime: "text/markdown"}
+	extractor := NewMetaExtractor(doc)
+	assert.NotNil(t, extractor)
+	content := "Some intro\n\n## Shopping list ##\n\n* apples\n* pears\n"
+	_, err := io.Copy(*extractor, strings.NewReader(content))
+	assert.NoError(t, err)
+	assert.NoError(t, (*extractor).Close())
+	meta := (*extractor).Result()
+	assert.Equal(t, MetadataExtractorVersion, meta["extractor_version"])
+	assert.Equal(t, "Shopping list", meta["title"])
+	assert.Equal(t, strings.TrimSpace(content), meta["text"])
+}
+
+func TestTextMetadataExtractorTruncates(t *testing.T) {
+	doc := &FileDoc{Mime: "text/plain"}
+	extractor := NewMetaExtractor(doc)
+	assert.NotNil(t, extractor)
+	content := strings.Repeat("é", maxTextLength)
+	_, err := io.Copy(*extractor, strings.NewReader(content))
+	assert.NoError(t, err)
+	assert.NoError(t, (*extractor).Close())
+	meta := (*extractor).Result()
+	text, ok := meta["text"].(string)
+	assert.True(t, ok, "text is present")
+	assert.Len(t, text, maxTextLength)
+	assert.True(t, strings.HasSuffix(text, "é"))
+	assert.NotContains(t, meta, "title")
+}
+
+func TestODFMetadataExtractor(t *testing.T) {
+	odt := makeZip(t, map[string]string{
+		"meta.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <office:meta>
+    <dc:title>Meeting notes</dc:title>
+    <meta:initial-creator>Alice</meta:initial-creator>
+    <dc:creator>Bob</dc:creator>
+    <dc:language>fr-FR</dc:language>
+    <meta:document-statistic meta:page-count="2" meta:word-count="7"/>
+  </office:meta>
+</office:document-meta>`,
+		"content.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+  <office:body><office:text>
+    <text:h>Agenda</text:h>
+    <text:p>Budget<text:s/>for <text:span>2018</text:span></text:p>
+  </office:text></office:body>
+</office:document-content>`,
+	})
+	doc := &FileDoc{Mime: "application/vnd.oasis.opendocument.text"}
+	extractor := NewDocumentExtractor(doc)
+	assert.NotNil(t, extractor)
+	_, err := io.Copy(*extractor, bytes.NewReader(odt))
+	assert.NoError(t, err)
+	assert.NoError(t, (*extractor).Close())
+	meta := (*extractor).Result()
+	assert.Equal(t, "Meeting notes", meta["title"])
+	assert.Equal(t, "Alice", meta["author"])
+	assert.Equal(t, "fr-FR", meta["language"])
+	assert.Equal(t, 2, meta["pages"])
+	assert.Equal(t, "Agenda\nBudget for 2018", meta["text"])
+}
+
+func TestOOXMLMetadataExtractor(t *testing.T) {
+	docx := makeZip(t, map[string]string{
+		"docProps/core.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <dc:title>Report</dc:title>
+  <dc:creator>Alice</dc:creator>
+  <dc:language>en-US</dc:language>
+</cp:coreProperties>`,
+		"docProps/app.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties">
+  <Pages>3</Pages>
+</Properties>`,
+		"word/document.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+  <w:body>
+    <w:p><w:r><w:t>Hel</w:t></w:r><w:r><w:t>lo</w:t></w:r></w:p>
+    <w:p><w:r><w:t>world</w:t></w:r></w:p>
+  </w:body>
+</w:document>`,
+	})
+	doc := &FileDoc{Mime: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"}
+	extractor := NewDocumentExtractor(doc)
+	assert.NotNil(t, extractor)
+	_, err := io.Copy(*extractor, bytes.NewReader(docx))
+	assert.NoError(t, err)
+	assert.NoError(t, (*extractor).Close())
+	meta := (*extractor).Result()
+	assert.Equal(t, "Report", meta["title"])
+	assert.Equal(t, "Alice", meta["author"])
+	assert.Equal(t, "en-US", meta["language"])
+	assert.Equal(t, 3, meta["pages"])
+	assert.Equal(t, "Hello\nworld", meta["text"])
+}
+
+func TestInvalidDocumentMetadataExtractor(t *testing.T) {
+	doc := &FileDoc{Mime: "application/pdf"}
+	assert.Nil(t, NewMetaExtractor(doc))
+	extractor := NewDocumentExtractor(doc)
+	assert.NotNil(t, extractor)
+	_, err := io.Copy(*extractor, strings.NewReader("not a PDF"))
+	assert.NoError(t, err)
+	assert.NoError(t, (*extractor).Close())
+	meta := (*extractor).Result()
+	assert.Equal(t, MetadataExtractorVersion, meta["extractor_version"])
+	assert.NotContains(t, meta, "text")
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
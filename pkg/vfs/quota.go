@@ -0,0 +1,136 @@
+package vfs
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// DirSize is used to count the size of the files inside a directory that
+// has a quota. It is kept up-to-date by the indexer when the files are
+// created, modified, moved or deleted. Its identifier is the identifier of
+// the directory.
+type DirSize struct {
+	DocID    string `json:"_id,omitempty"`
+	DocRev   string `json:"_rev,omitempty"`
+	Fullpath string `json:"path"`
+	ByteSize int64  `json:"size,string"`
+}
+
+// ID returns the directory size identifier
+func (s *DirSize) ID() string { return s.DocID }
+
+// Rev returns the directory size revision
+func (s *DirSize) Rev() string { return s.DocRev }
+
+// DocType returns the directory size document type
+func (s *DirSize) DocType() string { return consts.FilesSizes }
+
+// Clone implements couchdb.Doc
+func (s *DirSize) Clone() couchdb.Doc {
+	cloned := *s
+	return &cloned
+}
+
+// SetID changes the directory size identifier
+func (s *DirSize) SetID(id string) { s.DocID = id }
+
+// SetRev changes the directory size revision
+func (s *DirSize) SetRev(rev string) { s.DocRev = rev }
+
+// Contains returns true if the given path is inside the directory.
+func (s *DirSize) Contains(fullpath string) bool {
+	return strings.HasPrefix(fullpath, s.Fullpath+"/")
+}
+
+// DirQuota is the quota of a directory, with the size of its files.
+type DirQuota struct {
+	DirID string `json:"dir_id"`
+	Path  string `json:"path"`
+	Quota int64  `json:"quota,string"`
+	Used  int64  `json:"used,string"`
+}
+
+// DirQuotas returns the quotas of the directories, with their usage.
+func DirQuotas(fs Indexer) ([]*DirQuota, error) {
+	sizes, err := fs.DirSizes()
+	if err != nil {
+		return nil, err
+	}
+	quotas := make([]*DirQuota, 0, len(sizes))
+	for _, s := range sizes {
+		dir, err := fs.DirByID(s.ID())
+		if err != nil {
+			continue
+		}
+		if dir.Quota <= 0 {
+			continue
+		}
+		quotas = append(quotas, &DirQuota{
+			DirID: dir.ID(),
+			Path:  dir.Fullpath,
+			Quota: dir.Quota,
+			Used:  s.ByteSize,
+		})
+	}
+	return quotas, nil
+}
+
+// DirUsage returns the size of the files inside a directory with a quota.
+func DirUsage(fs Indexer, dir *DirDoc) (int64, error) {
+	sizes, err := fs.DirSizes()
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sizes {
+		if s.ID() == dir.ID() {
+			return s.ByteSize, nil
+		}
+	}
+	return 0, nil
+}
+
+// DirQuotasMaxSize returns the maximal size of a file created at the given
+// path, with the quotas of the directories that contain it, or -1 if there
+// is no quota. ErrDirQuotaExceeded is returned if the file is too big. The
+// old document is given when the content of an existing file is replaced, as
+// its old size is released.
+func DirQuotasMaxSize(fs Indexer, newpath string, newsize int64, olddoc *FileDoc) (int64, error) {
+	sizes, err := fs.DirSizes()
+	if err != nil || len(sizes) == 0 {
+		return -1, err
+	}
+	var oldpath string
+	if olddoc != nil {
+		if oldpath, err = olddoc.Path(fs); err != nil {
+			return 0, err
+		}
+	}
+	maxsize := int64(-1)
+	for _, s := range sizes {
+		if !s.Contains(newpath) {
+			continue
+		}
+		dir, err := fs.DirByID(s.ID())
+		if err != nil {
+			return 0, err
+		}
+		if dir.Quota <= 0 {
+			continue
+		}
+		free := dir.Quota - s.ByteSize
+		if olddoc != nil && s.Contains(oldpath) {
+			free += olddoc.ByteSize
+		}
+		if free <= 0 || (newsize >= 0 && newsize > free) {
+			return 0, ErrDirQuotaExceeded
+		}
+		if maxsize < 0 || free < maxsize {
+			maxsize = free
+		}
+	}
+	return maxsize, nil
+}
+
+var _ couchdb.Doc = &DirSize{}
@@ -0,0 +1,100 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ThumbFormats are the formats of the thumbnails, with the size of the box
+// where the thumbnail fits.
+var ThumbFormats = map[string]string{
+	"small":  "640x480",
+	"medium": "1280x720",
+	"large":  "1920x1080",
+}
+
+// ThumbFormatsNames is the list of the formats of the thumbnails.
+var ThumbFormatsNames = []string{
+	"small",
+	"medium",
+	"large",
+}
+
+// HasThumbnails returns true if thumbnails are generated for this file: it
+// is the case for the images, the PDFs (from their first page) and the videos
+// (from a keyframe).
+func HasThumbnails(doc *FileDoc) bool {
+	switch doc.Class {
+	case "image", "pdf", "video":
+		return true
+	}
+	return false
+}
+
+var placeholderColors = map[string]color.RGBA{
+	"image": {0x95, 0x99, 0xa1, 0xff},
+	"pdf":   {0xf5, 0x2d, 0x2d, 0xff},
+	"video": {0x7f, 0x6b, 0xee, 0xff},
+}
+
+var placeholderBackground = color.RGBA{0xf5, 0xf6, 0xf7, 0xff}
+
+var (
+	placeholdersMu sync.Mutex
+	placeholders   = make(map[string][]byte)
+)
+
+// ServeThumbPlaceholder serves a placeholder image for a thumbnail that is
+// missing, because it has not been generated yet, or its generation has
+// failed. The placeholder has the size of the format, and a color for the
+// class of the file.
+func ServeThumbPlaceholder(w http.ResponseWriter, req *http.Request, doc *FileDoc, format string) error {
+	if !HasThumbnails(doc) {
+		return os.ErrNotExist
+	}
+	content, err := thumbPlaceholder(doc.Class, format)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("placeholder-%s-%s.jpg", doc.Class, format)
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, req, name, time.Time{}, bytes.NewReader(content))
+	return nil
+}
+
+func thumbPlaceholder(class, format string) ([]byte, error) {
+	size, ok := ThumbFormats[format]
+	if !ok {
+		return nil, ErrInvalidThumbFormat
+	}
+	key := class + "-" + format
+	placeholdersMu.Lock()
+	defer placeholdersMu.Unlock()
+	if content, ok := placeholders[key]; ok {
+		return content, nil
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(size, "%dx%d", &width, &height); err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{placeholderBackground}, image.ZP, draw.Src)
+	side := height / 3
+	icon := image.Rect((width-side)/2, (height-side)/2, (width+side)/2, (height+side)/2)
+	draw.Draw(img, icon, &image.Uniform{placeholderColors[class]}, image.ZP, draw.Src)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 82}); err != nil {
+		return nil, err
+	}
+	placeholders[key] = buf.Bytes()
+	return placeholders[key], nil
+}
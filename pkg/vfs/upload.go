@@ -0,0 +1,403 @@
+package vfs
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+)
+
+// UploadSessionTTL is the duration after which an upload session that has not
+// received any chunk is considered as abandoned, and can be cleaned.
+const UploadSessionTTL = 24 * time.Hour
+
+// maxUploadSize is the maximal size of the content of an upload session, as
+// it is the largest file accepted by the swift and s3 backends.
+const maxUploadSize = 5 << (3 * 10) // 5 GiB
+
+// UploadSession is used for uploading the content of a file in several
+// requests, and resuming the upload after a network failure. The chunks are
+// staged in a temporary area of the Fs, and the file is created (or
+// overwritten) only when the session is finalized.
+//
+// If FileID is empty, a new file will be created with the given name in the
+// DirID directory. Else, the content of the file with this identifier will be
+// replaced.
+type UploadSession struct {
+	DocID      string    `json:"_id,omitempty"`
+	DocRev     string    `json:"_rev,omitempty"`
+	DirID      string    `json:"dir_id,omitempty"`
+	FileID     string    `json:"file_id,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	ByteSize   int64     `json:"size,string"`
+	MD5Sum     []byte    `json:"md5sum,omitempty"`
+	Mime       string    `json:"mime,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	Executable bool      `json:"executable"`
+	Tags       []string  `json:"tags,omitempty"`
+	Offset     int64     `json:"offset,string"`
+	Chunks     []int64   `json:"chunks"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// ID returns the upload session identifier
+func (s *UploadSession) ID() string { return s.DocID }
+
+// Rev returns the upload session revision
+func (s *UploadSession) Rev() string { return s.DocRev }
+
+// DocType returns the upload session document type
+func (s *UploadSession) DocType() string { return consts.FilesUploads }
+
+// Clone implements couchdb.Doc
+func (s *UploadSession) Clone() couchdb.Doc {
+	cloned := *s
+	cloned.MD5Sum = make([]byte, len(s.MD5Sum))
+	copy(cloned.MD5Sum, s.MD5Sum)
+	cloned.Tags = make([]string, len(s.Tags))
+	copy(cloned.Tags, s.Tags)
+	cloned.Chunks = make([]int64, len(s.Chunks))
+	copy(cloned.Chunks, s.Chunks)
+	return &cloned
+}
+
+// SetID changes the upload session identifier
+func (s *UploadSession) SetID(id string) { s.DocID = id }
+
+// SetRev changes the upload session revision
+func (s *UploadSession) SetRev(rev string) { s.DocRev = rev }
+
+// Size returns the expected length in bytes of the content, or -1 if it is
+// unknown.
+func (s *UploadSession) Size() int64 { return s.ByteSize }
+
+// Expired returns true if the session has not been used for too long.
+func (s *UploadSession) Expired() bool {
+	return time.Since(s.UpdatedAt) > UploadSessionTTL
+}
+
+// FileDoc returns the document of the file that will be written when the
+// session is finalized. For an overwrite, olddoc is the current document of
+// the file.
+func (s *UploadSession) FileDoc(olddoc *FileDoc) (*FileDoc, error) {
+	name, dirID, tags := s.Name, s.DirID, s.Tags
+	if olddoc != nil {
+		name, dirID, tags = olddoc.DocName, olddoc.DirID, olddoc.Tags
+	}
+	doc, err := NewFileDoc(name, dirID, s.Offset, s.MD5Sum, s.Mime, s.Class,
+		time.Now(), s.Executable, false, tags)
+	if err != nil {
+		return nil, err
+	}
+	if olddoc != nil {
+		doc.SetID(olddoc.ID())
+		doc.ReferencedBy = olddoc.ReferencedBy
+	}
+	return doc, nil
+}
+
+// NewUploadSession creates and persists a session for uploading the content of
+// newdoc. For an overwrite, olddoc is the current document of the file. The
+// size and md5sum of newdoc are the expected ones, and can be unknown.
+func NewUploadSession(fs VFS, newdoc, olddoc *FileDoc) (*UploadSession, error) {
+	if err := checkUploadQuota(fs, newdoc.ByteSize); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s := &UploadSession{
+		DirID:      newdoc.DirID,
+		Name:       newdoc.DocName,
+		ByteSize:   newdoc.ByteSize,
+		MD5Sum:     newdoc.MD5Sum,
+		Mime:       newdoc.Mime,
+		Class:      newdoc.Class,
+		Executable: newdoc.Executable,
+		Tags:       newdoc.Tags,
+		Chunks:     []int64{},
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if olddoc != nil {
+		s.FileID = olddoc.ID()
+		s.DirID = ""
+		s.Name = ""
+		s.Tags = nil
+	}
+	if err := couchdb.CreateDoc(fs, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetUploadSession returns the upload session with the given identifier.
+func GetUploadSession(fs VFS, sessionID string) (*UploadSession, error) {
+	s := &UploadSession{}
+	err := couchdb.GetDoc(fs, consts.FilesUploads, sessionID, s)
+	if couchdb.IsNotFoundError(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AppendUploadChunk stages a chunk of content for the upload session. The
+// offset must be the number of bytes already received by the session, or
+// ErrUploadOffsetMismatch is returned: it allows the client to resume the
+// upload from the right position after a failure.
+func AppendUploadChunk(fs VFS, sessionID string, offset int64, content io.Reader) (*UploadSession, error) {
+	mu := uploadLock(fs, sessionID)
+	if lockerr := mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer mu.Unlock()
+
+	s, err := GetUploadSession(fs, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if offset != s.Offset {
+		return s, ErrUploadOffsetMismatch
+	}
+
+	// The chunk is limited by the expected size of the file, or else by the
+	// quota, and one more byte is read to detect the bodies that are too long
+	maxsize, err := uploadMaxSize(fs, offset)
+	if err != nil {
+		return nil, err
+	}
+	limit := maxsize
+	if s.ByteSize >= 0 && s.ByteSize-offset < limit {
+		limit = s.ByteSize - offset
+	}
+	n, err := fs.WriteUploadChunk(sessionID, offset, io.LimitReader(content, limit+1))
+	if err == nil {
+		if s.ByteSize >= 0 && offset+n > s.ByteSize {
+			err = ErrContentLengthMismatch
+		} else if n > maxsize {
+			err = ErrFileTooBig
+		}
+	}
+	if err == nil && n > 0 {
+		s.Offset += n
+		s.Chunks = append(s.Chunks, offset)
+	}
+	if err == nil {
+		s.UpdatedAt = time.Now()
+		err = couchdb.UpdateDoc(fs, s)
+	}
+	if err != nil {
+		// The rejected chunk is not kept, as it is not counted in the disk
+		// usage
+		fs.DestroyUploadChunk(sessionID, offset) // #nosec
+		return nil, err
+	}
+	return s, nil
+}
+
+// FinalizeUpload checks the content received by the upload session, and
+// writes it in the file. The md5sum of the whole content is required, either
+// when the session is created or when it is finalized. The staged chunks and
+// the session are removed when the file has been successfully written.
+func FinalizeUpload(fs VFS, sessionID string, md5sum []byte) (newdoc, olddoc *FileDoc, err error) {
+	mu := uploadLock(fs, sessionID)
+	if lockerr := mu.Lock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer mu.Unlock()
+
+	s, err := GetUploadSession(fs, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(md5sum) > 0 {
+		if len(s.MD5Sum) > 0 && string(s.MD5Sum) != string(md5sum) {
+			return nil, nil, ErrInvalidHash
+		}
+		s.MD5Sum = md5sum
+	}
+	if len(s.MD5Sum) == 0 {
+		return nil, nil, ErrUploadMissingHash
+	}
+	if s.ByteSize >= 0 && s.Offset != s.ByteSize {
+		return nil, nil, ErrContentLengthMismatch
+	}
+
+	if s.FileID != "" {
+		olddoc, err = fs.FileByID(s.FileID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	newdoc, err = s.FileDoc(olddoc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	content := &uploadReader{fs: fs, sessionID: sessionID, chunks: s.Chunks}
+	_, err = io.Copy(file, content)
+	content.Close()
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = destroyUploadSession(fs, s); err != nil {
+		return nil, nil, err
+	}
+	return newdoc, olddoc, nil
+}
+
+// AbortUpload removes the upload session and its staged chunks.
+func AbortUpload(fs VFS, sessionID string) error {
+	mu := uploadLock(fs, sessionID)
+	if lockerr := mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer mu.Unlock()
+
+	s, err := GetUploadSession(fs, sessionID)
+	if err != nil {
+		return err
+	}
+	return destroyUploadSession(fs, s)
+}
+
+// CleanUploadSessions removes the upload sessions that have expired, with
+// their staged chunks. It returns the number of removed sessions.
+func CleanUploadSessions(fs VFS) (int, error) {
+	var expired []*UploadSession
+	err := couchdb.ForeachDocs(fs, consts.FilesUploads, func(_ string, data json.RawMessage) error {
+		s := &UploadSession{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return err
+		}
+		if s.Expired() {
+			expired = append(expired, s)
+		}
+		return nil
+	})
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	cleaned := 0
+	for _, s := range expired {
+		err = AbortUpload(fs, s.ID())
+		if err != nil && err != os.ErrNotExist {
+			return cleaned, err
+		}
+		cleaned++
+	}
+	return cleaned, nil
+}
+
+func destroyUploadSession(fs VFS, s *UploadSession) error {
+	if err := fs.DestroyUploadChunks(s.ID()); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(fs, s)
+}
+
+func uploadLock(fs VFS, sessionID string) lock.ErrorRWLocker {
+	return lock.ReadWrite(fs, "uploads/"+sessionID)
+}
+
+// checkUploadQuota returns ErrFileTooBig if a content of the given size can't
+// be added to the VFS without exceeding the disk quota, or if it is larger
+// than maxUploadSize.
+func checkUploadQuota(fs VFS, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	maxsize, err := uploadMaxSize(fs, 0)
+	if err != nil {
+		return err
+	}
+	if size > maxsize {
+		return ErrFileTooBig
+	}
+	return nil
+}
+
+// uploadMaxSize returns the number of bytes that can still be received by an
+// upload session that has already received offset bytes: it is limited by
+// the quota of the instance, and by maxUploadSize.
+func uploadMaxSize(fs VFS, offset int64) (int64, error) {
+	maxsize := maxUploadSize - offset
+	diskQuota := fs.DiskQuota()
+	if diskQuota > 0 {
+		diskUsage, err := fs.DiskUsage()
+		if err != nil {
+			return 0, err
+		}
+		if free := diskQuota - diskUsage - offset; free < maxsize {
+			maxsize = free
+		}
+	}
+	if maxsize < 0 {
+		maxsize = 0
+	}
+	return maxsize, nil
+}
+
+// uploadReader reads the staged chunks of an upload session, one after the
+// other, like if they were a single file.
+type uploadReader struct {
+	fs        Fs
+	sessionID string
+	chunks    []int64
+	current   io.ReadCloser
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			f, err := r.fs.OpenUploadChunk(r.sessionID, r.chunks[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current = f
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *uploadReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+var _ couchdb.Doc = &UploadSession{}
@@ -0,0 +1,222 @@
+package vfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// Version is used for keeping the content of a file that has been
+// overwritten. It is linked to the io.cozy.files document via the FileID
+// field, and it is numbered: the first version of a file has the number 1,
+// the next one 2, etc.
+type Version struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	FileID    string    `json:"file_id"`
+	Number    int       `json:"number"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ByteSize  int64     `json:"size,string"`
+	MD5Sum    []byte    `json:"md5sum"`
+	Mime      string    `json:"mime"`
+	Class     string    `json:"class"`
+	Metadata  Metadata  `json:"metadata,omitempty"`
+}
+
+// ID returns the version identifier
+func (v *Version) ID() string { return v.DocID }
+
+// Rev returns the version revision
+func (v *Version) Rev() string { return v.DocRev }
+
+// DocType returns the version document type
+func (v *Version) DocType() string { return consts.FilesVersions }
+
+// Clone implements couchdb.Doc
+func (v *Version) Clone() couchdb.Doc {
+	cloned := *v
+	cloned.MD5Sum = make([]byte, len(v.MD5Sum))
+	copy(cloned.MD5Sum, v.MD5Sum)
+	cloned.Metadata = make(Metadata, len(v.Metadata))
+	for k, val := range v.Metadata {
+		cloned.Metadata[k] = val
+	}
+	return &cloned
+}
+
+// SetID changes the version identifier
+func (v *Version) SetID(id string) { v.DocID = id }
+
+// SetRev changes the version revision
+func (v *Version) SetRev(rev string) { v.DocRev = rev }
+
+// Size returns the length in bytes of the content of the version
+func (v *Version) Size() int64 { return v.ByteSize }
+
+// MakeVersionID returns the identifier of the version of the given file with
+// the given number.
+func MakeVersionID(fileID string, number int) string {
+	return fileID + "/" + strconv.Itoa(number)
+}
+
+// NewVersion returns a version for the current content of the given file.
+func NewVersion(file *FileDoc, number int) *Version {
+	md5sum := make([]byte, len(file.MD5Sum))
+	copy(md5sum, file.MD5Sum)
+	return &Version{
+		DocID:     MakeVersionID(file.ID(), number),
+		FileID:    file.ID(),
+		Number:    number,
+		CreatedAt: time.Now(),
+		UpdatedAt: file.UpdatedAt,
+		ByteSize:  file.ByteSize,
+		MD5Sum:    md5sum,
+		Mime:      file.Mime,
+		Class:     file.Class,
+		Metadata:  file.Metadata,
+	}
+}
+
+// NextVersionNumber returns the number that should be used for a new version,
+// given the list of the existing versions of a file.
+func NextVersionNumber(versions []*Version) int {
+	number := 0
+	for _, v := range versions {
+		if v.Number > number {
+			number = v.Number
+		}
+	}
+	return number + 1
+}
+
+// VersionsToClean returns the list of versions that should be removed to
+// respect the retention policy: at most maxNumber versions are kept, and the
+// versions older than maxAge are removed (if maxAge is positive).
+func VersionsToClean(versions []*Version, maxNumber int, maxAge time.Duration) []*Version {
+	sorted := make([]*Version, len(versions))
+	copy(sorted, versions)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Number > sorted[j].Number
+	})
+	var toClean []*Version
+	for i, v := range sorted {
+		if i >= maxNumber || (maxAge > 0 && time.Since(v.CreatedAt) > maxAge) {
+			toClean = append(toClean, v)
+		}
+	}
+	return toClean
+}
+
+// CleanOldVersions removes the versions older than the max age of the
+// retention policy. This age is also checked when a new version is written,
+// but the files that are no longer modified need this periodic cleanup. It
+// returns the number of versions removed.
+func CleanOldVersions(fs VFS) (int, error) {
+	maxAge := fs.FileVersionsMaxAge()
+	if maxAge <= 0 {
+		return 0, nil
+	}
+	var expired []*Version
+	err := couchdb.ForeachDocs(fs, consts.FilesVersions, func(_ string, data json.RawMessage) error {
+		v := &Version{}
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+		if time.Since(v.CreatedAt) > maxAge {
+			expired = append(expired, v)
+		}
+		return nil
+	})
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	cleaned := 0
+	for _, v := range expired {
+		if err = fs.DestroyFileVersion(v); err != nil && !os.IsNotExist(err) {
+			return cleaned, err
+		}
+		cleaned++
+	}
+	return cleaned, nil
+}
+
+// VersionsSize returns the total number of bytes used by the given versions.
+func VersionsSize(versions []*Version) int64 {
+	var size int64
+	for _, v := range versions {
+		size += v.ByteSize
+	}
+	return size
+}
+
+// ServeVersionContent replies to a http request using the content of an old
+// version of a file.
+func ServeVersionContent(fs VFS, doc *FileDoc, version *Version, disposition string, req *http.Request, w http.ResponseWriter) error {
+	header := w.Header()
+	header.Set("Content-Type", version.Mime)
+	if disposition != "" {
+		header.Set("Content-Disposition", ContentDisposition(disposition, doc.DocName))
+	}
+
+	if header.Get("Range") == "" {
+		eTag := base64.StdEncoding.EncodeToString(version.MD5Sum)
+		header.Set("Etag", fmt.Sprintf(`"%s"`, eTag))
+	}
+
+	content, err := fs.OpenFileVersion(doc, version)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	http.ServeContent(w, req, doc.DocName, version.UpdatedAt, content)
+	return nil
+}
+
+// RestoreVersion replaces the content of the file by the content of the given
+// version. The current content of the file is kept as a new version, so this
+// operation can be undone.
+func RestoreVersion(fs VFS, olddoc *FileDoc, version *Version) (*FileDoc, error) {
+	content, err := fs.OpenFileVersion(olddoc, version)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	newdoc := olddoc.Clone().(*FileDoc)
+	newdoc.ByteSize = version.ByteSize
+	newdoc.MD5Sum = version.MD5Sum
+	newdoc.Mime = version.Mime
+	newdoc.Class = version.Class
+	newdoc.UpdatedAt = time.Now()
+	newdoc.Metadata = nil
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+var _ couchdb.Doc = &Version{}
@@ -0,0 +1,46 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextVersionNumber(t *testing.T) {
+	assert.Equal(t, 1, NextVersionNumber(nil))
+	versions := []*Version{
+		{Number: 3},
+		{Number: 7},
+		{Number: 5},
+	}
+	assert.Equal(t, 8, NextVersionNumber(versions))
+}
+
+func TestVersionsToClean(t *testing.T) {
+	now := time.Now()
+	versions := []*Version{
+		{Number: 1, CreatedAt: now.Add(-72 * time.Hour)},
+		{Number: 2, CreatedAt: now.Add(-48 * time.Hour)},
+		{Number: 3, CreatedAt: now.Add(-24 * time.Hour)},
+		{Number: 4, CreatedAt: now},
+	}
+
+	toClean := VersionsToClean(versions, 10, 0)
+	assert.Len(t, toClean, 0)
+
+	toClean = VersionsToClean(versions, 2, 0)
+	if assert.Len(t, toClean, 2) {
+		assert.Equal(t, 2, toClean[0].Number)
+		assert.Equal(t, 1, toClean[1].Number)
+	}
+
+	toClean = VersionsToClean(versions, 10, 36*time.Hour)
+	if assert.Len(t, toClean, 2) {
+		assert.Equal(t, 2, toClean[0].Number)
+		assert.Equal(t, 1, toClean[1].Number)
+	}
+
+	toClean = VersionsToClean(versions, 1, 36*time.Hour)
+	assert.Len(t, toClean, 3)
+}
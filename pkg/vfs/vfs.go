@@ -39,6 +39,15 @@ const (
 	// OrphansDirName is the path of the directory used to store data-files added
 	// in the index from a filesystem-check (fsck)
 	OrphansDirName = "/.cozy_orphans"
+	// VersionsDirName is the path of the directory used to store the old
+	// versions of the content of files
+	VersionsDirName = "/.cozy_versions"
+	// UploadsDirName is the path of the directory used to store the chunks of
+	// the upload sessions
+	UploadsDirName = "/.cozy_uploads"
+	// BlobsDirName is the path of the directory used to store the content of
+	// the files by their hash, when the deduplication is enabled
+	BlobsDirName = "/.cozy_blobs"
 )
 
 const (
@@ -86,6 +95,26 @@ type Fs interface {
 	// DestroyFile  destroys a file from the trash.
 	DestroyFile(doc *FileDoc) error
 
+	// OpenFileVersion returns a file handler for reading the content of an old
+	// version of the given file.
+	OpenFileVersion(doc *FileDoc, version *Version) (File, error)
+	// DestroyFileVersion removes an old version of a file, its content and its
+	// document.
+	DestroyFileVersion(version *Version) error
+
+	// WriteUploadChunk stores a chunk of an upload session, starting at the
+	// given offset, in a temporary area. It returns the number of bytes
+	// written. Writing again at the same offset replaces the chunk.
+	WriteUploadChunk(sessionID string, offset int64, content io.Reader) (int64, error)
+	// OpenUploadChunk returns a reader on the chunk of an upload session that
+	// starts at the given offset.
+	OpenUploadChunk(sessionID string, offset int64) (io.ReadCloser, error)
+	// DestroyUploadChunk removes the chunk of an upload session that starts
+	// at the given offset.
+	DestroyUploadChunk(sessionID string, offset int64) error
+	// DestroyUploadChunks removes all the chunks of an upload session.
+	DestroyUploadChunks(sessionID string) error
+
 	// Fsck return the list of inconsistencies in the VFS
 	Fsck(opts FsckOptions) (logbook []*FsckLog, err error)
 }
@@ -121,9 +150,18 @@ type Indexer interface {
 
 	FilePather
 
-	// DiskUsage computes the total size of the files contained in the VFS.
+	// DiskUsage computes the total size of the files contained in the VFS,
+	// including their old versions.
 	DiskUsage() (int64, error)
 
+	// DirSizes returns the sizes of the directories that have a quota.
+	DirSizes() ([]*DirSize, error)
+	// UpdateDirSizes removes the old size of a file from the directories with
+	// a quota that contain its old path, and adds its new size to those that
+	// contain its new path. An empty path is used for a file that is created
+	// or deleted.
+	UpdateDirSizes(oldpath string, oldsize int64, newpath string, newsize int64) error
+
 	// CreateFileDoc creates and add in the index a new file document.
 	CreateFileDoc(doc *FileDoc) error
 	// CreateNamedFileDoc creates and add in the index a new file document with
@@ -148,9 +186,9 @@ type Indexer interface {
 	// DeleteDirDoc removes from the index the specified directory document.
 	DeleteDirDoc(doc *DirDoc) error
 	// DeleteDirDocAndContent removes from the index the specified directory as
-	// well all its children. It returns the list of the children files ids that
+	// well all its children. It returns the list of the children files that
 	// were removed.
-	DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (int64, []string, error)
+	DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (int64, []*FileDoc, error)
 
 	// DirByID returns the directory document information associated with the
 	// specified identifier.
@@ -185,6 +223,34 @@ type Indexer interface {
 
 	BuildTree() (*TreeFile, error)
 	CheckIndexIntegrity() ([]*FsckLog, error)
+
+	// CreateVersion adds in the index the document of an old version of a
+	// file.
+	CreateVersion(v *Version) error
+	// DeleteVersion removes from the index the document of an old version of
+	// a file.
+	DeleteVersion(v *Version) error
+	// AllVersions returns the list of the old versions of the given file,
+	// ordered by their number.
+	AllVersions(fileID string) ([]*Version, error)
+	// VersionByNumber returns the old version of the given file with the
+	// given number.
+	VersionByNumber(fileID string, number int) (*Version, error)
+
+	// AddBlobRef adds a reference to the blob of the content with the given
+	// md5sum, and returns true if it is a new blob. ErrBlobCollision is
+	// returned if the blob has another sha256 or size.
+	AddBlobRef(md5sum, sha256sum []byte, size int64) (bool, error)
+	// RemoveBlobRef removes a reference to the blob of the content with the
+	// given md5sum, and returns true if it was the last one.
+	RemoveBlobRef(md5sum []byte) (bool, error)
+	// SetBlobRefs saves the number of references of a blob. The document of
+	// the blob is removed if this number is zero.
+	SetBlobRefs(blob *Blob) error
+	// CheckBlobsIntegrity compares the references to the blobs with the files
+	// and versions of the index, and with the blobs in storage (given as a map
+	// of their identifiers to their sizes).
+	CheckBlobsIntegrity(stored map[string]int64) ([]*FsckLog, error)
 }
 
 // DiskThresholder it an interface that can be implemeted to known how many space
@@ -193,6 +259,40 @@ type DiskThresholder interface {
 	// DiskQuota returns the total number of bytes allowed to be stored in the
 	// VFS. If minus or equal to zero, it is considered without limit.
 	DiskQuota() int64
+	// MaxFileVersions returns the maximal number of old versions kept for a
+	// file. If minus or equal to zero, the old contents are not kept.
+	MaxFileVersions() int
+	// FileVersionsMaxAge returns the duration after which an old version of a
+	// file is removed. If minus or equal to zero, there is no age limit.
+	FileVersionsMaxAge() time.Duration
+	// Deduplication returns true if the content of the files is stored by its
+	// hash, and shared by the files with the same content.
+	Deduplication() bool
+	// ContentCipher returns the cipher used to encrypt the content of the
+	// files at rest, or nil if the content is not encrypted.
+	ContentCipher() Cipher
+}
+
+// ReadSeekCloser is the interface for the content read from a storage.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Cipher is used by the storage backends to encrypt the content of the files
+// at rest. The md5sum and the size of the files are always computed on the
+// plain content.
+type Cipher interface {
+	// Encrypt returns a writer that encrypts the content before writing it to
+	// w. Closing the returned writer closes w.
+	Encrypt(w io.WriteCloser) (io.WriteCloser, error)
+	// Decrypt returns a file for reading the plain content from the encrypted
+	// content of r. Closing the returned file closes r.
+	Decrypt(r ReadSeekCloser) (File, error)
+	// PlainSize returns the size of the plain content for an encrypted
+	// content of the given size.
+	PlainSize(size int64) int64
 }
 
 // Thumbser defines an interface to define a thumbnail filesystem.
@@ -253,6 +353,7 @@ type DocPatch struct {
 	Executable  *bool      `json:"executable,omitempty"`
 	MD5Sum      *[]byte    `json:"md5sum,omitempty"`
 	Class       *string    `json:"class,omitempty"`
+	Quota       *int64     `json:"quota,omitempty"`
 }
 
 // DirOrFileDoc is a union struct of FileDoc and DirDoc. It is useful to
@@ -284,6 +385,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			DocName:      fd.DocName,
 			DirID:        fd.DirID,
 			RestorePath:  fd.RestorePath,
+			TrashedAt:    fd.TrashedAt,
 			CreatedAt:    fd.CreatedAt,
 			UpdatedAt:    fd.UpdatedAt,
 			ByteSize:     fd.ByteSize,
@@ -766,6 +868,10 @@ func normalizeDocPatch(data, patch *DocPatch, cdate time.Time) (*DocPatch, error
 		patch.Executable = data.Executable
 	}
 
+	if patch.Quota == nil {
+		patch.Quota = data.Quota
+	}
+
 	return patch, nil
 }
 
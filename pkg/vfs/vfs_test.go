@@ -3,6 +3,7 @@ package vfs_test
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
@@ -24,6 +25,8 @@ import (
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
 	"github.com/ncw/swift/swifttest"
 	"github.com/stretchr/testify/assert"
@@ -31,13 +34,34 @@ import (
 
 var fs vfs.VFS
 var diskQuota int64
+var maxFileVersions int
+var fileVersionsMaxAge time.Duration
 
-type diskImpl struct{}
+type diskImpl struct {
+	dedup  bool
+	cipher vfs.Cipher
+}
 
 func (d *diskImpl) DiskQuota() int64 {
 	return diskQuota
 }
 
+func (d *diskImpl) MaxFileVersions() int {
+	return maxFileVersions
+}
+
+func (d *diskImpl) FileVersionsMaxAge() time.Duration {
+	return fileVersionsMaxAge
+}
+
+func (d *diskImpl) Deduplication() bool {
+	return d.dedup
+}
+
+func (d *diskImpl) ContentCipher() vfs.Cipher {
+	return d.cipher
+}
+
 type H map[string]H
 
 func (h H) String() string {
@@ -580,6 +604,43 @@ func TestFileCollision(t *testing.T) {
 	}
 }
 
+func TestTrashedAt(t *testing.T) {
+	doc, err := vfs.NewFileDoc("trashed-at", consts.RootDirID, 3, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = file.Write([]byte("foo"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, file.Close()) {
+		return
+	}
+	assert.Nil(t, doc.TrashedAt)
+
+	trashed, err := vfs.TrashFile(fs, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.NotNil(t, trashed.TrashedAt) {
+		assert.WithinDuration(t, time.Now(), *trashed.TrashedAt, 5*time.Second)
+	}
+
+	fetched, err := fs.FileByID(doc.ID())
+	if assert.NoError(t, err) && assert.NotNil(t, fetched.TrashedAt) {
+		assert.True(t, fetched.TrashedAt.Equal(*trashed.TrashedAt))
+	}
+
+	restored, err := vfs.RestoreFile(fs, trashed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, restored.TrashedAt)
+	assert.NoError(t, fs.DestroyFile(restored))
+}
+
 func TestContentDisposition(t *testing.T) {
 	foo := vfs.ContentDisposition("inline", "foo.jpg")
 	assert.Equal(t, `inline; filename=foo.jpg`, foo)
@@ -655,6 +716,134 @@ func TestArchive(t *testing.T) {
 	}, zipfiles)
 }
 
+func TestDirQuota(t *testing.T) {
+	dir, err := vfs.Mkdir(fs, "/with-quota", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	quota := int64(10)
+	dir, err = vfs.ModifyDirMetadata(fs, dir, &vfs.DocPatch{Quota: &quota})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, quota, dir.Quota)
+
+	doc1, err := vfs.NewFileDoc("foo", dir.ID(), 6, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc1, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("foobar"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	used, err := vfs.DirUsage(fs, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), used)
+
+	doc2, err := vfs.NewFileDoc("bar", dir.ID(), 6, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = fs.CreateFile(doc2, nil)
+	assert.Equal(t, vfs.ErrDirQuotaExceeded, err)
+
+	doc3, err := vfs.NewFileDoc("baz", dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(doc3, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("bazbaz"))
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+	assert.Error(t, f.Close())
+	used, err = vfs.DirUsage(fs, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), used)
+
+	quotas, err := vfs.DirQuotas(fs)
+	if assert.NoError(t, err) && assert.Len(t, quotas, 1) {
+		assert.Equal(t, dir.ID(), quotas[0].DirID)
+		assert.Equal(t, "/with-quota", quotas[0].Path)
+		assert.Equal(t, int64(6), quotas[0].Used)
+	}
+
+	_, err = vfs.TrashFile(fs, doc1)
+	assert.NoError(t, err)
+	used, err = vfs.DirUsage(fs, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), used)
+
+	// Moving a file or a directory inside the directory is also limited by
+	// the quota
+	outside, err := vfs.Mkdir(fs, "/outside-quota", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc4, err := vfs.NewFileDoc("qux", outside.ID(), 8, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(doc4, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("quxquxqu"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	doc4, err = fs.FileByID(doc4.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc4, err = vfs.ModifyFileMetadata(fs, doc4, &vfs.DocPatch{DirID: &dir.DocID})
+	if !assert.NoError(t, err) {
+		return
+	}
+	used, err = vfs.DirUsage(fs, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), used)
+	_, err = vfs.ModifyFileMetadata(fs, doc4, &vfs.DocPatch{DirID: &outside.DocID})
+	assert.NoError(t, err)
+
+	doc5, err := vfs.NewFileDoc("quux", outside.ID(), 6, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(doc5, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("quuxqu"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	renamed := "renamed"
+	_, err = vfs.ModifyDirMetadata(fs, outside, &vfs.DocPatch{Name: &renamed, DirID: &dir.DocID})
+	assert.Equal(t, vfs.ErrDirQuotaExceeded, err)
+	used, err = vfs.DirUsage(fs, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), used)
+	assert.NoError(t, fs.DestroyDirAndContent(outside))
+
+	noquota := int64(0)
+	dir, err = vfs.ModifyDirMetadata(fs, dir, &vfs.DocPatch{Quota: &noquota})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(0), dir.Quota)
+	quotas, err = vfs.DirQuotas(fs)
+	assert.NoError(t, err)
+	assert.Len(t, quotas, 0)
+	assert.NoError(t, fs.DestroyDirAndContent(dir))
+}
+
 func TestCreateFileTooBig(t *testing.T) {
 	diskQuota = 1 << (1 * 10) // 1KB
 	defer func() { diskQuota = 0 }()
@@ -764,6 +953,247 @@ func TestCreateFileTooBig(t *testing.T) {
 	assert.NoError(t, fs.DestroyDirContent(root))
 }
 
+func TestUploadChunkTooBig(t *testing.T) {
+	diskUsage, err := fs.DiskUsage()
+	if !assert.NoError(t, err) {
+		return
+	}
+	diskQuota = diskUsage + 10
+	defer func() { diskQuota = 0 }()
+
+	doc, err := vfs.NewFileDoc("chunks", consts.RootDirID, -1, nil,
+		"text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	s, err := vfs.NewUploadSession(fs, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer vfs.AbortUpload(fs, s.ID())
+
+	// The size of the file is unknown, but the chunk can't exceed the quota,
+	// and it is not kept
+	_, err = vfs.AppendUploadChunk(fs, s.ID(), 0, strings.NewReader("12345678901"))
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+	_, err = fs.OpenUploadChunk(s.ID(), 0)
+	assert.True(t, os.IsNotExist(err))
+
+	s, err = vfs.AppendUploadChunk(fs, s.ID(), 0, strings.NewReader("123456"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(6), s.Offset)
+	}
+	_, err = vfs.AppendUploadChunk(fs, s.ID(), 6, strings.NewReader("78901"))
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+	_, err = fs.OpenUploadChunk(s.ID(), 6)
+	assert.True(t, os.IsNotExist(err))
+	s, err = vfs.GetUploadSession(fs, s.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(6), s.Offset)
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	maxFileVersions = 2
+	defer func() { maxFileVersions = 0 }()
+
+	usedBefore, err := fs.DiskUsage()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doc, err := vfs.NewFileDoc("versioned", consts.RootDirID, -1, nil, "", "", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("content 1"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	for i := 2; i <= 4; i++ {
+		olddoc, err := fs.FileByID(doc.ID())
+		if !assert.NoError(t, err) {
+			return
+		}
+		newdoc := olddoc.Clone().(*vfs.FileDoc)
+		newdoc.ByteSize = -1
+		newdoc.MD5Sum = nil
+		if i == 4 {
+			// The old content is kept even if the file is renamed
+			newdoc.DocName = "versioned-renamed"
+			newdoc.ResetFullpath()
+		}
+		f, err = fs.CreateFile(newdoc, olddoc)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = f.Write([]byte(fmt.Sprintf("content %d", i)))
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+	}
+
+	versions, err := fs.AllVersions(doc.ID())
+	if !assert.NoError(t, err) || !assert.Len(t, versions, 2) {
+		return
+	}
+	assert.Equal(t, 2, versions[0].Number)
+	assert.Equal(t, 3, versions[1].Number)
+
+	current, err := fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := fs.OpenFileVersion(current, versions[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf, err := ioutil.ReadAll(content)
+	assert.NoError(t, err)
+	assert.NoError(t, content.Close())
+	assert.Equal(t, "content 2", string(buf))
+
+	used, err := fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, usedBefore+int64(3*len("content 1")), used)
+
+	restored, err := vfs.RestoreVersion(fs, current, versions[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err = fs.OpenFile(restored)
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf, err = ioutil.ReadAll(content)
+	assert.NoError(t, err)
+	assert.NoError(t, content.Close())
+	assert.Equal(t, "content 2", string(buf))
+
+	versions, err = fs.AllVersions(doc.ID())
+	if !assert.NoError(t, err) || !assert.Len(t, versions, 2) {
+		return
+	}
+	assert.Equal(t, 3, versions[0].Number)
+	assert.Equal(t, 4, versions[1].Number)
+
+	assert.NoError(t, fs.DestroyFileVersion(versions[0]))
+	_, err = fs.VersionByNumber(doc.ID(), 3)
+	assert.True(t, os.IsNotExist(err))
+
+	// The versions older than the max age are removed by the nightly cleanup
+	cleaned, err := vfs.CleanOldVersions(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, cleaned)
+	fileVersionsMaxAge = time.Nanosecond
+	cleaned, err = vfs.CleanOldVersions(fs)
+	fileVersionsMaxAge = 0
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cleaned)
+	versions, err = fs.AllVersions(doc.ID())
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+
+	restored, err = fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, fs.DestroyFile(restored))
+	versions, err = fs.AllVersions(doc.ID())
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+}
+
+func TestDeduplication(t *testing.T) {
+	if !fs.Deduplication() {
+		t.Skip("The deduplication is not enabled for this VFS")
+	}
+
+	dir, err := vfs.Mkdir(fs, "/dedup", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, name := range []string{"foo", "bar"} {
+		doc, err := vfs.NewFileDoc(name, dir.ID(), -1, nil, "", "", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = f.Write([]byte("same content"))
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+	}
+
+	foo, err := fs.FileByPath("/dedup/foo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	blob := &vfs.Blob{}
+	err = couchdb.GetDoc(fs, consts.FilesBlobs, vfs.BlobID(foo.MD5Sum), blob)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, blob.Refs)
+	assert.EqualValues(t, len("same content"), blob.Size())
+	sum := sha256.Sum256([]byte("same content"))
+	assert.Equal(t, sum[:], blob.SHA256Sum)
+
+	// A content with the same md5sum but another sha256 doesn't share the blob
+	blob.SHA256Sum = []byte("another sha256")
+	assert.NoError(t, couchdb.UpdateDoc(fs, blob))
+	doc, err := vfs.NewFileDoc("baz", dir.ID(), -1, nil, "", "", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("same content"))
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.ErrBlobCollision, f.Close())
+	_, err = fs.FileByPath("/dedup/baz")
+	assert.True(t, os.IsNotExist(err))
+	blob.SHA256Sum = sum[:]
+	assert.NoError(t, couchdb.UpdateDoc(fs, blob))
+
+	assert.NoError(t, fs.DestroyFile(foo))
+	bar, err := fs.FileByPath("/dedup/bar")
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := fs.OpenFile(bar)
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf, err := ioutil.ReadAll(content)
+	assert.NoError(t, err)
+	assert.NoError(t, content.Close())
+	assert.Equal(t, "same content", string(buf))
+
+	logs, err := fs.Fsck(vfs.FsckOptions{})
+	assert.NoError(t, err)
+	for _, log := range logs {
+		assert.NotContains(t, []vfs.FsckLogType{vfs.BlobMissing, vfs.BlobOrphan, vfs.BlobRefsMismatch}, log.Type)
+	}
+
+	assert.NoError(t, fs.DestroyDirAndContent(dir))
+	err = couchdb.GetDoc(fs, consts.FilesBlobs, vfs.BlobID(foo.MD5Sum), blob)
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -774,7 +1204,7 @@ func TestMain(m *testing.M) {
 	}
 
 	var rollback func()
-	fs, rollback, err = makeAferoFS()
+	fs, rollback, err = makeAferoFS(false, nil)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -782,7 +1212,7 @@ func TestMain(m *testing.M) {
 	res1 := m.Run()
 	rollback()
 
-	fs, rollback, err = makeSwiftFS(true)
+	fs, rollback, err = makeSwiftFS(true, false, nil)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -790,7 +1220,7 @@ func TestMain(m *testing.M) {
 	res2 := m.Run()
 	rollback()
 
-	fs, rollback, err = makeSwiftFS(false)
+	fs, rollback, err = makeSwiftFS(false, false, nil)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -798,10 +1228,69 @@ func TestMain(m *testing.M) {
 	res3 := m.Run()
 	rollback()
 
-	os.Exit(res1 + res2 + res3)
+	fs, rollback, err = makeAferoFS(true, nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res4 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeSwiftFS(true, true, nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res5 := m.Run()
+	rollback()
+
+	key, err := vfscrypt.NewDataKey()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	contentCipher, err := vfscrypt.New(key)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fs, rollback, err = makeAferoFS(false, contentCipher)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res6 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeSwiftFS(true, true, contentCipher)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res7 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeS3FS(false, nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res8 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeS3FS(true, contentCipher)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res9 := m.Run()
+	rollback()
+
+	os.Exit(res1 + res2 + res3 + res4 + res5 + res6 + res7 + res8 + res9)
 }
 
-func makeAferoFS() (vfs.VFS, func(), error) {
+func makeAferoFS(dedup bool, cipher vfs.Cipher) (vfs.VFS, func(), error) {
 	tempdir, err := ioutil.TempDir("", "cozy-stack")
 	if err != nil {
 		return nil, nil, errors.New("could not create temporary directory")
@@ -809,7 +1298,7 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 
 	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
 	index := vfs.NewCouchdbIndexer(db)
-	aferoFs, err := vfsafero.New(db, index, &diskImpl{}, lock.ReadWrite(db, "vfs-afero-test"),
+	aferoFs, err := vfsafero.New(db, index, &diskImpl{dedup, cipher}, lock.ReadWrite(db, "vfs-afero-test"),
 		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test")
 	if err != nil {
 		return nil, nil, err
@@ -829,6 +1318,20 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 		return nil, nil, err
 	}
 
+	err = couchdb.ResetDB(db, consts.FilesVersions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesBlobs)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	err = aferoFs.InitFs()
 	if err != nil {
 		return nil, nil, err
@@ -837,10 +1340,12 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 	return aferoFs, func() {
 		os.RemoveAll(tempdir)
 		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesBlobs)
 	}, nil
 }
 
-func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
+func makeSwiftFS(layoutV2, dedup bool, cipher vfs.Cipher) (vfs.VFS, func(), error) {
 	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
 	index := vfs.NewCouchdbIndexer(db)
 	swiftSrv, err := swifttest.NewSwiftServer("localhost")
@@ -860,10 +1365,10 @@ func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
 	var swiftFs vfs.VFS
 	if layoutV2 {
 		swiftFs, err = vfsswift.NewV2(db,
-			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swiftv2-test"))
+			index, &diskImpl{dedup, cipher}, lock.ReadWrite(db, "vfs-swiftv2-test"))
 	} else {
 		swiftFs, err = vfsswift.New(db,
-			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swift-test"))
+			index, &diskImpl{cipher: cipher}, lock.ReadWrite(db, "vfs-swift-test"))
 	}
 	if err != nil {
 		return nil, nil, err
@@ -883,6 +1388,20 @@ func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
 		return nil, nil, err
 	}
 
+	err = couchdb.ResetDB(db, consts.FilesVersions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesBlobs)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	err = swiftFs.InitFs()
 	if err != nil {
 		return nil, nil, err
@@ -890,8 +1409,78 @@ func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
 
 	return swiftFs, func() {
 		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesBlobs)
 		if swiftSrv != nil {
 			swiftSrv.Close()
 		}
 	}, nil
 }
+
+// s3TestURL is the URL of the S3 server used for the tests, like a minio
+// server started with docker. It can be changed with the COZY_TEST_S3_URL
+// environment variable.
+func s3TestURL() (*url.URL, error) {
+	u := os.Getenv("COZY_TEST_S3_URL")
+	if u == "" {
+		u = "s3://localhost:9000/cozy-test?AccessKey=minioaccesskey&SecretKey=miniosecretkey&DisableSSL=true"
+	}
+	return url.Parse(u)
+}
+
+func makeS3FS(dedup bool, cipher vfs.Cipher) (vfs.VFS, func(), error) {
+	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	s3URL, err := s3TestURL()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = config.InitS3Client(s3URL); err != nil {
+		return nil, nil, fmt.Errorf("could not connect to the S3 server (minio): %s", err)
+	}
+
+	s3Fs, err := vfss3.New(db, index, &diskImpl{dedup, cipher}, lock.ReadWrite(db, "vfs-s3-test"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesVersions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.FilesBlobs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s3Fs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s3Fs, func() {
+		s3Fs.Delete()
+		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesBlobs)
+	}, nil
+}
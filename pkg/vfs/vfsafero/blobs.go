@@ -0,0 +1,121 @@
+package vfsafero
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+
+	"github.com/cozy/afero"
+)
+
+// blobPath returns the path of the blob with the given identifier. The blobs
+// are spread in sub-directories by the first two characters of their
+// identifier, to avoid having too many entries in a single directory.
+func blobPath(id string) string {
+	return path.Join(vfs.BlobsDirName, id[:2], id)
+}
+
+// commitBlob adds a reference to the blob for the content of doc, that has
+// been written in the temporary file tmppath, with the given sha256. If the
+// blob already exists, the temporary file is just removed. The VFS lock must
+// be held by the caller.
+func (afs *aferoVFS) commitBlob(tmppath string, doc *vfs.FileDoc, sha256sum []byte) error {
+	created, err := afs.Indexer.AddBlobRef(doc.MD5Sum, sha256sum, doc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return afs.fs.Remove(tmppath)
+	}
+	bpath := blobPath(vfs.BlobID(doc.MD5Sum))
+	if err = afs.fs.MkdirAll(path.Dir(bpath), 0755); err == nil {
+		err = afs.fs.Rename(tmppath, bpath)
+	}
+	if err != nil {
+		afs.Indexer.RemoveBlobRef(doc.MD5Sum) // #nosec
+		return err
+	}
+	return nil
+}
+
+// releaseBlob removes a reference to the blob with the given md5sum, and
+// removes its content if it was the last reference. The VFS lock must be held
+// by the caller.
+func (afs *aferoVFS) releaseBlob(md5sum []byte) error {
+	if len(md5sum) == 0 {
+		return nil
+	}
+	last, err := afs.Indexer.RemoveBlobRef(md5sum)
+	if err != nil || !last {
+		return err
+	}
+	err = afs.fs.Remove(blobPath(vfs.BlobID(md5sum)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// releaseBlobsOf removes the references of the given files to their blobs.
+// The errors are ignored, as the files have already been destroyed: the fsck
+// can find the orphan blobs.
+func (afs *aferoVFS) releaseBlobsOf(files []*vfs.FileDoc) {
+	for _, f := range files {
+		afs.releaseBlob(f.MD5Sum) // #nosec
+	}
+}
+
+// keepBlobVersion creates a version for the old content of a file: the
+// version takes over the reference of the file to its blob. The VFS lock must
+// be held by the caller.
+func (afs *aferoVFS) keepBlobVersion(olddoc *vfs.FileDoc) error {
+	maxNumber := afs.MaxFileVersions()
+	if maxNumber <= 0 {
+		return afs.releaseBlob(olddoc.MD5Sum)
+	}
+	versions, err := afs.Indexer.AllVersions(olddoc.ID())
+	if err != nil {
+		afs.releaseBlob(olddoc.MD5Sum) // #nosec
+		return err
+	}
+	v := vfs.NewVersion(olddoc, vfs.NextVersionNumber(versions))
+	if err = afs.Indexer.CreateVersion(v); err != nil {
+		afs.releaseBlob(olddoc.MD5Sum) // #nosec
+		return err
+	}
+	versions = append(versions, v)
+	for _, old := range vfs.VersionsToClean(versions, maxNumber, afs.FileVersionsMaxAge()) {
+		if err = afs.destroyVersion(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedBlobs returns the size of the blobs in the storage, indexed by their
+// identifiers.
+func (afs *aferoVFS) storedBlobs() (map[string]int64, error) {
+	stored := make(map[string]int64)
+	cipher := afs.ContentCipher()
+	err := afero.Walk(afs.fs, vfs.BlobsDirName, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// The temporary files of the uploads in progress start with a dot
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		size := info.Size()
+		if cipher != nil {
+			size = cipher.PlainSize(size)
+		}
+		stored[info.Name()] = size
+		return nil
+	})
+	return stored, err
+}
@@ -4,6 +4,7 @@ package vfsafero
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/magic"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/vfs"
@@ -168,8 +170,10 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 			return nil, err
 		}
 
+		// When the versioning is enabled, the old content is kept and still
+		// counts in the disk usage.
 		var oldsize int64
-		if olddoc != nil {
+		if olddoc != nil && afs.MaxFileVersions() <= 0 {
 			oldsize = olddoc.Size()
 		}
 		maxsize = diskQuota - diskUsage
@@ -192,9 +196,22 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		return nil, vfs.ErrParentInTrash
 	}
 
-	tmppath := newpath
+	// The quotas of the directories that contain the file are also enforced.
+	dirmaxsize, err := vfs.DirQuotasMaxSize(afs.Indexer, newpath, newsize, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	if dirmaxsize >= 0 && (maxsize < 0 || dirmaxsize < maxsize) {
+		maxsize = dirmaxsize
+	}
+
+	tmppath, oldpath := newpath, ""
 	if olddoc != nil {
 		tmppath = fmt.Sprintf("/.%s_%s", olddoc.ID(), olddoc.Rev())
+		oldpath, err = afs.Indexer.FilePath(olddoc)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if olddoc != nil {
@@ -233,11 +250,29 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		}
 	}
 
-	f, err := safeCreateFile(tmppath, newdoc.Mode(), afs.fs)
+	// With the deduplication, the content is written in a temporary file of
+	// the blobs directory, and it will be moved to its blob on Close().
+	if afs.Deduplication() {
+		tmppath = path.Join(vfs.BlobsDirName, fmt.Sprintf(".%s_%s", newdoc.ID(), newdoc.Rev()))
+		if err = afs.fs.MkdirAll(vfs.BlobsDirName, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := safeCreateFile(tmppath, newdoc.Mode(), afs.fs)
+	if err != nil {
+		return nil, err
+	}
+	f, err := afs.writeContent(file)
 	if err != nil {
+		afs.fs.Remove(tmppath) // #nosec
 		return nil, err
 	}
 
+	var sha hash.Hash
+	if afs.Deduplication() {
+		sha = sha256.New()
+	}
 	hash := md5.New() // #nosec
 	extractor := vfs.NewMetaExtractor(newdoc)
 
@@ -251,10 +286,12 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		olddoc:  olddoc,
 		tmppath: tmppath,
 		newpath: newpath,
+		oldpath: oldpath,
 		maxsize: maxsize,
 		capsize: capsize,
 
 		hash: hash,
+		sha:  sha,
 		meta: extractor,
 	}, nil
 }
@@ -265,10 +302,14 @@ func (afs *aferoVFS) DestroyDirContent(doc *vfs.DirDoc) error {
 	}
 	defer afs.mu.Unlock()
 	diskUsage, _ := afs.DiskUsage()
-	destroyed, _, err := afs.Indexer.DeleteDirDocAndContent(doc, true)
+	destroyed, files, err := afs.Indexer.DeleteDirDocAndContent(doc, true)
 	if err != nil {
 		return err
 	}
+	destroyed += afs.destroyVersionsOf(files)
+	if afs.Deduplication() {
+		afs.releaseBlobsOf(files)
+	}
 	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
 	infos, err := afero.ReadDir(afs.fs, doc.Fullpath)
 	if err != nil {
@@ -294,10 +335,14 @@ func (afs *aferoVFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
 	}
 	defer afs.mu.Unlock()
 	diskUsage, _ := afs.DiskUsage()
-	destroyed, _, err := afs.Indexer.DeleteDirDocAndContent(doc, false)
+	destroyed, files, err := afs.Indexer.DeleteDirDocAndContent(doc, false)
 	if err != nil {
 		return err
 	}
+	destroyed += afs.destroyVersionsOf(files)
+	if afs.Deduplication() {
+		afs.releaseBlobsOf(files)
+	}
 	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
 	return afs.fs.RemoveAll(doc.Fullpath)
 }
@@ -308,16 +353,29 @@ func (afs *aferoVFS) DestroyFile(doc *vfs.FileDoc) error {
 	}
 	defer afs.mu.Unlock()
 	diskUsage, _ := afs.DiskUsage()
-	name, err := afs.Indexer.FilePath(doc)
-	if err != nil {
-		return err
-	}
-	vfs.DiskQuotaAfterDestroy(afs, diskUsage, doc.ByteSize)
-	err = afs.fs.Remove(name)
-	if err != nil && !os.IsNotExist(err) {
-		return err
+	if afs.Deduplication() {
+		if err := afs.Indexer.DeleteFileDoc(doc); err != nil {
+			return err
+		}
+		if err := afs.releaseBlob(doc.MD5Sum); err != nil {
+			return err
+		}
+	} else {
+		name, err := afs.Indexer.FilePath(doc)
+		if err != nil {
+			return err
+		}
+		err = afs.fs.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = afs.Indexer.DeleteFileDoc(doc); err != nil {
+			return err
+		}
 	}
-	return afs.Indexer.DeleteFileDoc(doc)
+	destroyed, err := afs.destroyFileVersions(doc.ID())
+	vfs.DiskQuotaAfterDestroy(afs, diskUsage, doc.ByteSize+destroyed)
+	return err
 }
 
 func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
@@ -329,11 +387,44 @@ func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
+	if afs.Deduplication() {
+		name = blobPath(vfs.BlobID(doc.MD5Sum))
+	}
 	f, err := afs.fs.Open(name)
 	if err != nil {
 		return nil, err
 	}
-	return &aferoFileOpen{f}, nil
+	return afs.readContent(f)
+}
+
+// readContent returns a file for reading the content of f. It is decrypted
+// if the encryption of the files is enabled.
+func (afs *aferoVFS) readContent(f afero.File) (vfs.File, error) {
+	c := afs.ContentCipher()
+	if c == nil {
+		return &aferoFileOpen{f}, nil
+	}
+	file, err := c.Decrypt(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// writeContent returns a writer for the content of f. It is encrypted if the
+// encryption of the files is enabled.
+func (afs *aferoVFS) writeContent(f afero.File) (io.WriteCloser, error) {
+	c := afs.ContentCipher()
+	if c == nil {
+		return f, nil
+	}
+	w, err := c.Encrypt(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
 }
 
 func (afs *aferoVFS) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err error) {
@@ -357,6 +448,17 @@ func (afs *aferoVFS) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err err
 	if err != nil {
 		return nil, err
 	}
+	if afs.Deduplication() {
+		var stored map[string]int64
+		if stored, err = afs.storedBlobs(); err != nil {
+			return nil, err
+		}
+		var blobLogs []*vfs.FsckLog
+		if blobLogs, err = afs.Indexer.CheckBlobsIntegrity(stored); err != nil {
+			return nil, err
+		}
+		newLogs = append(newLogs, blobLogs...)
+	}
 	sort.Slice(newLogs, func(i, j int) bool {
 		return newLogs[i].Filename < newLogs[j].Filename
 	})
@@ -382,6 +484,10 @@ func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog) ([]*vfs.F
 		if f != nil {
 			var stat os.FileInfo
 			entries[f.DocName] = struct{}{}
+			// The content of the files are checked with the blobs
+			if afs.Deduplication() {
+				continue
+			}
 			fullpath = path.Join(dir.Fullpath, f.DocName)
 			stat, err = afs.fs.Stat(fullpath)
 			if _, ok := err.(*os.PathError); ok {
@@ -451,7 +557,10 @@ func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog) ([]*vfs.F
 			filename := path.Join(dir.Fullpath, fileinfo.Name())
 			if filename == vfs.WebappsDirName ||
 				filename == vfs.KonnectorsDirName ||
-				filename == vfs.ThumbsDirName {
+				filename == vfs.ThumbsDirName ||
+				filename == vfs.VersionsDirName ||
+				filename == vfs.UploadsDirName ||
+				filename == vfs.BlobsDirName {
 				continue
 			}
 			if fileinfo.Size() == 0 {
@@ -497,8 +606,24 @@ func fileInfosToFileDoc(dir *vfs.DirDoc, fullpath string, fileinfo os.FileInfo)
 func (afs *aferoVFS) fsckPrune(logbook []*vfs.FsckLog, dryrun bool) {
 	for _, entry := range logbook {
 		switch entry.Type {
-		case vfs.IndexOrphanTree, vfs.IndexBadFullpath, vfs.FileMissing, vfs.IndexMissing:
+		case vfs.IndexOrphanTree, vfs.IndexBadFullpath, vfs.FileMissing, vfs.IndexMissing,
+			vfs.BlobMissing, vfs.BlobRefsMismatch:
 			vfs.FsckPrune(afs, afs.Indexer, entry, dryrun)
+		case vfs.BlobOrphan:
+			entry.PruneAction = "deleting the blob"
+			if dryrun {
+				continue
+			}
+			err := afs.fs.Remove(blobPath(entry.Blob.ID()))
+			if err != nil && !os.IsNotExist(err) {
+				entry.PruneError = err
+				continue
+			}
+			blob := entry.Blob.Clone().(*vfs.Blob)
+			blob.Refs = 0
+			if err = afs.Indexer.SetBlobRefs(blob); err != nil {
+				entry.PruneError = err
+			}
 		case vfs.TypeMismatch:
 			if entry.IsFile {
 				// file on couchdb and directory on swift: we update the index to
@@ -547,7 +672,8 @@ func (afs *aferoVFS) fsckPrune(logbook []*vfs.FsckLog, dryrun bool) {
 
 // UpdateFileDoc overrides the indexer's one since the afero.Fs is by essence
 // also indexed by path. When moving a file, the index has to be moved and the
-// filesystem should also be updated.
+// filesystem should also be updated. With the deduplication, the content is
+// stored in a blob and only the index has to be updated.
 //
 // @override Indexer.UpdateFileDoc
 func (afs *aferoVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
@@ -555,6 +681,18 @@ func (afs *aferoVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
+	if afs.Deduplication() {
+		if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+			exists, err := afs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return os.ErrExist
+			}
+		}
+		return afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	}
 	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
 		oldpath, err := afs.Indexer.FilePath(olddoc)
 		if err != nil {
@@ -686,17 +824,19 @@ func (f *aferoFileOpen) Close() error {
 //
 // aferoFileCreation implements io.WriteCloser.
 type aferoFileCreation struct {
-	f       afero.File         // file handle
+	f       io.WriteCloser     // file handle
 	w       int64              // total size written
 	size    int64              // total file size, -1 if unknown
 	afs     *aferoVFS          // parent vfs
 	newdoc  *vfs.FileDoc       // new document
 	olddoc  *vfs.FileDoc       // old document
 	newpath string             // file new path
+	oldpath string             // file old path, for keeping its content as a version
 	tmppath string             // temporary file path for uploading a new version of this file
 	maxsize int64              // maximum size allowed for the file
 	capsize int64              // size cap from which we send a notification to the user
 	hash    hash.Hash          // hash we build up along the file
+	sha     hash.Hash          // sha256 of the content, for the deduplication
 	meta    *vfs.MetaExtractor // extracts metadata from the content
 	err     error              // write error
 }
@@ -738,6 +878,10 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 		}
 	}
 
+	if f.sha != nil {
+		f.sha.Write(p) // #nosec
+	}
+
 	_, err = f.hash.Write(p)
 	return n, err
 }
@@ -745,9 +889,13 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 func (f *aferoFileCreation) Close() (err error) {
 	defer func() {
 		if err == nil {
-			if f.olddoc != nil {
+			if f.olddoc != nil && !f.afs.Deduplication() {
 				// move the temporary file to its final location
 				f.afs.fs.Rename(f.tmppath, f.newpath) // #nosec
+				if f.oldpath != f.newpath {
+					// the old content may have not been kept as a version
+					f.afs.fs.Remove(f.oldpath) // #nosec
+				}
 			}
 			if f.capsize > 0 && f.size >= f.capsize {
 				vfs.PushDiskQuotaAlert(f.afs, true)
@@ -817,7 +965,27 @@ func (f *aferoFileCreation) Close() (err error) {
 		return lockerr
 	}
 	defer f.afs.mu.Unlock()
-	return f.afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	dedup := f.afs.Deduplication()
+	if dedup {
+		if err = f.afs.commitBlob(f.tmppath, newdoc, f.sha.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	if err = f.afs.Indexer.UpdateFileDoc(olddoc, newdoc); err != nil {
+		if dedup {
+			f.afs.releaseBlob(newdoc.MD5Sum) // #nosec
+		}
+		return err
+	}
+	if f.olddoc != nil {
+		// The old content is moved to the versions directory before the
+		// temporary file takes its place (see the deferred function).
+		if errv := f.afs.keepVersion(f.olddoc, f.oldpath); errv != nil {
+			logger.WithDomain(f.afs.domain).WithField("nspace", "vfsafero").
+				Warnf("Could not keep the old version of %s: %s", f.olddoc.ID(), errv)
+		}
+	}
+	return nil
 }
 
 func safeCreateFile(name string, mode os.FileMode, fs afero.Fs) (afero.File, error) {
@@ -0,0 +1,54 @@
+package vfsafero
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func (afs *aferoVFS) WriteUploadChunk(sessionID string, offset int64, content io.Reader) (int64, error) {
+	dir := path.Join(vfs.UploadsDirName, sessionID)
+	if err := afs.fs.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	file, err := afs.fs.OpenFile(uploadChunkPath(sessionID, offset), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	f, err := afs.writeContent(file)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, content)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (afs *aferoVFS) OpenUploadChunk(sessionID string, offset int64) (io.ReadCloser, error) {
+	f, err := afs.fs.Open(uploadChunkPath(sessionID, offset))
+	if err != nil {
+		return nil, err
+	}
+	return afs.readContent(f)
+}
+
+func (afs *aferoVFS) DestroyUploadChunk(sessionID string, offset int64) error {
+	err := afs.fs.Remove(uploadChunkPath(sessionID, offset))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (afs *aferoVFS) DestroyUploadChunks(sessionID string) error {
+	return afs.fs.RemoveAll(path.Join(vfs.UploadsDirName, sessionID))
+}
+
+func uploadChunkPath(sessionID string, offset int64) string {
+	return path.Join(vfs.UploadsDirName, sessionID, fmt.Sprintf("%020d", offset))
+}
@@ -0,0 +1,133 @@
+package vfsafero
+
+import (
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func (afs *aferoVFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.RUnlock()
+	name := versionPath(version)
+	if afs.Deduplication() {
+		name = blobPath(vfs.BlobID(version.MD5Sum))
+	}
+	f, err := afs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return afs.readContent(f)
+}
+
+func (afs *aferoVFS) DestroyFileVersion(version *vfs.Version) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	diskUsage, _ := afs.DiskUsage()
+	if err := afs.destroyVersion(version); err != nil {
+		return err
+	}
+	vfs.DiskQuotaAfterDestroy(afs, diskUsage, version.ByteSize)
+	return nil
+}
+
+// keepVersion moves the current content of the file to the versions
+// directory, and removes the old versions that are not kept by the retention
+// policy. The VFS lock must be held by the caller.
+func (afs *aferoVFS) keepVersion(olddoc *vfs.FileDoc, oldpath string) error {
+	if afs.Deduplication() {
+		return afs.keepBlobVersion(olddoc)
+	}
+	maxNumber := afs.MaxFileVersions()
+	if maxNumber <= 0 {
+		return nil
+	}
+	versions, err := afs.Indexer.AllVersions(olddoc.ID())
+	if err != nil {
+		return err
+	}
+	v := vfs.NewVersion(olddoc, vfs.NextVersionNumber(versions))
+	vpath := versionPath(v)
+	if err = afs.fs.MkdirAll(path.Dir(vpath), 0755); err != nil {
+		return err
+	}
+	if err = afs.fs.Rename(oldpath, vpath); err != nil {
+		return err
+	}
+	if err = afs.Indexer.CreateVersion(v); err != nil {
+		afs.fs.Rename(vpath, oldpath) // #nosec
+		return err
+	}
+	versions = append(versions, v)
+	for _, old := range vfs.VersionsToClean(versions, maxNumber, afs.FileVersionsMaxAge()) {
+		if err = afs.destroyVersion(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroyVersion removes the content and the document of a version. The VFS
+// lock must be held by the caller.
+func (afs *aferoVFS) destroyVersion(version *vfs.Version) error {
+	if afs.Deduplication() {
+		if err := afs.Indexer.DeleteVersion(version); err != nil {
+			return err
+		}
+		return afs.releaseBlob(version.MD5Sum)
+	}
+	err := afs.fs.Remove(versionPath(version))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return afs.Indexer.DeleteVersion(version)
+}
+
+// destroyFileVersions removes all the versions of a file, and returns the
+// number of bytes that were used by them. The VFS lock must be held by the
+// caller.
+func (afs *aferoVFS) destroyFileVersions(fileID string) (int64, error) {
+	versions, err := afs.Indexer.AllVersions(fileID)
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+	if afs.Deduplication() {
+		for _, v := range versions {
+			if err = afs.destroyVersion(v); err != nil {
+				return 0, err
+			}
+		}
+		return vfs.VersionsSize(versions), nil
+	}
+	for _, v := range versions {
+		if err = afs.Indexer.DeleteVersion(v); err != nil {
+			return 0, err
+		}
+	}
+	if err = afs.fs.RemoveAll(path.Join(vfs.VersionsDirName, fileID)); err != nil {
+		return 0, err
+	}
+	return vfs.VersionsSize(versions), nil
+}
+
+// destroyVersionsOf removes the versions of the given files, and returns the
+// number of bytes that were used by them. The errors are ignored, as the files
+// have already been destroyed.
+func (afs *aferoVFS) destroyVersionsOf(files []*vfs.FileDoc) int64 {
+	var destroyed int64
+	for _, f := range files {
+		size, _ := afs.destroyFileVersions(f.ID())
+		destroyed += size
+	}
+	return destroyed
+}
+
+func versionPath(version *vfs.Version) string {
+	return path.Join(vfs.VersionsDirName, version.FileID, strconv.Itoa(version.Number))
+}
@@ -0,0 +1,339 @@
+// Package vfscrypt is used to encrypt the content of the files at rest, in
+// the storage of the VFS (local file system or swift).
+//
+// The content is split in segments of 64KiB, and each segment is sealed with
+// AES-256-GCM. A header with a random salt is written at the beginning of the
+// encrypted content, and a key specific to the file is derived from the data
+// key of the instance and this salt. The nonce of a segment is its index, with
+// a flag for the last segment, so that the segments can't be reordered or
+// truncated without being detected.
+//
+// As the segments can be decrypted independently, the reader supports Seek
+// and ReadAt, for range requests and thumbnails.
+package vfscrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+const (
+	// KeyLen is the length in bytes of a data key
+	KeyLen = 32
+
+	magic       = "COZYENC1"
+	saltLen     = 16
+	headerLen   = len(magic) + saltLen
+	segmentLen  = 64 * 1024
+	overheadLen = 16 // The size of the GCM tag
+)
+
+var (
+	// ErrBadKey is used when the data key does not have the expected length
+	ErrBadKey = errors.New("vfscrypt: bad data key")
+	// ErrBadHeader is used when the encrypted content does not start with a
+	// valid header
+	ErrBadHeader = errors.New("vfscrypt: bad header")
+	// ErrCorrupted is used when a segment of the content can't be authenticated
+	ErrCorrupted = errors.New("vfscrypt: the content is corrupted")
+)
+
+// Cipher encrypts and decrypts the content of the files with the data key of
+// an instance. It implements the vfs.Cipher interface.
+type Cipher struct {
+	key []byte
+}
+
+// NewDataKey generates a random data key for an instance.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeyLen)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// New returns a cipher for the given data key.
+func New(key []byte) (*Cipher, error) {
+	if len(key) != KeyLen {
+		return nil, ErrBadKey
+	}
+	return &Cipher{key: key}, nil
+}
+
+// EncryptedSize returns the size of the encrypted content for a plain content
+// of the given size.
+func EncryptedSize(size int64) int64 {
+	segments := (size + segmentLen - 1) / segmentLen
+	if segments == 0 {
+		segments = 1
+	}
+	return int64(headerLen) + size + segments*overheadLen
+}
+
+// PlainSize returns the size of the plain content for an encrypted content of
+// the given size.
+func PlainSize(size int64) int64 {
+	body := size - int64(headerLen)
+	if body < overheadLen {
+		return 0
+	}
+	segments := (body + segmentLen + overheadLen - 1) / (segmentLen + overheadLen)
+	return body - segments*overheadLen
+}
+
+// PlainSize is the same as the PlainSize function, for the vfs.Cipher
+// interface.
+func (c *Cipher) PlainSize(size int64) int64 {
+	return PlainSize(size)
+}
+
+func (c *Cipher) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(salt) // #nosec
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(aead cipher.AEAD, index int64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// Encrypt returns a writer that encrypts the content written to it, and
+// writes the encrypted content to w. Closing the writer closes w.
+func (c *Cipher) Encrypt(w io.WriteCloser) (io.WriteCloser, error) {
+	salt := make([]byte, saltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.fileAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{
+		w:      w,
+		aead:   aead,
+		header: append([]byte(magic), salt...),
+		buf:    make([]byte, 0, segmentLen),
+	}, nil
+}
+
+// Decrypt returns a file for reading the plain content of the encrypted
+// content of r. Closing the file closes r.
+func (c *Cipher) Decrypt(r vfs.ReadSeekCloser) (vfs.File, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size < int64(headerLen+overheadLen) {
+		return nil, ErrBadHeader
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerLen)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return nil, ErrBadHeader
+	}
+	aead, err := c.fileAEAD(header[len(magic):])
+	if err != nil {
+		return nil, err
+	}
+	plain := PlainSize(size)
+	last := int64(0)
+	if plain > 0 {
+		last = (plain - 1) / segmentLen
+	}
+	return &reader{
+		r:       r,
+		aead:    aead,
+		size:    plain,
+		last:    last,
+		rpos:    int64(headerLen),
+		current: -1,
+	}, nil
+}
+
+type writer struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  int64
+	sealed []byte
+	err    error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// A full segment is only sealed when more content arrives, as the last
+		// segment is sealed with a different nonce on Close.
+		if len(w.buf) == segmentLen {
+			if w.err = w.flush(false); w.err != nil {
+				return 0, w.err
+			}
+		}
+		l := segmentLen - len(w.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		w.buf = append(w.buf, p[:l]...)
+		p = p[l:]
+	}
+	return n, nil
+}
+
+func (w *writer) flush(last bool) error {
+	if w.header != nil {
+		if _, err := w.w.Write(w.header); err != nil {
+			return err
+		}
+		w.header = nil
+	}
+	nonce := segmentNonce(w.aead, w.index, last)
+	w.sealed = w.aead.Seal(w.sealed[:0], nonce, w.buf, nil)
+	if _, err := w.w.Write(w.sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+func (w *writer) Close() error {
+	err := w.err
+	if err == nil {
+		err = w.flush(true)
+	}
+	if errc := w.w.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+type reader struct {
+	r       vfs.ReadSeekCloser
+	aead    cipher.AEAD
+	size    int64 // size of the plain content
+	last    int64 // index of the last segment
+	pos     int64 // position in the plain content
+	rpos    int64 // position in the encrypted content
+	current int64 // index of the segment in plain
+	plain   []byte
+	sealed  []byte
+}
+
+// load decrypts the segment with the given index, if it is not the current
+// one. The position in the underlying reader is kept to avoid seeking for
+// sequential reads.
+func (r *reader) load(index int64) error {
+	if index == r.current {
+		return nil
+	}
+	offset := int64(headerLen) + index*(segmentLen+overheadLen)
+	if offset != r.rpos {
+		if _, err := r.r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		r.rpos = offset
+	}
+	if r.sealed == nil {
+		r.sealed = make([]byte, segmentLen+overheadLen)
+	}
+	n, err := io.ReadFull(r.r, r.sealed)
+	r.rpos += int64(n)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	nonce := segmentNonce(r.aead, index, index == r.last)
+	r.plain, err = r.aead.Open(r.plain[:0], nonce, r.sealed[:n], nil)
+	if err != nil {
+		r.current = -1
+		return ErrCorrupted
+	}
+	r.current = index
+	return nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		if err := r.load(off / segmentLen); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], r.plain[off%segmentLen:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *reader) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (r *reader) Close() error {
+	return r.r.Close()
+}
+
+var (
+	_ vfs.Cipher = &Cipher{}
+	_ vfs.File   = &reader{}
+)
@@ -0,0 +1,140 @@
+package vfscrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type buffer struct {
+	*bytes.Buffer
+}
+
+func (b buffer) Close() error { return nil }
+
+type readSeeker struct {
+	*bytes.Reader
+}
+
+func (r readSeeker) Close() error { return nil }
+
+func newCipher(t *testing.T) *Cipher {
+	key, err := NewDataKey()
+	assert.NoError(t, err)
+	c, err := New(key)
+	assert.NoError(t, err)
+	return c
+}
+
+func encrypt(t *testing.T, c *Cipher, plain []byte) []byte {
+	buf := buffer{new(bytes.Buffer)}
+	w, err := c.Encrypt(buf)
+	assert.NoError(t, err)
+	// Write in small pieces to cross the segment boundaries
+	for p := plain; len(p) > 0; {
+		l := 1000
+		if l > len(p) {
+			l = len(p)
+		}
+		_, err = w.Write(p[:l])
+		assert.NoError(t, err)
+		p = p[l:]
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestNew(t *testing.T) {
+	_, err := New([]byte("too short"))
+	assert.Equal(t, ErrBadKey, err)
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := newCipher(t)
+	for _, size := range []int{0, 1, 1000, segmentLen - 1, segmentLen, segmentLen + 1, 3*segmentLen + 42} {
+		plain := make([]byte, size)
+		_, err := rand.Read(plain)
+		assert.NoError(t, err)
+
+		encrypted := encrypt(t, c, plain)
+		assert.EqualValues(t, EncryptedSize(int64(size)), len(encrypted))
+		assert.EqualValues(t, size, PlainSize(int64(len(encrypted))))
+
+		f, err := c.Decrypt(readSeeker{bytes.NewReader(encrypted)})
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plain, got), "size %d", size)
+		assert.NoError(t, f.Close())
+	}
+}
+
+func TestSeekAndReadAt(t *testing.T) {
+	c := newCipher(t)
+	plain := make([]byte, 2*segmentLen+500)
+	_, err := rand.Read(plain)
+	assert.NoError(t, err)
+	encrypted := encrypt(t, c, plain)
+
+	f, err := c.Decrypt(readSeeker{bytes.NewReader(encrypted)})
+	assert.NoError(t, err)
+
+	buf := make([]byte, 200)
+	n, err := f.ReadAt(buf, segmentLen-100)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, n)
+	assert.Equal(t, plain[segmentLen-100:segmentLen+100], buf)
+
+	pos, err := f.Seek(-300, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(plain)-300, pos)
+	rest, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, plain[len(plain)-300:], rest)
+
+	_, err = f.Seek(10, io.SeekStart)
+	assert.NoError(t, err)
+	n, err = f.Read(buf[:10])
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, plain[10:20], buf[:10])
+
+	n, err = f.ReadAt(buf, int64(len(plain))-50)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 50, n)
+}
+
+func TestTampering(t *testing.T) {
+	c := newCipher(t)
+	plain := make([]byte, 2*segmentLen)
+	encrypted := encrypt(t, c, plain)
+
+	// A modified byte
+	altered := append([]byte{}, encrypted...)
+	altered[headerLen+10] ^= 1
+	f, err := c.Decrypt(readSeeker{bytes.NewReader(altered)})
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(f)
+	assert.Equal(t, ErrCorrupted, err)
+
+	// A truncated content, on a segment boundary
+	truncated := encrypted[:headerLen+segmentLen+overheadLen]
+	f, err = c.Decrypt(readSeeker{bytes.NewReader(truncated)})
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(f)
+	assert.Equal(t, ErrCorrupted, err)
+
+	// Another key
+	f, err = newCipher(t).Decrypt(readSeeker{bytes.NewReader(encrypted)})
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(f)
+	assert.Equal(t, ErrCorrupted, err)
+
+	// Not an encrypted content
+	_, err = c.Decrypt(readSeeker{bytes.NewReader(plain)})
+	assert.Equal(t, ErrBadHeader, err)
+}
@@ -0,0 +1,111 @@
+package vfss3
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+const (
+	blobsPrefix    = "blobs/"
+	blobsTmpPrefix = "blobs-tmp/"
+)
+
+// s3Blobs is used when the deduplication is enabled: the content of the files
+// is stored with the <prefix>/blobs/<md5sum> keys, and shared by all the files
+// and versions with the same content.
+type s3Blobs struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+	index  vfs.Indexer
+	cipher vfs.Cipher
+}
+
+func (sb *s3Blobs) key(md5sum []byte) string {
+	return sb.prefix + blobsPrefix + vfs.BlobID(md5sum)
+}
+
+// tmpKey returns the key of a temporary object where the content of a file
+// can be uploaded before its md5sum is known.
+func (sb *s3Blobs) tmpKey(docID string) string {
+	return sb.prefix + blobsTmpPrefix + docID + "-" + utils.RandomString(16)
+}
+
+// commit adds a reference to the blob for the content of doc, that has been
+// uploaded in the tmpKey object, with the given sha256. If the blob already
+// exists, the temporary object is just removed. The VFS lock must be held by
+// the caller.
+func (sb *s3Blobs) commit(tmpKey string, doc *vfs.FileDoc, sha256sum []byte) error {
+	created, err := sb.index.AddBlobRef(doc.MD5Sum, sha256sum, doc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if created {
+		// There is no move operation with S3: the object is copied, and the
+		// temporary object is removed
+		var dst minio.DestinationInfo
+		dst, err = minio.NewDestinationInfo(sb.bucket, sb.key(doc.MD5Sum), nil, nil)
+		if err == nil {
+			err = sb.c.CopyObject(dst, minio.NewSourceInfo(sb.bucket, tmpKey, nil))
+		}
+		if err != nil {
+			sb.index.RemoveBlobRef(doc.MD5Sum) // #nosec
+			return err
+		}
+	}
+	return sb.c.RemoveObject(sb.bucket, tmpKey)
+}
+
+// release removes a reference to the blob with the given md5sum, and removes
+// its content if it was the last reference. The VFS lock must be held by the
+// caller.
+func (sb *s3Blobs) release(md5sum []byte) error {
+	if len(md5sum) == 0 {
+		return nil
+	}
+	last, err := sb.index.RemoveBlobRef(md5sum)
+	if err != nil || !last {
+		return err
+	}
+	err = sb.c.RemoveObject(sb.bucket, sb.key(md5sum))
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (sb *s3Blobs) open(md5sum []byte) (vfs.File, error) {
+	return openContent(sb.c, sb.bucket, sb.key(md5sum), sb.cipher)
+}
+
+// stored returns the size of the blobs in the bucket, indexed by their
+// identifiers.
+func (sb *s3Blobs) stored() (map[string]int64, error) {
+	objs, err := listObjects(sb.c, sb.bucket, sb.prefix+blobsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]int64, len(objs))
+	for _, obj := range objs {
+		size := obj.Size
+		if sb.cipher != nil {
+			size = sb.cipher.PlainSize(size)
+		}
+		stored[strings.TrimPrefix(obj.Key, sb.prefix+blobsPrefix)] = size
+	}
+	return stored, nil
+}
+
+// pruneOrphan removes a blob that is not referenced by any file or version.
+func (sb *s3Blobs) pruneOrphan(blob *vfs.Blob) error {
+	err := sb.c.RemoveObject(sb.bucket, sb.prefix+blobsPrefix+blob.ID())
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	cleared := blob.Clone().(*vfs.Blob)
+	cleared.Refs = 0
+	return sb.index.SetBlobRefs(cleared)
+}
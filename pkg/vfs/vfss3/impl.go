@@ -0,0 +1,956 @@
+// Package vfss3 is the implementation of the VFS for the S3-compatible object
+// storages, like MinIO or Ceph RGW.
+//
+// The stack uses a single bucket, and the objects of an instance have keys
+// starting with its prefix. Like the swift layout v2, the content of a file is
+// stored in an object named after the identifier of the file, so that moving
+// or renaming files and directories only changes the index.
+package vfss3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	multierror "github.com/hashicorp/go-multierror"
+	minio "github.com/minio/minio-go"
+	"github.com/sirupsen/logrus"
+)
+
+const maxFileSize = 5 << (3 * 10) // 5 GiB
+
+const filesPrefix = "files/"
+
+type s3VFS struct {
+	vfs.Indexer
+	vfs.DiskThresholder
+	c      *minio.Client
+	bucket string
+	domain string
+	prefix string
+	mu     lock.ErrorRWLocker
+	log    *logrus.Entry
+}
+
+// New returns a vfs.VFS instance associated with the specified indexer and
+// the S3 client of the configuration.
+func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		c:      config.GetS3Client(),
+		bucket: config.S3Bucket(),
+		domain: db.DomainName(),
+		prefix: db.DBPrefix(),
+		mu:     mu,
+		log:    logger.WithDomain(db.DomainName()).WithField("nspace", "vfss3"),
+	}, nil
+}
+
+// MakeObjectName builds the name of the object for a given file document. It
+// creates a virtual subfolder by splitting the document ID, which should be 32
+// bytes long, like the swift layout v2.
+func MakeObjectName(docID string) string {
+	if len(docID) != 32 {
+		return docID
+	}
+	return docID[:22] + "/" + docID[22:27] + "/" + docID[27:]
+}
+
+func makeDocID(objName string) string {
+	if len(objName) != 34 {
+		return objName
+	}
+	return objName[:22] + objName[23:28] + objName[29:]
+}
+
+// keyPrefix returns the prefix of the keys of all the objects of the
+// instance.
+func (sfs *s3VFS) keyPrefix() string {
+	return sfs.prefix + "/"
+}
+
+func (sfs *s3VFS) fileKey(docID string) string {
+	return sfs.keyPrefix() + filesPrefix + MakeObjectName(docID)
+}
+
+func (sfs *s3VFS) versions() *s3Versions {
+	sv := &s3Versions{
+		c:      sfs.c,
+		bucket: sfs.bucket,
+		prefix: sfs.keyPrefix(),
+		index:  sfs.Indexer,
+		disk:   sfs.DiskThresholder,
+	}
+	if sfs.Deduplication() {
+		sv.blobs = sfs.blobs()
+	}
+	return sv
+}
+
+func (sfs *s3VFS) blobs() *s3Blobs {
+	return &s3Blobs{
+		c:      sfs.c,
+		bucket: sfs.bucket,
+		prefix: sfs.keyPrefix(),
+		index:  sfs.Indexer,
+		cipher: sfs.ContentCipher(),
+	}
+}
+
+func (sfs *s3VFS) uploads() *s3Uploads {
+	return &s3Uploads{
+		c:      sfs.c,
+		bucket: sfs.bucket,
+		prefix: sfs.keyPrefix(),
+		cipher: sfs.ContentCipher(),
+	}
+}
+
+func (sfs *s3VFS) DBPrefix() string {
+	return sfs.prefix
+}
+
+func (sfs *s3VFS) DomainName() string {
+	return sfs.domain
+}
+
+func (sfs *s3VFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: sfs.DiskThresholder,
+		c:               sfs.c,
+		bucket:          sfs.bucket,
+		domain:          sfs.domain,
+		prefix:          sfs.prefix,
+		mu:              sfs.mu,
+		log:             sfs.log,
+	}
+}
+
+// InitFs only creates the index: there is no container to create with S3, as
+// the objects of all the instances are in the same bucket.
+func (sfs *s3VFS) InitFs() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.Indexer.InitIndex()
+}
+
+func (sfs *s3VFS) Delete() error {
+	sfs.log.Infof("Deleting the objects with the prefix %q", sfs.keyPrefix())
+	return removePrefix(sfs.c, sfs.bucket, sfs.keyPrefix())
+}
+
+func (sfs *s3VFS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	exists, err := sfs.Indexer.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	if doc.ID() == "" {
+		return sfs.Indexer.CreateDirDoc(doc)
+	}
+	return sfs.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (sfs *s3VFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	diskQuota := sfs.DiskQuota()
+
+	var maxsize, newsize, oldsize, capsize int64
+	newsize = newdoc.ByteSize
+	if diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		// When the versioning is enabled, the old content is kept and still
+		// counts in the disk usage.
+		if olddoc != nil && sfs.MaxFileVersions() <= 0 {
+			oldsize = olddoc.Size()
+		}
+		maxsize = diskQuota - diskUsage
+		if maxsize > maxFileSize {
+			maxsize = maxFileSize
+		}
+		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
+			capsize = quotaBytes - diskUsage
+		}
+	} else {
+		maxsize = maxFileSize
+	}
+	if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
+		return nil, vfs.ErrFileTooBig
+	}
+
+	if olddoc != nil {
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return nil, vfs.ErrParentInTrash
+	}
+
+	// The quotas of the directories that contain the file are also enforced.
+	dirmaxsize, err := vfs.DirQuotasMaxSize(sfs.Indexer, newpath, newsize, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	if dirmaxsize >= 0 && (maxsize < 0 || dirmaxsize < maxsize) {
+		maxsize = dirmaxsize
+	}
+
+	// Avoid storing negative size in the index.
+	if newdoc.ByteSize < 0 {
+		newdoc.ByteSize = 0
+	}
+
+	if olddoc == nil {
+		var exists bool
+		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+
+		// When added to the index, the document is first considered hidden. This
+		// flag will only be removed at the end of the upload when all its metadata
+		// are known. See the Close() method.
+		newdoc.Trashed = true
+
+		if newdoc.ID() == "" {
+			err = sfs.Indexer.CreateFileDoc(newdoc)
+		} else {
+			err = sfs.Indexer.CreateNamedFileDoc(newdoc)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key := sfs.fileKey(newdoc.DocID)
+	if sfs.Deduplication() {
+		key = sfs.blobs().tmpKey(newdoc.DocID)
+	}
+	var version *vfs.Version
+	if olddoc != nil {
+		version, err = sfs.versions().prepare(olddoc, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The upload of the content starts after the creation of the version, as
+	// it overwrites the old content.
+	ow := newObjectWriter(sfs.c, sfs.bucket, key, newdoc.Mime, objectMeta(newdoc))
+	wc, err := writeContent(ow, sfs.ContentCipher())
+	if err != nil {
+		if version != nil {
+			sfs.versions().abort(version)
+		}
+		return nil, err
+	}
+	var sha hash.Hash
+	if sfs.Deduplication() {
+		sha = sha256.New()
+	}
+	return &s3FileCreation{
+		ow:      ow,
+		wc:      wc,
+		hash:    md5.New(), // #nosec
+		sha:     sha,
+		fs:      sfs,
+		w:       0,
+		size:    newsize,
+		key:     key,
+		meta:    vfs.NewMetaExtractor(newdoc),
+		newdoc:  newdoc,
+		olddoc:  olddoc,
+		version: version,
+		maxsize: maxsize,
+		capsize: capsize,
+	}, nil
+}
+
+// objectMeta returns the user metadata of the object for the content of a
+// file. They are used by the fsck to rebuild the index of an orphan object.
+// The name is escaped, as the metadata are sent in HTTP headers.
+func objectMeta(doc *vfs.FileDoc) map[string]string {
+	meta := map[string]string{
+		"Creation-Name": url.PathEscape(doc.Name()),
+		"Created-At":    doc.CreatedAt.Format(time.RFC3339),
+		"Exec":          strconv.FormatBool(doc.Executable),
+	}
+	if len(doc.MD5Sum) > 0 {
+		meta[md5MetaKey] = hex.EncodeToString(doc.MD5Sum)
+	}
+	return meta
+}
+
+func (sfs *s3VFS) DestroyDirContent(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyDir(doc, true)
+}
+
+func (sfs *s3VFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyDir(doc, false)
+}
+
+// destroyDir removes the content of a directory, and the directory itself if
+// onlyContent is false. The VFS lock must be held by the caller.
+func (sfs *s3VFS) destroyDir(doc *vfs.DirDoc, onlyContent bool) error {
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	destroyed, files, err := sfs.Indexer.DeleteDirDocAndContent(doc, onlyContent)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = f.ID()
+	}
+	if n, errv := sfs.versions().destroyAll(ids...); errv == nil {
+		destroyed += n
+	} else {
+		sfs.log.Errorf("Could not delete the versions of the files: %s", errv)
+	}
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return sfs.destroyContentOf(files)
+}
+
+// destroyContentOf removes the content of the given files, that have already
+// been removed from the index. The VFS lock must be held by the caller.
+func (sfs *s3VFS) destroyContentOf(files []*vfs.FileDoc) error {
+	if sfs.Deduplication() {
+		var errm error
+		blobs := sfs.blobs()
+		for _, f := range files {
+			if err := blobs.release(f.MD5Sum); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+		return errm
+	}
+	keys := make([]string, len(files))
+	for i, f := range files {
+		keys[i] = sfs.fileKey(f.ID())
+	}
+	return removeObjects(sfs.c, sfs.bucket, keys)
+}
+
+func (sfs *s3VFS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	err := sfs.Indexer.DeleteFileDoc(doc)
+	if err != nil {
+		return err
+	}
+	if err = sfs.destroyContentOf([]*vfs.FileDoc{doc}); err != nil {
+		return err
+	}
+	destroyed, err := sfs.versions().destroyAll(doc.ID())
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, doc.ByteSize+destroyed)
+	return err
+}
+
+func (sfs *s3VFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.versions().open(version)
+}
+
+func (sfs *s3VFS) DestroyFileVersion(version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	err := sfs.versions().destroy(version)
+	if err == nil {
+		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, version.ByteSize)
+	}
+	return err
+}
+
+func (sfs *s3VFS) WriteUploadChunk(sessionID string, offset int64, content io.Reader) (int64, error) {
+	return sfs.uploads().write(sessionID, offset, content)
+}
+
+func (sfs *s3VFS) OpenUploadChunk(sessionID string, offset int64) (io.ReadCloser, error) {
+	return sfs.uploads().open(sessionID, offset)
+}
+
+func (sfs *s3VFS) DestroyUploadChunk(sessionID string, offset int64) error {
+	return sfs.uploads().destroyChunk(sessionID, offset)
+}
+
+func (sfs *s3VFS) DestroyUploadChunks(sessionID string) error {
+	return sfs.uploads().destroy(sessionID)
+}
+
+func (sfs *s3VFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	if sfs.Deduplication() {
+		return sfs.blobs().open(doc.MD5Sum)
+	}
+	return openContent(sfs.c, sfs.bucket, sfs.fileKey(doc.DocID), sfs.ContentCipher())
+}
+
+type fsckFile struct {
+	file     *vfs.FileDoc
+	fullpath string
+}
+
+func (sfs *s3VFS) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+
+	logbook, err = sfs.Indexer.CheckIndexIntegrity()
+	if err != nil {
+		return
+	}
+
+	if opts.Prune {
+		sfs.fsckPrune(logbook, opts.DryRun)
+	}
+
+	var newLogs []*vfs.FsckLog
+	if sfs.Deduplication() {
+		var stored map[string]int64
+		if stored, err = sfs.blobs().stored(); err == nil {
+			newLogs, err = sfs.Indexer.CheckBlobsIntegrity(stored)
+		}
+	} else {
+		newLogs, err = sfs.fsckObjects()
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(newLogs, func(i, j int) bool {
+		return newLogs[i].Filename < newLogs[j].Filename
+	})
+
+	logbook = append(logbook, newLogs...)
+
+	if opts.Prune {
+		sfs.fsckPrune(newLogs, opts.DryRun)
+	}
+
+	return
+}
+
+// fsckObjects checks that the objects of the bucket match the files of the
+// index. The listing of the objects does not include their metadata, so the
+// size is compared, and the md5sum is only fetched for the objects with a
+// different size.
+func (sfs *s3VFS) fsckObjects() ([]*vfs.FsckLog, error) {
+	root, err := sfs.Indexer.DirByID(consts.RootDirID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]fsckFile, 256)
+	if err = sfs.fsckWalk(root, entries); err != nil {
+		return nil, err
+	}
+
+	prefix := sfs.keyPrefix() + filesPrefix
+	objs, err := listObjects(sfs.c, sfs.bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher := sfs.ContentCipher()
+	var newLogs []*vfs.FsckLog
+	for _, obj := range objs {
+		docID := makeDocID(strings.TrimPrefix(obj.Key, prefix))
+		size := obj.Size
+		if cipher != nil {
+			size = cipher.PlainSize(size)
+		}
+		f, ok := entries[docID]
+		if !ok {
+			var fileDoc *vfs.FileDoc
+			var filePath string
+			filePath, fileDoc, err = sfs.objectToFileDoc(obj.Key, size)
+			if err != nil {
+				return nil, err
+			}
+			newLogs = append(newLogs, &vfs.FsckLog{
+				Type:     vfs.IndexMissing,
+				IsFile:   true,
+				FileDoc:  fileDoc,
+				Filename: filePath,
+			})
+			continue
+		}
+		delete(entries, docID)
+		if size == f.file.ByteSize {
+			continue
+		}
+		var infos minio.ObjectInfo
+		infos, err = sfs.c.StatObject(sfs.bucket, obj.Key, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		newdoc := f.file.Clone().(*vfs.FileDoc)
+		newdoc.ByteSize = size
+		if md5sum := storedMD5Sum(infos); md5sum != nil {
+			newdoc.MD5Sum = md5sum
+		}
+		newLogs = append(newLogs, &vfs.FsckLog{
+			Type:       vfs.ContentMismatch,
+			IsFile:     true,
+			FileDoc:    newdoc,
+			OldFileDoc: f.file,
+			Filename:   f.fullpath,
+		})
+	}
+
+	// entries should contain only the files without an object.
+	for _, f := range entries {
+		newLogs = append(newLogs, &vfs.FsckLog{
+			Type:     vfs.FileMissing,
+			IsFile:   true,
+			FileDoc:  f.file,
+			Filename: f.fullpath,
+		})
+	}
+	return newLogs, nil
+}
+
+func (sfs *s3VFS) fsckWalk(dir *vfs.DirDoc, entries map[string]fsckFile) error {
+	iter := sfs.Indexer.DirIterator(dir, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			fullpath := path.Join(dir.Fullpath, f.DocName)
+			entries[f.DocID] = fsckFile{f, fullpath}
+		} else if err = sfs.fsckWalk(d, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsckPrune tries to fix the given list on inconsistencies in the VFS
+func (sfs *s3VFS) fsckPrune(logbook []*vfs.FsckLog, dryrun bool) {
+	for _, entry := range logbook {
+		if entry.Type == vfs.BlobOrphan {
+			entry.PruneAction = "deleting the blob"
+			if !dryrun {
+				if err := sfs.blobs().pruneOrphan(entry.Blob); err != nil {
+					entry.PruneError = err
+				}
+			}
+			continue
+		}
+		vfs.FsckPrune(sfs, sfs.Indexer, entry, dryrun)
+	}
+}
+
+// UpdateFileDoc calls the indexer UpdateFileDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateFileDoc
+func (sfs *s3VFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UdpdateDirDoc calls the indexer UdpdateDirDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateDirDoc
+func (sfs *s3VFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+func (sfs *s3VFS) DirByID(fileID string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByID(fileID)
+}
+
+func (sfs *s3VFS) DirByPath(name string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByPath(name)
+}
+
+func (sfs *s3VFS) FileByID(fileID string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByID(fileID)
+}
+
+func (sfs *s3VFS) FileByPath(name string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByPath(name)
+}
+
+func (sfs *s3VFS) FilePath(doc *vfs.FileDoc) (string, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return "", lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FilePath(doc)
+}
+
+func (sfs *s3VFS) DirOrFileByID(fileID string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByID(fileID)
+}
+
+func (sfs *s3VFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByPath(name)
+}
+
+// s3FileCreation is the vfs.File for writing the content of a file. The
+// md5sum is always computed by the stack, as the ETag of an object uploaded
+// by parts is not its md5sum.
+type s3FileCreation struct {
+	ow      *objectWriter
+	wc      io.WriteCloser
+	hash    hash.Hash
+	sha     hash.Hash // sha256 of the content, for the deduplication
+	w       int64
+	size    int64
+	fs      *s3VFS
+	key     string
+	err     error
+	meta    *vfs.MetaExtractor
+	newdoc  *vfs.FileDoc
+	olddoc  *vfs.FileDoc
+	version *vfs.Version
+	maxsize int64
+	capsize int64
+}
+
+func (f *s3FileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Write(p []byte) (int, error) {
+	if f.meta != nil {
+		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+	}
+
+	n, err := f.wc.Write(p)
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+	f.hash.Write(p[:n]) // #nosec
+	if f.sha != nil {
+		f.sha.Write(p[:n]) // #nosec
+	}
+
+	f.w += int64(n)
+	if f.maxsize >= 0 && f.w > f.maxsize {
+		f.err = vfs.ErrFileTooBig
+		return n, f.err
+	}
+
+	if f.size >= 0 && f.w > f.size {
+		f.err = vfs.ErrContentLengthMismatch
+		return n, f.err
+	}
+
+	return n, nil
+}
+
+func (f *s3FileCreation) Close() (err error) {
+	defer func() {
+		if err == nil {
+			if f.capsize > 0 && f.size >= f.capsize {
+				vfs.PushDiskQuotaAlert(f.fs, true)
+			}
+		} else {
+			// The old content has been copied in a version (or in a blob when
+			// the deduplication is enabled), so it can be restored.
+			f.fs.restoreContent(f)
+
+			// If an error has occured that is not due to the index update, we should
+			// delete the file from the index.
+			_, isCouchErr := couchdb.IsCouchError(err)
+			if !isCouchErr && f.olddoc == nil {
+				f.fs.Indexer.DeleteFileDoc(f.newdoc) // #nosec
+			}
+		}
+	}()
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.w
+	md5sum := f.hash.Sum(nil)
+	if f.err == nil && newdoc.MD5Sum != nil && !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		f.err = vfs.ErrInvalidHash
+	}
+	if f.err == nil && f.size >= 0 && f.size != written {
+		f.err = vfs.ErrContentLengthMismatch
+	}
+
+	// The upload is interrupted if the content is not valid, to avoid
+	// overwriting the old content.
+	if f.err != nil {
+		f.ow.abort(f.err)
+	} else if errc := f.wc.Close(); errc != nil {
+		f.err = errc
+	}
+
+	if f.meta != nil {
+		if f.err != nil {
+			(*f.meta).Abort(f.err)
+		} else if errc := (*f.meta).Close(); errc == nil {
+			newdoc.Metadata = (*f.meta).Result()
+		}
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	newdoc.MD5Sum = md5sum
+	newdoc.ByteSize = written
+
+	// The document is already added to the index when closing the file creation
+	// handler. When updating the content of the document with the final
+	// informations (size, md5, ...) we can reuse the same document as olddoc.
+	if olddoc == nil || !olddoc.Trashed {
+		newdoc.Trashed = false
+	}
+	if olddoc == nil {
+		olddoc = newdoc.Clone().(*vfs.FileDoc)
+	}
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+	dedup := f.fs.Deduplication()
+	if dedup {
+		if err = f.fs.blobs().commit(f.key, newdoc, f.sha.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	// If we reach a conflict error, the document has been modified while
+	// uploading the content of the file.
+	if couchdb.IsConflictError(err) {
+		var resdoc *vfs.FileDoc
+		resdoc, err = f.fs.Indexer.FileByID(olddoc.ID())
+		if err != nil {
+			return err
+		}
+		resdoc.Metadata = newdoc.Metadata
+		resdoc.ByteSize = newdoc.ByteSize
+		resdoc.MD5Sum = newdoc.MD5Sum
+		err = f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+	}
+	if dedup {
+		if err != nil {
+			f.fs.blobs().release(newdoc.MD5Sum) // #nosec
+		} else if f.olddoc != nil && f.version == nil {
+			// Without a version, nothing references the old content anymore
+			if errr := f.fs.blobs().release(f.olddoc.MD5Sum); errr != nil {
+				f.fs.log.Warnf("Could not release the old content of %s: %s",
+					f.olddoc.ID(), errr)
+			}
+		}
+	}
+	if err == nil && f.version != nil {
+		if errv := f.fs.versions().keep(f.version); errv != nil {
+			f.fs.log.Warnf("Could not keep the old version of %s: %s",
+				f.version.FileID, errv)
+		}
+	}
+	return
+}
+
+// restoreContent is called when the creation of a file has failed. S3 has no
+// versioning of the objects like swift, so the old content is restored from
+// the copy made for the version.
+func (sfs *s3VFS) restoreContent(f *s3FileCreation) {
+	if sfs.Deduplication() {
+		sfs.c.RemoveObject(sfs.bucket, f.key) // #nosec
+		return
+	}
+	if f.version == nil {
+		if f.olddoc == nil {
+			sfs.c.RemoveObject(sfs.bucket, f.key) // #nosec
+		}
+		return
+	}
+	versions := sfs.versions()
+	dst, err := minio.NewDestinationInfo(sfs.bucket, f.key, nil, nil)
+	if err == nil {
+		err = sfs.c.CopyObject(dst, minio.NewSourceInfo(sfs.bucket, versions.key(f.version), nil))
+	}
+	if err != nil {
+		sfs.log.Errorf("Could not restore the content of %s: %s", f.version.FileID, err)
+	}
+	versions.abort(f.version)
+}
+
+func (sfs *s3VFS) objectToFileDoc(key string, size int64) (filePath string, fileDoc *vfs.FileDoc, err error) {
+	infos, err := sfs.c.StatObject(sfs.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return
+	}
+	name, _ := url.PathUnescape(infos.Metadata.Get("X-Amz-Meta-Creation-Name"))
+	if name == "" {
+		name = fmt.Sprintf("Unknown %s", utils.RandomString(10))
+	}
+	var cdate time.Time
+	if v := infos.Metadata.Get("X-Amz-Meta-Created-At"); v != "" {
+		cdate, _ = time.Parse(time.RFC3339, v)
+	}
+	if cdate.IsZero() {
+		cdate = time.Now()
+	}
+	executable, _ := strconv.ParseBool(infos.Metadata.Get("X-Amz-Meta-Exec"))
+	mime, class := vfs.ExtractMimeAndClass(infos.ContentType)
+	filePath = path.Join(vfs.OrphansDirName, name)
+	fileDoc, err = vfs.NewFileDoc(
+		name,
+		"",
+		size,
+		storedMD5Sum(infos),
+		mime,
+		class,
+		cdate,
+		executable,
+		false,
+		nil)
+	return
+}
+
+// storedMD5Sum returns the md5sum of the plain content of an object, from its
+// metadata. It is nil if the md5sum was not known when the upload started.
+func storedMD5Sum(infos minio.ObjectInfo) []byte {
+	md5sum, _ := hex.DecodeString(infos.Metadata.Get("X-Amz-Meta-" + md5MetaKey))
+	return md5sum
+}
+
+var (
+	_ vfs.VFS  = &s3VFS{}
+	_ vfs.File = &s3FileCreation{}
+	_ vfs.File = &s3FileOpen{}
+)
@@ -0,0 +1,115 @@
+package vfss3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+// Importer copies the content of the files of an instance from another
+// storage, for a migration to S3. The objects are written with the same
+// layout as the VFS, but the index is not modified: the files and versions
+// keep their identifiers.
+type Importer struct {
+	fs *s3VFS
+}
+
+// NewImporter returns an importer for the files of the given instance.
+func NewImporter(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder) (*Importer, error) {
+	fs, err := New(db, index, disk, lock.ReadWrite(db, "vfs"))
+	if err != nil {
+		return nil, err
+	}
+	return &Importer{fs: fs.(*s3VFS)}, nil
+}
+
+// ImportFile copies the current content of a file. It does nothing if the
+// same content is already in S3, so that an interrupted migration can be
+// resumed. As the objects are keyed by the file identifier, a file that has
+// been overwritten since the previous pass is copied again.
+func (im *Importer) ImportFile(doc *vfs.FileDoc, content io.Reader) error {
+	key := im.fs.fileKey(doc.ID())
+	if im.fs.Deduplication() {
+		key = im.fs.blobs().key(doc.MD5Sum)
+	}
+	meta := objectMeta(doc)
+	meta[sizeMetaKey] = strconv.FormatInt(doc.ByteSize, 10)
+	return im.importContent(key, doc.Mime, meta, doc.ByteSize, doc.MD5Sum, content)
+}
+
+// NeedsImport returns true if the content of the file is not in S3, or if it
+// differs from the file document.
+func (im *Importer) NeedsImport(doc *vfs.FileDoc) (bool, error) {
+	key := im.fs.fileKey(doc.ID())
+	if im.fs.Deduplication() {
+		key = im.fs.blobs().key(doc.MD5Sum)
+	}
+	same, err := im.hasContent(key, doc.ByteSize, doc.MD5Sum)
+	return !same, err
+}
+
+// ImportVersion copies the content of an old version of a file. Like for
+// ImportFile, the content is not copied again if it is already in S3.
+func (im *Importer) ImportVersion(v *vfs.Version, content io.Reader) error {
+	key := im.fs.versions().key(v)
+	if im.fs.Deduplication() {
+		key = im.fs.blobs().key(v.MD5Sum)
+	}
+	meta := map[string]string{
+		md5MetaKey:  hex.EncodeToString(v.MD5Sum),
+		sizeMetaKey: strconv.FormatInt(v.ByteSize, 10),
+	}
+	return im.importContent(key, "", meta, v.ByteSize, v.MD5Sum, content)
+}
+
+// hasContent returns true if the object with the given key exists and has
+// the given md5sum and size. The size is read from the metadata when it is
+// there, as the size of an encrypted object is not the size of its content.
+func (im *Importer) hasContent(key string, size int64, md5sum []byte) (bool, error) {
+	infos, err := im.fs.c.StatObject(im.fs.bucket, key, minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if infos.Metadata.Get("X-Amz-Meta-"+md5MetaKey) != hex.EncodeToString(md5sum) {
+		return false, nil
+	}
+	if v := infos.Metadata.Get("X-Amz-Meta-" + sizeMetaKey); v != "" {
+		return v == strconv.FormatInt(size, 10), nil
+	}
+	return im.fs.ContentCipher() == nil && infos.Size == size, nil
+}
+
+func (im *Importer) importContent(key, mime string, meta map[string]string, size int64, md5sum []byte, content io.Reader) error {
+	same, err := im.hasContent(key, size, md5sum)
+	if err != nil || same {
+		return err
+	}
+	ow := newObjectWriter(im.fs.c, im.fs.bucket, key, mime, meta)
+	w, err := writeContent(ow, im.fs.ContentCipher())
+	if err != nil {
+		return err
+	}
+	h := md5.New() // #nosec
+	n, err := io.Copy(io.MultiWriter(w, h), content)
+	if err == nil && n != size {
+		err = vfs.ErrContentLengthMismatch
+	}
+	if err == nil && !bytes.Equal(h.Sum(nil), md5sum) {
+		err = vfs.ErrInvalidHash
+	}
+	if err != nil {
+		ow.abort(err)
+		return err
+	}
+	return w.Close()
+}
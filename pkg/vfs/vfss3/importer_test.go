@@ -0,0 +1,158 @@
+package vfss3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfscrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+type diskImpl struct {
+	dedup  bool
+	cipher vfs.Cipher
+}
+
+func (d *diskImpl) DiskQuota() int64                  { return 0 }
+func (d *diskImpl) MaxFileVersions() int              { return 0 }
+func (d *diskImpl) FileVersionsMaxAge() time.Duration { return 0 }
+func (d *diskImpl) Deduplication() bool               { return d.dedup }
+func (d *diskImpl) ContentCipher() vfs.Cipher         { return d.cipher }
+
+func md5sum(content string) []byte {
+	h := md5.New() // #nosec
+	h.Write([]byte(content))
+	return h.Sum(nil)
+}
+
+func makeImporter(t *testing.T, disk *diskImpl) *Importer {
+	db := prefixer.NewPrefixer("io.cozy.vfss3.test", "io.cozy.vfss3.test")
+	im, err := NewImporter(db, vfs.NewCouchdbIndexer(db), disk)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return im
+}
+
+func makeFileDoc(t *testing.T, content string) *vfs.FileDoc {
+	doc, err := vfs.NewFileDoc("foo.txt", "", int64(len(content)), md5sum(content),
+		"text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	doc.SetID("4a6a5a0ec3c9d5b5b2ae8e0a1b9c1f20")
+	return doc
+}
+
+func readObject(t *testing.T, im *Importer, key string) string {
+	f, err := openContent(im.fs.c, im.fs.bucket, key, im.fs.ContentCipher())
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	return string(buf)
+}
+
+func testImportFile(t *testing.T, im *Importer) {
+	defer im.fs.Delete()
+
+	doc := makeFileDoc(t, "foo")
+	needed, err := im.NeedsImport(doc)
+	assert.NoError(t, err)
+	assert.True(t, needed)
+
+	err = im.ImportFile(doc, bytes.NewReader([]byte("foo")))
+	assert.NoError(t, err)
+	needed, err = im.NeedsImport(doc)
+	assert.NoError(t, err)
+	assert.False(t, needed)
+	key := im.fs.fileKey(doc.ID())
+	if im.fs.Deduplication() {
+		key = im.fs.blobs().key(doc.MD5Sum)
+	}
+	assert.Equal(t, "foo", readObject(t, im, key))
+
+	// The file has been overwritten with a content of the same size since
+	// the first pass: it must be copied again
+	doc = makeFileDoc(t, "bar")
+	needed, err = im.NeedsImport(doc)
+	assert.NoError(t, err)
+	assert.True(t, needed)
+	err = im.ImportFile(doc, bytes.NewReader([]byte("bar")))
+	assert.NoError(t, err)
+	key = im.fs.fileKey(doc.ID())
+	if im.fs.Deduplication() {
+		key = im.fs.blobs().key(doc.MD5Sum)
+	}
+	assert.Equal(t, "bar", readObject(t, im, key))
+
+	// A content that doesn't match the document is rejected
+	doc = makeFileDoc(t, "baz")
+	err = im.ImportFile(doc, bytes.NewReader([]byte("qux")))
+	assert.Equal(t, vfs.ErrInvalidHash, err)
+	err = im.ImportFile(doc, bytes.NewReader([]byte("bazz")))
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+	needed, err = im.NeedsImport(doc)
+	assert.NoError(t, err)
+	assert.True(t, needed)
+}
+
+func TestImportFile(t *testing.T) {
+	testImportFile(t, makeImporter(t, &diskImpl{}))
+}
+
+func TestImportFileWithDedupAndCipher(t *testing.T) {
+	key, err := vfscrypt.NewDataKey()
+	assert.NoError(t, err)
+	cipher, err := vfscrypt.New(key)
+	assert.NoError(t, err)
+	testImportFile(t, makeImporter(t, &diskImpl{dedup: true, cipher: cipher}))
+}
+
+func TestImportVersion(t *testing.T) {
+	im := makeImporter(t, &diskImpl{})
+	defer im.fs.Delete()
+
+	doc := makeFileDoc(t, "foo")
+	v := vfs.NewVersion(doc, 1)
+	err := im.ImportVersion(v, bytes.NewReader([]byte("foo")))
+	assert.NoError(t, err)
+	key := im.fs.versions().key(v)
+	assert.Equal(t, "foo", readObject(t, im, key))
+
+	// The version is already there: the content is not read again
+	err = im.ImportVersion(v, bytes.NewReader(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", readObject(t, im, key))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+
+	u := os.Getenv("COZY_TEST_S3_URL")
+	if u == "" {
+		u = "s3://localhost:9000/cozy-test?AccessKey=minioaccesskey&SecretKey=miniosecretkey&DisableSSL=true"
+	}
+	s3URL, err := url.Parse(u)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err = config.InitS3Client(s3URL); err != nil {
+		fmt.Println("This test need minio to run.")
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,186 @@
+package vfss3
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+// partSize is the size of the parts for the multipart uploads. As the size of
+// the content is not always known in advance, the objects are uploaded by
+// parts, and each part is kept in memory before being sent.
+const partSize = 16 << (2 * 10) // 16 MiB
+
+// md5MetaKey is the name of the user metadata used to store the md5sum of the
+// plain content, as the ETag of an object uploaded by parts is not its md5sum.
+const md5MetaKey = "File-Md5"
+
+// sizeMetaKey is the name of the user metadata used to store the size of the
+// plain content of an imported object.
+const sizeMetaKey = "File-Size"
+
+// errAborted is used to interrupt an upload
+var errAborted = errors.New("vfss3: the upload has been aborted")
+
+// objectWriter is an io.WriteCloser that uploads the content written to it in
+// an object. The upload is streamed through a pipe.
+type objectWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newObjectWriter(c *minio.Client, bucket, key, contentType string, meta map[string]string) *objectWriter {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.PutObject(bucket, key, pr, -1, minio.PutObjectOptions{
+			ContentType:  contentType,
+			UserMetadata: meta,
+			PartSize:     partSize,
+		})
+		// Unblock the writer if the upload has failed before reading
+		// everything
+		pr.CloseWithError(err) // #nosec
+		done <- err
+	}()
+	return &objectWriter{pw: pw, done: done}
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close waits for the end of the upload and returns its error.
+func (w *objectWriter) Close() error {
+	w.pw.Close() // #nosec
+	return <-w.done
+}
+
+// abort interrupts the upload: the object is not created.
+func (w *objectWriter) abort(err error) {
+	w.pw.CloseWithError(err) // #nosec
+	<-w.done
+}
+
+// s3FileOpen is the vfs.File for reading the content of an object.
+type s3FileOpen struct {
+	*minio.Object
+}
+
+func (f *s3FileOpen) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+// openObject returns the object for the given key. It checks that the object
+// exists, as the client only makes a request on the first read.
+func openObject(c *minio.Client, bucket, key string) (*minio.Object, error) {
+	obj, err := c.GetObject(bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, wrapS3Err(err)
+	}
+	if _, err = obj.Stat(); err != nil {
+		obj.Close() // #nosec
+		return nil, wrapS3Err(err)
+	}
+	return obj, nil
+}
+
+// openContent returns a file for reading the content of an object, decrypted
+// if cipher is not nil.
+func openContent(c *minio.Client, bucket, key string, cipher vfs.Cipher) (vfs.File, error) {
+	obj, err := openObject(c, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if cipher == nil {
+		return &s3FileOpen{obj}, nil
+	}
+	f, err := cipher.Decrypt(obj)
+	if err != nil {
+		obj.Close() // #nosec
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeContent returns a writer for the content of an object, encrypted if
+// cipher is not nil.
+func writeContent(ow *objectWriter, cipher vfs.Cipher) (io.WriteCloser, error) {
+	if cipher == nil {
+		return ow, nil
+	}
+	w, err := cipher.Encrypt(ow)
+	if err != nil {
+		ow.abort(err)
+		return nil, err
+	}
+	return w, nil
+}
+
+// listObjects returns the objects with the given prefix in the bucket.
+func listObjects(c *minio.Client, bucket, prefix string) ([]minio.ObjectInfo, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	var objs []minio.ObjectInfo
+	for obj := range c.ListObjectsV2(bucket, prefix, true, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// removeObjects removes the objects with the given keys. The keys of missing
+// objects are ignored.
+func removeObjects(c *minio.Client, bucket string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	keysCh := make(chan string, len(keys))
+	for _, key := range keys {
+		keysCh <- key
+	}
+	close(keysCh)
+	var err error
+	for rerr := range c.RemoveObjects(bucket, keysCh) {
+		if err == nil && !isNotFound(rerr.Err) {
+			err = rerr.Err
+		}
+	}
+	return err
+}
+
+// removePrefix removes all the objects with the given prefix.
+func removePrefix(c *minio.Client, bucket, prefix string) error {
+	objs, err := listObjects(c, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(objs))
+	for i, obj := range objs {
+		keys[i] = obj.Key
+	}
+	return removeObjects(c, bucket, keys)
+}
+
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return true
+	}
+	return false
+}
+
+func wrapS3Err(err error) error {
+	if isNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
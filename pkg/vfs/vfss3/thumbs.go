@@ -0,0 +1,98 @@
+package vfss3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+var unixEpochZero = time.Time{}
+
+const thumbsPrefix = "thumbs/"
+
+// NewThumbsFs creates a new thumb filesystem based on S3. The thumbnails are
+// stored in the bucket, with the <prefix>/thumbs/ keys.
+func NewThumbsFs(c *minio.Client, bucket, prefix string) vfs.Thumbser {
+	return &thumbs{c: c, bucket: bucket, prefix: prefix + "/"}
+}
+
+type thumbs struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+}
+
+type thumb struct {
+	*objectWriter
+}
+
+func (t *thumb) Abort() error {
+	t.abort(errAborted)
+	return nil
+}
+
+func (t *thumb) Commit() error {
+	return t.Close()
+}
+
+func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (vfs.ThumbFiler, error) {
+	meta := map[string]string{
+		md5MetaKey: hex.EncodeToString(img.MD5Sum),
+	}
+	ow := newObjectWriter(t.c, t.bucket, t.key(img, format), img.Mime, meta)
+	return &thumb{ow}, nil
+}
+
+func (t *thumbs) ThumbExists(img *vfs.FileDoc, format string) (bool, error) {
+	infos, err := t.c.StatObject(t.bucket, t.key(img, format), minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if infos.Size == 0 {
+		return false, nil
+	}
+	if md5 := infos.Metadata.Get("X-Amz-Meta-" + md5MetaKey); md5 != "" {
+		md5sum, err := hex.DecodeString(md5)
+		if err == nil && !bytes.Equal(md5sum, img.MD5Sum) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *thumbs) RemoveThumbs(img *vfs.FileDoc, formats []string) error {
+	keys := make([]string, len(formats))
+	for i, format := range formats {
+		keys[i] = t.key(img, format)
+	}
+	return removeObjects(t.c, t.bucket, keys)
+}
+
+func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *vfs.FileDoc, format string) error {
+	key := t.key(img, format)
+	obj, err := openObject(t.c, t.bucket, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	infos, err := obj.Stat()
+	if err != nil {
+		return wrapS3Err(err)
+	}
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, infos.ETag))
+	http.ServeContent(w, req, key, unixEpochZero, obj)
+	return nil
+}
+
+func (t *thumbs) key(img *vfs.FileDoc, format string) string {
+	return fmt.Sprintf("%s%s%s-%s", t.prefix, thumbsPrefix, MakeObjectName(img.ID()), format)
+}
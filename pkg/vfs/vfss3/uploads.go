@@ -0,0 +1,52 @@
+package vfss3
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+const uploadsPrefix = "uploads/"
+
+// s3Uploads stages the chunks of the upload sessions, with the
+// <prefix>/uploads/<session-id>/<offset> keys. The chunks are encrypted like
+// the files if cipher is not nil.
+type s3Uploads struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+	cipher vfs.Cipher
+}
+
+func (su *s3Uploads) key(sessionID string, offset int64) string {
+	// The offset is padded to keep the chunks sorted by their keys
+	return fmt.Sprintf("%s%s%s/%020d", su.prefix, uploadsPrefix, sessionID, offset)
+}
+
+func (su *s3Uploads) write(sessionID string, offset int64, content io.Reader) (int64, error) {
+	ow := newObjectWriter(su.c, su.bucket, su.key(sessionID, offset), "application/octet-stream", nil)
+	f, err := writeContent(ow, su.cipher)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, content)
+	if err != nil {
+		ow.abort(err)
+		return n, err
+	}
+	return n, f.Close()
+}
+
+func (su *s3Uploads) open(sessionID string, offset int64) (io.ReadCloser, error) {
+	return openContent(su.c, su.bucket, su.key(sessionID, offset), su.cipher)
+}
+
+func (su *s3Uploads) destroyChunk(sessionID string, offset int64) error {
+	return su.c.RemoveObject(su.bucket, su.key(sessionID, offset))
+}
+
+func (su *s3Uploads) destroy(sessionID string) error {
+	return removePrefix(su.c, su.bucket, su.prefix+uploadsPrefix+sessionID+"/")
+}
@@ -0,0 +1,130 @@
+package vfss3
+
+import (
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+const versionsPrefix = "versions/"
+
+// s3Versions stores the old versions of the files, with the
+// <prefix>/versions/<file-id>/<number> keys. When the deduplication is
+// enabled, blobs is not nil and the versions just keep a reference to the blob
+// of their content.
+type s3Versions struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+	index  vfs.Indexer
+	disk   vfs.DiskThresholder
+	blobs  *s3Blobs
+}
+
+func (sv *s3Versions) key(v *vfs.Version) string {
+	return sv.prefix + versionsPrefix + v.FileID + "/" + strconv.Itoa(v.Number)
+}
+
+// prepare copies the current content of a file before it is overwritten, and
+// returns the version that should be added to the index when the upload of
+// the new content succeeds. It returns nil if the versioning is disabled. The
+// VFS lock must be held by the caller.
+func (sv *s3Versions) prepare(olddoc *vfs.FileDoc, srcKey string) (*vfs.Version, error) {
+	if sv.disk.MaxFileVersions() <= 0 {
+		return nil, nil
+	}
+	versions, err := sv.index.AllVersions(olddoc.ID())
+	if err != nil {
+		return nil, err
+	}
+	v := vfs.NewVersion(olddoc, vfs.NextVersionNumber(versions))
+	if sv.blobs != nil {
+		return v, nil
+	}
+	dst, err := minio.NewDestinationInfo(sv.bucket, sv.key(v), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = sv.c.CopyObject(dst, minio.NewSourceInfo(sv.bucket, srcKey, nil))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// abort removes the copy of the content made for a version that will not be
+// kept.
+func (sv *s3Versions) abort(v *vfs.Version) {
+	if sv.blobs != nil {
+		return
+	}
+	sv.c.RemoveObject(sv.bucket, sv.key(v)) // #nosec
+}
+
+// keep adds the version to the index and removes the old versions that are
+// not kept by the retention policy. The VFS lock must be held by the caller.
+func (sv *s3Versions) keep(v *vfs.Version) error {
+	if err := sv.index.CreateVersion(v); err != nil {
+		if sv.blobs != nil {
+			sv.blobs.release(v.MD5Sum) // #nosec
+		} else {
+			sv.abort(v)
+		}
+		return err
+	}
+	versions, err := sv.index.AllVersions(v.FileID)
+	if err != nil {
+		return err
+	}
+	maxNumber, maxAge := sv.disk.MaxFileVersions(), sv.disk.FileVersionsMaxAge()
+	for _, old := range vfs.VersionsToClean(versions, maxNumber, maxAge) {
+		if err = sv.destroy(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *s3Versions) open(v *vfs.Version) (vfs.File, error) {
+	if sv.blobs != nil {
+		return sv.blobs.open(v.MD5Sum)
+	}
+	return openContent(sv.c, sv.bucket, sv.key(v), sv.disk.ContentCipher())
+}
+
+// destroy removes the content and the document of a version.
+func (sv *s3Versions) destroy(v *vfs.Version) error {
+	if sv.blobs != nil {
+		if err := sv.index.DeleteVersion(v); err != nil {
+			return err
+		}
+		return sv.blobs.release(v.MD5Sum)
+	}
+	if err := sv.c.RemoveObject(sv.bucket, sv.key(v)); err != nil && !isNotFound(err) {
+		return err
+	}
+	return sv.index.DeleteVersion(v)
+}
+
+// destroyAll removes all the versions of the given files, and returns the
+// number of bytes that were used by them.
+func (sv *s3Versions) destroyAll(fileIDs ...string) (int64, error) {
+	var destroyed int64
+	for _, fileID := range fileIDs {
+		versions, err := sv.index.AllVersions(fileID)
+		if err != nil {
+			return destroyed, err
+		}
+		for _, v := range versions {
+			if err = sv.destroy(v); err != nil {
+				return destroyed, err
+			}
+			destroyed += v.ByteSize
+		}
+	}
+	return destroyed, nil
+}
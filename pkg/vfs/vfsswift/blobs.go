@@ -0,0 +1,119 @@
+package vfsswift
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+const (
+	blobsPrefix    = "blobs/"
+	blobsTmpPrefix = "blobs-tmp/"
+)
+
+// swiftBlobs is used by the swift layout v2 when the deduplication is
+// enabled: the content of the files is stored in a container, with the
+// blobs/<md5sum> names, and shared by all the files and versions with the
+// same content.
+type swiftBlobs struct {
+	c         *swift.Connection
+	container string
+	index     vfs.Indexer
+	cipher    vfs.Cipher
+}
+
+func blobObjectName(md5sum []byte) string {
+	return blobsPrefix + vfs.BlobID(md5sum)
+}
+
+// tmpName returns the name of a temporary object where the content of a file
+// can be uploaded before its md5sum is known.
+func (sb *swiftBlobs) tmpName(docID string) string {
+	return blobsTmpPrefix + docID + "-" + utils.RandomString(16)
+}
+
+// commit adds a reference to the blob for the content of doc, that has been
+// uploaded in the tmpName object, with the given sha256. If the blob already
+// exists, the temporary object is just removed. The VFS lock must be held by
+// the caller.
+func (sb *swiftBlobs) commit(tmpName string, doc *vfs.FileDoc, sha256sum []byte) error {
+	created, err := sb.index.AddBlobRef(doc.MD5Sum, sha256sum, doc.ByteSize)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return sb.c.ObjectDelete(sb.container, tmpName)
+	}
+	err = sb.c.ObjectMove(sb.container, tmpName, sb.container, blobObjectName(doc.MD5Sum))
+	if err != nil {
+		sb.index.RemoveBlobRef(doc.MD5Sum) // #nosec
+		return err
+	}
+	return nil
+}
+
+// release removes a reference to the blob with the given md5sum, and removes
+// its content if it was the last reference. The VFS lock must be held by the
+// caller.
+func (sb *swiftBlobs) release(md5sum []byte) error {
+	if len(md5sum) == 0 {
+		return nil
+	}
+	last, err := sb.index.RemoveBlobRef(md5sum)
+	if err != nil || !last {
+		return err
+	}
+	err = sb.c.ObjectDelete(sb.container, blobObjectName(md5sum))
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	return nil
+}
+
+func (sb *swiftBlobs) open(md5sum []byte) (vfs.File, error) {
+	f, _, err := sb.c.ObjectOpen(sb.container, blobObjectName(md5sum), false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sb.cipher != nil {
+		return decryptContent(sb.cipher, f)
+	}
+	return &swiftFileOpenV2{f, nil}, nil
+}
+
+// stored returns the size of the blobs in the container, indexed by their
+// identifiers.
+func (sb *swiftBlobs) stored() (map[string]int64, error) {
+	objs, err := sb.c.ObjectsAll(sb.container, &swift.ObjectsOpts{
+		Prefix: blobsPrefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]int64, len(objs))
+	for _, obj := range objs {
+		size := obj.Bytes
+		if sb.cipher != nil {
+			size = sb.cipher.PlainSize(size)
+		}
+		stored[strings.TrimPrefix(obj.Name, blobsPrefix)] = size
+	}
+	return stored, nil
+}
+
+// pruneOrphan removes a blob that is not referenced by any file or version.
+func (sb *swiftBlobs) pruneOrphan(blob *vfs.Blob) error {
+	err := sb.c.ObjectDelete(sb.container, blobsPrefix+blob.ID())
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	cleared := blob.Clone().(*vfs.Blob)
+	cleared.Refs = 0
+	return sb.index.SetBlobRefs(cleared)
+}
@@ -0,0 +1,33 @@
+package vfsswift
+
+import (
+	"crypto/md5"
+	"hash"
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// encryptContent returns a writer that encrypts the content before sending it
+// to the object. As swift only knows the md5sum of the encrypted content, the
+// md5sum of the plain content is computed with the returned hash.
+func encryptContent(c vfs.Cipher, f *swift.ObjectCreateFile) (io.WriteCloser, hash.Hash, error) {
+	w, err := c.Encrypt(f)
+	if err != nil {
+		f.Close() // #nosec
+		return nil, nil, err
+	}
+	return w, md5.New(), nil // #nosec
+}
+
+// decryptContent returns a file for reading the plain content of an
+// encrypted object.
+func decryptContent(c vfs.Cipher, f *swift.ObjectOpenFile) (vfs.File, error) {
+	file, err := c.Decrypt(f)
+	if err != nil {
+		f.Close() // #nosec
+		return nil, err
+	}
+	return file, nil
+}
@@ -3,6 +3,7 @@ package vfsswift
 import (
 	"bytes"
 	"encoding/hex"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -56,6 +57,27 @@ func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu l
 	}, nil
 }
 
+// versions returns the handler for the old versions of the files. They are
+// stored in the same container as the files, with the versions/ prefix.
+func (sfs *swiftVFS) versions() *swiftVersions {
+	return &swiftVersions{
+		c:         sfs.c,
+		container: sfs.container,
+		index:     sfs.Indexer,
+		disk:      sfs.DiskThresholder,
+	}
+}
+
+// uploads returns the handler for the chunks of the upload sessions. They are
+// stored in the same container as the files, with the uploads/ prefix.
+func (sfs *swiftVFS) uploads() *swiftUploads {
+	return &swiftUploads{
+		c:         sfs.c,
+		container: sfs.container,
+		cipher:    sfs.ContentCipher(),
+	}
+}
+
 func (sfs *swiftVFS) DBPrefix() string {
 	return sfs.prefix
 }
@@ -186,7 +208,9 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		if err != nil {
 			return nil, err
 		}
-		if olddoc != nil {
+		// When the versioning is enabled, the old content is kept and still
+		// counts in the disk usage.
+		if olddoc != nil && sfs.MaxFileVersions() <= 0 {
 			oldsize = olddoc.Size()
 		}
 		maxsize = diskQuota - diskUsage
@@ -217,6 +241,15 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		return nil, vfs.ErrParentInTrash
 	}
 
+	// The quotas of the directories that contain the file are also enforced.
+	dirmaxsize, err := vfs.DirQuotasMaxSize(sfs.Indexer, newpath, newsize, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	if dirmaxsize >= 0 && (maxsize < 0 || dirmaxsize < maxsize) {
+		maxsize = dirmaxsize
+	}
+
 	// Avoid storing negative size in the index.
 	if newdoc.ByteSize < 0 {
 		newdoc.ByteSize = 0
@@ -248,7 +281,20 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 	}
 
 	objName := newdoc.DirID + "/" + newdoc.DocName
+	var version *vfs.Version
+	if olddoc != nil {
+		oldName := olddoc.DirID + "/" + olddoc.DocName
+		version, err = sfs.versions().prepare(olddoc, sfs.container, oldName)
+		if err != nil {
+			return nil, err
+		}
+	}
 	hash := hex.EncodeToString(newdoc.MD5Sum)
+	cipher := sfs.ContentCipher()
+	if cipher != nil {
+		// swift can only check the md5sum of the encrypted content
+		hash = ""
+	}
 	f, err := sfs.c.ObjectCreate(
 		sfs.container,
 		objName,
@@ -258,9 +304,13 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		nil,
 	)
 	if err != nil {
+		if version != nil {
+			sfs.versions().abort(version)
+		}
 		return nil, err
 	}
-	return &swiftFileCreation{
+	fc := &swiftFileCreation{
+		wc:      f,
 		f:       f,
 		fs:      sfs,
 		w:       0,
@@ -269,9 +319,21 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		meta:    vfs.NewMetaExtractor(newdoc),
 		newdoc:  newdoc,
 		olddoc:  olddoc,
+		version: version,
 		maxsize: maxsize,
 		capsize: capsize,
-	}, nil
+	}
+	if cipher != nil {
+		fc.wc, fc.plainHash, err = encryptContent(cipher, f)
+		if err != nil {
+			sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+			if version != nil {
+				sfs.versions().abort(version)
+			}
+			return nil, err
+		}
+	}
+	return fc, nil
 }
 
 func (sfs *swiftVFS) DestroyDirContent(doc *vfs.DirDoc) error {
@@ -306,9 +368,9 @@ func (sfs *swiftVFS) DestroyFile(doc *vfs.FileDoc) error {
 	}
 	defer sfs.mu.Unlock()
 	diskUsage, _ := sfs.Indexer.DiskUsage()
-	err := sfs.destroyFile(doc)
+	destroyed, err := sfs.destroyFile(doc)
 	if err == nil {
-		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, doc.ByteSize)
+		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
 	}
 	return err
 }
@@ -330,7 +392,7 @@ func (sfs *swiftVFS) destroyDirContent(doc *vfs.DirDoc) (int64, error) {
 		if d != nil {
 			destroyed, errd = sfs.destroyDirAndContent(d)
 		} else {
-			destroyed, errd = f.ByteSize, sfs.destroyFile(f)
+			destroyed, errd = sfs.destroyFile(f)
 		}
 		if errd != nil {
 			errm = multierror.Append(errm, errd)
@@ -353,7 +415,9 @@ func (sfs *swiftVFS) destroyDirAndContent(doc *vfs.DirDoc) (int64, error) {
 	return n, err
 }
 
-func (sfs *swiftVFS) destroyFile(doc *vfs.FileDoc) error {
+// destroyFile removes a file and its old versions, and returns the number of
+// bytes that were used by them.
+func (sfs *swiftVFS) destroyFile(doc *vfs.FileDoc) (int64, error) {
 	objName := doc.DirID + "/" + doc.DocName
 	err := sfs.destroyFileVersions(objName)
 	if err != nil {
@@ -362,9 +426,17 @@ func (sfs *swiftVFS) destroyFile(doc *vfs.FileDoc) error {
 	}
 	err = sfs.c.ObjectDelete(sfs.container, objName)
 	if err != nil && err != swift.ObjectNotFound {
-		return err
+		return 0, err
+	}
+	if err = sfs.Indexer.DeleteFileDoc(doc); err != nil {
+		return 0, err
+	}
+	destroyed, err := sfs.versions().destroyAll(doc.ID())
+	if err != nil {
+		sfs.log.Errorf("Could not delete the old versions of %s: %s",
+			doc.ID(), err.Error())
 	}
-	return sfs.Indexer.DeleteFileDoc(doc)
+	return doc.ByteSize + destroyed, nil
 }
 
 func (sfs *swiftVFS) destroyFileVersions(objName string) error {
@@ -384,6 +456,43 @@ func (sfs *swiftVFS) destroyFileVersions(objName string) error {
 	return nil
 }
 
+func (sfs *swiftVFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.versions().open(version)
+}
+
+func (sfs *swiftVFS) DestroyFileVersion(version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	err := sfs.versions().destroy(version)
+	if err == nil {
+		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, version.ByteSize)
+	}
+	return err
+}
+
+func (sfs *swiftVFS) WriteUploadChunk(sessionID string, offset int64, content io.Reader) (int64, error) {
+	return sfs.uploads().write(sessionID, offset, content)
+}
+
+func (sfs *swiftVFS) OpenUploadChunk(sessionID string, offset int64) (io.ReadCloser, error) {
+	return sfs.uploads().open(sessionID, offset)
+}
+
+func (sfs *swiftVFS) DestroyUploadChunk(sessionID string, offset int64) error {
+	return sfs.uploads().destroyChunk(sessionID, offset)
+}
+
+func (sfs *swiftVFS) DestroyUploadChunks(sessionID string) error {
+	return sfs.uploads().destroy(sessionID)
+}
+
 func (sfs *swiftVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if lockerr := sfs.mu.RLock(); lockerr != nil {
 		return nil, lockerr
@@ -396,6 +505,9 @@ func (sfs *swiftVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c := sfs.ContentCipher(); c != nil {
+		return decryptContent(c, f)
+	}
 	return &swiftFileOpen{f, nil}, nil
 }
 
@@ -736,17 +848,20 @@ func (sfs *swiftVFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, er
 }
 
 type swiftFileCreation struct {
-	f       *swift.ObjectCreateFile
-	w       int64
-	size    int64
-	fs      *swiftVFS
-	name    string
-	err     error
-	meta    *vfs.MetaExtractor
-	newdoc  *vfs.FileDoc
-	olddoc  *vfs.FileDoc
-	maxsize int64
-	capsize int64
+	f         *swift.ObjectCreateFile
+	wc        io.WriteCloser
+	w         int64
+	size      int64
+	fs        *swiftVFS
+	name      string
+	err       error
+	meta      *vfs.MetaExtractor
+	newdoc    *vfs.FileDoc
+	olddoc    *vfs.FileDoc
+	version   *vfs.Version
+	maxsize   int64
+	capsize   int64
+	plainHash hash.Hash
 }
 
 func (f *swiftFileCreation) Read(p []byte) (int, error) {
@@ -769,11 +884,14 @@ func (f *swiftFileCreation) Write(p []byte) (int, error) {
 		}
 	}
 
-	n, err := f.f.Write(p)
+	n, err := f.wc.Write(p)
 	if err != nil {
 		f.err = err
 		return n, err
 	}
+	if f.plainHash != nil {
+		f.plainHash.Write(p[:n]) // #nosec
+	}
 
 	f.w += int64(n)
 	if f.maxsize >= 0 && f.w > f.maxsize {
@@ -799,6 +917,9 @@ func (f *swiftFileCreation) Close() (err error) {
 			// Deleting the object should be secure since we use X-Versions-Location
 			// on the container and the old object should be restored.
 			f.fs.c.ObjectDelete(f.fs.container, f.name) // #nosec
+			if f.version != nil {
+				f.fs.versions().abort(f.version)
+			}
 
 			// If an error has occured that is not due to the index update, we should
 			// delete the file from the index.
@@ -809,7 +930,7 @@ func (f *swiftFileCreation) Close() (err error) {
 		}
 	}()
 
-	if err = f.f.Close(); err != nil {
+	if err = f.wc.Close(); err != nil {
 		if err == swift.ObjectCorrupted {
 			err = vfs.ErrInvalidHash
 		}
@@ -833,6 +954,16 @@ func (f *swiftFileCreation) Close() (err error) {
 		return f.err
 	}
 
+	if f.plainHash != nil {
+		// The content is encrypted: the md5sum is checked on the plain content.
+		md5sum := f.plainHash.Sum(nil)
+		if newdoc.MD5Sum == nil {
+			newdoc.MD5Sum = md5sum
+		} else if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+			return vfs.ErrInvalidHash
+		}
+	}
+
 	// The actual check of the optionally given md5 hash is handled by the swift
 	// library.
 	if newdoc.MD5Sum == nil {
@@ -886,13 +1017,20 @@ func (f *swiftFileCreation) Close() (err error) {
 	// TODO: remove dep on couchdb, with a generalized conflict error for
 	// UpdateFileDoc/UpdateDirDoc.
 	if couchdb.IsConflictError(err) {
-		resdoc, err := f.fs.Indexer.FileByID(olddoc.ID())
+		var resdoc *vfs.FileDoc
+		resdoc, err = f.fs.Indexer.FileByID(olddoc.ID())
 		if err != nil {
 			return err
 		}
 		resdoc.Metadata = newdoc.Metadata
 		resdoc.ByteSize = newdoc.ByteSize
-		return f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+		err = f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+	}
+	if err == nil && f.version != nil {
+		if errv := f.fs.versions().keep(f.version); errv != nil {
+			f.fs.log.Warnf("Could not keep the old version of %s: %s",
+				f.version.FileID, errv)
+		}
 	}
 	return
 }
@@ -2,8 +2,10 @@ package vfsswift
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -83,6 +85,40 @@ func makeDocID(objName string) string {
 	return objName[:22] + objName[23:28] + objName[29:]
 }
 
+func (sfs *swiftVFSV2) versions() *swiftVersions {
+	sv := &swiftVersions{
+		c:         sfs.c,
+		container: sfs.dataContainer,
+		index:     sfs.Indexer,
+		disk:      sfs.DiskThresholder,
+	}
+	if sfs.Deduplication() {
+		sv.blobs = sfs.blobs()
+	}
+	return sv
+}
+
+// blobs returns the handler for the deduplicated contents. They are stored in
+// the data container, with the blobs/ prefix.
+func (sfs *swiftVFSV2) blobs() *swiftBlobs {
+	return &swiftBlobs{
+		c:         sfs.c,
+		container: sfs.dataContainer,
+		index:     sfs.Indexer,
+		cipher:    sfs.ContentCipher(),
+	}
+}
+
+// uploads returns the handler for the chunks of the upload sessions. They are
+// stored in the data container, with the uploads/ prefix.
+func (sfs *swiftVFSV2) uploads() *swiftUploads {
+	return &swiftUploads{
+		c:         sfs.c,
+		container: sfs.dataContainer,
+		cipher:    sfs.ContentCipher(),
+	}
+}
+
 func (sfs *swiftVFSV2) DBPrefix() string {
 	return sfs.prefix
 }
@@ -223,7 +259,9 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		if err != nil {
 			return nil, err
 		}
-		if olddoc != nil {
+		// When the versioning is enabled, the old content is kept and still
+		// counts in the disk usage.
+		if olddoc != nil && sfs.MaxFileVersions() <= 0 {
 			oldsize = olddoc.Size()
 		}
 		maxsize = diskQuota - diskUsage
@@ -254,6 +292,15 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		return nil, vfs.ErrParentInTrash
 	}
 
+	// The quotas of the directories that contain the file are also enforced.
+	dirmaxsize, err := vfs.DirQuotasMaxSize(sfs.Indexer, newpath, newsize, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	if dirmaxsize >= 0 && (maxsize < 0 || dirmaxsize < maxsize) {
+		maxsize = dirmaxsize
+	}
+
 	// Avoid storing negative size in the index.
 	if newdoc.ByteSize < 0 {
 		newdoc.ByteSize = 0
@@ -284,15 +331,30 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		}
 	}
 
-	objName := MakeObjectName(newdoc.DocID)
+	container, objName := sfs.container, MakeObjectName(newdoc.DocID)
+	if sfs.Deduplication() {
+		container, objName = sfs.dataContainer, sfs.blobs().tmpName(newdoc.DocID)
+	}
+	var version *vfs.Version
+	if olddoc != nil {
+		version, err = sfs.versions().prepare(olddoc, sfs.container, objName)
+		if err != nil {
+			return nil, err
+		}
+	}
 	objMeta := swift.Metadata{
 		"creation-name": newdoc.Name(),
 		"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
 		"exec":          strconv.FormatBool(newdoc.Executable),
 	}
 	hash := hex.EncodeToString(newdoc.MD5Sum)
+	cipher := sfs.ContentCipher()
+	if cipher != nil {
+		// swift can only check the md5sum of the encrypted content
+		hash = ""
+	}
 	f, err := sfs.c.ObjectCreate(
-		sfs.container,
+		container,
 		objName,
 		hash != "",
 		hash,
@@ -300,20 +362,40 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		objMeta.ObjectHeaders(),
 	)
 	if err != nil {
+		if version != nil {
+			sfs.versions().abort(version)
+		}
 		return nil, err
 	}
-	return &swiftFileCreationV2{
-		f:       f,
-		fs:      sfs,
-		w:       0,
-		size:    newsize,
-		name:    objName,
-		meta:    vfs.NewMetaExtractor(newdoc),
-		newdoc:  newdoc,
-		olddoc:  olddoc,
-		maxsize: maxsize,
-		capsize: capsize,
-	}, nil
+	fc := &swiftFileCreationV2{
+		wc:        f,
+		f:         f,
+		fs:        sfs,
+		w:         0,
+		size:      newsize,
+		container: container,
+		name:      objName,
+		meta:      vfs.NewMetaExtractor(newdoc),
+		newdoc:    newdoc,
+		olddoc:    olddoc,
+		version:   version,
+		maxsize:   maxsize,
+		capsize:   capsize,
+	}
+	if cipher != nil {
+		fc.wc, fc.plainHash, err = encryptContent(cipher, f)
+		if err != nil {
+			sfs.c.ObjectDelete(container, objName) // #nosec
+			if version != nil {
+				sfs.versions().abort(version)
+			}
+			return nil, err
+		}
+	}
+	if sfs.Deduplication() {
+		fc.sha = sha256.New()
+	}
+	return fc, nil
 }
 
 func (sfs *swiftVFSV2) DestroyDirContent(doc *vfs.DirDoc) error {
@@ -322,25 +404,21 @@ func (sfs *swiftVFSV2) DestroyDirContent(doc *vfs.DirDoc) error {
 	}
 	defer sfs.mu.Unlock()
 	diskUsage, _ := sfs.Indexer.DiskUsage()
-	destroyed, ids, err := sfs.Indexer.DeleteDirDocAndContent(doc, true)
+	destroyed, files, err := sfs.Indexer.DeleteDirDocAndContent(doc, true)
 	if err != nil {
 		return err
 	}
-	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
-	objNames := make([]string, len(ids))
-	for i, id := range ids {
-		objNames[i] = MakeObjectName(id)
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = f.ID()
 	}
-	_, err = sfs.c.BulkDelete(sfs.container, objNames)
-	if err == swift.Forbidden {
-		err = nil
-		for _, objName := range objNames {
-			if errd := sfs.c.ObjectDelete(sfs.container, objName); err == nil {
-				err = errd
-			}
-		}
+	if n, errv := sfs.versions().destroyAll(ids...); errv == nil {
+		destroyed += n
+	} else {
+		sfs.log.Errorf("Could not delete the versions of the files: %s", errv)
 	}
-	return err
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	return sfs.destroyContentOf(files)
 }
 
 func (sfs *swiftVFSV2) DestroyDirAndContent(doc *vfs.DirDoc) error {
@@ -349,16 +427,41 @@ func (sfs *swiftVFSV2) DestroyDirAndContent(doc *vfs.DirDoc) error {
 	}
 	defer sfs.mu.Unlock()
 	diskUsage, _ := sfs.Indexer.DiskUsage()
-	destroyed, ids, err := sfs.Indexer.DeleteDirDocAndContent(doc, false)
+	destroyed, files, err := sfs.Indexer.DeleteDirDocAndContent(doc, false)
 	if err != nil {
 		return err
 	}
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = f.ID()
+	}
+	if n, errv := sfs.versions().destroyAll(ids...); errv == nil {
+		destroyed += n
+	} else {
+		sfs.log.Errorf("Could not delete the versions of the files: %s", errv)
+	}
 	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
-	objNames := make([]string, len(ids))
-	for i, id := range ids {
-		objNames[i] = MakeObjectName(id)
+	return sfs.destroyContentOf(files)
+}
+
+// destroyContentOf removes the content of the given files, that have already
+// been removed from the index. The VFS lock must be held by the caller.
+func (sfs *swiftVFSV2) destroyContentOf(files []*vfs.FileDoc) error {
+	if sfs.Deduplication() {
+		var errm error
+		blobs := sfs.blobs()
+		for _, f := range files {
+			if err := blobs.release(f.MD5Sum); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+		return errm
 	}
-	_, err = sfs.c.BulkDelete(sfs.container, objNames)
+	objNames := make([]string, len(files))
+	for i, f := range files {
+		objNames[i] = MakeObjectName(f.ID())
+	}
+	_, err := sfs.c.BulkDelete(sfs.container, objNames)
 	if err == swift.Forbidden {
 		err = nil
 		for _, objName := range objNames {
@@ -377,17 +480,64 @@ func (sfs *swiftVFSV2) DestroyFile(doc *vfs.FileDoc) error {
 	defer sfs.mu.Unlock()
 	diskUsage, _ := sfs.Indexer.DiskUsage()
 	err := sfs.Indexer.DeleteFileDoc(doc)
+	if err != nil {
+		return err
+	}
+	if sfs.Deduplication() {
+		if err = sfs.blobs().release(doc.MD5Sum); err != nil {
+			return err
+		}
+	}
+	destroyed, err := sfs.versions().destroyAll(doc.ID())
+	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, doc.ByteSize+destroyed)
+	return err
+}
+
+func (sfs *swiftVFSV2) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.versions().open(version)
+}
+
+func (sfs *swiftVFSV2) DestroyFileVersion(version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	diskUsage, _ := sfs.Indexer.DiskUsage()
+	err := sfs.versions().destroy(version)
 	if err == nil {
-		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, doc.ByteSize)
+		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, version.ByteSize)
 	}
 	return err
 }
 
+func (sfs *swiftVFSV2) WriteUploadChunk(sessionID string, offset int64, content io.Reader) (int64, error) {
+	return sfs.uploads().write(sessionID, offset, content)
+}
+
+func (sfs *swiftVFSV2) OpenUploadChunk(sessionID string, offset int64) (io.ReadCloser, error) {
+	return sfs.uploads().open(sessionID, offset)
+}
+
+func (sfs *swiftVFSV2) DestroyUploadChunk(sessionID string, offset int64) error {
+	return sfs.uploads().destroyChunk(sessionID, offset)
+}
+
+func (sfs *swiftVFSV2) DestroyUploadChunks(sessionID string) error {
+	return sfs.uploads().destroy(sessionID)
+}
+
 func (sfs *swiftVFSV2) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if lockerr := sfs.mu.RLock(); lockerr != nil {
 		return nil, lockerr
 	}
 	defer sfs.mu.RUnlock()
+	if sfs.Deduplication() {
+		return sfs.blobs().open(doc.MD5Sum)
+	}
 	objName := MakeObjectName(doc.DocID)
 	f, _, err := sfs.c.ObjectOpen(sfs.container, objName, false, nil)
 	if err == swift.ObjectNotFound {
@@ -396,6 +546,9 @@ func (sfs *swiftVFSV2) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c := sfs.ContentCipher(); c != nil {
+		return decryptContent(c, f)
+	}
 	return &swiftFileOpenV2{f, nil}, nil
 }
 
@@ -420,7 +573,40 @@ func (sfs *swiftVFSV2) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err e
 	}
 
 	var newLogs []*vfs.FsckLog
+	if sfs.Deduplication() {
+		newLogs, err = sfs.fsckBlobs()
+	} else {
+		newLogs, err = sfs.fsckObjects()
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(newLogs, func(i, j int) bool {
+		return newLogs[i].Filename < newLogs[j].Filename
+	})
+
+	logbook = append(logbook, newLogs...)
+
+	if opts.Prune {
+		sfs.fsckPrune(newLogs, opts.DryRun)
+	}
+
+	return
+}
 
+// fsckBlobs checks the references to the blobs when the deduplication is
+// enabled.
+func (sfs *swiftVFSV2) fsckBlobs() ([]*vfs.FsckLog, error) {
+	stored, err := sfs.blobs().stored()
+	if err != nil {
+		return nil, err
+	}
+	return sfs.Indexer.CheckBlobsIntegrity(stored)
+}
+
+// fsckObjects checks that the objects of the container match the files of the
+// index.
+func (sfs *swiftVFSV2) fsckObjects() (newLogs []*vfs.FsckLog, err error) {
 	root, err := sfs.Indexer.DirByID(consts.RootDirID)
 	if err != nil {
 		return
@@ -460,7 +646,9 @@ func (sfs *swiftVFSV2) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err e
 				if err != nil {
 					return nil, err
 				}
-				if !bytes.Equal(md5sum, f.file.MD5Sum) {
+				// The hash of an encrypted object can't be compared to the
+				// md5sum of the plain content.
+				if sfs.ContentCipher() == nil && !bytes.Equal(md5sum, f.file.MD5Sum) {
 					olddoc := f.file
 					newdoc := olddoc.Clone().(*vfs.FileDoc)
 					newdoc.MD5Sum = md5sum
@@ -496,17 +684,7 @@ func (sfs *swiftVFSV2) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err e
 			return nil, err
 		}
 	}
-	sort.Slice(newLogs, func(i, j int) bool {
-		return newLogs[i].Filename < newLogs[j].Filename
-	})
-
-	logbook = append(logbook, newLogs...)
-
-	if opts.Prune {
-		sfs.fsckPrune(newLogs, opts.DryRun)
-	}
-
-	return
+	return newLogs, nil
 }
 
 func (sfs *swiftVFSV2) fsckWalk(dir *vfs.DirDoc, entries map[string]fsckFile) error {
@@ -532,6 +710,15 @@ func (sfs *swiftVFSV2) fsckWalk(dir *vfs.DirDoc, entries map[string]fsckFile) er
 // fsckPrune tries to fix the given list on inconsistencies in the VFS
 func (sfs *swiftVFSV2) fsckPrune(logbook []*vfs.FsckLog, dryrun bool) {
 	for _, entry := range logbook {
+		if entry.Type == vfs.BlobOrphan {
+			entry.PruneAction = "deleting the blob"
+			if !dryrun {
+				if err := sfs.blobs().pruneOrphan(entry.Blob); err != nil {
+					entry.PruneError = err
+				}
+			}
+			continue
+		}
 		vfs.FsckPrune(sfs, sfs.Indexer, entry, dryrun)
 	}
 }
@@ -639,17 +826,22 @@ func (sfs *swiftVFSV2) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc,
 }
 
 type swiftFileCreationV2 struct {
-	f       *swift.ObjectCreateFile
-	w       int64
-	size    int64
-	fs      *swiftVFSV2
-	name    string
-	err     error
-	meta    *vfs.MetaExtractor
-	newdoc  *vfs.FileDoc
-	olddoc  *vfs.FileDoc
-	maxsize int64
-	capsize int64
+	f         *swift.ObjectCreateFile
+	wc        io.WriteCloser
+	w         int64
+	size      int64
+	fs        *swiftVFSV2
+	container string
+	name      string
+	err       error
+	meta      *vfs.MetaExtractor
+	newdoc    *vfs.FileDoc
+	olddoc    *vfs.FileDoc
+	version   *vfs.Version
+	maxsize   int64
+	capsize   int64
+	plainHash hash.Hash
+	sha       hash.Hash // sha256 of the content, for the deduplication
 }
 
 func (f *swiftFileCreationV2) Read(p []byte) (int, error) {
@@ -672,11 +864,17 @@ func (f *swiftFileCreationV2) Write(p []byte) (int, error) {
 		}
 	}
 
-	n, err := f.f.Write(p)
+	n, err := f.wc.Write(p)
 	if err != nil {
 		f.err = err
 		return n, err
 	}
+	if f.plainHash != nil {
+		f.plainHash.Write(p[:n]) // #nosec
+	}
+	if f.sha != nil {
+		f.sha.Write(p[:n]) // #nosec
+	}
 
 	f.w += int64(n)
 	if f.maxsize >= 0 && f.w > f.maxsize {
@@ -701,7 +899,10 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		} else {
 			// Deleting the object should be secure since we use X-Versions-Location
 			// on the container and the old object should be restored.
-			f.fs.c.ObjectDelete(f.fs.container, f.name) // #nosec
+			f.fs.c.ObjectDelete(f.container, f.name) // #nosec
+			if f.version != nil {
+				f.fs.versions().abort(f.version)
+			}
 
 			// If an error has occured that is not due to the index update, we should
 			// delete the file from the index.
@@ -712,7 +913,7 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		}
 	}()
 
-	if err = f.f.Close(); err != nil {
+	if err = f.wc.Close(); err != nil {
 		if err == swift.ObjectCorrupted {
 			err = vfs.ErrInvalidHash
 		}
@@ -736,6 +937,16 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		return f.err
 	}
 
+	if f.plainHash != nil {
+		// The content is encrypted: the md5sum is checked on the plain content.
+		md5sum := f.plainHash.Sum(nil)
+		if newdoc.MD5Sum == nil {
+			newdoc.MD5Sum = md5sum
+		} else if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+			return vfs.ErrInvalidHash
+		}
+	}
+
 	// The actual check of the optionally given md5 hash is handled by the swift
 	// library.
 	if newdoc.MD5Sum == nil {
@@ -782,6 +993,12 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		return lockerr
 	}
 	defer f.fs.mu.Unlock()
+	dedup := f.fs.Deduplication()
+	if dedup {
+		if err = f.fs.blobs().commit(f.name, newdoc, f.sha.Sum(nil)); err != nil {
+			return err
+		}
+	}
 	err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
 	// If we reach a conflict error, the document has been modified while
 	// uploading the content of the file.
@@ -789,13 +1006,34 @@ func (f *swiftFileCreationV2) Close() (err error) {
 	// TODO: remove dep on couchdb, with a generalized conflict error for
 	// UpdateFileDoc/UpdateDirDoc.
 	if couchdb.IsConflictError(err) {
-		resdoc, err := f.fs.Indexer.FileByID(olddoc.ID())
+		var resdoc *vfs.FileDoc
+		resdoc, err = f.fs.Indexer.FileByID(olddoc.ID())
 		if err != nil {
 			return err
 		}
 		resdoc.Metadata = newdoc.Metadata
 		resdoc.ByteSize = newdoc.ByteSize
-		return f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+		if dedup {
+			resdoc.MD5Sum = newdoc.MD5Sum
+		}
+		err = f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+	}
+	if dedup {
+		if err != nil {
+			f.fs.blobs().release(newdoc.MD5Sum) // #nosec
+		} else if f.olddoc != nil && f.version == nil {
+			// Without a version, nothing references the old content anymore
+			if errr := f.fs.blobs().release(f.olddoc.MD5Sum); errr != nil {
+				f.fs.log.Warnf("Could not release the old content of %s: %s",
+					f.olddoc.ID(), errr)
+			}
+		}
+	}
+	if err == nil && f.version != nil {
+		if errv := f.fs.versions().keep(f.version); errv != nil {
+			f.fs.log.Warnf("Could not keep the old version of %s: %s",
+				f.version.FileID, errv)
+		}
 	}
 	return
 }
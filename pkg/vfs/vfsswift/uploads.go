@@ -0,0 +1,87 @@
+package vfsswift
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+const uploadsPrefix = "uploads/"
+
+// swiftUploads is used by both swift layouts to stage the chunks of the
+// upload sessions in a container, with the uploads/<session-id>/<offset>
+// names. The chunks are encrypted like the files if cipher is not nil.
+type swiftUploads struct {
+	c         *swift.Connection
+	container string
+	cipher    vfs.Cipher
+}
+
+func uploadChunkName(sessionID string, offset int64) string {
+	// The offset is padded to keep the chunks sorted by their names
+	return fmt.Sprintf("%s%s/%020d", uploadsPrefix, sessionID, offset)
+}
+
+func (su *swiftUploads) write(sessionID string, offset int64, content io.Reader) (int64, error) {
+	objName := uploadChunkName(sessionID, offset)
+	obj, err := su.c.ObjectCreate(su.container, objName, true, "", "application/octet-stream", nil)
+	if err != nil {
+		return 0, err
+	}
+	var f io.WriteCloser = obj
+	if su.cipher != nil {
+		if f, _, err = encryptContent(su.cipher, obj); err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.Copy(f, content)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (su *swiftUploads) open(sessionID string, offset int64) (io.ReadCloser, error) {
+	objName := uploadChunkName(sessionID, offset)
+	f, _, err := su.c.ObjectOpen(su.container, objName, false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if su.cipher != nil {
+		return decryptContent(su.cipher, f)
+	}
+	return f, nil
+}
+
+func (su *swiftUploads) destroyChunk(sessionID string, offset int64) error {
+	err := su.c.ObjectDelete(su.container, uploadChunkName(sessionID, offset))
+	if err == swift.ObjectNotFound {
+		return nil
+	}
+	return err
+}
+
+func (su *swiftUploads) destroy(sessionID string) error {
+	objNames, err := su.c.ObjectNamesAll(su.container, &swift.ObjectsOpts{
+		Prefix: uploadsPrefix + sessionID + "/",
+	})
+	if err != nil || len(objNames) == 0 {
+		return err
+	}
+	_, err = su.c.BulkDelete(su.container, objNames)
+	if err == swift.Forbidden {
+		err = nil
+		for _, objName := range objNames {
+			if errd := su.c.ObjectDelete(su.container, objName); err == nil {
+				err = errd
+			}
+		}
+	}
+	return err
+}
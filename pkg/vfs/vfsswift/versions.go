@@ -0,0 +1,137 @@
+package vfsswift
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+const versionsPrefix = "versions/"
+
+// swiftVersions is used by both swift layouts to store the old versions of
+// the files in a container, with the versions/<file-id>/<number> names.
+// When the deduplication is enabled, blobs is not nil and the versions just
+// keep a reference to the blob of their content.
+type swiftVersions struct {
+	c         *swift.Connection
+	container string
+	index     vfs.Indexer
+	disk      vfs.DiskThresholder
+	blobs     *swiftBlobs
+}
+
+func versionObjectName(v *vfs.Version) string {
+	return versionsPrefix + v.FileID + "/" + strconv.Itoa(v.Number)
+}
+
+// prepare copies the current content of a file before it is overwritten, and
+// returns the version that should be added to the index when the upload of
+// the new content succeeds. It returns nil if the versioning is disabled. The
+// VFS lock must be held by the caller.
+func (sv *swiftVersions) prepare(olddoc *vfs.FileDoc, srcContainer, srcName string) (*vfs.Version, error) {
+	if sv.disk.MaxFileVersions() <= 0 {
+		return nil, nil
+	}
+	versions, err := sv.index.AllVersions(olddoc.ID())
+	if err != nil {
+		return nil, err
+	}
+	v := vfs.NewVersion(olddoc, vfs.NextVersionNumber(versions))
+	if sv.blobs != nil {
+		return v, nil
+	}
+	_, err = sv.c.ObjectCopy(srcContainer, srcName, sv.container, versionObjectName(v), nil)
+	if err == swift.ObjectNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// abort removes the copy of the content made for a version that will not be
+// kept.
+func (sv *swiftVersions) abort(v *vfs.Version) {
+	if sv.blobs != nil {
+		return
+	}
+	sv.c.ObjectDelete(sv.container, versionObjectName(v)) // #nosec
+}
+
+// keep adds the version to the index and removes the old versions that are
+// not kept by the retention policy. The VFS lock must be held by the caller.
+func (sv *swiftVersions) keep(v *vfs.Version) error {
+	if err := sv.index.CreateVersion(v); err != nil {
+		if sv.blobs != nil {
+			sv.blobs.release(v.MD5Sum) // #nosec
+		} else {
+			sv.abort(v)
+		}
+		return err
+	}
+	versions, err := sv.index.AllVersions(v.FileID)
+	if err != nil {
+		return err
+	}
+	maxNumber, maxAge := sv.disk.MaxFileVersions(), sv.disk.FileVersionsMaxAge()
+	for _, old := range vfs.VersionsToClean(versions, maxNumber, maxAge) {
+		if err = sv.destroy(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *swiftVersions) open(v *vfs.Version) (vfs.File, error) {
+	if sv.blobs != nil {
+		return sv.blobs.open(v.MD5Sum)
+	}
+	f, _, err := sv.c.ObjectOpen(sv.container, versionObjectName(v), false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c := sv.disk.ContentCipher(); c != nil {
+		return decryptContent(c, f)
+	}
+	return &swiftFileOpenV2{f, nil}, nil
+}
+
+// destroy removes the content and the document of a version.
+func (sv *swiftVersions) destroy(v *vfs.Version) error {
+	if sv.blobs != nil {
+		if err := sv.index.DeleteVersion(v); err != nil {
+			return err
+		}
+		return sv.blobs.release(v.MD5Sum)
+	}
+	err := sv.c.ObjectDelete(sv.container, versionObjectName(v))
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	return sv.index.DeleteVersion(v)
+}
+
+// destroyAll removes all the versions of the given files, and returns the
+// number of bytes that were used by them.
+func (sv *swiftVersions) destroyAll(fileIDs ...string) (int64, error) {
+	var destroyed int64
+	for _, fileID := range fileIDs {
+		versions, err := sv.index.AllVersions(fileID)
+		if err != nil {
+			return destroyed, err
+		}
+		for _, v := range versions {
+			if err = sv.destroy(v); err != nil {
+				return destroyed, err
+			}
+			destroyed += v.ByteSize
+		}
+	}
+	return destroyed, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"io"
 	"math"
 	"os"
 	"runtime"
@@ -83,8 +84,11 @@ func worker(ctx *jobs.WorkerContext) (err error) {
 	cmd := createCmd(cmdStr, workDir) // #nosec
 	cmd.Env = env
 
-	// set stderr writable with a bytes.Buffer limited total size of 256Ko
-	cmd.Stderr = utils.LimitWriterDiscard(&stderrBuf, 256*1024)
+	// set stderr writable with a bytes.Buffer limited total size of 256Ko,
+	// and keep its lines in the logs of the job
+	stderrLogs := &logWriter{ctx: ctx, stream: jobs.LogStderr}
+	defer stderrLogs.Flush()
+	cmd.Stderr = io.MultiWriter(utils.LimitWriterDiscard(&stderrBuf, 256*1024), stderrLogs)
 
 	// Log out all things printed in stderr, whatever the result of the
 	// konnector is.
@@ -120,8 +124,11 @@ func worker(ctx *jobs.WorkerContext) (err error) {
 		return wrapErr(ctx, err)
 	}
 
+	scanDone := make(chan struct{})
 	go func() {
+		defer close(scanDone)
 		for scanOut.Scan() {
+			ctx.AppendLog(jobs.LogStdout, scanOut.Text())
 			if errOut := worker.ScanOutput(ctx, inst, scanOut.Bytes()); errOut != nil {
 				log.Error(errOut)
 			}
@@ -131,8 +138,10 @@ func worker(ctx *jobs.WorkerContext) (err error) {
 		}
 	}()
 
+	// The output must have been read before waiting for the command.
 	waitDone := make(chan error)
 	go func() {
+		<-scanDone
 		waitDone <- cmd.Wait()
 		close(waitDone)
 	}()
@@ -148,6 +157,35 @@ func worker(ctx *jobs.WorkerContext) (err error) {
 	return worker.Error(inst, err)
 }
 
+// logWriter is an io.Writer that appends the lines written on it to the logs
+// of the job.
+type logWriter struct {
+	ctx    *jobs.WorkerContext
+	stream string
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.ctx.AppendLog(w.stream, string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush appends the last line, if it doesn't end with a newline.
+func (w *logWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.ctx.AppendLog(w.stream, string(w.buf))
+		w.buf = nil
+	}
+}
+
 func commit(ctx *jobs.WorkerContext, errjob error) error {
 	return ctx.Cookie().(execWorker).Commit(ctx, errjob)
 }
@@ -44,6 +44,7 @@ const (
 	konnectorMsgTypeWarning  = "warning"
 	konnectorMsgTypeError    = "error"
 	konnectorMsgTypeCritical = "critical"
+	konnectorMsgTypeProgress = "progress"
 )
 
 type konnectorMessage struct {
@@ -328,6 +329,7 @@ func (w *konnectorWorker) ScanOutput(ctx *jobs.WorkerContext, i *instance.Instan
 		Type    string `json:"type"`
 		Message string `json:"message"`
 		NoRetry bool   `json:"no_retry"`
+		Percent int    `json:"percent"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
@@ -335,6 +337,10 @@ func (w *konnectorWorker) ScanOutput(ctx *jobs.WorkerContext, i *instance.Instan
 
 	log := w.Logger(ctx)
 	switch msg.Type {
+	case konnectorMsgTypeProgress:
+		if err := ctx.SetProgress(msg.Percent, msg.Message); err != nil {
+			log.Warnf("Cannot save progress: %s", err)
+		}
 	case konnectorMsgTypeDebug, konnectorMsgTypeInfo:
 		log.Debug(msg.Message)
 	case konnectorMsgTypeWarning, "warn":
@@ -365,10 +371,15 @@ func (w *konnectorWorker) ScanOutput(ctx *jobs.WorkerContext, i *instance.Instan
 
 func (w *konnectorWorker) Error(i *instance.Instance, err error) error {
 	if w.err != nil {
-		return w.err
+		err = w.err
+	} else if w.lastErr != nil {
+		err = w.lastErr
 	}
-	if w.lastErr != nil {
-		return w.lastErr
+	// The login failures and the actions needed from the user cannot be fixed
+	// by executing the konnector again.
+	if err != nil && (strings.HasPrefix(err.Error(), konnErrorLoginFailed) ||
+		strings.HasPrefix(err.Error(), konnErrorUserActionNeeded)) {
+		return jobs.Permanent(err)
 	}
 	return err
 }
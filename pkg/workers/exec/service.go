@@ -134,12 +134,17 @@ func (w *serviceWorker) ScanOutput(ctx *jobs.WorkerContext, i *instance.Instance
 	var msg struct {
 		Type    string `json:"type"`
 		Message string `json:"message"`
+		Percent int    `json:"percent"`
 	}
 	if err := json.Unmarshal(line, &msg); err != nil {
 		return fmt.Errorf("Could not parse stdout as JSON: %q", string(line))
 	}
 	log := w.Logger(ctx)
 	switch msg.Type {
+	case konnectorMsgTypeProgress:
+		if err := ctx.SetProgress(msg.Percent, msg.Message); err != nil {
+			log.Warnf("Cannot save progress: %s", err)
+		}
 	case konnectorMsgTypeDebug, konnectorMsgTypeInfo:
 		log.Debug(msg.Message)
 	case konnectorMsgTypeWarning, "warn":
@@ -0,0 +1,95 @@
+package index
+
+import (
+	"encoding/json"
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "index",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Timeout:      30 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// message is the message of the index jobs. The jobs pushed by the triggers
+// have the doctype of the event, and a job with reindex rebuilds the whole
+// index of the instance.
+type message struct {
+	DocType string `json:"doctype"`
+	Reindex bool   `json:"reindex"`
+}
+
+type event struct {
+	Verb   string          `json:"verb"`
+	Doc    json.RawMessage `json:"doc"`
+	OldDoc json.RawMessage `json:"old,omitempty"`
+}
+
+// Worker is a worker that keeps the full-text index of an instance in sync
+// with its files and documents.
+func Worker(ctx *jobs.WorkerContext) error {
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	var msg message
+	if err = ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	if msg.Reindex {
+		if err = instance.AddMissingTriggers(i, "index"); err != nil {
+			return err
+		}
+		return search.Reindex(i, i.VFS())
+	}
+	if !search.IsIndexed(msg.DocType) {
+		return nil
+	}
+
+	var evt event
+	if err = ctx.UnmarshalEvent(&evt); err != nil {
+		return err
+	}
+	if msg.DocType != consts.Files {
+		doc := couchdb.JSONDoc{Type: msg.DocType}
+		if err = json.Unmarshal(evt.Doc, &doc); err != nil {
+			return err
+		}
+		if evt.Verb == realtime.EventDelete {
+			return search.Delete(i, msg.DocType, doc.ID())
+		}
+		return search.IndexDoc(i, &doc)
+	}
+
+	var doc vfs.DirOrFileDoc
+	if err = json.Unmarshal(evt.Doc, &doc); err != nil {
+		return err
+	}
+	if evt.Verb == realtime.EventDelete {
+		return search.Delete(i, consts.Files, doc.ID())
+	}
+	dir, file := doc.Refine()
+	if file != nil {
+		return search.IndexFile(i, i.VFS(), file)
+	}
+	if evt.Verb == realtime.EventUpdate && len(evt.OldDoc) > 0 {
+		var old vfs.DirDoc
+		if err = json.Unmarshal(evt.OldDoc, &old); err == nil && old.Fullpath != dir.Fullpath {
+			return search.IndexTree(i, i.VFS(), dir.ID())
+		}
+	}
+	return search.IndexDir(i, dir)
+}
@@ -384,6 +384,18 @@ func init() {
 				},
 			},
 		},
+		{
+			Name:    "notifications_trash_expiry",
+			Subject: "Notifications Trash Expiry Subject",
+			Intro:   "Notifications Trash Expiry Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Notifications Trash Expiry instruction",
+					Text:         "Notifications Trash Expiry text",
+					Link:         "{{.TrashLink}}",
+				},
+			},
+		},
 	}}
 }
 
@@ -0,0 +1,153 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "metadata",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+type fileEvent struct {
+	Verb   string       `json:"verb"`
+	Doc    vfs.FileDoc  `json:"doc"`
+	OldDoc *vfs.FileDoc `json:"old,omitempty"`
+}
+
+// Worker is a worker that extracts the metadata of the PDF and office
+// documents when they are uploaded. Without a trigger, it extracts again the
+// metadata of the files, when they have been extracted by an older version of
+// the extractors, and it adds the trigger to the instances created before it.
+func Worker(ctx *jobs.WorkerContext) error {
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.TriggerID(); ok {
+		var evt fileEvent
+		if err = ctx.UnmarshalEvent(&evt); err != nil {
+			return err
+		}
+		return extractDocument(i.VFS(), &evt)
+	}
+	if err = instance.AddMissingTriggers(i, "metadata"); err != nil {
+		return err
+	}
+	fs := i.VFS()
+	var errm error
+	count := 0
+	err = vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil || extractorVersion(file) >= vfs.MetadataExtractorVersion {
+			return nil
+		}
+		extractor := vfs.NewMetaExtractor(file)
+		if extractor == nil {
+			extractor = vfs.NewDocumentExtractor(file)
+		}
+		updated, err := extractMetadata(fs, file, extractor)
+		if err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", name, err))
+		} else if updated {
+			count++
+		}
+		return nil
+	})
+	if count > 0 {
+		ctx.Logger().WithField("nspace", "metadata").
+			Infof("Metadata extracted again for %d files", count)
+	}
+	if err != nil {
+		return err
+	}
+	return errm
+}
+
+func extractorVersion(file *vfs.FileDoc) int {
+	switch v := file.Metadata["extractor_version"].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// extractDocument extracts the metadata of a document that has been created,
+// or whose content has changed. The event for the update of the metadata by
+// this worker is ignored, as the content is the same.
+func extractDocument(fs vfs.VFS, evt *fileEvent) error {
+	if evt.OldDoc != nil && bytes.Equal(evt.OldDoc.MD5Sum, evt.Doc.MD5Sum) {
+		return nil
+	}
+	file, err := fs.FileByID(evt.Doc.ID())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// The content has changed again: the metadata will be extracted for the
+	// next event
+	if !bytes.Equal(file.MD5Sum, evt.Doc.MD5Sum) {
+		return nil
+	}
+	_, err = extractMetadata(fs, file, vfs.NewDocumentExtractor(file))
+	return err
+}
+
+// extractMetadata reads the content of the file to extract its metadata with
+// the given extractor, and updates the file document with them. The other
+// metadata of the file, that can have been added by the applications, are
+// kept.
+func extractMetadata(fs vfs.VFS, file *vfs.FileDoc, extractor *vfs.MetaExtractor) (bool, error) {
+	if extractor == nil {
+		return false, nil
+	}
+	f, err := fs.OpenFile(file)
+	if err != nil {
+		(*extractor).Abort(err)
+		return false, err
+	}
+	_, err = io.Copy(*extractor, f)
+	// The extractors can stop reading when they have found what they need
+	if err == io.ErrClosedPipe {
+		err = nil
+	}
+	if errc := f.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		(*extractor).Abort(err)
+		return false, err
+	}
+	if err = (*extractor).Close(); err != nil {
+		return false, err
+	}
+	newdoc := file.Clone().(*vfs.FileDoc)
+	for k, v := range (*extractor).Result() {
+		newdoc.Metadata[k] = v
+	}
+	if err = fs.UpdateFileDoc(file, newdoc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
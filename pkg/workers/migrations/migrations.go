@@ -1,18 +1,23 @@
 package migrations
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
 	"strings"
 
+	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
 	"github.com/cozy/swift"
 	multierror "github.com/hashicorp/go-multierror"
@@ -36,6 +41,7 @@ func init() {
 }
 
 const swiftV1ToV2 = "swift-v1-to-v2"
+const toS3 = "to-s3"
 
 type message struct {
 	Type    string `json:"type"`
@@ -53,6 +59,8 @@ func worker(ctx *jobs.WorkerContext) error {
 	switch msg.Type {
 	case swiftV1ToV2:
 		return migrateSwiftV1ToV2(domain)
+	case toS3:
+		return migrateToS3(domain)
 	default:
 		return fmt.Errorf("unknown migration type %q", msg.Type)
 	}
@@ -72,6 +80,8 @@ func commit(ctx *jobs.WorkerContext, err error) error {
 	switch msg.Type {
 	case swiftV1ToV2:
 		return commitSwiftV1ToV2(domain, msg.Cluster)
+	case toS3:
+		return commitToS3(domain)
 	default:
 		return fmt.Errorf("unknown migration type %q", msg.Type)
 	}
@@ -155,6 +165,162 @@ func commitSwiftV1ToV2(domain string, swiftCluster int) error {
 	return instance.Patch(inst, &instance.Options{SwiftCluster: swiftCluster})
 }
 
+// migrateToS3 copies the content of the files, their old versions, and the
+// applications of an instance to the S3 storage. The objects already copied
+// are skipped, so the migration can be retried. The instance keeps using its
+// current storage until the commit.
+func migrateToS3(domain string) error {
+	if config.S3URL() == nil {
+		return errors.New("no S3 storage has been configured")
+	}
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	if inst.S3Storage {
+		return nil
+	}
+
+	im, err := vfss3.NewImporter(inst, vfs.NewCouchdbIndexer(inst), inst)
+	if err != nil {
+		return err
+	}
+	errm := importFilesToS3(inst.VFS(), im)
+
+	c := config.GetS3Client()
+	bucket := config.S3Bucket()
+	webapps, err := apps.ListWebapps(inst)
+	if err != nil {
+		return err
+	}
+	dst := apps.NewS3Copier(c, bucket, apps.Webapp)
+	for _, app := range webapps {
+		err = apps.CopyApp(inst.AppsFileServer(), dst, app.Slug(), app.Version())
+		if err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	konnectors, err := apps.ListKonnectors(inst)
+	if err != nil {
+		return err
+	}
+	dst = apps.NewS3Copier(c, bucket, apps.Konnector)
+	for _, konn := range konnectors {
+		err = apps.CopyApp(inst.KonnectorsFileServer(), dst, konn.Slug(), konn.Version())
+		if err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+
+	return errm
+}
+
+// importFilesToS3 copies the files that are not in S3, or whose content has
+// changed since they were copied.
+func importFilesToS3(fs vfs.VFS, im *vfss3.Importer) error {
+	var errm error
+	err := vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return nil
+		}
+		if err = importFileToS3(fs, im, file); err != nil {
+			errm = multierror.Append(errm, fmt.Errorf("%s: %s", name, err))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return errm
+}
+
+func importFileToS3(fs vfs.VFS, im *vfss3.Importer, doc *vfs.FileDoc) error {
+	needed, err := im.NeedsImport(doc)
+	if err != nil {
+		return err
+	}
+	if needed {
+		f, err := fs.OpenFile(doc)
+		if err != nil {
+			return err
+		}
+		err = im.ImportFile(doc, f)
+		if errc := f.Close(); errc != nil && err == nil {
+			err = errc
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	versions, err := fs.AllVersions(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		f, err := fs.OpenFileVersion(doc, v)
+		if err != nil {
+			return err
+		}
+		err = im.ImportVersion(v, f)
+		if errc := f.Close(); errc != nil && err == nil {
+			err = errc
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitToS3 switches the instance to the S3 storage. The VFS is locked
+// during the switch, and the files modified since the migration are copied
+// again, so that no write is lost. The thumbnails are not copied, they are
+// generated again by the thumbnailck worker.
+func commitToS3(domain string) error {
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	if inst.S3Storage {
+		return nil
+	}
+
+	mu := lock.ReadWrite(inst, "vfs")
+	if err = mu.Lock(); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	// The files are read with another lock, as the lock of the VFS is held
+	fs, err := inst.VFSWithLocker(lock.ReadWrite(inst, "migrations/to-s3"))
+	if err != nil {
+		return err
+	}
+	im, err := vfss3.NewImporter(inst, vfs.NewCouchdbIndexer(inst), inst)
+	if err != nil {
+		return err
+	}
+	if err = importFilesToS3(fs, im); err != nil {
+		return err
+	}
+	if err = instance.Patch(inst, &instance.Options{S3Storage: true}); err != nil {
+		return err
+	}
+	msg, err := jobs.NewMessage(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	_, err = jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "thumbnailck",
+		Message:    msg,
+	})
+	return err
+}
+
 func readObjects(c *swift.Connection, objc chan object,
 	containerSrc, containerDst string) error {
 	return c.ObjectsWalk(containerSrc, nil, func(opts *swift.ObjectsOpts) (interface{}, error) {
@@ -0,0 +1,129 @@
+package migrations
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var inst *instance.Instance
+
+func writeFile(t *testing.T, fs vfs.VFS, name, content string, olddoc *vfs.FileDoc) *vfs.FileDoc {
+	var doc *vfs.FileDoc
+	if olddoc != nil {
+		doc = olddoc.Clone().(*vfs.FileDoc)
+		doc.ByteSize = int64(len(content))
+		doc.MD5Sum = nil
+	} else {
+		var err error
+		doc, err = vfs.NewFileDoc(name, consts.RootDirID, int64(len(content)), nil,
+			"text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	f, err := fs.CreateFile(doc, olddoc)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = f.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	doc, err = fs.FileByPath("/" + name)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return doc
+}
+
+func readFile(t *testing.T, fs vfs.VFS, name string) string {
+	doc, err := fs.FileByPath("/" + name)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	f, err := fs.OpenFile(doc)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	return string(buf)
+}
+
+func TestMigrateAndCommitToS3(t *testing.T) {
+	fs := inst.VFS()
+	foo := writeFile(t, fs, "foo.txt", "foo", nil)
+	bar := writeFile(t, fs, "bar.txt", "bar", nil)
+
+	assert.NoError(t, migrateToS3(inst.Domain))
+	im, err := vfss3.NewImporter(inst, vfs.NewCouchdbIndexer(inst), inst)
+	assert.NoError(t, err)
+	for _, doc := range []*vfs.FileDoc{foo, bar} {
+		needed, err := im.NeedsImport(doc)
+		assert.NoError(t, err)
+		assert.False(t, needed)
+	}
+
+	// A resumed migration copies again the files modified since the first
+	// pass
+	foo = writeFile(t, fs, "foo.txt", "FOO", foo)
+	needed, err := im.NeedsImport(foo)
+	assert.NoError(t, err)
+	assert.True(t, needed)
+	assert.NoError(t, migrateToS3(inst.Domain))
+	needed, err = im.NeedsImport(foo)
+	assert.NoError(t, err)
+	assert.False(t, needed)
+
+	// The files written between the migration and the commit are not lost
+	writeFile(t, fs, "bar.txt", "BAR", bar)
+	baz := writeFile(t, fs, "baz.txt", "baz", nil)
+	assert.NoError(t, commitToS3(inst.Domain))
+
+	migrated, err := instance.Get(inst.Domain)
+	assert.NoError(t, err)
+	assert.True(t, migrated.S3Storage)
+	s3fs := migrated.VFS()
+	assert.Equal(t, "FOO", readFile(t, s3fs, "foo.txt"))
+	assert.Equal(t, "BAR", readFile(t, s3fs, "bar.txt"))
+	assert.Equal(t, "baz", readFile(t, s3fs, baz.DocName))
+
+	// The commit is idempotent
+	assert.NoError(t, commitToS3(inst.Domain))
+	assert.NoError(t, migrateToS3(inst.Domain))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+
+	u := os.Getenv("COZY_TEST_S3_URL")
+	if u == "" {
+		u = "s3://localhost:9000/cozy-test?AccessKey=minioaccesskey&SecretKey=miniosecretkey&DisableSSL=true"
+	}
+	s3URL, err := url.Parse(u)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err = config.InitS3Client(s3URL); err != nil {
+		fmt.Println("This test need minio to run.")
+		os.Exit(1)
+	}
+	config.GetConfig().Fs.S3URL = s3URL
+
+	setup := testutils.NewSetup(m, "migrations_test")
+	inst = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/swift"
 	multierror "github.com/hashicorp/go-multierror"
+	minio "github.com/minio/minio-go"
 )
 
 var (
@@ -43,6 +44,8 @@ func SystemArchiver() Archiver {
 		return newAferoArchiver(fs)
 	case config.SchemeSwift:
 		return newSwiftArchiver()
+	case config.SchemeS3:
+		return newS3Archiver()
 	default:
 		panic(fmt.Errorf("exports: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -159,3 +162,79 @@ func (a *switfArchiver) RemoveArchives(exportDocs []*ExportDoc) error {
 	}
 	return nil
 }
+
+func newS3Archiver() Archiver {
+	return &s3Archiver{
+		c:      config.GetS3Client(),
+		bucket: config.S3Bucket(),
+		prefix: "exports/",
+	}
+}
+
+// s3Archiver stores the archives in the bucket of the stack. S3 has no
+// equivalent of the X-Delete-At header of swift, so the archives are only
+// removed by RemoveArchives.
+type s3Archiver struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+}
+
+func (a *s3Archiver) key(exportDoc *ExportDoc) string {
+	return a.prefix + exportDoc.Domain + "/" + exportDoc.ID()
+}
+
+func (a *s3Archiver) OpenArchive(inst *instance.Instance, exportDoc *ExportDoc) (io.ReadCloser, int64, error) {
+	obj, err := a.c.GetObject(a.bucket, a.key(exportDoc), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	infos, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, 0, err
+	}
+	return obj, infos.Size, nil
+}
+
+func (a *s3Archiver) CreateArchive(exportDoc *ExportDoc) (io.WriteCloser, error) {
+	// The size of the archive is not known in advance: it is streamed to the
+	// S3 server through a pipe.
+	pr, pw := io.Pipe()
+	w := &s3ArchiveWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := a.c.PutObject(a.bucket, a.key(exportDoc), pr, -1, minio.PutObjectOptions{
+			ContentType: "application/tar+gzip",
+			UserMetadata: map[string]string{
+				"Created-At": exportDoc.CreatedAt.Format(time.RFC3339),
+			},
+		})
+		pr.CloseWithError(err) // #nosec
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (a *s3Archiver) RemoveArchives(exportDocs []*ExportDoc) error {
+	var errm error
+	for _, e := range exportDocs {
+		if err := a.c.RemoveObject(a.bucket, a.key(e)); err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	return errm
+}
+
+type s3ArchiveWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3ArchiveWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3ArchiveWriter) Close() error {
+	w.pw.Close() // #nosec
+	return <-w.done
+}
@@ -726,6 +726,7 @@ func writeInstanceDoc(in *instance.Instance, name string,
 	clone.OAuthSecret = nil
 	clone.CLISecret = nil
 	clone.SwiftCluster = 0
+	clone.S3Storage = false
 	return writeDoc("", name, clone, now, tw)
 }
 
@@ -39,6 +39,14 @@ func init() {
 		Timeout:      1 * time.Hour,
 		WorkerFunc:   WorkerUpload,
 	})
+
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "share-groups",
+		Concurrency:  1,
+		MaxExecCount: 2,
+		Timeout:      30 * time.Second,
+		WorkerFunc:   WorkerGroups,
+	})
 }
 
 // WorkerTrack is used to update the io.cozy.shared database when a document
@@ -102,3 +110,26 @@ func WorkerUpload(ctx *jobs.WorkerContext) error {
 	}
 	return s.Upload(inst, msg.Errors)
 }
+
+// WorkerGroups is used to add or revoke the members of a sharing when the
+// contacts are added to or removed from its groups
+func WorkerGroups(ctx *jobs.WorkerContext) error {
+	var msg sharing.GroupsMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	var evt sharing.ContactEvent
+	if err := ctx.UnmarshalEvent(&evt); err != nil {
+		return err
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	inst.Logger().WithField("nspace", "share").Debugf("Groups %#v - %#v", msg, evt.Verb)
+	s, err := sharing.FindSharing(inst, msg.SharingID)
+	if err != nil {
+		return err
+	}
+	return s.ApplyContactChange(inst, &evt)
+}
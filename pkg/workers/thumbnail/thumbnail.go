@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -23,24 +25,12 @@ type imageEvent struct {
 	OldDoc *vfs.FileDoc `json:"old,omitempty"`
 }
 
-var formats = map[string]string{
-	"small":  "640x480",
-	"medium": "1280x720",
-	"large":  "1920x1080",
-}
-
-var formatsNames = []string{
-	"small",
-	"medium",
-	"large",
-}
-
 func init() {
 	jobs.AddWorker(&jobs.WorkerConfig{
 		WorkerType:   "thumbnail",
 		Concurrency:  runtime.NumCPU(),
 		MaxExecCount: 2,
-		Timeout:      30 * time.Second,
+		Timeout:      2 * time.Minute,
 		WorkerFunc:   Worker,
 	})
 
@@ -53,7 +43,8 @@ func init() {
 	})
 }
 
-// Worker is a worker that creates thumbnails for photos and images.
+// Worker is a worker that creates thumbnails for photos and images, PDFs and
+// videos.
 func Worker(ctx *jobs.WorkerContext) error {
 	var img imageEvent
 	if err := ctx.UnmarshalEvent(&img); err != nil {
@@ -87,8 +78,9 @@ type thumbnailMsg struct {
 	WithMetadata bool `json:"with_metadata"`
 }
 
-// WorkerCheck is a worker function that checks all the images to generate
-// missing thumbnails.
+// WorkerCheck is a worker function that checks all the images, PDFs and
+// videos to generate missing thumbnails. It also adds the trigger for the PDFs
+// and videos to the instances created before they had thumbnails.
 func WorkerCheck(ctx *jobs.WorkerContext) error {
 	i, err := instance.Get(ctx.Domain())
 	if err != nil {
@@ -98,6 +90,9 @@ func WorkerCheck(ctx *jobs.WorkerContext) error {
 	if err = ctx.UnmarshalMessage(&msg); err != nil {
 		return err
 	}
+	if err = instance.AddMissingTriggers(i, "thumbnail"); err != nil {
+		return err
+	}
 	fs := i.VFS()
 	fsThumb := i.ThumbsFS()
 	var errm error
@@ -105,11 +100,11 @@ func WorkerCheck(ctx *jobs.WorkerContext) error {
 		if err != nil {
 			return err
 		}
-		if dir != nil || img.Class != "image" {
+		if dir != nil || !vfs.HasThumbnails(img) || !canGenerate(img) {
 			return nil
 		}
 		allExists := true
-		for _, format := range formatsNames {
+		for _, format := range vfs.ThumbFormatsNames {
 			var exists bool
 			exists, err = fsThumb.ThumbExists(img, format)
 			if err != nil {
@@ -125,7 +120,7 @@ func WorkerCheck(ctx *jobs.WorkerContext) error {
 				errm = multierror.Append(errm, err)
 			}
 		}
-		if msg.WithMetadata {
+		if msg.WithMetadata && img.Class == "image" {
 			var meta *vfs.Metadata
 			meta, err = calculateMetadata(fs, img)
 			if err != nil {
@@ -168,6 +163,9 @@ func calculateMetadata(fs vfs.VFS, img *vfs.FileDoc) (*vfs.Metadata, error) {
 }
 
 func generateThumbnails(ctx *jobs.WorkerContext, i *instance.Instance, img *vfs.FileDoc) error {
+	if !canGenerate(img) {
+		return nil
+	}
 	fs := i.ThumbsFS()
 	var in io.Reader
 	in, err := i.VFS().OpenFile(img)
@@ -176,8 +174,8 @@ func generateThumbnails(ctx *jobs.WorkerContext, i *instance.Instance, img *vfs.
 	}
 
 	var env []string
+	var tempDir string
 	{
-		var tempDir string
 		tempDir, err = ioutil.TempDir("", "magick")
 		if err == nil {
 			defer os.RemoveAll(tempDir) // #nosec
@@ -186,6 +184,19 @@ func generateThumbnails(ctx *jobs.WorkerContext, i *instance.Instance, img *vfs.
 		}
 	}
 
+	if img.Class != "image" {
+		if tempDir == "" {
+			if inCloser, ok := in.(io.Closer); ok {
+				inCloser.Close()
+			}
+			return err
+		}
+		in, err = extractImage(ctx, in, img, tempDir, env)
+		if err != nil {
+			return err
+		}
+	}
+
 	in, err = recGenerateThub(ctx, in, fs, img, "large", env, false)
 	if err != nil {
 		return err
@@ -198,6 +209,74 @@ func generateThumbnails(ctx *jobs.WorkerContext, i *instance.Instance, img *vfs.
 	return err
 }
 
+// extractCmd returns the command used to extract an image from a PDF or a
+// video, as configured in the jobs section of the configuration file.
+func extractCmd(doc *vfs.FileDoc) string {
+	switch doc.Class {
+	case "pdf":
+		return config.GetConfig().Jobs.PDFThumbnailCmd
+	case "video":
+		return config.GetConfig().Jobs.VideoThumbnailCmd
+	}
+	return ""
+}
+
+// canGenerate returns false for the PDFs and videos when the command to
+// extract an image from them has been disabled in the configuration.
+func canGenerate(doc *vfs.FileDoc) bool {
+	return doc.Class == "image" || extractCmd(doc) != ""
+}
+
+// extractImage copies the content of a PDF or a video in a temporary file,
+// as the tools need to seek in it, and runs the configured command to get an
+// image of the first page or of a keyframe. This image is then used as the
+// source for the thumbnails.
+func extractImage(ctx *jobs.WorkerContext, in io.Reader, doc *vfs.FileDoc, tempDir string, env []string) (io.Reader, error) {
+	input := path.Join(tempDir, "input")
+	err := copyToFile(input, in)
+	if inCloser, ok := in.(io.Closer); ok {
+		if errc := inCloser.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	args := strings.Fields(extractCmd(doc))
+	for i, arg := range args {
+		args[i] = strings.Replace(arg, "{input}", input, -1)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...) // #nosec
+	cmd.Env = env
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		ctx.Logger().
+			WithField("stderr", stderr.String()).
+			WithField("file_id", doc.ID()).
+			Errorf("%s failed: %s", args[0], err)
+		return nil, err
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("%s has not extracted an image from %s", args[0], doc.ID())
+	}
+	return &stdout, nil
+}
+
+func copyToFile(name string, in io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	if errc := f.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	return err
+}
+
 func recGenerateThub(ctx *jobs.WorkerContext, in io.Reader, fs vfs.Thumbser, img *vfs.FileDoc, format string, env []string, noOuput bool) (r io.Reader, err error) {
 	defer func() {
 		if inCloser, ok := in.(io.Closer); ok {
@@ -252,7 +331,7 @@ func generateThumb(ctx *jobs.WorkerContext, in io.Reader, out io.Writer, fileID
 		"-strip",         // Strip the EXIF metadata
 		"-quality", "82", // A good compromise between file size and quality
 		"-interlace", "none", // Don't use progressive JPEGs, they are heavier
-		"-thumbnail", formats[format], // Makes a thumbnail that fits inside the given format
+		"-thumbnail", vfs.ThumbFormats[format], // Makes a thumbnail that fits inside the given format
 		"-colorspace", "sRGB", // Use the colorspace recommended for web, sRGB
 		"jpg:-", // Send the output on stdout, in JPEG format
 	}
@@ -273,5 +352,5 @@ func generateThumb(ctx *jobs.WorkerContext, in io.Reader, out io.Writer, fileID
 }
 
 func removeThumbnails(i *instance.Instance, img *vfs.FileDoc) error {
-	return i.ThumbsFS().RemoveThumbs(img, formatsNames)
+	return i.ThumbsFS().RemoveThumbs(img, vfs.ThumbFormatsNames)
 }
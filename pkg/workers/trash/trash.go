@@ -0,0 +1,165 @@
+package trash
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/notification"
+	"github.com/cozy/cozy-stack/pkg/notification/center"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// notifyBefore is the delay before the deletion of the items of the trash
+// when the user is notified.
+const notifyBefore = 3 * 24 * time.Hour
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "trash-clean",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Timeout:      30 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// item is a file or directory at the root of the trash.
+type item struct {
+	dir  *vfs.DirDoc
+	file *vfs.FileDoc
+}
+
+// trashedAt returns when the item has been moved to the trash. For the items
+// trashed before this date was recorded, the date is set to now, so that they
+// have the full retention period (and the notification) before being deleted.
+func (it *item) trashedAt(fs vfs.VFS, now time.Time) (time.Time, error) {
+	if it.dir != nil {
+		if it.dir.TrashedAt != nil {
+			return *it.dir.TrashedAt, nil
+		}
+		newdir := it.dir.Clone().(*vfs.DirDoc)
+		newdir.TrashedAt = &now
+		return now, fs.UpdateDirDoc(it.dir, newdir)
+	}
+	if it.file.TrashedAt != nil {
+		return *it.file.TrashedAt, nil
+	}
+	newfile := it.file.Clone().(*vfs.FileDoc)
+	newfile.TrashedAt = &now
+	return now, fs.UpdateFileDoc(it.file, newfile)
+}
+
+// Worker is a worker that deletes the items of the trash that have been
+// trashed for more than the retention period chosen by the user in the
+// settings of the instance. It can also notify the user of the items that
+// will be deleted in the next days.
+func Worker(ctx *jobs.WorkerContext) error {
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	days, notify, err := i.SettingsTrashRetention()
+	if err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if days == 0 {
+		return nil
+	}
+
+	fs := i.VFS()
+	items, err := trashItems(fs)
+	if err != nil {
+		return err
+	}
+
+	retention := time.Duration(days) * 24 * time.Hour
+	now := time.Now()
+	var errm error
+	var deleted, soon int
+	var nextDeletion time.Time
+	for _, it := range items {
+		trashedAt, err := it.trashedAt(fs, now)
+		if err != nil {
+			errm = multierror.Append(errm, err)
+			continue
+		}
+		expiresAt := trashedAt.Add(retention)
+		if expiresAt.Before(now) {
+			if it.dir != nil {
+				err = fs.DestroyDirAndContent(it.dir)
+			} else {
+				err = fs.DestroyFile(it.file)
+			}
+			if err != nil {
+				errm = multierror.Append(errm, err)
+			} else {
+				deleted++
+			}
+		} else if expiresAt.Before(now.Add(notifyBefore)) {
+			soon++
+			if nextDeletion.IsZero() || expiresAt.Before(nextDeletion) {
+				nextDeletion = expiresAt
+			}
+		}
+	}
+
+	log := ctx.Logger().WithField("nspace", "trash")
+	if deleted > 0 {
+		log.Infof("%d items deleted from the trash", deleted)
+	}
+	if notify && soon > 0 {
+		if err = notifyExpiry(i, soon, days, nextDeletion); err != nil {
+			log.Warnf("Cannot notify the user: %s", err)
+		}
+	}
+	return errm
+}
+
+// trashItems returns the files and directories at the root of the trash. They
+// are all fetched before deleting any of them, as the iterator works with an
+// offset.
+func trashItems(fs vfs.VFS) ([]*item, error) {
+	trash, err := fs.DirByID(consts.TrashDirID)
+	if err != nil {
+		return nil, err
+	}
+	var items []*item
+	iter := fs.DirIterator(trash, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &item{dir: d, file: f})
+	}
+}
+
+// notifyExpiry sends a notification to the user about the items that will be
+// deleted soon. The notification is stateful, with the date of the next
+// deletion, so that the user is not notified every day for the same items.
+func notifyExpiry(i *instance.Instance, count, days int, nextDeletion time.Time) error {
+	trashLink := i.SubDomain(consts.DriveSlug)
+	trashLink.Fragment = "/trash"
+	date := nextDeletion.Format("2006-01-02")
+	n := &notification.Notification{
+		State: date,
+		Data: map[string]interface{}{
+			"Count":     count,
+			"Days":      days,
+			"Date":      date,
+			"TrashLink": trashLink.String(),
+		},
+	}
+	return center.PushStack(i.Domain, center.NotificationTrashExpiry, n)
+}
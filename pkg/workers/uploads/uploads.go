@@ -0,0 +1,38 @@
+package uploads
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "clean-uploads",
+		Concurrency:  4,
+		MaxExecCount: 1,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that removes the upload sessions of the files that have
+// not been finalized, and the chunks staged for them. It also adds the
+// nightly trigger to the instances created before the upload sessions.
+func Worker(ctx *jobs.WorkerContext) error {
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	if err = instance.AddMissingTriggers(i, "clean-uploads"); err != nil {
+		return err
+	}
+	cleaned, err := vfs.CleanUploadSessions(i.VFS())
+	if cleaned > 0 {
+		ctx.Logger().WithField("nspace", "uploads").
+			Infof("%d expired upload sessions cleaned", cleaned)
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package versions
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "clean-versions",
+		Concurrency:  4,
+		MaxExecCount: 1,
+		Timeout:      30 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that removes the old versions of the files that are
+// older than the max age of the retention policy, as this age is checked only
+// when a new version is written. It also adds the nightly trigger to the
+// instances created before the versions.
+func Worker(ctx *jobs.WorkerContext) error {
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	if err = instance.AddMissingTriggers(i, "clean-versions"); err != nil {
+		return err
+	}
+	cleaned, err := vfs.CleanOldVersions(i.VFS())
+	if cleaned > 0 {
+		ctx.Logger().WithField("nspace", "versions").
+			Infof("%d old versions cleaned", cleaned)
+	}
+	return err
+}
@@ -204,6 +204,9 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs apps.FileServer, app
 		token = i.BuildAppToken(app, session.ID())
 	} else {
 		token = c.QueryParam("sharecode")
+		if token != "" {
+			permissions.RecordShareView(c, i, token)
+		}
 	}
 
 	tracking := "false"
@@ -374,6 +374,9 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if err = permissions.AllowDownload(c, doc.ByteSize); err != nil {
+		return err
+	}
 
 	disposition := "inline"
 	if c.QueryParam("Dl") == "1" {
@@ -409,7 +412,8 @@ func HeadDirOrFile(c echo.Context) error {
 	return nil
 }
 
-// ThumbnailHandler serves thumbnails of the images/photos
+// ThumbnailHandler serves thumbnails of the images/photos, PDFs and videos.
+// A placeholder is served when the thumbnail is missing.
 func ThumbnailHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -435,8 +439,16 @@ func ThumbnailHandler(c echo.Context) error {
 		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
 	}
 
+	format := c.Param("format")
+	if _, ok := vfs.ThumbFormats[format]; !ok {
+		return WrapVfsError(vfs.ErrInvalidThumbFormat)
+	}
 	fs := instance.ThumbsFS()
-	return fs.ServeThumbContent(c.Response(), c.Request(), doc, c.Param("format"))
+	err = fs.ServeThumbContent(c.Response(), c.Request(), doc, format)
+	if os.IsNotExist(err) && vfs.HasThumbnails(doc) {
+		err = vfs.ServeThumbPlaceholder(c.Response(), c.Request(), doc, format)
+	}
+	return WrapVfsError(err)
 }
 
 func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
@@ -452,6 +464,9 @@ func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 		if err != nil {
 			return err
 		}
+		if err = permissions.AllowDownload(c, doc.ByteSize); err != nil {
+			return err
+		}
 	}
 
 	disposition := "inline"
@@ -507,6 +522,9 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 			return err
 		}
 	}
+	if err = permissions.AllowDownload(c, -1); err != nil {
+		return err
+	}
 
 	// if accept header is application/zip, send the archive immediately
 	if c.Request().Header.Get("Accept") == "application/zip" {
@@ -553,6 +571,9 @@ func FileDownloadCreateHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if err = permissions.AllowDownload(c, -1); err != nil {
+		return err
+	}
 
 	secret, err := vfs.GetStore().AddFile(instance, path)
 	if err != nil {
@@ -833,12 +854,24 @@ func Routes(router *echo.Group) {
 	router.PATCH("/metadata", ModifyMetadataByPathHandler)
 	router.PATCH("/:file-id", ModifyMetadataByIDHandler)
 
+	router.POST("/uploads", CreateUploadHandler)
+	router.HEAD("/uploads/:session-id", GetUploadHandler)
+	router.GET("/uploads/:session-id", GetUploadHandler)
+	router.PATCH("/uploads/:session-id", UploadChunkHandler)
+	router.POST("/uploads/:session-id", FinalizeUploadHandler)
+	router.DELETE("/uploads/:session-id", AbortUploadHandler)
+
 	router.POST("/", CreationHandler)
 	router.POST("/:file-id", CreationHandler)
 	router.PUT("/:file-id", OverwriteFileContentHandler)
 
 	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler)
 
+	router.GET("/:file-id/versions", ListVersionsHandler)
+	router.GET("/:file-id/versions/:number", DownloadVersionHandler)
+	router.POST("/:file-id/versions/:number", RestoreVersionHandler)
+	router.DELETE("/:file-id/versions/:number", DestroyVersionHandler)
+
 	router.POST("/archive", ArchiveDownloadCreateHandler)
 	router.GET("/archive/:secret/:fake-name", ArchiveDownloadHandler)
 
@@ -874,16 +907,16 @@ func WrapVfsError(err error) error {
 		return jsonapi.InvalidParameter("name", err)
 	case vfs.ErrIllegalTime:
 		return jsonapi.InvalidParameter("UpdatedAt", err)
-	case vfs.ErrInvalidHash:
+	case vfs.ErrInvalidHash, vfs.ErrUploadMissingHash:
 		return jsonapi.PreconditionFailed("Content-MD5", err)
 	case vfs.ErrContentLengthMismatch:
 		return jsonapi.PreconditionFailed("Content-Length", err)
-	case vfs.ErrConflict:
+	case vfs.ErrConflict, vfs.ErrUploadOffsetMismatch, vfs.ErrBlobCollision:
 		return jsonapi.Conflict(err)
 	case vfs.ErrFileInTrash, vfs.ErrNonAbsolutePath,
-		vfs.ErrDirNotEmpty:
+		vfs.ErrDirNotEmpty, vfs.ErrInvalidThumbFormat:
 		return jsonapi.BadRequest(err)
-	case vfs.ErrFileTooBig:
+	case vfs.ErrFileTooBig, vfs.ErrDirQuotaExceeded:
 		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err)
 	}
 	return err
@@ -17,6 +17,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -906,6 +907,70 @@ func TestDownloadRangeSuccess(t *testing.T) {
 	assert.Equal(t, "bar", string(res4body))
 }
 
+func TestShareLinkDownloadsWithRanges(t *testing.T) {
+	body := "foo,bar"
+	res1, v := upload(t, "/files/?Type=file&Name=sharedbyrange", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID := v["data"].(map[string]interface{})["id"].(string)
+
+	code, err := testInstance.CreateShareCode("email")
+	if !assert.NoError(t, err) {
+		return
+	}
+	parent := &pkgperm.Permission{
+		Type:        pkgperm.TypeOauth,
+		Permissions: pkgperm.Set{pkgperm.Rule{Type: consts.Files}},
+	}
+	set := pkgperm.Set{pkgperm.Rule{Type: consts.Files, Values: []string{fileID}}}
+	pdoc, err := pkgperm.CreateShareSet(testInstance, parent, map[string]string{"email": code},
+		set, &pkgperm.ShareOptions{MaxDownloads: 4})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	downloads := func(byteRange string) int {
+		req, err := http.NewRequest("GET", ts.URL+"/files/download/"+fileID, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+code)
+		req.Header.Add("Range", byteRange)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		res.Body.Close()
+		assert.Equal(t, 206, res.StatusCode)
+		doc, err := pkgperm.GetByID(testInstance, pdoc.ID())
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return doc.Downloads
+	}
+
+	// The next parts of a range request are not counted, but all the ranges
+	// that give the first byte are
+	assert.Equal(t, 0, downloads("bytes=4-"))
+	assert.Equal(t, 1, downloads("bytes=-999999999"))
+	assert.Equal(t, 2, downloads("bytes=00-"))
+	assert.Equal(t, 3, downloads("bytes=1-,0-0"))
+	assert.Equal(t, 4, downloads("bytes=-7"))
+
+	req, err := http.NewRequest("GET", ts.URL+"/files/download/"+fileID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+code)
+	req.Header.Add("Range", "bytes=0-")
+	res2, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		res2.Body.Close()
+		assert.Equal(t, 403, res2.StatusCode)
+	}
+}
+
 func TestGetFileMetadataFromPath(t *testing.T) {
 	res1, _ := httpGet(ts.URL + "/files/metadata?Path=/noooooop")
 	assert.Equal(t, 404, res1.StatusCode)
@@ -1721,6 +1786,149 @@ func TestThumbnail(t *testing.T) {
 	assert.True(t, strings.HasPrefix(res4.Header.Get("Content-Type"), "image/jpeg"))
 }
 
+func TestThumbnailPlaceholder(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=placeholder.pdf", "application/pdf", "%PDF-1.4", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	links := data1["data"].(map[string]interface{})["links"].(map[string]interface{})
+	small := links["small"].(string)
+
+	res2, body := download(t, small, "")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.Equal(t, "image/jpeg", res2.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", res2.Header.Get("Cache-Control"))
+	assert.NotEmpty(t, body)
+
+	res3, _ := download(t, strings.TrimSuffix(small, "small")+"huge", "")
+	assert.Equal(t, 400, res3.StatusCode)
+}
+
+func TestFileVersions(t *testing.T) {
+	config.GetConfig().Fs.VersionsMaxNumber = 5
+	defer func() { config.GetConfig().Fs.VersionsMaxNumber = 0 }()
+
+	res1, data1 := upload(t, "/files/?Type=file&Name=versioned", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID := data1["data"].(map[string]interface{})["id"].(string)
+
+	res2, _ := uploadMod(t, "/files/"+fileID, "text/plain", "bar", "")
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	res3, err := httpGet(ts.URL + "/files/" + fileID + "/versions")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res3.StatusCode)
+	var list map[string]interface{}
+	assert.NoError(t, extractJSONRes(res3, &list))
+	items := list["data"].([]interface{})
+	if !assert.Len(t, items, 1) {
+		return
+	}
+	attrs := items[0].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, fileID, attrs["file_id"])
+	assert.Equal(t, float64(1), attrs["number"])
+
+	res4, body := download(t, "/files/"+fileID+"/versions/1", "")
+	assert.Equal(t, 200, res4.StatusCode)
+	assert.Equal(t, "foo", string(body))
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/"+fileID+"/versions/1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res5, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res5.StatusCode)
+	buf, err := readFile(testInstance.VFS(), "/versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+
+	req, err = http.NewRequest("DELETE", ts.URL+"/files/"+fileID+"/versions/2", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res6, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 204, res6.StatusCode)
+
+	res7, _ := download(t, "/files/"+fileID+"/versions/2", "")
+	assert.Equal(t, 404, res7.StatusCode)
+}
+
+func TestResumableUpload(t *testing.T) {
+	doReq := func(method, path, offset, hash, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		if offset != "" {
+			req.Header.Add("Upload-Offset", offset)
+		}
+		if hash != "" {
+			req.Header.Add("Content-MD5", hash)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return res
+	}
+
+	res1 := doReq("POST", "/files/uploads?Name=resumable&Size=11", "", "", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	assert.Equal(t, "0", res1.Header.Get("Upload-Offset"))
+	var v map[string]interface{}
+	assert.NoError(t, extractJSONRes(res1, &v))
+	sessionID := v["data"].(map[string]interface{})["id"].(string)
+	path := "/files/uploads/" + sessionID
+
+	res2 := doReq("PATCH", path, "0", "", "hello ")
+	assert.Equal(t, 200, res2.StatusCode)
+	assert.Equal(t, "6", res2.Header.Get("Upload-Offset"))
+
+	res3 := doReq("PATCH", path, "0", "", "foo")
+	assert.Equal(t, 409, res3.StatusCode)
+	assert.Equal(t, "6", res3.Header.Get("Upload-Offset"))
+
+	res4 := doReq("HEAD", path, "", "", "")
+	assert.Equal(t, 200, res4.StatusCode)
+	assert.Equal(t, "6", res4.Header.Get("Upload-Offset"))
+
+	res5 := doReq("POST", path, "", "", "")
+	assert.Equal(t, 412, res5.StatusCode)
+
+	res6 := doReq("PATCH", path, "6", "", "world")
+	assert.Equal(t, 200, res6.StatusCode)
+	assert.Equal(t, "11", res6.Header.Get("Upload-Offset"))
+
+	res7 := doReq("POST", path, "", "UmfjCVWct/albVkURcJJfg==", "")
+	assert.Equal(t, 412, res7.StatusCode)
+
+	res8 := doReq("POST", path, "", "XrY7u+Ae7tCTyyK7j1rNww==", "")
+	assert.Equal(t, 201, res8.StatusCode)
+	buf, err := readFile(testInstance.VFS(), "/resumable")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(buf))
+
+	res9 := doReq("GET", path, "", "", "")
+	assert.Equal(t, 404, res9.StatusCode)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -21,6 +21,7 @@ type dir struct {
 	doc      *vfs.DirDoc
 	rel      jsonapi.RelationshipMap
 	included []jsonapi.Object
+	used     *int64 // size of the files inside a directory with a quota
 }
 
 type file struct {
@@ -157,6 +158,13 @@ func dirData(c echo.Context, statusCode int, doc *vfs.DirDoc) error {
 		rel:      rel,
 		included: included,
 	}
+	if doc.Quota > 0 {
+		used, err := vfs.DirUsage(instance.VFS(), doc)
+		if err != nil {
+			return err
+		}
+		d.used = &used
+	}
 
 	return jsonapi.Data(c, statusCode, d, &links)
 }
@@ -218,11 +226,20 @@ func (d *dir) DocType() string                        { return d.doc.DocType() }
 func (d *dir) Clone() couchdb.Doc                     { cloned := *d; return &cloned }
 func (d *dir) Relationships() jsonapi.RelationshipMap { return d.rel }
 func (d *dir) Included() []jsonapi.Object             { return d.included }
-func (d *dir) MarshalJSON() ([]byte, error)           { return json.Marshal(d.doc) }
 func (d *dir) Links() *jsonapi.LinksList {
 	return &jsonapi.LinksList{Self: "/files/" + d.doc.DocID}
 }
 
+func (d *dir) MarshalJSON() ([]byte, error) {
+	if d.used == nil {
+		return json.Marshal(d.doc)
+	}
+	return json.Marshal(struct {
+		*vfs.DirDoc
+		QuotaUsed int64 `json:"quota_used,string"`
+	}{d.doc, *d.used})
+}
+
 func (a *apiArchive) Relationships() jsonapi.RelationshipMap { return nil }
 func (a *apiArchive) Included() []jsonapi.Object             { return nil }
 func (a *apiArchive) MarshalJSON() ([]byte, error)           { return json.Marshal(a.Archive) }
@@ -265,7 +282,7 @@ func (f *file) MarshalJSON() ([]byte, error) {
 }
 func (f *file) Links() *jsonapi.LinksList {
 	links := jsonapi.LinksList{Self: "/files/" + f.doc.DocID}
-	if f.doc.Class == "image" {
+	if vfs.HasThumbnails(f.doc) {
 		if path, err := f.doc.Path(f.instance.VFS()); err == nil {
 			if secret, err := vfs.GetStore().AddFile(f.instance, path); err == nil {
 				links.Small = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/small"
@@ -0,0 +1,215 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// UploadOffsetHeader is the HTTP header used to tell the number of bytes
+// already received by an upload session.
+const UploadOffsetHeader = "Upload-Offset"
+
+type apiUpload struct {
+	*vfs.UploadSession
+}
+
+func (u *apiUpload) Relationships() jsonapi.RelationshipMap {
+	if u.FileID == "" {
+		return nil
+	}
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Related: "/files/" + u.FileID,
+			},
+			Data: couchdb.DocReference{
+				ID:   u.FileID,
+				Type: consts.Files,
+			},
+		},
+	}
+}
+func (u *apiUpload) Included() []jsonapi.Object   { return nil }
+func (u *apiUpload) MarshalJSON() ([]byte, error) { return json.Marshal(u.UploadSession) }
+func (u *apiUpload) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/uploads/" + u.ID()}
+}
+
+var _ jsonapi.Object = (*apiUpload)(nil)
+
+func uploadData(c echo.Context, statusCode int, s *vfs.UploadSession) error {
+	c.Response().Header().Set(UploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+	return jsonapi.Data(c, statusCode, &apiUpload{s}, nil)
+}
+
+// uploadSessionFromReq returns the upload session given in the request
+// parameters, after checking that the request has the permission to write
+// the file of this session.
+func uploadSessionFromReq(c echo.Context) (*vfs.UploadSession, error) {
+	fs := middlewares.GetInstance(c).VFS()
+	s, err := vfs.GetUploadSession(fs, c.Param("session-id"))
+	if err != nil {
+		return nil, WrapVfsError(err)
+	}
+	if s.FileID != "" {
+		olddoc, err := fs.FileByID(s.FileID)
+		if err != nil {
+			return nil, WrapVfsError(err)
+		}
+		if err = checkPerm(c, permissions.PUT, nil, olddoc); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	doc, err := s.FileDoc(nil)
+	if err != nil {
+		return nil, WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.POST, nil, doc); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CreateUploadHandler handles POST requests on /files/uploads, and creates an
+// upload session. The DirID and Name parameters are used for a new file, and
+// the FileID parameter for overwriting the content of an existing file.
+func CreateUploadHandler(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+
+	var olddoc, newdoc *vfs.FileDoc
+	var err error
+	if fileID := c.QueryParam("FileID"); fileID != "" {
+		olddoc, err = fs.FileByID(fileID)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
+			return WrapVfsError(err)
+		}
+		if err = checkPerm(c, permissions.PUT, nil, olddoc); err != nil {
+			return err
+		}
+		newdoc, err = FileDocFromReq(c, olddoc.DocName, olddoc.DirID, olddoc.Tags)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		newdoc.SetID(olddoc.ID()) // The ID can be useful to check permissions
+		if err = checkPerm(c, permissions.PUT, nil, newdoc); err != nil {
+			return err
+		}
+	} else {
+		tags := strings.Split(c.QueryParam("Tags"), TagSeparator)
+		newdoc, err = FileDocFromReq(c, c.QueryParam("Name"), c.QueryParam("DirID"), tags)
+		if err != nil {
+			return WrapVfsError(err)
+		}
+		if err = checkPerm(c, permissions.POST, nil, newdoc); err != nil {
+			return err
+		}
+	}
+
+	// The body of this request is empty, the size of the content is given
+	// with the Size parameter.
+	newdoc.ByteSize = -1
+	if size := c.QueryParam("Size"); size != "" {
+		newdoc.ByteSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || newdoc.ByteSize < 0 {
+			return jsonapi.InvalidParameter("Size", errors.New("Invalid size"))
+		}
+	}
+
+	s, err := vfs.NewUploadSession(fs, newdoc, olddoc)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return uploadData(c, http.StatusCreated, s)
+}
+
+// GetUploadHandler handles GET and HEAD requests on
+// /files/uploads/:session-id, and returns the state of the upload session,
+// in particular the offset from which the upload can be resumed.
+func GetUploadHandler(c echo.Context) error {
+	s, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	if c.Request().Method == http.MethodHead {
+		c.Response().Header().Set(UploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+		return c.NoContent(http.StatusOK)
+	}
+	return uploadData(c, http.StatusOK, s)
+}
+
+// UploadChunkHandler handles PATCH requests on /files/uploads/:session-id,
+// and stages the body of the request as the next chunk of the content. The
+// Upload-Offset header must match the offset of the session.
+func UploadChunkHandler(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	s, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.ParseInt(c.Request().Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil {
+		return jsonapi.InvalidParameter(UploadOffsetHeader, err)
+	}
+	s, err = vfs.AppendUploadChunk(fs, s.ID(), offset, c.Request().Body)
+	if err == vfs.ErrUploadOffsetMismatch {
+		c.Response().Header().Set(UploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+	}
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return uploadData(c, http.StatusOK, s)
+}
+
+// FinalizeUploadHandler handles POST requests on /files/uploads/:session-id,
+// and writes the staged content in the file, after checking its md5sum.
+func FinalizeUploadHandler(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	s, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	var md5Sum []byte
+	if md5Str := c.Request().Header.Get("Content-MD5"); md5Str != "" {
+		md5Sum, err = parseMD5Hash(md5Str)
+		if err != nil {
+			return jsonapi.InvalidParameter("Content-MD5", err)
+		}
+	}
+	newdoc, olddoc, err := vfs.FinalizeUpload(fs, s.ID(), md5Sum)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if olddoc != nil {
+		return fileData(c, http.StatusOK, newdoc, nil)
+	}
+	return fileData(c, http.StatusCreated, newdoc, nil)
+}
+
+// AbortUploadHandler handles DELETE requests on /files/uploads/:session-id,
+// and removes the upload session with its staged chunks.
+func AbortUploadHandler(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	s, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	if err = vfs.AbortUpload(fs, s.ID()); err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
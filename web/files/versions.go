@@ -0,0 +1,141 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiVersion struct {
+	*vfs.Version
+}
+
+func (v *apiVersion) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Related: "/files/" + v.FileID,
+			},
+			Data: couchdb.DocReference{
+				ID:   v.FileID,
+				Type: consts.Files,
+			},
+		},
+	}
+}
+func (v *apiVersion) Included() []jsonapi.Object   { return nil }
+func (v *apiVersion) MarshalJSON() ([]byte, error) { return json.Marshal(v.Version) }
+func (v *apiVersion) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/" + v.FileID + "/versions/" + strconv.Itoa(v.Number)}
+}
+
+var _ jsonapi.Object = (*apiVersion)(nil)
+
+// fileAndVersion returns the file and the version given in the request
+// parameters, after checking that the request has the permission to use the
+// verb on the file.
+func fileAndVersion(c echo.Context, v pkgperm.Verb) (*vfs.FileDoc, *vfs.Version, error) {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return nil, nil, WrapVfsError(err)
+	}
+	if err = checkPerm(c, v, nil, doc); err != nil {
+		return nil, nil, err
+	}
+	number, err := strconv.Atoi(c.Param("number"))
+	if err != nil {
+		return nil, nil, jsonapi.InvalidParameter("number", err)
+	}
+	version, err := instance.VFS().VersionByNumber(doc.ID(), number)
+	if err != nil {
+		return nil, nil, WrapVfsError(err)
+	}
+	return doc, version, nil
+}
+
+// ListVersionsHandler handles GET requests on /files/:file-id/versions, and
+// returns the list of the old versions of the file.
+func ListVersionsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+	versions, err := instance.VFS().AllVersions(doc.ID())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	objs := make([]jsonapi.Object, len(versions))
+	for i, v := range versions {
+		objs[i] = &apiVersion{v}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// DownloadVersionHandler handles GET requests on
+// /files/:file-id/versions/:number, and sends the content of the version.
+func DownloadVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, version, err := fileAndVersion(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	if err = permissions.AllowDownload(c, version.ByteSize); err != nil {
+		return err
+	}
+	disposition := "inline"
+	if c.QueryParam("Dl") == "1" {
+		disposition = "attachment"
+	}
+	err = vfs.ServeVersionContent(instance.VFS(), doc, version, disposition, c.Request(), c.Response())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return nil
+}
+
+// RestoreVersionHandler handles POST requests on
+// /files/:file-id/versions/:number, and replaces the content of the file by
+// the content of the version. The current content is kept as a new version.
+func RestoreVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, version, err := fileAndVersion(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	if err = CheckIfMatch(c, doc.Rev()); err != nil {
+		return WrapVfsError(err)
+	}
+	newdoc, err := vfs.RestoreVersion(instance.VFS(), doc, version)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return fileData(c, http.StatusOK, newdoc, nil)
+}
+
+// DestroyVersionHandler handles DELETE requests on
+// /files/:file-id/versions/:number, and destroys the version.
+func DestroyVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	_, version, err := fileAndVersion(c, permissions.DELETE)
+	if err != nil {
+		return err
+	}
+	if err = instance.VFS().DestroyFileVersion(version); err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
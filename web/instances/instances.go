@@ -60,6 +60,7 @@ func createHandler(c echo.Context) error {
 		Passphrase: c.QueryParam("Passphrase"),
 		Apps:       utils.SplitTrimString(c.QueryParam("Apps"), ","),
 		Dev:        (c.QueryParam("Dev") == "true"),
+		Dedup:      (c.QueryParam("Dedup") == "true"),
 	}
 	if domainAliases := c.QueryParam("DomainAliases"); domainAliases != "" {
 		opts.DomainAliases = strings.Split(domainAliases, ",")
@@ -134,6 +135,20 @@ func modifyHandler(c echo.Context) error {
 		}
 		opts.DiskQuota = i
 	}
+	if maxVersions := c.QueryParam("VersionsMaxNumber"); maxVersions != "" {
+		i, err := strconv.Atoi(maxVersions)
+		if err != nil {
+			return wrapError(err)
+		}
+		opts.MaxVersions = i
+	}
+	if maxAge := c.QueryParam("VersionsMaxAge"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return wrapError(err)
+		}
+		opts.VersionsAge = d
+	}
 	if onboardingFinished, err := strconv.ParseBool(c.QueryParam("OnboardingFinished")); err == nil {
 		opts.OnboardingFinished = &onboardingFinished
 	}
@@ -147,6 +162,13 @@ func modifyHandler(c echo.Context) error {
 	if err = instance.Patch(i, opts); err != nil {
 		return wrapError(err)
 	}
+	// The instances created before the versions have no trigger for removing
+	// the old ones
+	if opts.VersionsAge > 0 {
+		if err = instance.AddMissingTriggers(i, "clean-versions"); err != nil {
+			return wrapError(err)
+		}
+	}
 	return jsonapi.Data(c, http.StatusOK, &apiInstance{i}, nil)
 }
 
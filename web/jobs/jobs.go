@@ -2,6 +2,10 @@ package jobs
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"time"
@@ -9,6 +13,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
@@ -17,21 +22,46 @@ import (
 
 	// import workers
 	_ "github.com/cozy/cozy-stack/pkg/workers/exec"
+	_ "github.com/cozy/cozy-stack/pkg/workers/index"
 	_ "github.com/cozy/cozy-stack/pkg/workers/log"
 	_ "github.com/cozy/cozy-stack/pkg/workers/mails"
+	_ "github.com/cozy/cozy-stack/pkg/workers/metadata"
 	_ "github.com/cozy/cozy-stack/pkg/workers/migrations"
 	_ "github.com/cozy/cozy-stack/pkg/workers/move"
 	_ "github.com/cozy/cozy-stack/pkg/workers/push"
 	_ "github.com/cozy/cozy-stack/pkg/workers/share"
 	_ "github.com/cozy/cozy-stack/pkg/workers/thumbnail"
+	_ "github.com/cozy/cozy-stack/pkg/workers/trash"
 	_ "github.com/cozy/cozy-stack/pkg/workers/unzip"
 	_ "github.com/cozy/cozy-stack/pkg/workers/updates"
+	_ "github.com/cozy/cozy-stack/pkg/workers/uploads"
+	_ "github.com/cozy/cozy-stack/pkg/workers/versions"
+)
+
+const typeTextEventStream = "text/event-stream"
+
+// logsPollInterval is the time between two reads of the logs of a job, when
+// they are streamed.
+var logsPollInterval = 500 * time.Millisecond
+
+// webhookMaxBodySize is the maximal size of the body of a request on a
+// webhook.
+var webhookMaxBodySize int64 = 1 << 20
+
+var (
+	errWebhookSignature   = errors.New("Invalid signature")
+	errWebhookRateLimited = errors.New("Too many requests on this webhook")
 )
 
 type (
 	apiJob struct {
 		j *jobs.Job
 	}
+	// apiWebhookJob is the job returned to the caller of a webhook: only its
+	// ID is given, as the job can contain the message of the trigger.
+	apiWebhookJob struct {
+		id string
+	}
 	apiJobRequest struct {
 		Arguments json.RawMessage  `json:"arguments"`
 		Options   *jobs.JobOptions `json:"options"`
@@ -39,6 +69,15 @@ type (
 	apiQueue struct {
 		workerType string
 	}
+	apiFailedJob struct {
+		f *jobs.FailedJob
+	}
+	apiWorkflow struct {
+		w *jobs.Workflow
+	}
+	apiWorkflowRequest struct {
+		Steps []*jobs.WorkflowStep `json:"steps"`
+	}
 	apiTrigger struct {
 		t *jobs.TriggerInfos
 	}
@@ -52,6 +91,7 @@ type (
 		WorkerType      string           `json:"worker"`
 		WorkerArguments json.RawMessage  `json:"worker_arguments"`
 		Debounce        string           `json:"debounce"`
+		Timezone        string           `json:"timezone"`
 		Options         *jobs.JobOptions `json:"options"`
 	}
 )
@@ -71,6 +111,49 @@ func (j apiJob) MarshalJSON() ([]byte, error) {
 	return json.Marshal(j.j)
 }
 
+func (j apiWebhookJob) ID() string                             { return j.id }
+func (j apiWebhookJob) Rev() string                            { return "" }
+func (j apiWebhookJob) DocType() string                        { return consts.Jobs }
+func (j apiWebhookJob) Clone() couchdb.Doc                     { return j }
+func (j apiWebhookJob) SetID(_ string)                         {}
+func (j apiWebhookJob) SetRev(_ string)                        {}
+func (j apiWebhookJob) Relationships() jsonapi.RelationshipMap { return nil }
+func (j apiWebhookJob) Included() []jsonapi.Object             { return nil }
+func (j apiWebhookJob) Links() *jsonapi.LinksList              { return nil }
+func (j apiWebhookJob) MarshalJSON() ([]byte, error) {
+	return []byte("{}"), nil
+}
+
+func (f apiFailedJob) ID() string                             { return f.f.ID() }
+func (f apiFailedJob) Rev() string                            { return f.f.Rev() }
+func (f apiFailedJob) DocType() string                        { return consts.JobsFailed }
+func (f apiFailedJob) Clone() couchdb.Doc                     { return f }
+func (f apiFailedJob) SetID(_ string)                         {}
+func (f apiFailedJob) SetRev(_ string)                        {}
+func (f apiFailedJob) Relationships() jsonapi.RelationshipMap { return nil }
+func (f apiFailedJob) Included() []jsonapi.Object             { return nil }
+func (f apiFailedJob) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/failed/" + f.f.ID()}
+}
+func (f apiFailedJob) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.f)
+}
+
+func (w apiWorkflow) ID() string                             { return w.w.ID() }
+func (w apiWorkflow) Rev() string                            { return w.w.Rev() }
+func (w apiWorkflow) DocType() string                        { return consts.JobsWorkflows }
+func (w apiWorkflow) Clone() couchdb.Doc                     { return w }
+func (w apiWorkflow) SetID(_ string)                         {}
+func (w apiWorkflow) SetRev(_ string)                        {}
+func (w apiWorkflow) Relationships() jsonapi.RelationshipMap { return nil }
+func (w apiWorkflow) Included() []jsonapi.Object             { return nil }
+func (w apiWorkflow) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/workflows/" + w.w.ID()}
+}
+func (w apiWorkflow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.w)
+}
+
 func (q apiQueue) ID() string      { return q.workerType }
 func (q apiQueue) DocType() string { return consts.Jobs }
 func (q apiQueue) Match(key, value string) bool {
@@ -90,7 +173,11 @@ func (t apiTrigger) SetRev(_ string)                        {}
 func (t apiTrigger) Relationships() jsonapi.RelationshipMap { return nil }
 func (t apiTrigger) Included() []jsonapi.Object             { return nil }
 func (t apiTrigger) Links() *jsonapi.LinksList {
-	return &jsonapi.LinksList{Self: "/jobs/triggers/" + t.ID()}
+	links := &jsonapi.LinksList{Self: "/jobs/triggers/" + t.ID()}
+	if t.t.WebhookID != "" {
+		links.Related = "/jobs/webhooks/" + t.t.WebhookID
+	}
+	return links
 }
 func (t apiTrigger) MarshalJSON() ([]byte, error) {
 	return json.Marshal(t.t)
@@ -145,6 +232,12 @@ func pushJob(c echo.Context) error {
 		return wrapJobsError(err)
 	}
 
+	if req.Options != nil && req.Options.Retry != nil {
+		if err := req.Options.Retry.Validate(); err != nil {
+			return jsonapi.InvalidAttribute("retry", err)
+		}
+	}
+
 	jr := &jobs.JobRequest{
 		WorkerType: c.Param("worker-type"),
 		Options:    req.Options,
@@ -166,6 +259,52 @@ func pushJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusAccepted, apiJob{job}, nil)
 }
 
+// allowWorkflow checks that the application can use the workers of all the
+// steps of the workflow.
+func allowWorkflow(c echo.Context, v pkgperm.Verb, w *jobs.Workflow) error {
+	for _, s := range w.Steps {
+		if err := permissions.Allow(c, v, s.JobRequest(w)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pushWorkflow(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	req := apiWorkflowRequest{}
+	if _, err := jsonapi.Bind(c.Request().Body, &req); err != nil {
+		return wrapJobsError(err)
+	}
+
+	w := &jobs.Workflow{Steps: req.Steps}
+	if err := w.Validate(); err != nil {
+		return wrapJobsError(err)
+	}
+	if err := allowWorkflow(c, permissions.POST, w); err != nil {
+		return err
+	}
+
+	if err := jobs.PushWorkflow(jobs.System(), instance, w); err != nil {
+		return wrapJobsError(err)
+	}
+
+	return jsonapi.Data(c, http.StatusAccepted, apiWorkflow{w}, nil)
+}
+
+func getWorkflow(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	w, err := jobs.GetWorkflow(instance, c.Param("workflow-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := allowWorkflow(c, permissions.GET, w); err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, apiWorkflow{w}, nil)
+}
+
 func newTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	sched := jobs.System()
@@ -179,6 +318,11 @@ func newTrigger(c echo.Context) error {
 			return jsonapi.InvalidAttribute("debounce", err)
 		}
 	}
+	if req.Options != nil && req.Options.Retry != nil {
+		if err := req.Options.Retry.Validate(); err != nil {
+			return jsonapi.InvalidAttribute("retry", err)
+		}
+	}
 
 	t, err := jobs.NewTrigger(instance, jobs.TriggerInfos{
 		Type:       req.Type,
@@ -186,6 +330,7 @@ func newTrigger(c echo.Context) error {
 		Domain:     instance.Domain,
 		Arguments:  req.Arguments,
 		Debounce:   req.Debounce,
+		Timezone:   req.Timezone,
 		Options:    req.Options,
 	}, req.WorkerArguments)
 	if err != nil {
@@ -293,6 +438,36 @@ func launchTrigger(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusCreated, apiJob{j}, nil)
 }
 
+// callWebhook pushes a job for a @webhook trigger. It doesn't need a
+// permission: the ID of the webhook is a secret, and the signature of the
+// body is checked if the trigger has a secret.
+func callWebhook(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	t, err := jobs.GetWebhookTrigger(instance, c.Param("webhook-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, webhookMaxBodySize))
+	if err != nil {
+		return err
+	}
+	if !t.CheckSignature(body, c.Request().Header.Get(jobs.WebhookSignatureHeader)) {
+		return jsonapi.Forbidden(errWebhookSignature)
+	}
+	if !t.Allow() {
+		return jsonapi.NewError(http.StatusTooManyRequests, errWebhookRateLimited)
+	}
+	req, err := t.JobRequestWithBody(body)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	j, err := jobs.System().PushJob(instance, req)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, apiWebhookJob{j.ID()}, nil)
+}
+
 func deleteTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	sched := jobs.System()
@@ -357,6 +532,97 @@ func getJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, apiJob{job}, nil)
 }
 
+func getJobLogs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	job, err := jobs.Get(instance, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := permissions.Allow(c, permissions.GET, job); err != nil {
+		return err
+	}
+
+	store := jobs.GetLogsStore()
+	if c.Request().Header.Get("Accept") != typeTextEventStream {
+		logs, err := store.Read(job.ID(), 0)
+		if err != nil {
+			return err
+		}
+		if logs == nil {
+			logs = []*jobs.JobLog{}
+		}
+		return c.JSON(http.StatusOK, logs)
+	}
+
+	w := c.Response().Writer
+	w.Header().Set("Content-Type", typeTextEventStream)
+	w.WriteHeader(http.StatusOK)
+	offset := 0
+	for {
+		// The state is checked before reading the logs, to be sure to send
+		// all the lines written before the end of the job.
+		ended := job.State != jobs.Queued && job.State != jobs.Running
+		logs, err := store.Read(job.ID(), offset)
+		if err != nil {
+			writeStreamError(w, err)
+			return nil
+		}
+		for _, log := range logs {
+			if b, err := json.Marshal(log); err == nil {
+				writeStream(w, "log", string(b))
+			}
+		}
+		offset += len(logs)
+		if ended {
+			if b, err := json.Marshal(job.State); err == nil {
+				writeStream(w, "end", string(b))
+			}
+			return nil
+		}
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-time.After(logsPollInterval):
+		}
+		if job, err = jobs.Get(instance, job.ID()); err != nil {
+			writeStreamError(w, err)
+			return nil
+		}
+	}
+}
+
+func writeStream(w http.ResponseWriter, event string, b string) {
+	s := fmt.Sprintf("event: %s\r\ndata: %s\r\n\r\n", event, b)
+	if _, err := w.Write([]byte(s)); err != nil {
+		return
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func writeStreamError(w http.ResponseWriter, err error) {
+	if b, errm := json.Marshal(err.Error()); errm == nil {
+		writeStream(w, "error", string(b))
+	}
+}
+
+func cancelJob(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	job, err := jobs.Get(instance, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err := permissions.Allow(c, permissions.DELETE, job); err != nil {
+		return err
+	}
+	job, err = jobs.System().CancelJob(instance, job.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, apiJob{job}, nil)
+}
+
 func cleanJobs(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	if err := permissions.AllowWholeType(c, permissions.POST, consts.Jobs); err != nil {
@@ -393,6 +659,50 @@ func cleanJobs(c echo.Context) error {
 	return c.JSON(200, map[string]int{"deleted": len(ups)})
 }
 
+func getFailedJobs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	if err := permissions.AllowWholeType(c, permissions.GET, consts.JobsFailed); err != nil {
+		return err
+	}
+	failed, err := jobs.GetFailedJobs(instance, c.QueryParam("Worker"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	objs := make([]jsonapi.Object, len(failed))
+	for i, f := range failed {
+		objs[i] = apiFailedJob{f}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func replayFailedJob(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	if err := permissions.AllowWholeType(c, permissions.POST, consts.JobsFailed); err != nil {
+		return err
+	}
+	f, err := jobs.GetFailedJob(instance, c.Param("failed-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	job, err := f.Replay(jobs.System())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, apiJob{job}, nil)
+}
+
+func purgeFailedJobs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	if err := permissions.AllowWholeType(c, permissions.DELETE, consts.JobsFailed); err != nil {
+		return err
+	}
+	count, err := jobs.PurgeFailedJobs(instance, c.QueryParam("Worker"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return c.JSON(http.StatusOK, map[string]int{"deleted": count})
+}
+
 // Routes sets the routing for the jobs service
 func Routes(router *echo.Group) {
 	router.GET("/queue/:worker-type", getQueue)
@@ -406,16 +716,34 @@ func Routes(router *echo.Group) {
 	router.POST("/triggers/:trigger-id/launch", launchTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
 
+	router.POST("/webhooks/:webhook-id", callWebhook)
+
+	router.GET("/failed", getFailedJobs)
+	router.POST("/failed/:failed-id/replay", replayFailedJob)
+	router.DELETE("/failed", purgeFailedJobs)
+
+	router.POST("/workflows", pushWorkflow)
+	router.GET("/workflows/:workflow-id", getWorkflow)
+
 	router.POST("/clean", cleanJobs)
 	router.GET("/:job-id", getJob)
+	router.GET("/:job-id/logs", getJobLogs)
+	router.DELETE("/:job-id", cancelJob)
 }
 
 func wrapJobsError(err error) error {
 	switch err {
 	case jobs.ErrNotFoundTrigger,
 		jobs.ErrNotFoundJob,
+		jobs.ErrNotFoundWorkflow,
 		jobs.ErrUnknownWorker:
 		return jsonapi.NotFound(err)
+	case jobs.ErrInvalidWorkflow:
+		return jsonapi.InvalidAttribute("steps", err)
+	case jobs.ErrInvalidRetryPolicy:
+		return jsonapi.InvalidAttribute("retry", err)
+	case jobs.ErrJobEnded:
+		return jsonapi.Conflict(err)
 	case jobs.ErrUnknownTrigger:
 		return jsonapi.InvalidAttribute("Type", err)
 	}
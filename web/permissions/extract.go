@@ -118,6 +118,9 @@ func ParseJWT(c echo.Context, instance *instance.Instance, token string) (*permi
 		if err != nil {
 			return nil, err
 		}
+		if err = checkSharePassword(c, instance, pdoc); err != nil {
+			return nil, err
+		}
 		return pdoc, nil
 
 	default:
@@ -2,6 +2,7 @@ package permissions
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -43,11 +44,40 @@ const ContextClaims = "token_claims"
 // JSON-API
 type APIPermission struct {
 	*permissions.Permission
+	withAccessLog bool
+}
+
+// newAPIPermission returns the JSON-API representation of a permission doc
+// for the current permissions. The access log of a share by link, and its
+// counters, are only shown to its parent.
+func newAPIPermission(doc, current *permissions.Permission) *APIPermission {
+	return &APIPermission{
+		Permission:    doc,
+		withAccessLog: current != nil && current.ParentOf(doc),
+	}
 }
 
 // MarshalJSON implements jsonapi.Doc
 func (p *APIPermission) MarshalJSON() ([]byte, error) {
-	return json.Marshal(p.Permission)
+	// The hash of the password is replaced by a boolean
+	doc := struct {
+		*permissions.Permission
+		Password            bool                         `json:"password,omitempty"`
+		Downloads           int                          `json:"downloads,omitempty"`
+		AccessLog           []permissions.AccessLogEntry `json:"access_log,omitempty"`
+		PasswordFailures    int                          `json:"password_failures,omitempty"`
+		LastPasswordFailure *time.Time                   `json:"last_password_failure,omitempty"`
+	}{
+		Permission: p.Permission,
+		Password:   len(p.Password) > 0,
+	}
+	if p.withAccessLog {
+		doc.Downloads = p.Downloads
+		doc.AccessLog = p.AccessLog
+		doc.PasswordFailures = p.PasswordFailures
+		doc.LastPasswordFailure = p.LastPasswordFailure
+	}
+	return json.Marshal(doc)
 }
 
 // Relationships implements jsonapi.Doc
@@ -68,6 +98,9 @@ func (p *APIPermission) Links() *jsonapi.LinksList {
 
 type getPermsFunc func(db prefixer.Prefixer, id string) (*permissions.Permission, error)
 
+// displayPermissions shows the permissions set of the current request. The
+// other attributes of the permission doc, like the access log of a share by
+// link, are not sent, as a visitor of the link should not see them.
 func displayPermissions(c echo.Context) error {
 	doc, err := GetPermission(c)
 	if err != nil {
@@ -85,10 +118,18 @@ func createPermission(c echo.Context) error {
 		return err
 	}
 
-	var subdoc permissions.Permission
+	var subdoc struct {
+		Permissions  permissions.Set `json:"permissions"`
+		Password     string          `json:"password,omitempty"`
+		MaxDownloads int             `json:"max_downloads,omitempty"`
+		ViewOnly     bool            `json:"view_only,omitempty"`
+	}
 	if _, err = jsonapi.Bind(c.Request().Body, &subdoc); err != nil {
 		return err
 	}
+	if subdoc.MaxDownloads < 0 {
+		return jsonapi.InvalidAttribute("max_downloads", errors.New("Must be positive"))
+	}
 
 	var codes map[string]string
 	if names != nil {
@@ -105,20 +146,24 @@ func createPermission(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "no parent")
 	}
 
-	var expiresAt *time.Time
+	opts := &permissions.ShareOptions{
+		Password:     subdoc.Password,
+		MaxDownloads: subdoc.MaxDownloads,
+		ViewOnly:     subdoc.ViewOnly,
+	}
 	if ttl != "" {
 		if d, errd := bigduration.ParseDuration(ttl); errd == nil {
 			ex := time.Now().Add(d)
-			expiresAt = &ex
+			opts.ExpiresAt = &ex
 		}
 	}
 
-	pdoc, err := permissions.CreateShareSet(instance, parent, codes, subdoc.Permissions, expiresAt)
+	pdoc, err := permissions.CreateShareSet(instance, parent, codes, subdoc.Permissions, opts)
 	if err != nil {
 		return err
 	}
 
-	return jsonapi.Data(c, http.StatusOK, &APIPermission{pdoc}, nil)
+	return jsonapi.Data(c, http.StatusOK, newAPIPermission(pdoc, parent), nil)
 }
 
 const limitPermissionsByDoctype = 30
@@ -162,7 +207,7 @@ func listPermissionsByDoctype(c echo.Context, route, permType string) error {
 
 	out := make([]jsonapi.Object, len(perms))
 	for i := range perms {
-		out[i] = &APIPermission{&perms[i]}
+		out[i] = newAPIPermission(&perms[i], current)
 	}
 
 	return jsonapi.DataList(c, http.StatusOK, out, links)
@@ -266,7 +311,7 @@ func patchPermission(getPerms getPermsFunc, paramName string) echo.HandlerFunc {
 			return err
 		}
 
-		return jsonapi.Data(c, http.StatusOK, &APIPermission{toPatch}, nil)
+		return jsonapi.Data(c, http.StatusOK, newAPIPermission(toPatch, current), nil)
 	}
 }
 
@@ -0,0 +1,171 @@
+package permissions
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// SharePasswordHeader is the HTTP header used to send the password of a
+// share by link protected by a password.
+const SharePasswordHeader = "X-Cozy-Share-Password"
+
+// ShareSessionHeader is the HTTP header used to send the short-lived token
+// given after a good password for a share by link. It can be sent instead of
+// the password for the next requests.
+const ShareSessionHeader = "X-Cozy-Share-Session"
+
+var shareSessionMACConfig = crypto.MACConfig{
+	Name:   "share-session",
+	MaxAge: 1 * time.Hour,
+	MaxLen: 256,
+}
+
+// checkSharePassword checks the password of a share by link, or the token
+// given after a good password. The password is hashed with scrypt, so it is
+// checked only once, and a token is sent in the response headers for the next
+// requests.
+func checkSharePassword(c echo.Context, inst *instance.Instance, pdoc *permissions.Permission) error {
+	if len(pdoc.Password) == 0 {
+		return nil
+	}
+	// The token is no longer valid if the password is changed
+	additionalData := append([]byte(pdoc.PID+":"), pdoc.Password...)
+	if token := c.Request().Header.Get(ShareSessionHeader); token != "" {
+		_, err := crypto.DecodeAuthMessage(shareSessionMACConfig, inst.SessionSecret,
+			[]byte(token), additionalData)
+		if err == nil {
+			return nil
+		}
+	}
+	password := c.Request().Header.Get(SharePasswordHeader)
+	if err := pdoc.VerifyPassword(inst, password); err != nil {
+		return err
+	}
+	token, err := crypto.EncodeAuthMessage(shareSessionMACConfig, inst.SessionSecret,
+		nil, additionalData)
+	if err != nil {
+		return err
+	}
+	res := c.Response()
+	res.Header().Set(ShareSessionHeader, string(token))
+	res.Header().Add(echo.HeaderAccessControlExposeHeaders, ShareSessionHeader)
+	return nil
+}
+
+// AllowDownload checks that the files can be downloaded with the permissions
+// of the current context. For a share by link, the downloads are forbidden in
+// view-only mode, and they are counted and logged. The size is the size of
+// the content served with the Range header, or -1 if this header is ignored.
+func AllowDownload(c echo.Context, size int64) error {
+	pdoc, err := GetPermission(c)
+	if err != nil {
+		return err
+	}
+	if pdoc.Type != permissions.TypeShareByLink {
+		return nil
+	}
+	if err = pdoc.CanDownload(); err != nil {
+		return err
+	}
+	// A HEAD request, or the next parts of a range request, are not new
+	// downloads
+	req := c.Request()
+	if req.Method == http.MethodHead || isNextRange(req, size) {
+		return nil
+	}
+	inst := middlewares.GetInstance(c)
+	return pdoc.RecordAccess(inst, permissions.AccessDownload, requestIP(req))
+}
+
+// RecordShareView adds an entry to the access log of a share by link when
+// its page is opened. Errors are just logged.
+func RecordShareView(c echo.Context, inst *instance.Instance, code string) {
+	pdoc, err := permissions.GetForShareCode(inst, code)
+	if err != nil || pdoc.Type != permissions.TypeShareByLink {
+		return
+	}
+	if err = pdoc.RecordAccess(inst, permissions.AccessView, requestIP(c.Request())); err != nil {
+		inst.Logger().WithField("nspace", "permissions").
+			Warnf("Cannot log the access to %s: %s", pdoc.PID, err)
+	}
+}
+
+// isNextRange returns true if the request asks only for ranges of the content
+// that don't start at its first byte. The ranges are parsed like net/http
+// does, and the requests for which it may send the whole content are counted
+// as downloads.
+func isNextRange(req *http.Request, size int64) bool {
+	r := req.Header.Get("Range")
+	if r == "" || size <= 0 || req.Header.Get("If-Range") != "" {
+		return false
+	}
+	if !strings.HasPrefix(r, "bytes=") {
+		return false
+	}
+	var total int64
+	nb := 0
+	for _, ra := range strings.Split(r[len("bytes="):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return false
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		var first, last int64
+		if start == "" {
+			// A suffix range, for the last bytes of the content
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			if n >= size {
+				return false
+			}
+			first, last = size-n, size-1
+		} else {
+			n, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			if n >= size {
+				// This range is ignored by net/http
+				continue
+			}
+			first, last = n, size-1
+			if end != "" {
+				n, err = strconv.ParseInt(end, 10, 64)
+				if err != nil || n < first {
+					return false
+				}
+				if n < last {
+					last = n
+				}
+			}
+		}
+		if first == 0 {
+			return false
+		}
+		total += last - first + 1
+		nb++
+	}
+	// net/http sends the whole content if the ranges are larger than it
+	return nb > 0 && total <= size
+}
+
+func requestIP(req *http.Request) string {
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		return strings.TrimSpace(strings.SplitN(forwardedFor, ",", 2)[0])
+	}
+	return req.RemoteAddr
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/cozy/cozy-stack/web/realtime"
 	"github.com/cozy/cozy-stack/web/registry"
 	"github.com/cozy/cozy-stack/web/remote"
+	"github.com/cozy/cozy-stack/web/search"
 	"github.com/cozy/cozy-stack/web/settings"
 	"github.com/cozy/cozy-stack/web/sharings"
 	"github.com/cozy/cozy-stack/web/statik"
@@ -155,6 +156,7 @@ func SetupRoutes(router *echo.Echo) error {
 		permissions.Routes(router.Group("/permissions", mws...))
 		realtime.Routes(router.Group("/realtime", mws...))
 		remote.Routes(router.Group("/remote", mws...))
+		search.Routes(router.Group("/search", mws...))
 		sharings.Routes(router.Group("/sharings", mws...))
 
 		// The settings routes needs not to be blocked
@@ -0,0 +1,105 @@
+// Package search is for the full-text search over the files and the indexed
+// documents.
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const defaultLimit = 30
+const maxLimit = 100
+
+type apiHit struct {
+	hit *search.Hit
+}
+
+func (h *apiHit) ID() string                             { return h.hit.DocType + "/" + h.hit.DocID }
+func (h *apiHit) Rev() string                            { return "" }
+func (h *apiHit) DocType() string                        { return consts.SearchResults }
+func (h *apiHit) Clone() couchdb.Doc                     { return h }
+func (h *apiHit) SetID(_ string)                         {}
+func (h *apiHit) SetRev(_ string)                        {}
+func (h *apiHit) Relationships() jsonapi.RelationshipMap { return nil }
+func (h *apiHit) Included() []jsonapi.Object             { return nil }
+func (h *apiHit) Links() *jsonapi.LinksList              { return nil }
+func (h *apiHit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.hit)
+}
+
+// searchHandler is the route GET /search, for a full-text search over the
+// documents that the caller can read.
+func searchHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	q := &search.Query{
+		Q:     c.QueryParam("q"),
+		Limit: defaultLimit,
+	}
+	if doctypes := c.QueryParam("doctypes"); doctypes != "" {
+		q.Doctypes = strings.Split(doctypes, ",")
+	}
+	if limit := c.QueryParam("page[limit]"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit <= 0 {
+			return jsonapi.NewError(http.StatusBadRequest, "page limit is not a number")
+		}
+		if q.Limit > maxLimit {
+			q.Limit = maxLimit
+		}
+	}
+	if skip := c.QueryParam("page[skip]"); skip != "" {
+		if q.Skip, err = strconv.Atoi(skip); err != nil || q.Skip < 0 {
+			return jsonapi.NewError(http.StatusBadRequest, "page skip is not a number")
+		}
+	}
+
+	hits, err := search.Search(instance, instance.VFS(), pdoc.Permissions, q)
+	if err != nil {
+		return wrapSearchError(err)
+	}
+
+	objs := make([]jsonapi.Object, len(hits))
+	for i, hit := range hits {
+		objs[i] = &apiHit{hit}
+	}
+	var links *jsonapi.LinksList
+	if len(hits) == q.Limit {
+		v := url.Values{}
+		v.Set("q", q.Q)
+		if len(q.Doctypes) > 0 {
+			v.Set("doctypes", strings.Join(q.Doctypes, ","))
+		}
+		v.Set("page[limit]", strconv.Itoa(q.Limit))
+		v.Set("page[skip]", strconv.Itoa(q.Skip+q.Limit))
+		links = &jsonapi.LinksList{Next: "/search?" + v.Encode()}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+func wrapSearchError(err error) error {
+	if err == search.ErrInvalidQuery {
+		return jsonapi.InvalidParameter("q", err)
+	}
+	return err
+}
+
+// Routes sets the routing for the search service
+func Routes(router *echo.Group) {
+	router.GET("", searchHandler)
+	router.GET("/", searchHandler)
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
@@ -14,8 +15,9 @@ import (
 )
 
 type apiDiskUsage struct {
-	Used  int64 `json:"used,string"`
-	Quota int64 `json:"quota,string,omitempty"`
+	Used  int64           `json:"used,string"`
+	Quota int64           `json:"quota,string,omitempty"`
+	Dirs  []*vfs.DirQuota `json:"dirs,omitempty"`
 }
 
 func (j *apiDiskUsage) ID() string                             { return consts.DiskUsageID }
@@ -53,7 +55,13 @@ func diskUsage(c echo.Context) error {
 
 	quota := fs.DiskQuota()
 
+	dirs, err := vfs.DirQuotas(fs)
+	if err != nil {
+		return err
+	}
+
 	result.Used = used
 	result.Quota = quota
+	result.Dirs = dirs
 	return jsonapi.Data(c, http.StatusOK, &result, nil)
 }
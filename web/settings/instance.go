@@ -89,6 +89,13 @@ func updateInstance(c echo.Context) error {
 		return err
 	}
 
+	// The instances created before the trash expiry have no trigger for it
+	if _, ok := doc.M["trash_retention_days"]; ok {
+		if err := instance.AddMissingTriggers(inst, "trash-clean"); err != nil {
+			return err
+		}
+	}
+
 	doc.M["locale"] = inst.Locale
 	doc.M["onboarding_finished"] = inst.OnboardingFinished
 	doc.M["auto_update"] = !inst.NoAutoUpdate
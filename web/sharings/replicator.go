@@ -21,6 +21,10 @@ func RevsDiff(c echo.Context) error {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Sharing was not found: %s", err)
 		return wrapErrors(err)
 	}
+	if err = checkWriteAccess(c, s); err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Member is read-only: %s", err)
+		return wrapErrors(err)
+	}
 	var changed sharing.Changed
 	if err = c.Bind(&changed); err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Changes cannot be bound: %s", err)
@@ -47,6 +51,11 @@ func BulkDocs(c echo.Context) error {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Sharing was not found: %s", err)
 		return wrapErrors(err)
 	}
+	member, err := requestMember(c, s)
+	if err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Member was not found: %s", err)
+		return wrapErrors(err)
+	}
 	var docs sharing.DocsByDoctype
 	if err = c.Bind(&docs); err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Docs cannot be bound: %s", err)
@@ -56,7 +65,7 @@ func BulkDocs(c echo.Context) error {
 		inst.Logger().WithField("nspace", "replicator").Debugf("No bulk docs")
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
-	err = s.ApplyBulkDocs(inst, docs)
+	err = s.ApplyBulkDocs(inst, member, docs)
 	if err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Error on apply: %s", err)
 		return wrapErrors(err)
@@ -97,6 +106,15 @@ func SyncFile(c echo.Context) error {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Sharing was not found: %s", err)
 		return wrapErrors(err)
 	}
+	member, err := requestMember(c, s)
+	if err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Member was not found: %s", err)
+		return wrapErrors(err)
+	}
+	if err = s.CheckWriteAccess(member); err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Member is read-only: %s", err)
+		return wrapErrors(err)
+	}
 	var fileDoc *sharing.FileDocWithRevisions
 	if err = c.Bind(&fileDoc); err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("File cannot be bound: %s", err)
@@ -106,7 +124,7 @@ func SyncFile(c echo.Context) error {
 		err = errors.New("The identifiers in the URL and in the doc are not the same")
 		return jsonapi.InvalidAttribute("id", err)
 	}
-	key, err := s.SyncFile(inst, fileDoc)
+	key, err := s.SyncFile(inst, member, fileDoc)
 	if err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Error on sync file: %s", err)
 		return wrapErrors(err)
@@ -126,7 +144,16 @@ func FileHandler(c echo.Context) error {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Sharing was not found: %s", err)
 		return wrapErrors(err)
 	}
-	if err := s.HandleFileUpload(inst, c.Param("id"), c.Request().Body); err != nil {
+	member, err := requestMember(c, s)
+	if err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Member was not found: %s", err)
+		return wrapErrors(err)
+	}
+	if err = s.CheckWriteAccess(member); err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Member is read-only: %s", err)
+		return wrapErrors(err)
+	}
+	if err := s.HandleFileUpload(inst, member, c.Param("id"), c.Request().Body); err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Error on file upload: %s", err)
 		return wrapErrors(err)
 	}
@@ -168,3 +195,13 @@ func requestMember(c echo.Context, s *sharing.Sharing) (*sharing.Member, error)
 	}
 	return s.FindMemberByInboundClientID(requestPerm.SourceID)
 }
+
+// checkWriteAccess returns an error if the member that has made the request
+// is not allowed to send changes on the shared documents
+func checkWriteAccess(c echo.Context, s *sharing.Sharing) error {
+	member, err := requestMember(c, s)
+	if err != nil {
+		return err
+	}
+	return s.CheckWriteAccess(member)
+}
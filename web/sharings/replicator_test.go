@@ -60,6 +60,7 @@ func TestCreateSharingForReplicatorTest(t *testing.T) {
 	cli, err := sharing.CreateOAuthClient(replInstance, &s.Members[1])
 	assert.NoError(t, err)
 	s.Credentials[0].Client = sharing.ConvertOAuthClient(cli)
+	s.Credentials[0].InboundClientID = cli.ClientID
 	token, err := sharing.CreateAccessToken(replInstance, cli, s.SID, permissions.ALL)
 	assert.NoError(t, err)
 	s.Credentials[0].AccessToken = token
@@ -38,16 +38,8 @@ func CreateSharing(c echo.Context) error {
 		return wrapErrors(err)
 	}
 
-	if rel, ok := obj.GetRelationship("recipients"); ok {
-		if data, ok := rel.Data.([]interface{}); ok {
-			for _, ref := range data {
-				if id, ok := ref.(map[string]interface{})["id"].(string); ok {
-					if err = s.AddContact(inst, id); err != nil {
-						return err
-					}
-				}
-			}
-		}
+	if _, err = addRecipients(inst, &s, obj); err != nil {
+		return err
 	}
 
 	codes, err := s.Create(inst)
@@ -57,6 +49,9 @@ func CreateSharing(c echo.Context) error {
 	if err = s.SendMails(inst, codes); err != nil {
 		return wrapErrors(err)
 	}
+	if err = s.AddGroupsTrigger(inst); err != nil {
+		return wrapErrors(err)
+	}
 	as := &sharing.APISharing{
 		Sharing:     &s,
 		Credentials: nil,
@@ -121,6 +116,37 @@ func GetSharing(c echo.Context) error {
 	return jsonapiSharingWithDocs(c, s)
 }
 
+// GetActivity returns the last changes applied on this cozy to the shared
+// documents, with the members who have sent them. The most recent changes
+// come first.
+func GetActivity(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if err = checkGetPermissions(c, s); err != nil {
+		return wrapErrors(err)
+	}
+	var limit int
+	if l := c.QueryParam("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			return jsonapi.InvalidParameter("limit", err)
+		}
+	}
+	activities, err := s.GetActivities(inst, limit)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	objs := make([]jsonapi.Object, len(activities))
+	for i, a := range activities {
+		objs[i] = a
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
 // GetSharingsInfoByDocType returns, for a given doctype, all the sharing
 // information, i.e. the involved sharings and the shared documents
 func GetSharingsInfoByDocType(c echo.Context) error {
@@ -198,28 +224,92 @@ func AddRecipient(c echo.Context) error {
 	if err != nil {
 		return jsonapi.BadJSON()
 	}
-	if rel, ok := obj.GetRelationship("recipients"); ok {
-		if data, ok := rel.Data.([]interface{}); ok {
-			for _, ref := range data {
-				if id, ok := ref.(map[string]interface{})["id"].(string); ok {
-					if err = s.AddContact(inst, id); err != nil {
-						return err
-					}
-				}
+	added, err := addRecipients(inst, s, obj)
+	if err != nil {
+		return err
+	}
+	if added {
+		var codes map[string]string
+		if s.Owner && s.PreviewPath != "" {
+			if codes, err = s.CreatePreviewPermissions(inst); err != nil {
+				return wrapErrors(err)
 			}
-			var codes map[string]string
-			if s.Owner && s.PreviewPath != "" {
-				if codes, err = s.CreatePreviewPermissions(inst); err != nil {
-					return wrapErrors(err)
-				}
+		}
+		if err = s.SendMails(inst, codes); err != nil {
+			return wrapErrors(err)
+		}
+		if err = s.AddGroupsTrigger(inst); err != nil {
+			return wrapErrors(err)
+		}
+		cloned := s.Clone().(*sharing.Sharing)
+		go cloned.NotifyRecipients(inst, nil)
+	}
+	return jsonapiSharingWithDocs(c, s)
+}
+
+// addRecipients adds to the sharing the contacts and the groups of contacts
+// from the recipients and read_only_recipients relationships. It returns true
+// if at least one contact or group has been added.
+func addRecipients(inst *instance.Instance, s *sharing.Sharing, obj *jsonapi.ObjectMarshalling) (bool, error) {
+	added := false
+	for _, name := range []string{"recipients", "read_only_recipients"} {
+		readOnly := name == "read_only_recipients"
+		rel, ok := obj.GetRelationship(name)
+		if !ok {
+			continue
+		}
+		data, ok := rel.Data.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, ref := range data {
+			item, _ := ref.(map[string]interface{})
+			id, ok := item["id"].(string)
+			if !ok {
+				continue
 			}
-			if err = s.SendMails(inst, codes); err != nil {
-				return wrapErrors(err)
+			var err error
+			if doctype, _ := item["type"].(string); doctype == consts.Groups {
+				err = s.AddGroup(inst, id, readOnly)
+			} else {
+				err = s.AddContact(inst, id, readOnly)
+			}
+			if err != nil {
+				return added, err
 			}
-			cloned := s.Clone().(*sharing.Sharing)
-			go cloned.NotifyRecipients(inst, nil)
+			added = true
 		}
 	}
+	return added, nil
+}
+
+// SetRecipientRole is used by the owner to promote or demote a recipient
+func SetRecipientRole(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	_, err = checkCreatePermissions(c, s)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index == 0 || index >= len(s.Members) {
+		return jsonapi.InvalidParameter("index", err)
+	}
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err = s.SetMemberRole(inst, index, body.Role); err != nil {
+		return wrapErrors(err)
+	}
+	cloned := s.Clone().(*sharing.Sharing)
+	go cloned.NotifyRecipients(inst, nil)
 	return jsonapiSharingWithDocs(c, s)
 }
 
@@ -440,6 +530,7 @@ func Routes(router *echo.Group) {
 	router.POST("/", CreateSharing)        // On the sharer
 	router.PUT("/:sharing-id", PutSharing) // On a recipient
 	router.GET("/:sharing-id", GetSharing)
+	router.GET("/:sharing-id/activity", GetActivity)
 	router.POST("/:sharing-id/answer", AnswerSharing)
 
 	// Managing recipients
@@ -447,6 +538,7 @@ func Routes(router *echo.Group) {
 	router.PUT("/:sharing-id/recipients", PutRecipients, checkSharingPermissions)
 	router.DELETE("/:sharing-id/recipients", RevokeSharing)                             // On the sharer
 	router.DELETE("/:sharing-id/recipients/:index", RevokeRecipient)                    // On the sharer
+	router.PUT("/:sharing-id/recipients/:index/role", SetRecipientRole)                 // On the sharer
 	router.DELETE("/:sharing-id", RevocationRecipientNotif, checkSharingPermissions)    // On the recipient
 	router.DELETE("/:sharing-id/recipients/self", RevokeRecipientBySelf)                // On the recipient
 	router.DELETE("/:sharing-id/answer", RevocationOwnerNotif, checkSharingPermissions) // On the sharer
@@ -562,6 +654,10 @@ func wrapErrors(err error) error {
 		return jsonapi.NotFound(err)
 	case sharing.ErrSafety:
 		return jsonapi.BadRequest(err)
+	case sharing.ErrReadOnlyMember:
+		return jsonapi.Forbidden(err)
+	case sharing.ErrInvalidRole:
+		return jsonapi.InvalidAttribute("role", err)
 	}
 	return err
 }